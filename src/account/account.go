@@ -0,0 +1,209 @@
+// accounts hold buyers' cash. Before a bid is accepted the engine reserves
+// its full notional (limit price × quantity) so the bidder cannot commit
+// the same funds twice; each fill captures what was actually paid and
+// releases any price improvement, and a cancel releases what is left.
+
+package account
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"fractr-marketplace-secondary/price"
+)
+
+var (
+	ErrInsufficientFunds  = errors.New("account: insufficient funds")
+	ErrUnknownReservation = errors.New("account: unknown reservation")
+)
+
+// AccountService is implemented by whatever holds users' balances. Every
+// reservation is identified by the user and the id of the order it backs.
+type AccountService interface {
+	// Reserve moves amount from the user's available balance into a
+	// reservation for the order, failing with ErrInsufficientFunds if the
+	// available balance is too low. Reserving again for an order adds to
+	// its reservation.
+	Reserve(userId, orderId uint64, amount price.Price, currency string) error
+	// Capture takes amount out of the reservation as paid.
+	Capture(userId, orderId uint64, amount price.Price) error
+	// Release returns amount of the reservation to the available balance.
+	Release(userId, orderId uint64, amount price.Price) error
+	// Refund adds amount to the available balance, e.g. when a fill the
+	// user paid for is busted.
+	Refund(userId uint64, amount price.Price, currency string) error
+	// Charge takes amount straight out of the available balance, failing
+	// with ErrInsufficientFunds if it is too low.
+	Charge(userId uint64, amount price.Price, currency string) error
+}
+
+type Balance struct {
+	Available price.Price `json:"available"`
+	Reserved  price.Price `json:"reserved"`
+}
+
+type reservationKey struct {
+	userId  uint64
+	orderId uint64
+}
+
+type reservation struct {
+	currency string
+	amount   price.Price
+}
+
+type balanceKey struct {
+	userId   uint64
+	currency string
+}
+
+// Memory is an in-memory AccountService. It is safe for concurrent use.
+type Memory struct {
+	balances     map[balanceKey]*Balance
+	reservations map[reservationKey]*reservation
+	mu           sync.Mutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		balances:     make(map[balanceKey]*Balance),
+		reservations: make(map[reservationKey]*reservation),
+	}
+}
+
+func (m *Memory) balance(userId uint64, currency string) *Balance {
+	key := balanceKey{userId, currency}
+	if m.balances[key] == nil {
+		m.balances[key] = &Balance{}
+	}
+	return m.balances[key]
+}
+
+func (m *Memory) Deposit(userId uint64, currency string, amount price.Price) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance := m.balance(userId, currency)
+	available, err := balance.Available.Add(amount)
+	if err != nil {
+		return err
+	}
+	balance.Available = available
+	return nil
+}
+
+func (m *Memory) Balance(userId uint64, currency string) Balance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return *m.balance(userId, currency)
+}
+
+func (m *Memory) Reserve(userId, orderId uint64, amount price.Price, currency string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := reservationKey{userId, orderId}
+	res, ok := m.reservations[key]
+	if ok && res.currency != currency {
+		return fmt.Errorf("account: order %d of user %d is reserved in %s, not %s", orderId, userId, res.currency, currency)
+	}
+
+	balance := m.balance(userId, currency)
+	available, err := balance.Available.Sub(amount)
+	if err == price.ErrNegative {
+		return fmt.Errorf("%w: user %d has %s %s available, order %d needs %s",
+			ErrInsufficientFunds, userId, balance.Available, currency, orderId, amount)
+	} else if err != nil {
+		return err
+	}
+	reserved, err := balance.Reserved.Add(amount)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res = &reservation{currency: currency}
+	}
+	total, err := res.amount.Add(amount)
+	if err != nil {
+		return err
+	}
+
+	balance.Available, balance.Reserved = available, reserved
+	res.amount = total
+	m.reservations[key] = res
+	return nil
+}
+
+// take removes amount from the order's reservation and the user's reserved
+// balance, forgetting the reservation once it is used up.
+func (m *Memory) take(userId, orderId uint64, amount price.Price) (*Balance, error) {
+	key := reservationKey{userId, orderId}
+	res, ok := m.reservations[key]
+	if !ok {
+		return nil, ErrUnknownReservation
+	}
+
+	remaining, err := res.amount.Sub(amount)
+	if err != nil {
+		return nil, fmt.Errorf("account: order %d of user %d: cannot take %s from reservation of %s",
+			orderId, userId, amount, res.amount)
+	}
+	balance := m.balance(userId, res.currency)
+	reserved, err := balance.Reserved.Sub(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	balance.Reserved = reserved
+	res.amount = remaining
+	if remaining.IsZero() {
+		delete(m.reservations, key)
+	}
+	return balance, nil
+}
+
+func (m *Memory) Capture(userId, orderId uint64, amount price.Price) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.take(userId, orderId, amount)
+	return err
+}
+
+func (m *Memory) Release(userId, orderId uint64, amount price.Price) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance, err := m.take(userId, orderId, amount)
+	if err != nil {
+		return err
+	}
+	available, err := balance.Available.Add(amount)
+	if err != nil {
+		return err
+	}
+	balance.Available = available
+	return nil
+}
+
+func (m *Memory) Refund(userId uint64, amount price.Price, currency string) error {
+	return m.Deposit(userId, currency, amount)
+}
+
+func (m *Memory) Charge(userId uint64, amount price.Price, currency string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance := m.balance(userId, currency)
+	available, err := balance.Available.Sub(amount)
+	if err == price.ErrNegative {
+		return fmt.Errorf("%w: user %d has %s %s available, cannot be charged %s",
+			ErrInsufficientFunds, userId, balance.Available, currency, amount)
+	} else if err != nil {
+		return err
+	}
+	balance.Available = available
+	return nil
+}
@@ -0,0 +1,71 @@
+package account
+
+import (
+	"errors"
+	"testing"
+
+	"fractr-marketplace-secondary/price"
+)
+
+func TestReserveCaptureRelease(t *testing.T) {
+	accounts := NewMemory()
+	accounts.Deposit(1, "USD", price.New(10000, 2))
+
+	if err := accounts.Reserve(1, 100, price.New(6000, 2), "USD"); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	if err := accounts.Reserve(1, 101, price.New(6000, 2), "USD"); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got %v", err)
+	}
+
+	accounts.Capture(1, 100, price.New(2500, 2))
+	accounts.Release(1, 100, price.New(500, 2))
+
+	balance := accounts.Balance(1, "USD")
+	if balance.Available.String() != "45.00" || balance.Reserved.String() != "30.00" {
+		t.Fatalf("Expected 45.00 available and 30.00 reserved, got %+v", balance)
+	}
+
+	if err := accounts.Capture(1, 100, price.New(4000, 2)); err == nil {
+		t.Fatalf("Expected capture beyond the reservation to fail")
+	}
+	if err := accounts.Release(1, 100, price.New(3000, 2)); err != nil {
+		t.Fatalf("failed to release the rest of the reservation: %v", err)
+	}
+	if err := accounts.Release(1, 100, price.New(1, 2)); err != ErrUnknownReservation {
+		t.Fatalf("Expected used up reservation to be forgotten, got %v", err)
+	}
+
+	balance = accounts.Balance(1, "USD")
+	if balance.Available.String() != "75.00" || !balance.Reserved.IsZero() {
+		t.Fatalf("Expected 75.00 available and nothing reserved, got %+v", balance)
+	}
+}
+
+func TestReservationsAreIsolatedByCurrency(t *testing.T) {
+	accounts := NewMemory()
+	accounts.Deposit(1, "ETH", price.New(5, 0))
+
+	if err := accounts.Reserve(1, 100, price.New(1, 0), "USD"); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("Expected ETH balance not to fund a USD order, got %v", err)
+	}
+}
+
+func TestChargeRefund(t *testing.T) {
+	accounts := NewMemory()
+	accounts.Deposit(1, "USD", price.New(5000, 2))
+
+	if err := accounts.Charge(1, price.New(6000, 2), "USD"); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got %v", err)
+	}
+	if err := accounts.Charge(1, price.New(2000, 2), "USD"); err != nil {
+		t.Fatalf("failed to charge: %v", err)
+	}
+	if err := accounts.Refund(1, price.New(500, 2), "USD"); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+
+	if balance := accounts.Balance(1, "USD"); balance.Available.String() != "35.00" || !balance.Reserved.IsZero() {
+		t.Fatalf("Expected 35.00 available and nothing reserved, got %+v", balance)
+	}
+}
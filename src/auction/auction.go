@@ -0,0 +1,434 @@
+// auctions sell a seller's block of fractions, the whole of an artwork or a
+// part of it, outside the order book. An English auction takes ascending
+// bids for the whole block until it closes, extending its close when a bid
+// arrives at the last moment; a Dutch auction lowers its price on a clock
+// and sells to whoever takes some or all of the block first. Sales cross
+// through the matching engine, so they produce the same fills and storage
+// updates as trades on the book.
+
+package auction
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// auction formats
+const (
+	FORMAT_ENGLISH = iota
+	FORMAT_DUTCH
+)
+
+var formatNames = map[uint32]string{
+	FORMAT_ENGLISH: "ENGLISH",
+	FORMAT_DUTCH:   "DUTCH",
+}
+
+func FormatName(format uint32) string {
+	if name, ok := formatNames[format]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", format)
+}
+
+// ParseFormat returns the format named name, ignoring case.
+func ParseFormat(name string) (uint32, error) {
+	for format, formatName := range formatNames {
+		if strings.EqualFold(name, formatName) {
+			return format, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown auction format %q", name)
+}
+
+// auction statuses
+const (
+	AUCTION_OPEN = iota
+	// the whole block was sold
+	AUCTION_SOLD
+	// the auction ended with fractions left unsold, which are unlocked
+	AUCTION_ENDED
+	AUCTION_CANCELLED
+)
+
+var statusNames = map[uint32]string{
+	AUCTION_OPEN:      "OPEN",
+	AUCTION_SOLD:      "SOLD",
+	AUCTION_ENDED:     "ENDED",
+	AUCTION_CANCELLED: "CANCELLED",
+}
+
+func StatusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", status)
+}
+
+var (
+	ErrInvalidListing  = errors.New("invalid auction listing")
+	ErrInvalidBid      = errors.New("invalid auction bid")
+	ErrAuctionExists   = errors.New("auction already exists")
+	ErrAuctionNotFound = errors.New("auction not found")
+	ErrAuctionClosed   = errors.New("auction is closed")
+	ErrBidTooLow       = errors.New("bid is too low")
+	// ErrHasBids is returned when cancelling an English auction that has
+	// been bid on.
+	ErrHasBids = errors.New("auction has bids")
+)
+
+// Listing describes an auction as the seller creates it. Its id is also the
+// id of the ask that holds the block's fractions locked.
+type Listing struct {
+	Id        uint64
+	SellerId  uint64
+	ArtworkId uint64
+	Quantity  uint64
+	Format    uint32
+	Duration  time.Duration
+
+	// An English auction opens at StartPrice and sells only if its high bid
+	// reaches Reserve, which may be zero. A Dutch auction's clock starts at
+	// StartPrice and stops at Reserve.
+	StartPrice price.Price
+	Reserve    price.Price
+
+	// English only: each bid must beat the high bid by Increment, one tick
+	// if zero, and a bid within Extension of the close moves the close to
+	// Extension after the bid.
+	Increment price.Price
+	Extension time.Duration
+
+	// Dutch only: the clock drops by Decrement every Step.
+	Decrement price.Price
+	Step      time.Duration
+}
+
+type Auction struct {
+	Listing
+	Status    uint32
+	StartedAt time.Time
+	EndsAt    time.Time
+
+	// the current high bid of an English auction
+	HighBid      price.Price
+	HighBidderId uint64
+	QuantitySold uint64
+	Fills        []match.FillOrder
+
+	highBid *pqueue.Bid
+	ask     *pqueue.Ask // holds the block's fractions locked
+}
+
+// Price returns what the auction would sell at, at now: the clock price of
+// a Dutch auction, and the high bid, or the start price before the first
+// bid, of an English one.
+func (a *Auction) Price(now time.Time) price.Price {
+	if a.Format == FORMAT_ENGLISH {
+		if a.highBid != nil {
+			return a.HighBid
+		}
+		return a.StartPrice
+	}
+
+	steps := uint64(now.Sub(a.StartedAt) / a.Step)
+	drop, err := a.Decrement.Mul(steps)
+	if err != nil {
+		return a.Reserve
+	}
+	clock, err := a.StartPrice.Sub(drop)
+	if err != nil || clock.Cmp(a.Reserve) < 0 {
+		return a.Reserve
+	}
+	return clock
+}
+
+// snapshot copies the auction for callers outside the house.
+func (a *Auction) snapshot() Auction {
+	snapshot := *a
+	snapshot.Fills = append([]match.FillOrder(nil), a.Fills...)
+	snapshot.highBid, snapshot.ask = nil, nil
+	return snapshot
+}
+
+// House runs auction listings against the engine's funds and holdings. It
+// is safe for concurrent use.
+type House struct {
+	engine   *match.OrderMatchingEngine
+	mu       sync.Mutex
+	auctions map[uint64]*Auction // key: listing id
+}
+
+func New(engine *match.OrderMatchingEngine) *House {
+	return &House{
+		engine:   engine,
+		auctions: make(map[uint64]*Auction),
+	}
+}
+
+// Get returns the auction with the given id.
+func (house *House) Get(auctionId uint64) (Auction, error) {
+	house.mu.Lock()
+	defer house.mu.Unlock()
+
+	a, ok := house.auctions[auctionId]
+	if !ok {
+		return Auction{}, ErrAuctionNotFound
+	}
+	return a.snapshot(), nil
+}
+
+// Create opens an auction for the listing, locking its block of fractions
+// against the seller's position until it closes.
+func (house *House) Create(listing Listing) (Auction, error) {
+	if !house.engine.HasArtwork(listing.ArtworkId) {
+		return Auction{}, match.ErrArtworkNotListed
+	}
+	inst := house.engine.Instrument(listing.ArtworkId)
+	if err := checkListing(inst, &listing); err != nil {
+		return Auction{}, err
+	}
+
+	house.mu.Lock()
+	defer house.mu.Unlock()
+
+	if _, ok := house.auctions[listing.Id]; ok {
+		return Auction{}, fmt.Errorf("%w: %d", ErrAuctionExists, listing.Id)
+	}
+
+	ask := pqueue.NewAsk(match.AuctionOrderId(listing.Id), listing.SellerId, listing.ArtworkId, listing.Quantity, listing.Reserve)
+	if listing.Reserve.IsZero() {
+		ask.Price = listing.StartPrice
+	}
+	if err := house.engine.LockHoldings(ask); err != nil {
+		return Auction{}, err
+	}
+
+	now := time.Now()
+	a := &Auction{
+		Listing:   listing,
+		Status:    AUCTION_OPEN,
+		StartedAt: now,
+		EndsAt:    now.Add(listing.Duration),
+		ask:       ask,
+	}
+	house.auctions[listing.Id] = a
+	time.AfterFunc(listing.Duration, func() { house.close(listing.Id) })
+
+	return a.snapshot(), nil
+}
+
+// checkListing validates the listing against the artwork's instrument,
+// filling in a default English increment.
+func checkListing(inst instrument.Instrument, listing *Listing) error {
+	if _, ok := formatNames[listing.Format]; !ok {
+		return fmt.Errorf("%w: unknown format %d", ErrInvalidListing, listing.Format)
+	}
+	if listing.Duration <= 0 {
+		return fmt.Errorf("%w: duration must be positive", ErrInvalidListing)
+	}
+	if listing.Id > match.MaxOrderId {
+		return fmt.Errorf("%w: auction id %d exceeds maximum %d", ErrInvalidListing, listing.Id, match.MaxOrderId)
+	}
+	if err := inst.CheckOrder(listing.Quantity, listing.StartPrice); err != nil {
+		return err
+	}
+	if !listing.Reserve.IsZero() {
+		if err := inst.CheckOrder(listing.Quantity, listing.Reserve); err != nil {
+			return err
+		}
+	}
+
+	switch listing.Format {
+	case FORMAT_ENGLISH:
+		if listing.Increment.IsZero() {
+			listing.Increment = inst.Price(inst.TickSize)
+		}
+		if err := inst.CheckOrder(listing.Quantity, listing.Increment); err != nil {
+			return err
+		}
+	case FORMAT_DUTCH:
+		if listing.Reserve.IsZero() || listing.Reserve.Cmp(listing.StartPrice) > 0 {
+			return fmt.Errorf("%w: a Dutch clock needs a reserve at or below its start price", ErrInvalidListing)
+		}
+		if listing.Decrement.IsZero() || listing.Step <= 0 {
+			return fmt.Errorf("%w: a Dutch clock needs a decrement and a step", ErrInvalidListing)
+		}
+		if err := inst.CheckOrder(listing.Quantity, listing.Decrement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bid places bid on the auction. An English bid is for the whole block and
+// must beat the high bid by the increment; its funds stay reserved until it
+// is outbid or the auction closes. A Dutch bid takes its quantity at the
+// clock price straight away, provided its limit is at or above it.
+func (house *House) Bid(auctionId uint64, bid *pqueue.Bid) (Auction, error) {
+	house.mu.Lock()
+	defer house.mu.Unlock()
+
+	a, ok := house.auctions[auctionId]
+	if !ok {
+		return Auction{}, ErrAuctionNotFound
+	}
+	now := time.Now()
+	if a.Status != AUCTION_OPEN || !now.Before(a.EndsAt) {
+		return Auction{}, fmt.Errorf("%w: auction %d is %s", ErrAuctionClosed, auctionId, StatusName(a.Status))
+	}
+	if bid.Id > match.MaxOrderId {
+		return Auction{}, fmt.Errorf("%w: bid id %d exceeds maximum %d", ErrInvalidBid, bid.Id, match.MaxOrderId)
+	}
+	bid.ArtworkId = a.ArtworkId
+
+	var err error
+	if a.Format == FORMAT_ENGLISH {
+		err = house.bidEnglish(a, bid, now)
+	} else {
+		err = house.bidDutch(a, bid, now)
+	}
+	if err != nil {
+		return Auction{}, err
+	}
+	return a.snapshot(), nil
+}
+
+func (house *House) bidEnglish(a *Auction, bid *pqueue.Bid, now time.Time) error {
+	if err := house.engine.Instrument(a.ArtworkId).CheckOrder(bid.Quantity(), bid.Price); err != nil {
+		return err
+	}
+	if bid.Quantity() != a.Quantity {
+		return fmt.Errorf("%w: English bids are for the whole block of %d", ErrInvalidBid, a.Quantity)
+	}
+
+	least := a.StartPrice
+	if a.highBid != nil {
+		var err error
+		if least, err = a.HighBid.Add(a.Increment); err != nil {
+			return err
+		}
+	}
+	if bid.Price.Cmp(least) < 0 {
+		return fmt.Errorf("%w: auction %d needs a bid of at least %s", ErrBidTooLow, a.Id, least)
+	}
+
+	if err := house.engine.ReserveFunds(bid); err != nil {
+		return err
+	}
+	if a.highBid != nil {
+		if err := house.engine.ReleaseFunds(a.highBid); err != nil {
+			log.Printf("failed to release outbid bid %d on auction %d: %v", a.highBid.Id, a.Id, err)
+		}
+	}
+	a.highBid, a.HighBid, a.HighBidderId = bid, bid.Price, bid.BidderId
+
+	// a late bid gives the others time to respond
+	if a.Extension > 0 && a.EndsAt.Sub(now) < a.Extension {
+		a.EndsAt = now.Add(a.Extension)
+	}
+	return nil
+}
+
+func (house *House) bidDutch(a *Auction, bid *pqueue.Bid, now time.Time) error {
+	clock := a.Price(now)
+	if err := house.engine.Instrument(a.ArtworkId).CheckOrder(bid.Quantity(), clock); err != nil {
+		return err
+	}
+	if bid.Quantity() > a.ask.QuantityRemaining() {
+		return fmt.Errorf("%w: auction %d has %d left", ErrInvalidBid, a.Id, a.ask.QuantityRemaining())
+	}
+	if bid.Price.Cmp(clock) < 0 {
+		return fmt.Errorf("%w: auction %d is at %s", ErrBidTooLow, a.Id, clock)
+	}
+
+	if err := house.engine.ReserveFunds(bid); err != nil {
+		return err
+	}
+	fill, err := house.engine.Cross(bid, a.ask, clock, bid.Quantity(), match.SIDE_BID)
+	if err != nil {
+		if releaseErr := house.engine.ReleaseFunds(bid); releaseErr != nil {
+			log.Printf("failed to release bid %d on auction %d: %v", bid.Id, a.Id, releaseErr)
+		}
+		return err
+	}
+	a.Fills = append(a.Fills, fill)
+	a.QuantitySold += fill.QuantityFilled
+	if a.ask.QuantityRemaining() == 0 {
+		a.Status = AUCTION_SOLD
+	}
+	return nil
+}
+
+// Cancel withdraws an auction, unlocking its unsold fractions. English
+// auctions can only be cancelled before their first bid.
+func (house *House) Cancel(auctionId uint64) (Auction, error) {
+	house.mu.Lock()
+	defer house.mu.Unlock()
+
+	a, ok := house.auctions[auctionId]
+	if !ok {
+		return Auction{}, ErrAuctionNotFound
+	}
+	if a.Status != AUCTION_OPEN {
+		return Auction{}, fmt.Errorf("%w: auction %d is %s", ErrAuctionClosed, auctionId, StatusName(a.Status))
+	}
+	if a.highBid != nil {
+		return Auction{}, fmt.Errorf("%w: auction %d is bid at %s", ErrHasBids, auctionId, a.HighBid)
+	}
+
+	if err := house.engine.UnlockHoldings(a.ask); err != nil {
+		return Auction{}, err
+	}
+	a.Status = AUCTION_CANCELLED
+	return a.snapshot(), nil
+}
+
+// close ends the auction once its close time has passed, waiting again if a
+// late bid extended it. An English auction sells to its high bid if the bid
+// meets the reserve; what is left unsold is unlocked.
+func (house *House) close(auctionId uint64) {
+	house.mu.Lock()
+	defer house.mu.Unlock()
+
+	a := house.auctions[auctionId]
+	if a.Status != AUCTION_OPEN {
+		return
+	}
+	if wait := time.Until(a.EndsAt); wait > 0 {
+		time.AfterFunc(wait, func() { house.close(auctionId) })
+		return
+	}
+
+	if bid := a.highBid; bid != nil {
+		if a.Reserve.IsZero() || bid.Price.Cmp(a.Reserve) >= 0 {
+			fill, err := house.engine.Cross(bid, a.ask, bid.Price, a.Quantity, match.SIDE_BID)
+			if err != nil {
+				log.Printf("failed to sell auction %d to bid %d: %v", a.Id, bid.Id, err)
+			} else {
+				a.Fills = append(a.Fills, fill)
+				a.QuantitySold += fill.QuantityFilled
+			}
+		}
+		if err := house.engine.ReleaseFunds(bid); err != nil {
+			log.Printf("failed to release bid %d on auction %d: %v", bid.Id, a.Id, err)
+		}
+	}
+
+	if err := house.engine.UnlockHoldings(a.ask); err != nil {
+		log.Printf("failed to unlock auction %d: %v", a.Id, err)
+	}
+	a.Status = AUCTION_ENDED
+	if a.ask.QuantityRemaining() == 0 {
+		a.Status = AUCTION_SOLD
+	}
+}
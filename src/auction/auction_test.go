@@ -0,0 +1,292 @@
+package auction
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+const (
+	artworkId = 1
+	sellerId  = 10
+	alice     = 20
+	bob       = 21
+)
+
+// setupHouse returns a house on an engine whose fills are sent to the
+// returned channel, with the seller holding 10 fractions and each buyer
+// 1000.00 USD.
+func setupHouse() (*House, *account.Memory, *holdings.Memory, chan match.FillOrder) {
+	engine := match.New()
+	engine.AddArtworkIfNotExists(artworkId)
+
+	accounts := account.NewMemory()
+	accounts.Deposit(alice, "USD", price.New(100000, 2))
+	accounts.Deposit(bob, "USD", price.New(100000, 2))
+	engine.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	ledger.Credit(sellerId, artworkId, 10)
+	engine.SetHoldingsLedger(ledger)
+
+	fills := make(chan match.FillOrder, 8)
+	go func() {
+		for {
+			select {
+			case fill := <-engine.Orders():
+				fills <- fill
+			case <-engine.Jobs():
+			}
+		}
+	}()
+	return New(engine), accounts, ledger, fills
+}
+
+func awaitStatus(t *testing.T, house *House, auctionId uint64, status uint32) Auction {
+	deadline := time.Now().Add(time.Second)
+	for {
+		a, err := house.Get(auctionId)
+		if err != nil {
+			t.Fatalf("failed to get auction %d: %v", auctionId, err)
+		}
+		if a.Status == status {
+			return a
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected auction %d to be %s, got %+v", auctionId, StatusName(status), a)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEnglishAuctionSellsToHighBid(t *testing.T) {
+	house, accounts, ledger, fills := setupHouse()
+
+	_, err := house.Create(Listing{
+		Id: 1, SellerId: sellerId, ArtworkId: artworkId, Quantity: 10,
+		Format:     FORMAT_ENGLISH,
+		Duration:   100 * time.Millisecond,
+		StartPrice: price.New(1000, 2),
+		Reserve:    price.New(1200, 2),
+		Increment:  price.New(100, 2),
+		Extension:  100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create auction: %v", err)
+	}
+	if pos := ledger.Position(sellerId, artworkId); pos.Locked != 10 {
+		t.Fatalf("Expected the block to be locked, got %+v", pos)
+	}
+
+	if _, err := house.Bid(1, pqueue.NewBid(1, alice, artworkId, 10, price.New(1100, 2))); err != nil {
+		t.Fatalf("failed to bid: %v", err)
+	}
+	if _, err := house.Bid(1, pqueue.NewBid(2, bob, artworkId, 10, price.New(1150, 2))); !errors.Is(err, ErrBidTooLow) {
+		t.Fatalf("Expected a bid under the increment to be too low, got %v", err)
+	}
+	if _, err := house.Bid(1, pqueue.NewBid(3, bob, artworkId, 10, price.New(1200, 2))); err != nil {
+		t.Fatalf("failed to bid: %v", err)
+	}
+	if balance := accounts.Balance(alice, "USD"); !balance.Reserved.IsZero() {
+		t.Fatalf("Expected the outbid funds to be released, got %+v", balance)
+	}
+
+	// a bid in the last moments extends the close
+	time.Sleep(60 * time.Millisecond)
+	before, _ := house.Get(1)
+	a, err := house.Bid(1, pqueue.NewBid(4, alice, artworkId, 10, price.New(1300, 2)))
+	if err != nil {
+		t.Fatalf("failed to bid: %v", err)
+	}
+	if !a.EndsAt.After(before.EndsAt) {
+		t.Fatalf("Expected a late bid to extend the close past %v, got %v", before.EndsAt, a.EndsAt)
+	}
+
+	select {
+	case fill := <-fills:
+		if fill.BuyerId != alice || fill.SellerId != sellerId || fill.QuantityFilled != 10 || fill.Price.String() != "13.00" {
+			t.Fatalf("Expected alice to buy the block at 13.00, got %+v", fill)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("auction did not sell")
+	}
+	awaitStatus(t, house, 1, AUCTION_SOLD)
+
+	if pos := ledger.Position(alice, artworkId); pos.Available != 10 {
+		t.Errorf("Expected alice to hold the block, got %+v", pos)
+	}
+	if balance := accounts.Balance(bob, "USD"); !balance.Reserved.IsZero() || balance.Available.String() != "1000.00" {
+		t.Errorf("Expected bob's funds to be released, got %+v", balance)
+	}
+}
+
+func TestEnglishAuctionBelowReserveEnds(t *testing.T) {
+	house, accounts, ledger, fills := setupHouse()
+
+	_, err := house.Create(Listing{
+		Id: 1, SellerId: sellerId, ArtworkId: artworkId, Quantity: 10,
+		Format:     FORMAT_ENGLISH,
+		Duration:   30 * time.Millisecond,
+		StartPrice: price.New(1000, 2),
+		Reserve:    price.New(5000, 2),
+	})
+	if err != nil {
+		t.Fatalf("failed to create auction: %v", err)
+	}
+	if _, err := house.Bid(1, pqueue.NewBid(1, alice, artworkId, 10, price.New(1000, 2))); err != nil {
+		t.Fatalf("failed to bid: %v", err)
+	}
+	if _, err := house.Cancel(1); !errors.Is(err, ErrHasBids) {
+		t.Fatalf("Expected an auction with bids not to be cancelled, got %v", err)
+	}
+
+	awaitStatus(t, house, 1, AUCTION_ENDED)
+	select {
+	case fill := <-fills:
+		t.Fatalf("Expected no sale below the reserve, got %+v", fill)
+	default:
+	}
+	if balance := accounts.Balance(alice, "USD"); !balance.Reserved.IsZero() {
+		t.Errorf("Expected the bid's funds to be released, got %+v", balance)
+	}
+	if pos := ledger.Position(sellerId, artworkId); pos.Locked != 0 || pos.Available != 10 {
+		t.Errorf("Expected the block to be unlocked, got %+v", pos)
+	}
+	if _, err := house.Bid(1, pqueue.NewBid(2, bob, artworkId, 10, price.New(6000, 2))); !errors.Is(err, ErrAuctionClosed) {
+		t.Errorf("Expected bids on an ended auction to fail, got %v", err)
+	}
+}
+
+func TestDutchClock(t *testing.T) {
+	start := time.Now()
+	a := Auction{
+		Listing: Listing{
+			Format:     FORMAT_DUTCH,
+			StartPrice: price.New(2000, 2),
+			Reserve:    price.New(1250, 2),
+			Decrement:  price.New(300, 2),
+			Step:       time.Minute,
+		},
+		StartedAt: start,
+	}
+
+	tests := []struct {
+		elapsed  time.Duration
+		expected string
+	}{
+		{0, "20.00"},
+		{59 * time.Second, "20.00"},
+		{time.Minute, "17.00"},
+		{2 * time.Minute, "14.00"},
+		// the clock stops at the reserve
+		{3 * time.Minute, "12.50"},
+		{time.Hour, "12.50"},
+	}
+	for _, test := range tests {
+		if got := a.Price(start.Add(test.elapsed)).String(); got != test.expected {
+			t.Errorf("Price after %v = %s, expected %s", test.elapsed, got, test.expected)
+		}
+	}
+}
+
+func TestDutchAuctionSellsFractions(t *testing.T) {
+	house, accounts, ledger, fills := setupHouse()
+
+	_, err := house.Create(Listing{
+		Id: 1, SellerId: sellerId, ArtworkId: artworkId, Quantity: 10,
+		Format:     FORMAT_DUTCH,
+		Duration:   time.Hour,
+		StartPrice: price.New(2000, 2),
+		Reserve:    price.New(1000, 2),
+		Decrement:  price.New(100, 2),
+		Step:       time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create auction: %v", err)
+	}
+
+	if _, err := house.Bid(1, pqueue.NewBid(1, bob, artworkId, 4, price.New(1500, 2))); !errors.Is(err, ErrBidTooLow) {
+		t.Fatalf("Expected a limit under the clock to be too low, got %v", err)
+	}
+	// a higher limit still pays the clock price
+	if _, err := house.Bid(1, pqueue.NewBid(2, alice, artworkId, 4, price.New(2500, 2))); err != nil {
+		t.Fatalf("failed to take the clock: %v", err)
+	}
+	if _, err := house.Bid(1, pqueue.NewBid(3, bob, artworkId, 7, price.New(2000, 2))); !errors.Is(err, ErrInvalidBid) {
+		t.Fatalf("Expected taking more than is left to fail, got %v", err)
+	}
+	a, err := house.Bid(1, pqueue.NewBid(4, bob, artworkId, 6, price.New(2000, 2)))
+	if err != nil {
+		t.Fatalf("failed to take the clock: %v", err)
+	}
+	if a.Status != AUCTION_SOLD || a.QuantitySold != 10 || len(a.Fills) != 2 {
+		t.Fatalf("Expected the block to sell out, got %+v", a)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case fill := <-fills:
+			if fill.Price.String() != "20.00" {
+				t.Errorf("Expected fills at the clock price, got %+v", fill)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("fill %d was not sent", i)
+		}
+	}
+	if balance := accounts.Balance(alice, "USD"); balance.Available.String() != "920.00" || !balance.Reserved.IsZero() {
+		t.Errorf("Expected alice to pay 80.00, got %+v", balance)
+	}
+	if pos := ledger.Position(bob, artworkId); pos.Available != 6 {
+		t.Errorf("Expected bob to hold 6 fractions, got %+v", pos)
+	}
+}
+
+func TestAuctionLockIsApartFromBookAsks(t *testing.T) {
+	house, _, ledger, _ := setupHouse()
+	otherArtworkId := uint64(artworkId + 1)
+	house.engine.AddArtworkIfNotExists(otherArtworkId)
+	ledger.Credit(sellerId, otherArtworkId, 5)
+
+	_, err := house.Create(Listing{
+		Id: 5, SellerId: sellerId, ArtworkId: artworkId, Quantity: 10,
+		Format:     FORMAT_ENGLISH,
+		Duration:   time.Minute,
+		StartPrice: price.New(1000, 2),
+	})
+	if err != nil {
+		t.Fatalf("failed to create auction: %v", err)
+	}
+
+	// the seller's own ask with the auction's id locks another artwork
+	if _, err := house.engine.FillAskOrder(pqueue.NewAsk(5, sellerId, otherArtworkId, 5, price.New(1000, 2))); err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+	if pos := ledger.Position(sellerId, otherArtworkId); pos.Locked != 5 {
+		t.Fatalf("Expected the ask to lock its fractions, got %+v", pos)
+	}
+
+	if _, err := house.Cancel(5); err != nil {
+		t.Fatalf("failed to cancel auction: %v", err)
+	}
+	if pos := ledger.Position(sellerId, artworkId); pos.Locked != 0 || pos.Available != 10 {
+		t.Fatalf("Expected the block to be unlocked, got %+v", pos)
+	}
+	if pos := ledger.Position(sellerId, otherArtworkId); pos.Locked != 5 {
+		t.Fatalf("Expected the ask to stay locked, got %+v", pos)
+	}
+
+	_, err = house.Create(Listing{
+		Id: match.MaxOrderId + 1, SellerId: sellerId, ArtworkId: artworkId, Quantity: 10,
+		Format:     FORMAT_ENGLISH,
+		Duration:   time.Minute,
+		StartPrice: price.New(1000, 2),
+	})
+	if !errors.Is(err, ErrInvalidListing) {
+		t.Fatalf("Expected an auction id above the order ids to be refused, got %v", err)
+	}
+}
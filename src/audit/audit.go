@@ -0,0 +1,97 @@
+// the audit log records every action operators take that changes trades or
+// the market, who took it and why, so it can be reviewed later.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/libstore"
+)
+
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Operator  string    `json:"operator"`
+	Reason    string    `json:"reason"`
+	FillId    uint64    `json:"fill_id,omitempty"`
+	ArtworkId uint64    `json:"artwork_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Log is safe for concurrent use. A log opened on a journal appends every
+// entry to it and replays it on open.
+type Log struct {
+	entries []Entry
+	journal *libstore.Journal // nil keeps the log in memory only
+	mu      sync.Mutex
+}
+
+func New() *Log {
+	return &Log{}
+}
+
+func Open(path string) (*Log, error) {
+	journal, err := libstore.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log := New()
+	err = journal.Replay(func(record json.RawMessage) error {
+		var entry Entry
+		if err := json.Unmarshal(record, &entry); err != nil {
+			return err
+		}
+		log.entries = append(log.entries, entry)
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to replay audit log: %v", err)
+	}
+
+	log.journal = journal
+	return log, nil
+}
+
+func (log *Log) Close() error {
+	if log.journal == nil {
+		return nil
+	}
+	return log.journal.Close()
+}
+
+func (log *Log) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if log.journal != nil {
+		if err := log.journal.Append(entry); err != nil {
+			return err
+		}
+	}
+	log.entries = append(log.entries, entry)
+	return nil
+}
+
+// Fill returns the entries about one fill, oldest first.
+func (log *Log) Fill(fillId uint64) []Entry {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	var entries []Entry
+	for _, entry := range log.entries {
+		if entry.FillId == fillId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
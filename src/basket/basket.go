@@ -0,0 +1,428 @@
+// baskets place one order on each of several artworks as a single
+// instruction, e.g. to buy a fraction of each work in a portfolio. By
+// default the legs are placed one
+// after another as limit orders that rest until they fill; if a book
+// refuses a leg, the legs placed before it are cancelled and the rest are
+// not placed, leaving whatever had filled. An all-or-none basket fills
+// every leg in full at once or none of them, and nothing of it rests.
+
+package basket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// basket and leg statuses
+const (
+	// the basket or leg has orders resting on the book
+	STATUS_WORKING = iota
+	STATUS_FILLED
+	// cancelled, or not placed because another leg was refused; what had
+	// filled stands
+	STATUS_CANCELLED
+	// refused by the book
+	STATUS_REJECTED
+)
+
+var statusNames = map[uint32]string{
+	STATUS_WORKING:   "WORKING",
+	STATUS_FILLED:    "FILLED",
+	STATUS_CANCELLED: "CANCELLED",
+	STATUS_REJECTED:  "REJECTED",
+}
+
+func StatusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", status)
+}
+
+var (
+	ErrInvalidBasket  = errors.New("invalid basket")
+	ErrBasketExists   = errors.New("basket already exists")
+	ErrBasketNotFound = errors.New("basket not found")
+	ErrNotOwner       = errors.New("basket is not the user's")
+	ErrBasketDone     = errors.New("basket has no working legs")
+)
+
+// LegError is returned for the leg at fault.
+type LegError struct {
+	Index int
+	Err   error
+}
+
+func (e *LegError) Error() string {
+	return fmt.Sprintf("leg %d: %v", e.Index, e.Err)
+}
+
+func (e *LegError) Unwrap() error {
+	return e.Err
+}
+
+type Leg struct {
+	ArtworkId uint64
+	OrderId   uint64 // distinct for each leg
+	Side      uint32 // match.SIDE_BID or match.SIDE_ASK
+	Quantity  uint64
+	Price     price.Price // limit price
+
+	Status         uint32
+	QuantityFilled uint64
+	Reason         string // why the leg was refused or not placed
+
+	// fills seen when the order returned from the book, and printed to the
+	// desk since; either may be ahead of the other
+	placed, printed uint64
+}
+
+// settle brings the leg's fill quantity and status up to date.
+func (leg *Leg) settle() {
+	leg.QuantityFilled = leg.placed
+	if leg.printed > leg.QuantityFilled {
+		leg.QuantityFilled = leg.printed
+	}
+	// a leg cancelled as its last fill printed still filled in full
+	if leg.Status != STATUS_REJECTED && leg.QuantityFilled >= leg.Quantity {
+		leg.Status = STATUS_FILLED
+	}
+}
+
+type Basket struct {
+	Id        uint64
+	UserId    uint64
+	AllOrNone bool
+	Legs      []Leg
+	Status    uint32
+	Reason    string // why the basket was cancelled or refused
+	PlacedAt  time.Time
+}
+
+// Quantity is the basket's total quantity across its legs.
+func (b Basket) Quantity() uint64 {
+	var quantity uint64
+	for _, leg := range b.Legs {
+		quantity += leg.Quantity
+	}
+	return quantity
+}
+
+// QuantityFilled is the basket's total quantity filled across its legs.
+func (b Basket) QuantityFilled() uint64 {
+	var filled uint64
+	for _, leg := range b.Legs {
+		filled += leg.QuantityFilled
+	}
+	return filled
+}
+
+// settle brings the basket's legs and status up to date.
+func (b *Basket) settle() {
+	filled := true
+	for i := range b.Legs {
+		leg := &b.Legs[i]
+		leg.settle()
+		// legs of a basket that stopped working are done too
+		if b.Status != STATUS_WORKING && leg.Status == STATUS_WORKING {
+			leg.Status = STATUS_CANCELLED
+		}
+		filled = filled && leg.Status == STATUS_FILLED
+	}
+	if b.Status == STATUS_WORKING && filled {
+		b.Status = STATUS_FILLED
+	}
+}
+
+// snapshot copies the basket for callers outside the desk.
+func (b *Basket) snapshot() Basket {
+	snapshot := *b
+	snapshot.Legs = append([]Leg(nil), b.Legs...)
+	return snapshot
+}
+
+type legKey struct {
+	artworkId uint64
+	side      uint32
+	userId    uint64
+	orderId   uint64
+}
+
+// Desk places baskets and follows their legs' fills. It is safe for
+// concurrent use. It never calls the engine with its lock held, since the
+// engine may be waiting on whoever prints fills to the desk.
+type Desk struct {
+	engine  *match.OrderMatchingEngine
+	mu      sync.Mutex
+	baskets map[uint64]*Basket // key: basket id
+	legs    map[legKey]uint64  // basket id of each leg's order
+}
+
+func New(engine *match.OrderMatchingEngine) *Desk {
+	return &Desk{
+		engine:  engine,
+		baskets: make(map[uint64]*Basket),
+		legs:    make(map[legKey]uint64),
+	}
+}
+
+// Place places the basket's legs, returning the basket as they left it.
+// Legs the books refuse are reported in the basket rather than as errors;
+// only a fill failing partway through an all-or-none basket is returned as
+// one, with the basket recorded REJECTED.
+func (desk *Desk) Place(b Basket) (Basket, error) {
+	if err := desk.check(b); err != nil {
+		return Basket{}, err
+	}
+
+	b.Status, b.Reason, b.PlacedAt = STATUS_WORKING, "", time.Now()
+	b.Legs = append([]Leg(nil), b.Legs...)
+	for i := range b.Legs {
+		b.Legs[i].Status, b.Legs[i].QuantityFilled, b.Legs[i].Reason = STATUS_WORKING, 0, ""
+		b.Legs[i].placed, b.Legs[i].printed = 0, 0
+	}
+	desk.mu.Lock()
+	if _, ok := desk.baskets[b.Id]; ok {
+		desk.mu.Unlock()
+		return Basket{}, fmt.Errorf("%w: %d", ErrBasketExists, b.Id)
+	}
+	desk.baskets[b.Id] = &b
+	for _, leg := range b.Legs {
+		desk.legs[legKey{leg.ArtworkId, leg.Side, b.UserId, leg.OrderId}] = b.Id
+	}
+	desk.mu.Unlock()
+
+	orders := make([]match.BidAsk, len(b.Legs))
+	for i, leg := range b.Legs {
+		orders[i] = order(b, leg)
+	}
+	if b.AllOrNone {
+		return desk.fillAllOrNone(b.Id, orders)
+	}
+
+	placed := make([]uint64, len(orders))
+	for i, o := range orders {
+		var filled match.BidAsk
+		var err error
+		switch o := o.(type) {
+		case *pqueue.Bid:
+			filled, err = desk.engine.FillBidOrder(o)
+		case *pqueue.Ask:
+			filled, err = desk.engine.FillAskOrder(o)
+		}
+		if err != nil {
+			cancelled := desk.cancel(b.Id, orders[:i])
+			return desk.update(b.Id, func(b *Basket) {
+				for j, filled := range placed {
+					b.Legs[j].placed = filled
+				}
+				b.Status, b.Reason = STATUS_CANCELLED, fmt.Sprintf("leg %d refused: %v", i, err)
+				b.Legs[i].Status, b.Legs[i].Reason = STATUS_REJECTED, err.Error()
+				for j := i + 1; j < len(b.Legs); j++ {
+					b.Legs[j].Reason = "not placed"
+				}
+				cancelled(b)
+			}), nil
+		}
+		placed[i] = filled.QuantityFilled()
+	}
+	return desk.update(b.Id, func(b *Basket) {
+		for i, filled := range placed {
+			b.Legs[i].placed = filled
+		}
+	}), nil
+}
+
+func (desk *Desk) fillAllOrNone(basketId uint64, orders []match.BidAsk) (Basket, error) {
+	err := desk.engine.FillAllOrNone(orders)
+	var legErr *match.LegError
+	if errors.As(err, &legErr) {
+		return desk.update(basketId, func(b *Basket) {
+			b.Status, b.Reason = STATUS_REJECTED, fmt.Sprintf("leg %d cannot fill: %v", legErr.Index, legErr.Err)
+			for i := range b.Legs {
+				b.Legs[i].Status, b.Legs[i].Reason = STATUS_CANCELLED, "not placed"
+			}
+			b.Legs[legErr.Index].Status, b.Legs[legErr.Index].Reason = STATUS_REJECTED, legErr.Err.Error()
+		}), nil
+	}
+
+	// a fill failing partway leaves the legs before it filled and cancels
+	// the rest, which the basket reports before returning the failure
+	b := desk.update(basketId, func(b *Basket) {
+		for i, o := range orders {
+			b.Legs[i].placed = o.QuantityFilled()
+			if err != nil && b.Legs[i].placed < b.Legs[i].Quantity {
+				b.Legs[i].Status, b.Legs[i].Reason = STATUS_REJECTED, err.Error()
+			}
+		}
+		if err != nil {
+			b.Status, b.Reason = STATUS_REJECTED, err.Error()
+		}
+	})
+	return b, err
+}
+
+// Get returns the basket with the given id.
+func (desk *Desk) Get(basketId uint64) (Basket, error) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	b, ok := desk.baskets[basketId]
+	if !ok {
+		return Basket{}, fmt.Errorf("%w: %d", ErrBasketNotFound, basketId)
+	}
+	return b.snapshot(), nil
+}
+
+// Cancel cancels the user's working legs of the basket.
+func (desk *Desk) Cancel(basketId, userId uint64) (Basket, error) {
+	desk.mu.Lock()
+	b, ok := desk.baskets[basketId]
+	if !ok {
+		desk.mu.Unlock()
+		return Basket{}, fmt.Errorf("%w: %d", ErrBasketNotFound, basketId)
+	}
+	if b.UserId != userId {
+		desk.mu.Unlock()
+		return Basket{}, fmt.Errorf("%w: basket %d is user %d's, not %d", ErrNotOwner, basketId, b.UserId, userId)
+	}
+	if b.Status != STATUS_WORKING {
+		desk.mu.Unlock()
+		return Basket{}, fmt.Errorf("%w: basket %d is %s", ErrBasketDone, basketId, StatusName(b.Status))
+	}
+	var orders []match.BidAsk
+	for _, leg := range b.Legs {
+		if leg.Status == STATUS_WORKING {
+			orders = append(orders, order(*b, leg))
+		}
+	}
+	desk.mu.Unlock()
+
+	cancelled := desk.cancel(basketId, orders)
+	return desk.update(basketId, func(b *Basket) {
+		b.Status, b.Reason = STATUS_CANCELLED, "cancelled by user"
+		cancelled(b)
+	}), nil
+}
+
+// Print follows a fill with the basket legs it filled.
+func (desk *Desk) Print(fill match.FillOrder) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	for _, key := range []legKey{
+		{fill.ArtworkId, match.SIDE_BID, fill.BuyerId, fill.BidId},
+		{fill.ArtworkId, match.SIDE_ASK, fill.SellerId, fill.AskId},
+	} {
+		basketId, ok := desk.legs[key]
+		if !ok {
+			continue
+		}
+		b := desk.baskets[basketId]
+		for i := range b.Legs {
+			if b.Legs[i].ArtworkId == key.artworkId && b.Legs[i].Side == key.side && b.Legs[i].OrderId == key.orderId {
+				b.Legs[i].printed += fill.QuantityFilled
+			}
+		}
+		b.settle()
+	}
+}
+
+// cancel takes the basket's orders off their books if they are still
+// resting there, returning a function that marks their legs cancelled.
+func (desk *Desk) cancel(basketId uint64, orders []match.BidAsk) func(*Basket) {
+	type result struct {
+		artworkId uint64
+		orderId   uint64
+		filled    uint64
+	}
+	var results []result
+	for _, o := range orders {
+		var err error
+		switch o := o.(type) {
+		case *pqueue.Bid:
+			var bid *pqueue.Bid
+			if bid, err = desk.engine.CancelUserBid(o.ArtworkId, o.Id, o.BidderId); bid != nil {
+				results = append(results, result{o.ArtworkId, o.Id, bid.QuantityFilled()})
+			}
+		case *pqueue.Ask:
+			var ask *pqueue.Ask
+			if ask, err = desk.engine.CancelUserAsk(o.ArtworkId, o.Id, o.AskerId); ask != nil {
+				results = append(results, result{o.ArtworkId, o.Id, ask.QuantityFilled()})
+			}
+		}
+		if err != nil && !errors.Is(err, match.ErrOrderNotFound) {
+			log.Printf("failed to cancel leg of basket %d: %v", basketId, err)
+		}
+	}
+
+	return func(b *Basket) {
+		for _, r := range results {
+			for i := range b.Legs {
+				leg := &b.Legs[i]
+				if leg.ArtworkId == r.artworkId && leg.OrderId == r.orderId {
+					leg.placed = r.filled
+					leg.Status, leg.Reason = STATUS_CANCELLED, "cancelled"
+				}
+			}
+		}
+	}
+}
+
+// update applies fn to the basket under the desk's lock and returns it
+// brought up to date.
+func (desk *Desk) update(basketId uint64, fn func(*Basket)) Basket {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	b := desk.baskets[basketId]
+	fn(b)
+	b.settle()
+	return b.snapshot()
+}
+
+// check returns an error wrapping ErrInvalidBasket, or a *LegError, if the
+// basket cannot be placed. Legs that break their instrument's rules are
+// refused here, before any leg is placed.
+func (desk *Desk) check(b Basket) error {
+	if len(b.Legs) == 0 {
+		return fmt.Errorf("%w: a basket needs at least one leg", ErrInvalidBasket)
+	}
+	artworks, orders := make(map[uint64]bool), make(map[uint64]bool)
+	for i, leg := range b.Legs {
+		if !desk.engine.HasArtwork(leg.ArtworkId) {
+			return &LegError{i, fmt.Errorf("%w: %d", match.ErrArtworkNotListed, leg.ArtworkId)}
+		}
+		if artworks[leg.ArtworkId] {
+			return &LegError{i, fmt.Errorf("%w: artwork %d has another leg", ErrInvalidBasket, leg.ArtworkId)}
+		}
+		if orders[leg.OrderId] {
+			return &LegError{i, fmt.Errorf("%w: order id %d is another leg's", ErrInvalidBasket, leg.OrderId)}
+		}
+		artworks[leg.ArtworkId], orders[leg.OrderId] = true, true
+		if leg.Side != match.SIDE_BID && leg.Side != match.SIDE_ASK {
+			return &LegError{i, fmt.Errorf("%w: side must be BID (0) or ASK (1)", ErrInvalidBasket)}
+		}
+		var ruleErr *instrument.RuleError
+		if err := desk.engine.Instrument(leg.ArtworkId).CheckOrder(leg.Quantity, leg.Price); errors.As(err, &ruleErr) {
+			return &LegError{i, ruleErr}
+		}
+	}
+	return nil
+}
+
+// order is the order a leg of the basket places.
+func order(b Basket, leg Leg) match.BidAsk {
+	if leg.Side == match.SIDE_BID {
+		return pqueue.NewBid(leg.OrderId, b.UserId, leg.ArtworkId, leg.Quantity, leg.Price)
+	}
+	return pqueue.NewAsk(leg.OrderId, b.UserId, leg.ArtworkId, leg.Quantity, leg.Price)
+}
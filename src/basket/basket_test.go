@@ -0,0 +1,201 @@
+package basket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+const (
+	collectorId = 10
+	sellerId    = 20
+)
+
+// setupDesk returns a desk on an engine listing artworks 1 to 3, with the
+// seller holding 10 fractions of each and every fill printed to the desk as
+// the server's worker does.
+func setupDesk() (*Desk, *match.OrderMatchingEngine) {
+	engine := match.New()
+	ledger := holdings.NewMemory()
+	for artworkId := uint64(1); artworkId <= 3; artworkId++ {
+		engine.AddArtworkIfNotExists(artworkId)
+		ledger.Credit(sellerId, artworkId, 10)
+	}
+	engine.SetHoldingsLedger(ledger)
+
+	desk := New(engine)
+	go func() {
+		for {
+			select {
+			case fill := <-engine.Orders():
+				desk.Print(fill)
+			case <-engine.Jobs():
+			}
+		}
+	}()
+	return desk, engine
+}
+
+func portfolio(basketId uint64, allOrNone bool) Basket {
+	b := Basket{Id: basketId, UserId: collectorId, AllOrNone: allOrNone}
+	for artworkId := uint64(1); artworkId <= 3; artworkId++ {
+		b.Legs = append(b.Legs, Leg{ArtworkId: artworkId, OrderId: basketId*10 + artworkId, Side: match.SIDE_BID, Quantity: 1, Price: price.New(500, 2)})
+	}
+	return b
+}
+
+func placeAsk(t *testing.T, engine *match.OrderMatchingEngine, askId, artworkId uint64) {
+	if _, err := engine.FillAskOrder(pqueue.NewAsk(askId, sellerId, artworkId, 1, price.New(400, 2))); err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+}
+
+func TestRefusedLegCancelsTheOthers(t *testing.T) {
+	desk, engine := setupDesk()
+	placeAsk(t, engine, 100, 1)
+
+	// the collector holds none of artwork 3 to sell
+	b := portfolio(1, false)
+	b.Legs[1].Price = price.New(300, 2)
+	b.Legs[2].Side = match.SIDE_ASK
+	b.Legs = append(b.Legs, Leg{ArtworkId: 4, OrderId: 14, Side: match.SIDE_BID, Quantity: 1, Price: price.New(500, 2)})
+	var legErr *LegError
+	if _, err := desk.Place(b); !errors.As(err, &legErr) || legErr.Index != 3 {
+		t.Fatalf("Expected the unlisted artwork's leg to be refused, got %v", err)
+	}
+
+	b.Legs = b.Legs[:3]
+	placed, err := desk.Place(b)
+	if err != nil {
+		t.Fatalf("failed to place basket: %v", err)
+	}
+	if placed.Status != STATUS_CANCELLED || placed.QuantityFilled() != 1 {
+		t.Fatalf("Expected the basket to be cancelled after filling 1, got %+v", placed)
+	}
+	want := []uint32{STATUS_FILLED, STATUS_CANCELLED, STATUS_REJECTED}
+	for i, leg := range placed.Legs {
+		if leg.Status != want[i] {
+			t.Errorf("Expected leg %d to be %s, got %+v", i, StatusName(want[i]), leg)
+		}
+	}
+	if _, err := engine.CancelBid(2, b.Legs[1].OrderId); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected the resting leg to be cancelled, got %v", err)
+	}
+}
+
+func TestAllOrNoneBasket(t *testing.T) {
+	desk, engine := setupDesk()
+	placeAsk(t, engine, 100, 1)
+	placeAsk(t, engine, 200, 2)
+
+	// nothing is offered on artwork 3, so nothing fills
+	b, err := desk.Place(portfolio(1, true))
+	if err != nil || b.Status != STATUS_REJECTED || b.QuantityFilled() != 0 || b.Legs[2].Status != STATUS_REJECTED {
+		t.Fatalf("Expected the basket to be refused on leg 2, got %+v (%v)", b, err)
+	}
+	for _, askId := range []uint64{100, 200} {
+		if ask, err := engine.CancelAsk(askId/100, askId); err != nil || ask.QuantityFilled() != 0 {
+			t.Fatalf("Expected ask %d to be untouched, got %v", askId, err)
+		}
+	}
+
+	for _, artworkId := range []uint64{1, 2, 3} {
+		placeAsk(t, engine, artworkId*100+1, artworkId)
+	}
+	b, err = desk.Place(portfolio(2, true))
+	if err != nil || b.Status != STATUS_FILLED || b.QuantityFilled() != 3 {
+		t.Fatalf("Expected every leg to fill, got %+v (%v)", b, err)
+	}
+}
+
+func TestAllOrNoneBasketKeepsItsBand(t *testing.T) {
+	desk, engine := setupDesk()
+	inst := instrument.Default
+	inst.ArtworkId, inst.PriceBandBps, inst.HaltSeconds = 1, 1000, 60
+	if err := engine.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+
+	// a trade at 100.00 bands artwork 1 from 90.00 to 110.00
+	engine.FillAskOrder(pqueue.NewAsk(100, sellerId, 1, 1, price.New(10000, 2)))
+	engine.FillBidOrder(pqueue.NewBid(101, 30, 1, 1, price.New(10000, 2)))
+	// a fill at 91.00 would recentre the band below the ask at 110.00
+	engine.FillAskOrder(pqueue.NewAsk(102, sellerId, 1, 1, price.New(9100, 2)))
+	engine.FillAskOrder(pqueue.NewAsk(103, sellerId, 1, 1, price.New(11000, 2)))
+	placeAsk(t, engine, 200, 2)
+
+	b := Basket{Id: 1, UserId: collectorId, AllOrNone: true, Legs: []Leg{
+		{ArtworkId: 1, OrderId: 11, Side: match.SIDE_BID, Quantity: 2, Price: price.New(11000, 2)},
+		{ArtworkId: 2, OrderId: 12, Side: match.SIDE_BID, Quantity: 1, Price: price.New(500, 2)},
+	}}
+	placed, err := desk.Place(b)
+	if err != nil || placed.Status != STATUS_FILLED || placed.QuantityFilled() != 3 {
+		t.Fatalf("Expected every leg to fill inside the band it was checked against, got %+v (%v)", placed, err)
+	}
+	if status := engine.TradingStatus(1); status.Phase != match.TRADING_OPEN {
+		t.Errorf("Expected the basket's own fills not to halt artwork 1, got %+v", status)
+	}
+}
+
+func TestWorkingLegFillsLater(t *testing.T) {
+	desk, engine := setupDesk()
+	placeAsk(t, engine, 100, 1)
+
+	b := portfolio(1, false)
+	b.Legs = b.Legs[:2]
+	placed, err := desk.Place(b)
+	if err != nil || placed.Status != STATUS_WORKING || placed.Legs[0].Status != STATUS_FILLED {
+		t.Fatalf("Expected leg 1 to fill and leg 2 to rest, got %+v (%v)", placed, err)
+	}
+
+	placeAsk(t, engine, 200, 2)
+	deadline := time.Now().Add(time.Second)
+	for {
+		b, err := desk.Get(b.Id)
+		if err != nil {
+			t.Fatalf("failed to get basket: %v", err)
+		}
+		if b.Status == STATUS_FILLED {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the basket to fill, got %+v", b)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := desk.Cancel(b.Id, collectorId); !errors.Is(err, ErrBasketDone) {
+		t.Errorf("Expected a filled basket not to be cancellable, got %v", err)
+	}
+}
+
+func TestLegsAreTheBasketOwnersOrders(t *testing.T) {
+	desk, engine := setupDesk()
+
+	b := portfolio(1, false)
+	b.Legs = b.Legs[1:2]
+	if _, err := desk.Place(b); err != nil {
+		t.Fatalf("failed to place basket: %v", err)
+	}
+	// another user's bid with the leg's id fills ahead of it
+	other := pqueue.NewBid(b.Legs[0].OrderId, collectorId+1, 2, 2, price.New(600, 2))
+	if _, err := engine.FillBidOrder(other); err != nil {
+		t.Fatalf("failed to place the other user's bid: %v", err)
+	}
+	placeAsk(t, engine, 100, 2)
+	// a resting ask is printed after the fill before it
+	placeAsk(t, engine, 101, 3)
+
+	cancelled, err := desk.Cancel(b.Id, collectorId)
+	if err != nil || cancelled.Legs[0].QuantityFilled != 0 || cancelled.Legs[0].Status != STATUS_CANCELLED {
+		t.Fatalf("Expected the unfilled leg to be cancelled, got %+v (%v)", cancelled, err)
+	}
+	if bid, err := engine.CancelUserBid(2, other.Id, collectorId+1); err != nil || bid != other {
+		t.Errorf("Expected the other user's bid to keep resting, got %v, %v", bid, err)
+	}
+}
@@ -0,0 +1,219 @@
+// the chain settles fills on-chain. Each fill moves the fraction tokens
+// from seller to buyer and the payment, fees and royalties between buyer,
+// seller, the marketplace treasury and the artwork's artists. A batch of
+// fills is submitted as one transaction whose transfers are netted, so a
+// user who both buys and sells in the batch only moves the difference.
+// Executors either apply the whole transaction or none of it.
+
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/settlement"
+)
+
+var (
+	// ErrReverted is wrapped by executors whose transaction was mined but
+	// reverted, e.g. for running out of gas. Reverted settlements are
+	// rejected rather than retried.
+	ErrReverted = errors.New("chain: transaction reverted")
+	// ErrUnavailable is wrapped by executors that could not reach the
+	// chain. The settlement is retried.
+	ErrUnavailable = errors.New("chain: unavailable")
+)
+
+// Treasury is the address fees are paid to.
+const Treasury = "treasury"
+
+func UserAddress(userId uint64) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+// FractionToken is the token of an artwork's fractions, counted in whole
+// fractions.
+func FractionToken(artworkId uint64) string {
+	return fmt.Sprintf("artwork:%d", artworkId)
+}
+
+type Transfer struct {
+	Token  string      `json:"token"` // a FractionToken or a currency
+	From   string      `json:"from"`
+	To     string      `json:"to"`
+	Amount price.Price `json:"amount"`
+}
+
+// Transaction settles every fill it lists by making its transfers.
+type Transaction struct {
+	FillIds   []uint64   `json:"fill_ids"`
+	Transfers []Transfer `json:"transfers"`
+}
+
+type Receipt struct {
+	FillIds []uint64 `json:"fill_ids"`
+	TxHash  string   `json:"tx_hash"`
+	Block   uint64   `json:"block"`
+	GasUsed uint64   `json:"gas_used"`
+}
+
+type SettlementExecutor interface {
+	// Submit makes the transaction's transfers atomically and returns its
+	// receipt once mined.
+	Submit(tx Transaction) (Receipt, error)
+	// Receipt returns the receipt of the transaction that settled the
+	// fill, if one was mined.
+	Receipt(fillId uint64) (Receipt, bool, error)
+}
+
+// Transfers lists what must move on chain to settle the job.
+func Transfers(job settlement.Job) ([]Transfer, error) {
+	fill := job.Fill
+	notional, err := fill.Notional()
+	if err != nil {
+		return nil, err
+	}
+
+	buyer, seller := UserAddress(fill.BuyerId), UserAddress(fill.SellerId)
+	var transfers []Transfer
+	add := func(token, from, to string, amount price.Price) {
+		if !amount.IsZero() {
+			transfers = append(transfers, Transfer{Token: token, From: from, To: to, Amount: amount})
+		}
+	}
+
+	add(FractionToken(fill.ArtworkId), seller, buyer, price.New(fill.QuantityFilled, 0))
+	add(fill.Currency, buyer, seller, notional)
+	add(fill.Currency, buyer, Treasury, fill.BuyerFee)
+	add(fill.Currency, seller, Treasury, fill.SellerFee)
+	for _, payout := range job.Royalties {
+		add(payout.Currency, seller, UserAddress(payout.RecipientId), payout.Amount)
+	}
+	return transfers, nil
+}
+
+// Net replaces the transfers with as few as move the same net amounts:
+// each address's receipts less its payments, per token. Debtors pay
+// creditors in address order, so the result is deterministic.
+func Net(transfers []Transfer) ([]Transfer, error) {
+	type flow struct{ in, out price.Price }
+	flows := make(map[string]map[string]*flow) // token, then address
+	for _, transfer := range transfers {
+		if flows[transfer.Token] == nil {
+			flows[transfer.Token] = make(map[string]*flow)
+		}
+		for _, address := range []string{transfer.From, transfer.To} {
+			if flows[transfer.Token][address] == nil {
+				flows[transfer.Token][address] = &flow{}
+			}
+		}
+
+		var err error
+		from, to := flows[transfer.Token][transfer.From], flows[transfer.Token][transfer.To]
+		if from.out, err = from.out.Add(transfer.Amount); err != nil {
+			return nil, err
+		}
+		if to.in, err = to.in.Add(transfer.Amount); err != nil {
+			return nil, err
+		}
+	}
+
+	tokens := make([]string, 0, len(flows))
+	for token := range flows {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	var netted []Transfer
+	for _, token := range tokens {
+		type position struct {
+			address string
+			amount  price.Price
+		}
+		var debtors, creditors []position
+		for address, f := range flows[token] {
+			switch f.in.Cmp(f.out) {
+			case 1:
+				amount, _ := f.in.Sub(f.out)
+				creditors = append(creditors, position{address, amount})
+			case -1:
+				amount, _ := f.out.Sub(f.in)
+				debtors = append(debtors, position{address, amount})
+			}
+		}
+		sort.Slice(debtors, func(i, j int) bool { return debtors[i].address < debtors[j].address })
+		sort.Slice(creditors, func(i, j int) bool { return creditors[i].address < creditors[j].address })
+
+		// debts and credits of a token add up to the same total
+		for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+			amount := debtors[i].amount
+			if creditors[j].amount.Cmp(amount) < 0 {
+				amount = creditors[j].amount
+			}
+			netted = append(netted, Transfer{Token: token, From: debtors[i].address, To: creditors[j].address, Amount: amount})
+
+			debtors[i].amount, _ = debtors[i].amount.Sub(amount)
+			creditors[j].amount, _ = creditors[j].amount.Sub(amount)
+			if debtors[i].amount.IsZero() {
+				i++
+			}
+			if creditors[j].amount.IsZero() {
+				j++
+			}
+		}
+	}
+	return netted, nil
+}
+
+// Settler settles jobs for the settlement pipeline, one transaction per
+// batch, rejecting those whose transaction reverts.
+type Settler struct {
+	executor SettlementExecutor
+}
+
+func NewSettler(executor SettlementExecutor) *Settler {
+	return &Settler{executor: executor}
+}
+
+func (s *Settler) Execute(job settlement.Job) error {
+	return s.ExecuteBatch([]settlement.Job{job})
+}
+
+// ExecuteBatch submits the jobs whose fills have not already been mined,
+// e.g. before a restart, as one netted transaction.
+func (s *Settler) ExecuteBatch(jobs []settlement.Job) error {
+	var tx Transaction
+	for _, job := range jobs {
+		_, mined, err := s.executor.Receipt(job.Fill.Id)
+		if err != nil {
+			return err
+		}
+		if mined {
+			continue
+		}
+
+		transfers, err := Transfers(job)
+		if err != nil {
+			return fmt.Errorf("%w: fill %d: %v", settlement.ErrRejected, job.Fill.Id, err)
+		}
+		tx.FillIds = append(tx.FillIds, job.Fill.Id)
+		tx.Transfers = append(tx.Transfers, transfers...)
+	}
+	if len(tx.FillIds) == 0 {
+		return nil
+	}
+
+	netted, err := Net(tx.Transfers)
+	if err != nil {
+		return fmt.Errorf("%w: %v", settlement.ErrRejected, err)
+	}
+	tx.Transfers = netted
+
+	_, err = s.executor.Submit(tx)
+	if errors.Is(err, ErrReverted) {
+		return fmt.Errorf("%w: %v", settlement.ErrRejected, err)
+	}
+	return err
+}
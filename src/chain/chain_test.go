@@ -0,0 +1,173 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/royalty"
+	"fractr-marketplace-secondary/settlement"
+)
+
+// 10 fractions of artwork 1 at 100.00 with fees and a royalty
+var job = settlement.Job{
+	Fill: match.FillOrder{
+		Id:             5,
+		ArtworkId:      1,
+		BuyerId:        10,
+		SellerId:       20,
+		Price:          price.New(10000, 2),
+		Currency:       "USD",
+		QuantityFilled: 10,
+		BuyerFee:       price.New(300, 2),
+		SellerFee:      price.New(100, 2),
+	},
+	Royalties: []royalty.Payout{
+		{FillId: 5, ArtworkId: 1, SellerId: 20, RecipientId: 30, Amount: price.New(5000, 2), Currency: "USD"},
+	},
+}
+
+func TestSettlerMovesTokensAndPayment(t *testing.T) {
+	sim := NewSimulated(DefaultSimulatedConfig)
+	if err := NewSettler(sim).Execute(job); err != nil {
+		t.Fatalf("failed to settle: %v", err)
+	}
+
+	expected := []struct {
+		address string
+		token   string
+		balance string
+	}{
+		{UserAddress(10), FractionToken(1), "10"},
+		{UserAddress(20), FractionToken(1), "0"},
+		{UserAddress(20), "USD", "949.00"},
+		{UserAddress(30), "USD", "50.00"},
+		{Treasury, "USD", "4.00"},
+	}
+	for _, e := range expected {
+		if got := sim.Balance(e.address, e.token).String(); got != e.balance {
+			t.Errorf("Expected %s to hold %s %s, got %s", e.address, e.balance, e.token, got)
+		}
+	}
+
+	receipt, ok, _ := sim.Receipt(5)
+	// the buyer pays the seller, treasury and artist directly, and the
+	// seller's fee and royalty net out of what they are paid
+	if !ok || receipt.Block != 1 || receipt.GasUsed != 21000+4*30000 {
+		t.Errorf("Unexpected receipt %+v", receipt)
+	}
+
+	// settling the fill again after a restart does not move anything twice
+	if err := NewSettler(sim).Execute(job); err != nil {
+		t.Fatalf("failed to resettle: %v", err)
+	}
+	if got := sim.Balance(UserAddress(10), FractionToken(1)).String(); got != "10" {
+		t.Errorf("Expected resubmission to be a no-op, buyer holds %s", got)
+	}
+}
+
+func TestSettlerRejectsRevertedTransactions(t *testing.T) {
+	cfg := DefaultSimulatedConfig
+	cfg.Strict = true
+	sim := NewSimulated(cfg)
+	sim.Mint(UserAddress(20), FractionToken(1), price.New(10, 0))
+
+	// the buyer has no cash, so the whole transaction reverts
+	err := NewSettler(sim).Execute(job)
+	if !errors.Is(err, settlement.ErrRejected) {
+		t.Fatalf("Expected a rejected revert, got %v", err)
+	}
+	if got := sim.Balance(UserAddress(10), FractionToken(1)); !got.IsZero() {
+		t.Errorf("Expected a reverted transaction to move nothing, buyer holds %s", got)
+	}
+
+	cfg = DefaultSimulatedConfig
+	cfg.GasLimit = 100000
+	if err := NewSettler(NewSimulated(cfg)).Execute(job); !errors.Is(err, settlement.ErrRejected) {
+		t.Fatalf("Expected running out of gas to be rejected, got %v", err)
+	}
+}
+
+func TestSimulatedFailureInjection(t *testing.T) {
+	sim := NewSimulated(DefaultSimulatedConfig)
+	sim.FailNext(ErrUnavailable)
+
+	err := NewSettler(sim).Execute(job)
+	if !errors.Is(err, ErrUnavailable) || errors.Is(err, settlement.ErrRejected) {
+		t.Fatalf("Expected a retriable failure, got %v", err)
+	}
+	if err := NewSettler(sim).Execute(job); err != nil {
+		t.Fatalf("Expected the next submission to succeed, got %v", err)
+	}
+
+	// the same seed fails the same submissions
+	outcomes := func() []bool {
+		cfg := DefaultSimulatedConfig
+		cfg.FailureRate, cfg.Seed = 0.5, 42
+		sim := NewSimulated(cfg)
+		var failed []bool
+		for fillId := uint64(1); fillId <= 20; fillId++ {
+			_, err := sim.Submit(Transaction{FillIds: []uint64{fillId}})
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+	first, second := outcomes(), outcomes()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected seeded failures to repeat, got %v and %v", first, second)
+		}
+	}
+}
+
+func TestNetTransfers(t *testing.T) {
+	netted, err := Net([]Transfer{
+		{Token: "USD", From: "a", To: "b", Amount: price.New(1000, 2)},
+		{Token: "USD", From: "b", To: "a", Amount: price.New(400, 2)},
+		{Token: "USD", From: "b", To: "c", Amount: price.New(600, 2)},
+		{Token: "artwork:1", From: "b", To: "a", Amount: price.New(3, 0)},
+		{Token: "artwork:1", From: "a", To: "b", Amount: price.New(3, 0)},
+	})
+	if err != nil {
+		t.Fatalf("failed to net transfers: %v", err)
+	}
+
+	// a owes 6.00 net, all of it ending up with c; the fractions cancel out
+	if len(netted) != 1 {
+		t.Fatalf("Expected a single transfer, got %+v", netted)
+	}
+	if netted[0].From != "a" || netted[0].To != "c" || netted[0].Amount.String() != "6.00" {
+		t.Errorf("Expected a to pay c 6.00, got %+v", netted[0])
+	}
+}
+
+func TestSettlerBatchesFills(t *testing.T) {
+	sim := NewSimulated(DefaultSimulatedConfig)
+
+	// user 20 sells 10 fractions to user 10, who sells 4 back
+	resale := settlement.Job{Fill: match.FillOrder{
+		Id:             6,
+		ArtworkId:      1,
+		BuyerId:        20,
+		SellerId:       10,
+		Price:          price.New(10000, 2),
+		Currency:       "USD",
+		QuantityFilled: 4,
+	}}
+	if err := NewSettler(sim).ExecuteBatch([]settlement.Job{job, resale}); err != nil {
+		t.Fatalf("failed to settle batch: %v", err)
+	}
+
+	first, _, _ := sim.Receipt(5)
+	second, _, _ := sim.Receipt(6)
+	if first.TxHash != second.TxHash || len(first.FillIds) != 2 {
+		t.Errorf("Expected both fills in one transaction, got %+v and %+v", first, second)
+	}
+	if got := sim.Balance(UserAddress(10), FractionToken(1)).String(); got != "6" {
+		t.Errorf("Expected the buyer to net 6 fractions, got %s", got)
+	}
+	if got := sim.Balance(UserAddress(20), "USD").String(); got != "549.00" {
+		t.Errorf("Expected the seller to net 549.00, got %s", got)
+	}
+}
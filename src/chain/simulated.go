@@ -0,0 +1,184 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/price"
+)
+
+type SimulatedConfig struct {
+	Latency        time.Duration // how long each submission waits to be mined
+	BaseGas        uint64        // gas of a transaction without transfers
+	GasPerTransfer uint64
+	GasLimit       uint64  // transactions needing more gas revert; 0 means unlimited
+	FailureRate    float64 // share of submissions failing with ErrUnavailable
+	Seed           int64   // seeds failure injection, so runs are repeatable
+	// Strict reverts transfers the sender cannot cover. Otherwise a short
+	// sender is assumed funded off-chain and the shortfall is minted.
+	Strict bool
+}
+
+var DefaultSimulatedConfig = SimulatedConfig{
+	BaseGas:        21000,
+	GasPerTransfer: 30000,
+}
+
+type balanceKey struct {
+	address string
+	token   string
+}
+
+// Simulated is a deterministic in-process chain that mines every
+// submission into its own block. It is safe for concurrent use.
+type Simulated struct {
+	cfg      SimulatedConfig
+	rng      *rand.Rand
+	failNext []error
+	balances map[balanceKey]price.Price
+	receipts map[uint64]Receipt // key: fillId
+	block    uint64
+	mu       sync.Mutex
+}
+
+func NewSimulated(cfg SimulatedConfig) *Simulated {
+	return &Simulated{
+		cfg:      cfg,
+		rng:      rand.New(rand.NewSource(cfg.Seed)),
+		balances: make(map[balanceKey]price.Price),
+		receipts: make(map[uint64]Receipt),
+	}
+}
+
+// FailNext makes the next submission fail with err without being mined.
+// Queued failures are used up in order.
+func (sim *Simulated) FailNext(err error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	sim.failNext = append(sim.failNext, err)
+}
+
+func (sim *Simulated) Mint(address, token string, amount price.Price) error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	key := balanceKey{address, token}
+	balance, err := sim.balances[key].Add(amount)
+	if err != nil {
+		return err
+	}
+	sim.balances[key] = balance
+	return nil
+}
+
+func (sim *Simulated) Balance(address, token string) price.Price {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	return sim.balances[balanceKey{address, token}]
+}
+
+func (sim *Simulated) Receipt(fillId uint64) (Receipt, bool, error) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	receipt, ok := sim.receipts[fillId]
+	return receipt, ok, nil
+}
+
+func (sim *Simulated) Submit(tx Transaction) (Receipt, error) {
+	if err := sim.inject(); err != nil {
+		return Receipt{}, err
+	}
+	time.Sleep(sim.cfg.Latency)
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	sim.block++
+	for _, fillId := range tx.FillIds {
+		if _, ok := sim.receipts[fillId]; ok {
+			return Receipt{}, fmt.Errorf("%w: fill %d is already settled", ErrReverted, fillId)
+		}
+	}
+
+	gas := sim.cfg.BaseGas + sim.cfg.GasPerTransfer*uint64(len(tx.Transfers))
+	if sim.cfg.GasLimit > 0 && gas > sim.cfg.GasLimit {
+		return Receipt{}, fmt.Errorf("%w: fills %v need %d gas, limit is %d", ErrReverted, tx.FillIds, gas, sim.cfg.GasLimit)
+	}
+
+	balances, err := sim.apply(tx.Transfers)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("%w: fills %v: %v", ErrReverted, tx.FillIds, err)
+	}
+	for key, balance := range balances {
+		sim.balances[key] = balance
+	}
+
+	receipt := Receipt{FillIds: tx.FillIds, TxHash: txHash(sim.block), Block: sim.block, GasUsed: gas}
+	for _, fillId := range tx.FillIds {
+		sim.receipts[fillId] = receipt
+	}
+	return receipt, nil
+}
+
+func (sim *Simulated) inject() error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if len(sim.failNext) > 0 {
+		err := sim.failNext[0]
+		sim.failNext = sim.failNext[1:]
+		return err
+	}
+	if sim.cfg.FailureRate > 0 && sim.rng.Float64() < sim.cfg.FailureRate {
+		return fmt.Errorf("%w: injected failure", ErrUnavailable)
+	}
+	return nil
+}
+
+// apply returns the balances the transfers would leave without changing
+// the chain, so a transaction that fails part way changes nothing.
+func (sim *Simulated) apply(transfers []Transfer) (map[balanceKey]price.Price, error) {
+	balances := make(map[balanceKey]price.Price)
+	get := func(key balanceKey) price.Price {
+		if balance, ok := balances[key]; ok {
+			return balance
+		}
+		return sim.balances[key]
+	}
+
+	for _, transfer := range transfers {
+		from, to := balanceKey{transfer.From, transfer.Token}, balanceKey{transfer.To, transfer.Token}
+
+		balance := get(from)
+		if balance.Cmp(transfer.Amount) < 0 {
+			if sim.cfg.Strict {
+				return nil, fmt.Errorf("%s holds %s %s, cannot send %s", transfer.From, balance, transfer.Token, transfer.Amount)
+			}
+			balance = transfer.Amount
+		}
+		remaining, err := balance.Sub(transfer.Amount)
+		if err != nil {
+			return nil, err
+		}
+		balances[from] = remaining
+
+		received, err := get(to).Add(transfer.Amount)
+		if err != nil {
+			return nil, err
+		}
+		balances[to] = received
+	}
+	return balances, nil
+}
+
+func txHash(block uint64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("block:%d", block)))
+	return "0x" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,199 @@
+// the feed fans market events out to every subscriber: trades as they are
+// matched and, later, anything else participants need to see as it
+// happens. Publishing never blocks; a subscriber that falls a full buffer
+// behind is dropped and its channel closed, so it knows to resubscribe.
+
+package feed
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/rfq"
+	"fractr-marketplace-secondary/royalty"
+)
+
+type EventType uint32
+
+const (
+	EVENT_TRADE EventType = iota
+	EVENT_ROYALTY
+	EVENT_BUST           // a trade was busted
+	EVENT_CORRECTION     // a busted trade was replaced at corrected terms
+	EVENT_TRADING_STATUS // an artwork was halted or reopened, or its auction indication moved
+	EVENT_QUOTE_REQUEST  // a buyer asked market makers to quote a block
+)
+
+var eventTypeNames = map[EventType]string{
+	EVENT_TRADE:          "TRADE",
+	EVENT_ROYALTY:        "ROYALTY",
+	EVENT_BUST:           "BUST",
+	EVENT_CORRECTION:     "CORRECTION",
+	EVENT_TRADING_STATUS: "TRADING_STATUS",
+	EVENT_QUOTE_REQUEST:  "QUOTE_REQUEST",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", uint32(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+type Event struct {
+	Type      EventType        `json:"type"`
+	ArtworkId uint64           `json:"artwork_id"`
+	Time      time.Time        `json:"time"`
+	Trade     *match.FillOrder `json:"trade,omitempty"`
+	Royalty   *royalty.Payout  `json:"royalty,omitempty"`
+	Replaces  uint64           `json:"replaces,omitempty"` // fill id a correction replaces
+	Trading   *TradingStatus   `json:"trading,omitempty"`
+	Rfq       *QuoteRequest    `json:"rfq,omitempty"`
+}
+
+// TradingStatus is an artwork's trading status as published on the feed,
+// with its phase named.
+type TradingStatus struct {
+	Phase     string    `json:"phase"`
+	Reason    string    `json:"reason,omitempty"`
+	ReopensAt time.Time `json:"reopens_at"`
+
+	IndicativePrice  price.Price `json:"indicative_price"`
+	IndicativeVolume uint64      `json:"indicative_volume"`
+}
+
+// QuoteRequest is a request for quote as broadcast to market makers. The
+// requester is not named.
+type QuoteRequest struct {
+	RfqId     uint64    `json:"rfq_id"`
+	Quantity  uint64    `json:"quantity"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Involves reports whether the user is a counterparty of the event.
+func (ev Event) Involves(userId uint64) bool {
+	if ev.Trade != nil && (ev.Trade.BuyerId == userId || ev.Trade.SellerId == userId) {
+		return true
+	}
+	if ev.Royalty != nil && (ev.Royalty.RecipientId == userId || ev.Royalty.SellerId == userId) {
+		return true
+	}
+	return false
+}
+
+type Subscription struct {
+	C <-chan Event
+
+	c    chan Event
+	feed *Feed
+}
+
+// Close stops delivery to the subscription and closes its channel.
+func (sub *Subscription) Close() {
+	sub.feed.remove(sub)
+}
+
+// Feed is safe for concurrent use.
+type Feed struct {
+	subscribers map[*Subscription]struct{}
+	mu          sync.Mutex
+}
+
+func New() *Feed {
+	return &Feed{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+func (f *Feed) Subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c, feed: f}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (f *Feed) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for sub := range f.subscribers {
+		select {
+		case sub.c <- ev:
+		default:
+			delete(f.subscribers, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// PublishTrade publishes a fill as a trade event.
+func (f *Feed) PublishTrade(order match.FillOrder) {
+	f.Publish(Event{Type: EVENT_TRADE, ArtworkId: order.ArtworkId, Trade: &order})
+}
+
+// PublishBust tells both counterparties their trade was busted.
+func (f *Feed) PublishBust(order match.FillOrder) {
+	f.Publish(Event{Type: EVENT_BUST, ArtworkId: order.ArtworkId, Trade: &order})
+}
+
+// PublishCorrection publishes the fill replacing a busted one.
+func (f *Feed) PublishCorrection(order match.FillOrder, replaces uint64) {
+	f.Publish(Event{Type: EVENT_CORRECTION, ArtworkId: order.ArtworkId, Trade: &order, Replaces: replaces})
+}
+
+// PublishTradingStatus publishes a change to an artwork's trading status,
+// including the indicative price of a call auction in progress.
+func (f *Feed) PublishTradingStatus(artworkId uint64, status match.TradingStatus) {
+	f.Publish(Event{
+		Type:      EVENT_TRADING_STATUS,
+		ArtworkId: artworkId,
+		Time:      status.Since,
+		Trading: &TradingStatus{
+			Phase:     match.PhaseName(status.Phase),
+			Reason:    status.Reason,
+			ReopensAt: status.ReopensAt,
+
+			IndicativePrice:  status.IndicativePrice,
+			IndicativeVolume: status.IndicativeVolume,
+		},
+	})
+}
+
+// PublishQuoteRequest broadcasts a new request for quote.
+func (f *Feed) PublishQuoteRequest(r rfq.Rfq) {
+	f.Publish(Event{
+		Type:      EVENT_QUOTE_REQUEST,
+		ArtworkId: r.ArtworkId,
+		Time:      r.RequestedAt,
+		Rfq:       &QuoteRequest{RfqId: r.Id, Quantity: r.Quantity, ExpiresAt: r.ExpiresAt},
+	})
+}
+
+func (f *Feed) PublishRoyalty(payout royalty.Payout) {
+	f.Publish(Event{Type: EVENT_ROYALTY, ArtworkId: payout.ArtworkId, Royalty: &payout})
+}
+
+func (f *Feed) remove(sub *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.c)
+	}
+}
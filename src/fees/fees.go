@@ -0,0 +1,201 @@
+// the fee schedule decides what each side of a fill pays the marketplace.
+// Rates are in basis points of the fill's notional and differ for the maker,
+// whose order was resting in the book, and the taker, whose incoming order
+// matched it. Rates come from the user's tier if they have one, otherwise
+// from the artwork, otherwise from the schedule defaults.
+
+package fees
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"fractr-marketplace-secondary/price"
+)
+
+const maxBps = 10000
+
+type Liquidity uint32
+
+const (
+	MAKER Liquidity = iota
+	TAKER
+)
+
+type Rates struct {
+	MakerBps uint32 `json:"maker_bps"`
+	TakerBps uint32 `json:"taker_bps"`
+	MinFee   uint64 `json:"min_fee"` // units of the artwork's price scale
+}
+
+func (rates Rates) Validate() error {
+	if rates.MakerBps > maxBps || rates.TakerBps > maxBps {
+		return fmt.Errorf("fee rates must not exceed %d bps", maxBps)
+	}
+	return nil
+}
+
+func (rates Rates) bps(liquidity Liquidity) uint32 {
+	if liquidity == MAKER {
+		return rates.MakerBps
+	}
+	return rates.TakerBps
+}
+
+type Tier struct {
+	Name     string `json:"name"`
+	MakerBps uint32 `json:"maker_bps"`
+	TakerBps uint32 `json:"taker_bps"`
+}
+
+type ArtworkRates struct {
+	ArtworkId uint64 `json:"artwork_id"`
+	Rates
+}
+
+type UserTier struct {
+	UserId uint64 `json:"user_id"`
+	Tier   string `json:"tier"`
+}
+
+// Config is the on-disk layout of a fee schedule.
+type Config struct {
+	Default  Rates          `json:"default"`
+	Artworks []ArtworkRates `json:"artworks"`
+	Tiers    []Tier         `json:"tiers"`
+	Users    []UserTier     `json:"users"`
+}
+
+// Schedule is safe for concurrent use.
+type Schedule struct {
+	defaults Rates
+	artworks map[uint64]Rates  // key: artworkId
+	tiers    map[string]Tier   // key: tier name
+	users    map[uint64]string // userId -> tier name
+	mu       sync.RWMutex
+}
+
+func NewSchedule(defaults Rates) *Schedule {
+	return &Schedule{
+		defaults: defaults,
+		artworks: make(map[uint64]Rates),
+		tiers:    make(map[string]Tier),
+		users:    make(map[uint64]string),
+	}
+}
+
+// FromConfig builds a schedule, rejecting rates above 100% and users
+// assigned to tiers that do not exist.
+func FromConfig(cfg Config) (*Schedule, error) {
+	if err := cfg.Default.Validate(); err != nil {
+		return nil, err
+	}
+	schedule := NewSchedule(cfg.Default)
+
+	for _, artwork := range cfg.Artworks {
+		if err := schedule.SetArtworkRates(artwork.ArtworkId, artwork.Rates); err != nil {
+			return nil, err
+		}
+	}
+	for _, tier := range cfg.Tiers {
+		if err := schedule.SetTier(tier); err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range cfg.Users {
+		if err := schedule.AssignTier(user.UserId, user.Tier); err != nil {
+			return nil, err
+		}
+	}
+
+	return schedule, nil
+}
+
+func LoadFile(path string) (*Schedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fee schedule: %v", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse fee schedule: %v", err)
+	}
+	return FromConfig(cfg)
+}
+
+func (s *Schedule) SetArtworkRates(artworkId uint64, rates Rates) error {
+	if err := rates.Validate(); err != nil {
+		return fmt.Errorf("artwork %d: %v", artworkId, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.artworks[artworkId] = rates
+	return nil
+}
+
+func (s *Schedule) SetTier(tier Tier) error {
+	if err := (Rates{MakerBps: tier.MakerBps, TakerBps: tier.TakerBps}).Validate(); err != nil {
+		return fmt.Errorf("tier %q: %v", tier.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tiers[tier.Name] = tier
+	return nil
+}
+
+func (s *Schedule) AssignTier(userId uint64, tier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tiers[tier]; !ok {
+		return fmt.Errorf("user %d: unknown fee tier %q", userId, tier)
+	}
+	s.users[userId] = tier
+	return nil
+}
+
+// Rates returns the rates that apply to the user trading the artwork.
+func (s *Schedule) Rates(artworkId, userId uint64) Rates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rates, ok := s.artworks[artworkId]
+	if !ok {
+		rates = s.defaults
+	}
+	if name, ok := s.users[userId]; ok {
+		tier := s.tiers[name]
+		rates.MakerBps = tier.MakerBps
+		rates.TakerBps = tier.TakerBps
+	}
+	return rates
+}
+
+// Fee returns what the user pays on a fill of the given notional. The rate
+// is applied rounding down, then raised to the minimum fee; the fee never
+// exceeds the notional itself, and a seller's royalty only takes what their
+// fee leaves.
+func (s *Schedule) Fee(artworkId, userId uint64, liquidity Liquidity, notional price.Price) (price.Price, error) {
+	rates := s.Rates(artworkId, userId)
+
+	fee, err := notional.MulDiv(uint64(rates.bps(liquidity)), maxBps)
+	if err != nil {
+		return price.Price{}, err
+	}
+
+	minFee := price.New(rates.MinFee, notional.Scale)
+	if fee.Cmp(minFee) < 0 {
+		fee = minFee
+	}
+	if fee.Cmp(notional) > 0 {
+		fee = notional
+	}
+	return fee, nil
+}
@@ -0,0 +1,59 @@
+package fees
+
+import (
+	"testing"
+
+	"fractr-marketplace-secondary/price"
+)
+
+func TestRatesPrecedence(t *testing.T) {
+	schedule, err := FromConfig(Config{
+		Default:  Rates{MakerBps: 10, TakerBps: 30},
+		Artworks: []ArtworkRates{{ArtworkId: 1, Rates: Rates{MakerBps: 5, TakerBps: 20, MinFee: 100}}},
+		Tiers:    []Tier{{Name: "pro", MakerBps: 0, TakerBps: 15}},
+		Users:    []UserTier{{UserId: 42, Tier: "pro"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to build schedule: %v", err)
+	}
+
+	if rates := schedule.Rates(2, 7); rates.TakerBps != 30 {
+		t.Errorf("Expected default taker rate 30, got %d", rates.TakerBps)
+	}
+	if rates := schedule.Rates(1, 7); rates.TakerBps != 20 {
+		t.Errorf("Expected artwork taker rate 20, got %d", rates.TakerBps)
+	}
+	// tiers override the rates but keep the artwork's minimum fee
+	if rates := schedule.Rates(1, 42); rates.TakerBps != 15 || rates.MinFee != 100 {
+		t.Errorf("Expected tier rates with artwork minimum, got %+v", rates)
+	}
+}
+
+func TestFee(t *testing.T) {
+	schedule := NewSchedule(Rates{MakerBps: 10, TakerBps: 25, MinFee: 50})
+	notional := price.New(1000000, 2) // 10000.00
+
+	fee, err := schedule.Fee(1, 1, TAKER, notional)
+	if err != nil || fee.Cmp(price.New(2500, 2)) != 0 {
+		t.Errorf("Expected taker fee 25.00, got %v (%v)", fee, err)
+	}
+
+	fee, err = schedule.Fee(1, 1, MAKER, price.New(10000, 2))
+	if err != nil || fee.Cmp(price.New(50, 2)) != 0 {
+		t.Errorf("Expected minimum fee 0.50, got %v (%v)", fee, err)
+	}
+
+	fee, err = schedule.Fee(1, 1, MAKER, price.New(20, 2))
+	if err != nil || fee.Cmp(price.New(20, 2)) != 0 {
+		t.Errorf("Expected fee capped at notional 0.20, got %v (%v)", fee, err)
+	}
+}
+
+func TestFromConfigRejectsInvalidSchedules(t *testing.T) {
+	if _, err := FromConfig(Config{Default: Rates{TakerBps: 10001}}); err == nil {
+		t.Errorf("Expected rate above 100%% to be rejected")
+	}
+	if _, err := FromConfig(Config{Users: []UserTier{{UserId: 1, Tier: "missing"}}}); err == nil {
+		t.Errorf("Expected unknown tier to be rejected")
+	}
+}
@@ -6,6 +6,7 @@ replace github.com/blidd/fractr-proto => /Users/brianli/fractr-proto
 
 require (
 	github.com/blidd/fractr-proto v0.0.0-20220725190110-17b0365e528a
+	google.golang.org/genproto v0.0.0-20220725144611-272f38e5d71b
 	google.golang.org/grpc v1.48.0
 )
 
@@ -14,6 +15,5 @@ require (
 	golang.org/x/net v0.0.0-20220725212005-46097bf591d3 // indirect
 	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
 	golang.org/x/text v0.3.7 // indirect
-	google.golang.org/genproto v0.0.0-20220725144611-272f38e5d71b // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
 )
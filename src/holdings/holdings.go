@@ -0,0 +1,182 @@
+// holdings are the fractions of each artwork a user owns. Before an ask is
+// accepted the engine locks its quantity against the seller's position so
+// the same fractions cannot be listed twice; a fill transfers locked
+// fractions to the buyer, and a cancel or expiry unlocks what is left.
+
+package holdings
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrInsufficientHoldings = errors.New("holdings: insufficient holdings")
+	ErrUnknownLock          = errors.New("holdings: unknown lock")
+)
+
+// Ledger is implemented by whatever records users' positions. Every lock is
+// identified by the user and the id of the ask it backs.
+type Ledger interface {
+	// Lock moves quantity fractions from the seller's available position
+	// into a lock for the ask, failing with ErrInsufficientHoldings if the
+	// seller does not have them available. Locking again for an ask adds
+	// to its lock.
+	Lock(userId, artworkId, askId, quantity uint64) error
+	// Unlock returns quantity of the ask's lock to the available position.
+	Unlock(userId, artworkId, askId, quantity uint64) error
+	// Transfer moves quantity out of the ask's lock into the buyer's
+	// available position.
+	Transfer(sellerId, buyerId, artworkId, askId, quantity uint64) error
+	// Move moves quantity between two users' available positions, e.g.
+	// to hand back the fractions of a busted fill, failing with
+	// ErrInsufficientHoldings if the sender does not have them available.
+	Move(fromId, toId, artworkId, quantity uint64) error
+}
+
+type Position struct {
+	Available uint64 `json:"available"`
+	Locked    uint64 `json:"locked"`
+}
+
+type positionKey struct {
+	userId    uint64
+	artworkId uint64
+}
+
+type lockKey struct {
+	userId uint64
+	askId  uint64
+}
+
+type lock struct {
+	artworkId uint64
+	quantity  uint64
+}
+
+// Memory is an in-memory Ledger. It is safe for concurrent use.
+type Memory struct {
+	positions map[positionKey]*Position
+	locks     map[lockKey]*lock
+	mu        sync.Mutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		positions: make(map[positionKey]*Position),
+		locks:     make(map[lockKey]*lock),
+	}
+}
+
+func (m *Memory) position(userId, artworkId uint64) *Position {
+	key := positionKey{userId, artworkId}
+	if m.positions[key] == nil {
+		m.positions[key] = &Position{}
+	}
+	return m.positions[key]
+}
+
+// Credit adds fractions to the user's available position, e.g. from a
+// primary sale.
+func (m *Memory) Credit(userId, artworkId, quantity uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pos := m.position(userId, artworkId)
+	if pos.Available+quantity < pos.Available {
+		return fmt.Errorf("holdings: position of user %d in artwork %d overflows", userId, artworkId)
+	}
+	pos.Available += quantity
+	return nil
+}
+
+func (m *Memory) Position(userId, artworkId uint64) Position {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return *m.position(userId, artworkId)
+}
+
+func (m *Memory) Lock(userId, artworkId, askId, quantity uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := lockKey{userId, askId}
+	l, ok := m.locks[key]
+	if ok && l.artworkId != artworkId {
+		return fmt.Errorf("holdings: ask %d of user %d locks artwork %d, not %d", askId, userId, l.artworkId, artworkId)
+	}
+
+	pos := m.position(userId, artworkId)
+	if pos.Available < quantity {
+		return fmt.Errorf("%w: user %d has %d fractions of artwork %d available, ask %d needs %d",
+			ErrInsufficientHoldings, userId, pos.Available, artworkId, askId, quantity)
+	}
+
+	if !ok {
+		l = &lock{artworkId: artworkId}
+		m.locks[key] = l
+	}
+	pos.Available -= quantity
+	pos.Locked += quantity
+	l.quantity += quantity
+	return nil
+}
+
+// take removes quantity from the ask's lock and the seller's locked
+// position, forgetting the lock once it is used up.
+func (m *Memory) take(userId, artworkId, askId, quantity uint64) error {
+	key := lockKey{userId, askId}
+	l, ok := m.locks[key]
+	if !ok || l.artworkId != artworkId {
+		return ErrUnknownLock
+	}
+	if quantity > l.quantity {
+		return fmt.Errorf("holdings: ask %d of user %d: cannot take %d from lock of %d",
+			askId, userId, quantity, l.quantity)
+	}
+
+	l.quantity -= quantity
+	m.position(userId, artworkId).Locked -= quantity
+	if l.quantity == 0 {
+		delete(m.locks, key)
+	}
+	return nil
+}
+
+func (m *Memory) Unlock(userId, artworkId, askId, quantity uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.take(userId, artworkId, askId, quantity); err != nil {
+		return err
+	}
+	m.position(userId, artworkId).Available += quantity
+	return nil
+}
+
+func (m *Memory) Transfer(sellerId, buyerId, artworkId, askId, quantity uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.take(sellerId, artworkId, askId, quantity); err != nil {
+		return err
+	}
+	m.position(buyerId, artworkId).Available += quantity
+	return nil
+}
+
+func (m *Memory) Move(fromId, toId, artworkId, quantity uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from := m.position(fromId, artworkId)
+	if from.Available < quantity {
+		return fmt.Errorf("%w: user %d has %d fractions of artwork %d available, cannot move %d",
+			ErrInsufficientHoldings, fromId, from.Available, artworkId, quantity)
+	}
+	from.Available -= quantity
+	m.position(toId, artworkId).Available += quantity
+	return nil
+}
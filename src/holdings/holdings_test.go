@@ -0,0 +1,75 @@
+package holdings
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLockTransferUnlock(t *testing.T) {
+	ledger := NewMemory()
+	ledger.Credit(1, 7, 100)
+
+	if err := ledger.Lock(1, 7, 200, 60); err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	// the same fractions cannot back a second ask
+	if err := ledger.Lock(1, 7, 201, 60); !errors.Is(err, ErrInsufficientHoldings) {
+		t.Fatalf("Expected ErrInsufficientHoldings, got %v", err)
+	}
+
+	if err := ledger.Transfer(1, 2, 7, 200, 25); err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	if err := ledger.Transfer(1, 2, 7, 200, 50); err == nil {
+		t.Fatalf("Expected transfer beyond the lock to fail")
+	}
+
+	if pos := ledger.Position(1, 7); pos.Available != 40 || pos.Locked != 35 {
+		t.Fatalf("Expected 40 available and 35 locked, got %+v", pos)
+	}
+	if pos := ledger.Position(2, 7); pos.Available != 25 || pos.Locked != 0 {
+		t.Fatalf("Expected buyer to hold 25, got %+v", pos)
+	}
+
+	if err := ledger.Unlock(1, 7, 200, 35); err != nil {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+	if err := ledger.Unlock(1, 7, 200, 1); err != ErrUnknownLock {
+		t.Fatalf("Expected used up lock to be forgotten, got %v", err)
+	}
+	if pos := ledger.Position(1, 7); pos.Available != 75 || pos.Locked != 0 {
+		t.Fatalf("Expected 75 available and nothing locked, got %+v", pos)
+	}
+}
+
+func TestPositionsAreIsolatedByArtwork(t *testing.T) {
+	ledger := NewMemory()
+	ledger.Credit(1, 7, 100)
+
+	if err := ledger.Lock(1, 8, 200, 1); !errors.Is(err, ErrInsufficientHoldings) {
+		t.Fatalf("Expected fractions of artwork 7 not to back an ask on artwork 8, got %v", err)
+	}
+}
+
+func TestMoveLeavesLocksAlone(t *testing.T) {
+	ledger := NewMemory()
+	ledger.Credit(1, 7, 100)
+	if err := ledger.Lock(1, 7, 200, 80); err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	// only available fractions can be moved
+	if err := ledger.Move(1, 2, 7, 30); !errors.Is(err, ErrInsufficientHoldings) {
+		t.Fatalf("Expected ErrInsufficientHoldings, got %v", err)
+	}
+	if err := ledger.Move(1, 2, 7, 20); err != nil {
+		t.Fatalf("failed to move: %v", err)
+	}
+
+	if pos := ledger.Position(1, 7); pos.Available != 0 || pos.Locked != 80 {
+		t.Fatalf("Expected nothing available and 80 locked, got %+v", pos)
+	}
+	if pos := ledger.Position(2, 7); pos.Available != 20 {
+		t.Fatalf("Expected 20 moved, got %+v", pos)
+	}
+}
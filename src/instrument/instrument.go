@@ -0,0 +1,375 @@
+// instruments describe the trading rules of each fractionalised artwork:
+// the increments prices and quantities move in, the bounds on a single
+// order, the price band that halts trading when a fill strays too far and
+// whether orders match continuously or in periodic batches. The engine
+// consults them before an order is matched.
+
+package instrument
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/price"
+)
+
+// Prices of an artwork are quoted in Currency with PriceScale decimal places;
+// TickSize and MinPrice are counted in units of that scale, so a tick size of
+// 5 at scale 2 is 0.05.
+type Instrument struct {
+	ArtworkId   uint64 `json:"artwork_id"`
+	Currency    string `json:"currency"`
+	PriceScale  uint8  `json:"price_scale"`
+	TickSize    uint64 `json:"tick_size"`
+	LotSize     uint64 `json:"lot_size"`
+	MinQuantity uint64 `json:"min_quantity"`
+	MaxQuantity uint64 `json:"max_quantity"` // 0 means unbounded
+	MinPrice    uint64 `json:"min_price"`
+	OrderTTL    uint64 `json:"order_ttl_seconds"` // 0 means good-till-cancelled
+
+	// A fill more than PriceBandBps basis points away from the reference
+	// price halts the artwork for HaltSeconds, after which it reopens with a
+	// volatility auction. 0 disables the band.
+	PriceBandBps  uint64 `json:"price_band_bps"`
+	BandReference string `json:"band_reference"`      // REFERENCE_LAST if empty
+	VWAPWindow    uint64 `json:"vwap_window_seconds"` // trades REFERENCE_VWAP averages over
+	HaltSeconds   uint64 `json:"halt_seconds"`
+
+	// a newly listed artwork opens with a call auction lasting
+	// OpeningAuction seconds; 0 opens it straight to continuous trading
+	OpeningAuction uint64 `json:"opening_auction_seconds"`
+
+	// In MATCHING_BATCH mode orders rest without matching and the book
+	// clears at a single price every BatchInterval milliseconds.
+	MatchingMode  string `json:"matching_mode"` // MATCHING_CONTINUOUS if empty
+	BatchInterval uint64 `json:"batch_interval_ms"`
+
+	// how an incoming order is shared among the resting orders at the best
+	// price: by time priority, or pro rata to their resting size
+	Allocation string `json:"allocation"` // ALLOCATION_PRICE_TIME if empty
+}
+
+// how an artwork's orders are matched
+const (
+	MATCHING_CONTINUOUS = "CONTINUOUS"
+	MATCHING_BATCH      = "BATCH"
+)
+
+// how a fill is allocated across a price level
+const (
+	ALLOCATION_PRICE_TIME = "PRICE_TIME"
+	ALLOCATION_PRO_RATA   = "PRO_RATA"
+)
+
+// prices a band can be centred on
+const (
+	REFERENCE_LAST = "LAST" // the last trade
+	REFERENCE_VWAP = "VWAP" // volume-weighted average of recent trades
+)
+
+const bpsPerUnit = 10000
+
+// Default is used for artworks that have no explicit configuration.
+var Default = Instrument{
+	Currency:    "USD",
+	PriceScale:  2,
+	TickSize:    1,
+	LotSize:     1,
+	MinQuantity: 1,
+	MinPrice:    1,
+}
+
+// Violation names an order field that breaks an instrument rule.
+type Violation struct {
+	Field       string
+	Description string
+}
+
+// RuleError is returned when an order does not satisfy its instrument.
+type RuleError struct {
+	ArtworkId  uint64
+	Violations []Violation
+}
+
+func (err *RuleError) Error() string {
+	descriptions := make([]string, len(err.Violations))
+	for i, v := range err.Violations {
+		descriptions[i] = v.Description
+	}
+	return fmt.Sprintf("artwork %d: %s", err.ArtworkId, strings.Join(descriptions, "; "))
+}
+
+// Validate checks that the instrument itself is usable.
+func (inst Instrument) Validate() error {
+	if !validCurrency(inst.Currency) {
+		return fmt.Errorf("invalid currency code %q", inst.Currency)
+	}
+	if inst.PriceScale > price.MaxScale {
+		return fmt.Errorf("price scale %d exceeds maximum %d", inst.PriceScale, price.MaxScale)
+	}
+	if inst.TickSize == 0 {
+		return errors.New("tick size must be greater than zero")
+	}
+	if inst.LotSize == 0 {
+		return errors.New("lot size must be greater than zero")
+	}
+	if inst.MinQuantity == 0 {
+		return errors.New("min quantity must be greater than zero")
+	}
+	if inst.MaxQuantity != 0 && inst.MaxQuantity < inst.MinQuantity {
+		return fmt.Errorf("max quantity %d is below min quantity %d", inst.MaxQuantity, inst.MinQuantity)
+	}
+	if inst.MinPrice == 0 {
+		return errors.New("min price must be greater than zero")
+	}
+	if inst.PriceBandBps > 0 {
+		switch inst.BandReference {
+		case "", REFERENCE_LAST:
+		case REFERENCE_VWAP:
+			if inst.VWAPWindow == 0 {
+				return errors.New("VWAP band reference needs a VWAP window")
+			}
+		default:
+			return fmt.Errorf("unknown band reference %q", inst.BandReference)
+		}
+		if inst.HaltSeconds == 0 {
+			return errors.New("price band needs a halt duration")
+		}
+	}
+	switch inst.MatchingMode {
+	case "", MATCHING_CONTINUOUS:
+	case MATCHING_BATCH:
+		if inst.BatchInterval == 0 {
+			return errors.New("batch matching needs a batch interval")
+		}
+	default:
+		return fmt.Errorf("unknown matching mode %q", inst.MatchingMode)
+	}
+	switch inst.Allocation {
+	case "", ALLOCATION_PRICE_TIME, ALLOCATION_PRO_RATA:
+	default:
+		return fmt.Errorf("unknown allocation %q", inst.Allocation)
+	}
+	return nil
+}
+
+// Batched reports whether the artwork's orders are matched in batches.
+func (inst Instrument) Batched() bool {
+	return inst.MatchingMode == MATCHING_BATCH
+}
+
+// currency codes are 3-5 upper case letters or digits, e.g. USD or ETH
+func validCurrency(code string) bool {
+	if len(code) < 3 || len(code) > 5 {
+		return false
+	}
+	for _, c := range code {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Expiry returns when an order placed at placedAt expires, or the zero time
+// if orders on the artwork are good-till-cancelled.
+func (inst Instrument) Expiry(placedAt time.Time) time.Time {
+	if inst.OrderTTL == 0 {
+		return time.Time{}
+	}
+	return placedAt.Add(time.Duration(inst.OrderTTL) * time.Second)
+}
+
+// Band returns the lowest and highest prices the artwork may trade at
+// around the reference price.
+func (inst Instrument) Band(reference price.Price) (low, high price.Price, err error) {
+	low = price.New(0, reference.Scale)
+	if inst.PriceBandBps < bpsPerUnit {
+		if low, err = reference.MulDiv(bpsPerUnit-inst.PriceBandBps, bpsPerUnit); err != nil {
+			return price.Price{}, price.Price{}, err
+		}
+	}
+	if high, err = reference.MulDiv(bpsPerUnit+inst.PriceBandBps, bpsPerUnit); err != nil {
+		return price.Price{}, price.Price{}, err
+	}
+	return low, high, nil
+}
+
+func (inst Instrument) HaltDuration() time.Duration {
+	return time.Duration(inst.HaltSeconds) * time.Second
+}
+
+func (inst Instrument) BatchIntervalDuration() time.Duration {
+	return time.Duration(inst.BatchInterval) * time.Millisecond
+}
+
+func (inst Instrument) OpeningAuctionDuration() time.Duration {
+	return time.Duration(inst.OpeningAuction) * time.Second
+}
+
+func (inst Instrument) VWAPWindowDuration() time.Duration {
+	return time.Duration(inst.VWAPWindow) * time.Second
+}
+
+// Price returns units of the instrument's currency at its price scale.
+func (inst Instrument) Price(units uint64) price.Price {
+	return price.New(units, inst.PriceScale)
+}
+
+// CheckOrder returns a *RuleError if quantity or limit break the instrument's
+// rules, and nil otherwise.
+func (inst Instrument) CheckOrder(quantity uint64, limit price.Price) error {
+	var violations []Violation
+
+	switch {
+	case quantity < inst.MinQuantity:
+		violations = append(violations, Violation{
+			Field:       "quantity",
+			Description: fmt.Sprintf("quantity %d is below minimum order quantity %d", quantity, inst.MinQuantity),
+		})
+	case inst.MaxQuantity != 0 && quantity > inst.MaxQuantity:
+		violations = append(violations, Violation{
+			Field:       "quantity",
+			Description: fmt.Sprintf("quantity %d exceeds maximum order quantity %d", quantity, inst.MaxQuantity),
+		})
+	case quantity%inst.LotSize != 0:
+		violations = append(violations, Violation{
+			Field:       "quantity",
+			Description: fmt.Sprintf("quantity %d is not a multiple of lot size %d", quantity, inst.LotSize),
+		})
+	}
+
+	scaled, err := limit.Rescale(inst.PriceScale)
+	switch {
+	case err != nil:
+		violations = append(violations, Violation{
+			Field:       "price",
+			Description: fmt.Sprintf("price %s cannot be quoted with %d decimal places", limit, inst.PriceScale),
+		})
+	case scaled.Units < inst.MinPrice:
+		violations = append(violations, Violation{
+			Field:       "price",
+			Description: fmt.Sprintf("price %s is below minimum price %s", scaled, inst.Price(inst.MinPrice)),
+		})
+	case scaled.Units%inst.TickSize != 0:
+		violations = append(violations, Violation{
+			Field:       "price",
+			Description: fmt.Sprintf("price %s is not a multiple of tick size %s", scaled, inst.Price(inst.TickSize)),
+		})
+	}
+
+	// the whole order must be settleable without the notional overflowing,
+	// which bounds every fill and running total taken from it
+	if len(violations) == 0 {
+		if _, err := limit.Mul(quantity); err != nil {
+			violations = append(violations, Violation{
+				Field:       "quantity",
+				Description: fmt.Sprintf("notional of %d at %s overflows", quantity, limit),
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &RuleError{ArtworkId: inst.ArtworkId, Violations: violations}
+	}
+	return nil
+}
+
+// Registry holds the instrument of every configured artwork. It is safe for
+// concurrent use.
+type Registry struct {
+	defaults    Instrument
+	instruments map[uint64]Instrument // key: artworkId
+	mu          sync.RWMutex
+}
+
+func NewRegistry(defaults Instrument) *Registry {
+	return &Registry{
+		defaults:    defaults,
+		instruments: make(map[uint64]Instrument),
+	}
+}
+
+// Get returns the instrument for the artwork, falling back to the registry
+// defaults when the artwork has not been configured.
+func (r *Registry) Get(artworkId uint64) Instrument {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if inst, ok := r.instruments[artworkId]; ok {
+		return inst
+	}
+	inst := r.defaults
+	inst.ArtworkId = artworkId
+	return inst
+}
+
+// SetDefaults changes the instrument of artworks that have not been
+// configured.
+func (r *Registry) SetDefaults(defaults Instrument) error {
+	if err := defaults.Validate(); err != nil {
+		return fmt.Errorf("default instrument: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.defaults = defaults
+	return nil
+}
+
+func (r *Registry) Set(inst Instrument) error {
+	if err := inst.Validate(); err != nil {
+		return fmt.Errorf("artwork %d: %v", inst.ArtworkId, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.instruments[inst.ArtworkId] = inst
+	return nil
+}
+
+// LoadFile reads instruments from a JSON config file laid out as
+//
+//	{"instruments": [{"artwork_id": 1, "tick_size": 5, "lot_size": 10}]}
+//
+// Fields left out of an entry take their value from Default.
+func LoadFile(path string) ([]Instrument, error) {
+	return LoadFileWithDefaults(path, Default)
+}
+
+// LoadFileWithDefaults is LoadFile with fields left out of an entry taking
+// their value from defaults.
+func LoadFileWithDefaults(path string, defaults Instrument) ([]Instrument, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instrument config: %v", err)
+	}
+
+	var raw struct {
+		Instruments []json.RawMessage `json:"instruments"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse instrument config: %v", err)
+	}
+
+	instruments := make([]Instrument, len(raw.Instruments))
+	for i, entry := range raw.Instruments {
+		inst := defaults
+		if err := json.Unmarshal(entry, &inst); err != nil {
+			return nil, fmt.Errorf("failed to parse instrument %d: %v", i, err)
+		}
+		if err := inst.Validate(); err != nil {
+			return nil, fmt.Errorf("artwork %d: %v", inst.ArtworkId, err)
+		}
+		instruments[i] = inst
+	}
+
+	return instruments, nil
+}
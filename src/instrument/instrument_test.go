@@ -0,0 +1,147 @@
+package instrument
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fractr-marketplace-secondary/price"
+)
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instruments.json")
+	config := `{"instruments": [
+		{"artwork_id": 1, "tick_size": 5, "lot_size": 10, "min_quantity": 10, "max_quantity": 500},
+		{"artwork_id": 2}
+	]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	instruments, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if len(instruments) != 2 {
+		t.Fatalf("Expected 2 instruments, got %d", len(instruments))
+	}
+	if instruments[0].TickSize != 5 || instruments[0].Currency != Default.Currency {
+		t.Errorf("Unexpected instrument: %+v", instruments[0])
+	}
+	if instruments[1].TickSize != Default.TickSize || instruments[1].ArtworkId != 2 {
+		t.Errorf("Expected defaults for artwork 2, got %+v", instruments[1])
+	}
+}
+
+func TestLoadFileWithDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instruments.json")
+	if err := os.WriteFile(path, []byte(`{"instruments": [{"artwork_id": 1, "tick_size": 5}]}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	defaults := Default
+	defaults.LotSize, defaults.TickSize = 10, 25
+	instruments, err := LoadFileWithDefaults(path, defaults)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if len(instruments) != 1 || instruments[0].TickSize != 5 || instruments[0].LotSize != 10 {
+		t.Errorf("Expected the lot size left out to be the default's, got %+v", instruments)
+	}
+
+	registry := NewRegistry(Default)
+	if err := registry.SetDefaults(defaults); err != nil {
+		t.Fatalf("failed to set defaults: %v", err)
+	}
+	if inst := registry.Get(2); inst.TickSize != 25 || inst.ArtworkId != 2 {
+		t.Errorf("Expected an unconfigured artwork to take the defaults, got %+v", inst)
+	}
+	defaults.LotSize = 0
+	if err := registry.SetDefaults(defaults); err == nil {
+		t.Errorf("Expected a zero lot size default to be rejected")
+	}
+}
+
+func TestLoadFileRejectsInvalidInstrument(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instruments.json")
+	if err := os.WriteFile(path, []byte(`{"instruments": [{"artwork_id": 1, "lot_size": 0}]}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	if _, err := LoadFile(path); err == nil {
+		t.Fatalf("Expected zero lot size to be rejected")
+	}
+}
+
+func TestCheckOrder(t *testing.T) {
+	inst := Instrument{
+		ArtworkId:   1,
+		Currency:    "ETH",
+		PriceScale:  2,
+		TickSize:    5,
+		LotSize:     10,
+		MinQuantity: 10,
+		MaxQuantity: 100,
+		MinPrice:    5,
+	}
+
+	if err := inst.CheckOrder(20, price.New(15, 2)); err != nil {
+		t.Errorf("Expected valid order, got %v", err)
+	}
+	if err := inst.CheckOrder(20, price.New(3, 0)); err != nil {
+		t.Errorf("Expected whole price to be rescaled, got %v", err)
+	}
+	if err := inst.CheckOrder(200, price.New(15, 2)); err == nil {
+		t.Errorf("Expected quantity above maximum to be rejected")
+	}
+	if err := inst.CheckOrder(20, price.New(3, 2)); err == nil {
+		t.Errorf("Expected price below minimum to be rejected")
+	}
+	if err := inst.CheckOrder(20, price.New(1505, 4)); err == nil {
+		t.Errorf("Expected price beyond the price scale to be rejected")
+	}
+
+	inst.MaxQuantity = 0
+	if err := inst.CheckOrder(math.MaxUint64/10*10, price.New(1000, 2)); err == nil {
+		t.Errorf("Expected order with overflowing notional to be rejected")
+	}
+}
+
+func TestValidateCurrency(t *testing.T) {
+	inst := Default
+	inst.Currency = "usd"
+	if err := inst.Validate(); err == nil {
+		t.Errorf("Expected lower case currency code to be rejected")
+	}
+	inst.Currency = "ETH"
+	if err := inst.Validate(); err != nil {
+		t.Errorf("Expected ETH to be accepted, got %v", err)
+	}
+}
+
+func TestBand(t *testing.T) {
+	inst := Default
+	inst.PriceBandBps = 1000
+	if err := inst.Validate(); err == nil {
+		t.Errorf("Expected a band without a halt duration to be rejected")
+	}
+	inst.HaltSeconds = 60
+	inst.BandReference = REFERENCE_VWAP
+	if err := inst.Validate(); err == nil {
+		t.Errorf("Expected a VWAP band without a window to be rejected")
+	}
+	inst.VWAPWindow = 300
+	if err := inst.Validate(); err != nil {
+		t.Errorf("Expected a valid band, got %v", err)
+	}
+
+	low, high, err := inst.Band(price.New(10000, 2))
+	if err != nil || low.String() != "90.00" || high.String() != "110.00" {
+		t.Errorf("Expected 10%% around 100.00 to be 90.00-110.00, got %s-%s (%v)", low, high, err)
+	}
+	inst.PriceBandBps = 20000
+	if low, _, _ := inst.Band(price.New(10000, 2)); !low.IsZero() {
+		t.Errorf("Expected a band wider than the price to start at zero, got %s", low)
+	}
+}
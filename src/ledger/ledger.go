@@ -0,0 +1,456 @@
+// the ledger keeps the marketplace's books by double entry. Every fill is
+// posted as one balanced set of entries: the buyer's cash is debited and the
+// seller's credited, the fees and royalties taken out go to their own
+// accounts, and the fractions move from the seller's position to the
+// buyer's. A posting whose debits and credits differ in any currency or
+// artwork is refused, so the books always add up to zero.
+
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/libstore"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/royalty"
+)
+
+var (
+	ErrUnbalanced      = errors.New("ledger: posting does not balance")
+	ErrNotPosted       = errors.New("ledger: fill not posted")
+	ErrAlreadyReversed = errors.New("ledger: fill already reversed")
+)
+
+type AccountKind uint32
+
+const (
+	ACCOUNT_CASH     AccountKind = iota // a user's cash in one currency
+	ACCOUNT_POSITION                    // a user's fractions of one artwork
+	ACCOUNT_FEES                        // fees collected by the marketplace in one currency
+	ACCOUNT_ROYALTY                     // royalties owed to one recipient in one currency
+)
+
+var accountKindNames = map[AccountKind]string{
+	ACCOUNT_CASH:     "CASH",
+	ACCOUNT_POSITION: "POSITION",
+	ACCOUNT_FEES:     "FEES",
+	ACCOUNT_ROYALTY:  "ROYALTY",
+}
+
+func (k AccountKind) String() string {
+	if name, ok := accountKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("AccountKind(%d)", uint32(k))
+}
+
+func (k AccountKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *AccountKind) UnmarshalText(text []byte) error {
+	for kind, name := range accountKindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown account kind %q", text)
+}
+
+type Account struct {
+	Kind      AccountKind `json:"kind"`
+	UserId    uint64      `json:"user_id,omitempty"`
+	Currency  string      `json:"currency,omitempty"`
+	ArtworkId uint64      `json:"artwork_id,omitempty"`
+}
+
+func Cash(userId uint64, currency string) Account {
+	return Account{Kind: ACCOUNT_CASH, UserId: userId, Currency: currency}
+}
+
+func Position(userId, artworkId uint64) Account {
+	return Account{Kind: ACCOUNT_POSITION, UserId: userId, ArtworkId: artworkId}
+}
+
+func Fees(currency string) Account {
+	return Account{Kind: ACCOUNT_FEES, Currency: currency}
+}
+
+func Royalty(userId uint64, currency string) Account {
+	return Account{Kind: ACCOUNT_ROYALTY, UserId: userId, Currency: currency}
+}
+
+// asset is what the account is denominated in. Postings balance per asset.
+func (a Account) asset() string {
+	if a.Kind == ACCOUNT_POSITION {
+		return fmt.Sprintf("artwork %d", a.ArtworkId)
+	}
+	return a.Currency
+}
+
+type Direction uint32
+
+const (
+	DEBIT Direction = iota
+	CREDIT
+)
+
+var directionNames = map[Direction]string{
+	DEBIT:  "DEBIT",
+	CREDIT: "CREDIT",
+}
+
+func (d Direction) String() string {
+	if name, ok := directionNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Direction(%d)", uint32(d))
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d Direction) opposite() Direction {
+	if d == DEBIT {
+		return CREDIT
+	}
+	return DEBIT
+}
+
+func (d *Direction) UnmarshalText(text []byte) error {
+	for direction, name := range directionNames {
+		if name == string(text) {
+			*d = direction
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown direction %q", text)
+}
+
+// Entry moves an amount into (CREDIT) or out of (DEBIT) one account. Cash
+// is in units of its currency and positions are whole fractions.
+type Entry struct {
+	Account   Account     `json:"account"`
+	Direction Direction   `json:"direction"`
+	Amount    price.Price `json:"amount"`
+}
+
+type Posting struct {
+	Id       uint64    `json:"id"`
+	FillId   uint64    `json:"fill_id"`
+	Reverses uint64    `json:"reverses,omitempty"` // id of the posting this one reverses
+	Time     time.Time `json:"time"`
+	Entries  []Entry   `json:"entries"`
+}
+
+// Validate checks that the posting's debits equal its credits in every
+// asset it touches.
+func (p Posting) Validate() error {
+	if len(p.Entries) == 0 {
+		return fmt.Errorf("%w: posting has no entries", ErrUnbalanced)
+	}
+
+	debits := make(map[string]price.Price)
+	credits := make(map[string]price.Price)
+	for _, entry := range p.Entries {
+		totals := debits
+		if entry.Direction == CREDIT {
+			totals = credits
+		}
+		asset := entry.Account.asset()
+		total, err := totals[asset].Add(entry.Amount)
+		if err != nil {
+			return fmt.Errorf("posting total of %s: %v", asset, err)
+		}
+		totals[asset] = total
+	}
+
+	for asset := range debits {
+		if _, ok := credits[asset]; !ok {
+			credits[asset] = price.Price{}
+		}
+	}
+	for asset, credit := range credits {
+		if debit := debits[asset]; debit.Cmp(credit) != 0 {
+			return fmt.Errorf("%w: %s debited %s but credited %s", ErrUnbalanced, asset, debit, credit)
+		}
+	}
+	return nil
+}
+
+// Balance is the running total of every entry into one account.
+type Balance struct {
+	Debits  price.Price `json:"debits"`
+	Credits price.Price `json:"credits"`
+}
+
+// Net is the account's credits less its debits as a signed decimal, e.g.
+// "-12.50" for a buyer who has paid 12.50 more than they have received.
+func (b Balance) Net() string {
+	if net, err := b.Credits.Sub(b.Debits); err == nil {
+		return net.String()
+	}
+	net, _ := b.Debits.Sub(b.Credits)
+	return "-" + net.String()
+}
+
+func (b Balance) add(entry Entry) (Balance, error) {
+	var err error
+	if entry.Direction == CREDIT {
+		b.Credits, err = b.Credits.Add(entry.Amount)
+	} else {
+		b.Debits, err = b.Debits.Add(entry.Amount)
+	}
+	return b, err
+}
+
+type AccountBalance struct {
+	Account Account `json:"account"`
+	Balance Balance `json:"balance"`
+	Net     string  `json:"net"`
+}
+
+// Ledger is safe for concurrent use. A ledger opened on a journal appends
+// every posting to it before applying it and replays it on open.
+type Ledger struct {
+	balances      map[Account]Balance
+	fills         map[uint64][]Posting // key: fillId
+	lastPostingId uint64
+	journal       *libstore.Journal // nil keeps the ledger in memory only
+	mu            sync.Mutex
+}
+
+func New() *Ledger {
+	return &Ledger{
+		balances: make(map[Account]Balance),
+		fills:    make(map[uint64][]Posting),
+	}
+}
+
+func Open(path string) (*Ledger, error) {
+	journal, err := libstore.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := New()
+	err = journal.Replay(func(record json.RawMessage) error {
+		var posting Posting
+		if err := json.Unmarshal(record, &posting); err != nil {
+			return err
+		}
+		if err := posting.Validate(); err != nil {
+			return err
+		}
+		if err := ledger.apply(posting); err != nil {
+			return err
+		}
+		ledger.lastPostingId = posting.Id
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to replay ledger: %v", err)
+	}
+
+	ledger.journal = journal
+	return ledger, nil
+}
+
+func (l *Ledger) Close() error {
+	if l.journal == nil {
+		return nil
+	}
+	return l.journal.Close()
+}
+
+// Post validates the posting, assigns it the next id and applies it. The
+// posting is only applied once it is safely in the journal.
+func (l *Ledger) Post(posting Posting) (Posting, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.post(posting)
+}
+
+func (l *Ledger) post(posting Posting) (Posting, error) {
+	if err := posting.Validate(); err != nil {
+		return Posting{}, err
+	}
+	if posting.Time.IsZero() {
+		posting.Time = time.Now()
+	}
+
+	posting.Id = l.lastPostingId + 1
+	if _, err := l.applied(posting); err != nil {
+		return Posting{}, err
+	}
+	if l.journal != nil {
+		if err := l.journal.Append(posting); err != nil {
+			return Posting{}, err
+		}
+	}
+	if err := l.apply(posting); err != nil {
+		return Posting{}, err
+	}
+	l.lastPostingId = posting.Id
+	return posting, nil
+}
+
+// Reverse posts the mirror image of every posting of the fill, e.g. when
+// the fill is busted, leaving the books as if it had never happened.
+func (l *Ledger) Reverse(fillId uint64) ([]Posting, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	postings := l.fills[fillId]
+	if len(postings) == 0 {
+		return nil, ErrNotPosted
+	}
+	for _, posting := range postings {
+		if posting.Reverses != 0 {
+			return nil, ErrAlreadyReversed
+		}
+	}
+
+	var reversals []Posting
+	for _, posting := range postings {
+		reversal := Posting{FillId: fillId, Reverses: posting.Id}
+		for _, entry := range posting.Entries {
+			entry.Direction = entry.Direction.opposite()
+			reversal.Entries = append(reversal.Entries, entry)
+		}
+		reversal, err := l.post(reversal)
+		if err != nil {
+			return reversals, err
+		}
+		reversals = append(reversals, reversal)
+	}
+	return reversals, nil
+}
+
+// PostFill posts a fill and the royalties paid out of it.
+func (l *Ledger) PostFill(order match.FillOrder, payouts []royalty.Payout) (Posting, error) {
+	notional, err := order.Notional()
+	if err != nil {
+		return Posting{}, err
+	}
+
+	var entries []Entry
+	add := func(account Account, direction Direction, amount price.Price) {
+		if !amount.IsZero() {
+			entries = append(entries, Entry{Account: account, Direction: direction, Amount: amount})
+		}
+	}
+
+	buyer, seller := Cash(order.BuyerId, order.Currency), Cash(order.SellerId, order.Currency)
+	add(buyer, DEBIT, notional)
+	add(seller, CREDIT, notional)
+
+	add(buyer, DEBIT, order.BuyerFee)
+	add(seller, DEBIT, order.SellerFee)
+	add(Fees(order.Currency), CREDIT, order.BuyerFee)
+	add(Fees(order.Currency), CREDIT, order.SellerFee)
+
+	for _, payout := range payouts {
+		add(seller, DEBIT, payout.Amount)
+		add(Royalty(payout.RecipientId, payout.Currency), CREDIT, payout.Amount)
+	}
+
+	fractions := price.New(order.QuantityFilled, 0)
+	add(Position(order.SellerId, order.ArtworkId), DEBIT, fractions)
+	add(Position(order.BuyerId, order.ArtworkId), CREDIT, fractions)
+
+	return l.Post(Posting{FillId: order.Id, Entries: entries})
+}
+
+// applied returns the balances the posting would leave, without changing
+// the ledger, so a posting that would overflow is refused whole.
+func (l *Ledger) applied(posting Posting) (map[Account]Balance, error) {
+	balances := make(map[Account]Balance, len(posting.Entries))
+	for _, entry := range posting.Entries {
+		balance, ok := balances[entry.Account]
+		if !ok {
+			balance = l.balances[entry.Account]
+		}
+		balance, err := balance.add(entry)
+		if err != nil {
+			return nil, fmt.Errorf("balance of %s account: %v", entry.Account.Kind, err)
+		}
+		balances[entry.Account] = balance
+	}
+	return balances, nil
+}
+
+func (l *Ledger) apply(posting Posting) error {
+	balances, err := l.applied(posting)
+	if err != nil {
+		return err
+	}
+	for account, balance := range balances {
+		l.balances[account] = balance
+	}
+	l.fills[posting.FillId] = append(l.fills[posting.FillId], posting)
+	return nil
+}
+
+func (l *Ledger) Balance(account Account) Balance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.balances[account]
+}
+
+// User returns the balances of every account the user holds, cash first,
+// then positions, then royalties owed to them.
+func (l *Ledger) User(userId uint64) []AccountBalance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var balances []AccountBalance
+	for account, balance := range l.balances {
+		if account.Kind != ACCOUNT_FEES && account.UserId == userId {
+			balances = append(balances, AccountBalance{Account: account, Balance: balance, Net: balance.Net()})
+		}
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		a, b := balances[i].Account, balances[j].Account
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.ArtworkId != b.ArtworkId {
+			return a.ArtworkId < b.ArtworkId
+		}
+		return a.Currency < b.Currency
+	})
+	return balances
+}
+
+// Trial sums the debits and credits of every account per asset. They are
+// equal in every asset as long as the books balance.
+func (l *Ledger) Trial() (map[string]Balance, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	totals := make(map[string]Balance)
+	for account, balance := range l.balances {
+		total := totals[account.asset()]
+		var err error
+		if total.Debits, err = total.Debits.Add(balance.Debits); err != nil {
+			return nil, err
+		}
+		if total.Credits, err = total.Credits.Add(balance.Credits); err != nil {
+			return nil, err
+		}
+		totals[account.asset()] = total
+	}
+	return totals, nil
+}
@@ -0,0 +1,151 @@
+package ledger
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/royalty"
+)
+
+// 10 fractions at 100.00, 3.00 buyer fee, 1.00 seller fee and a 50.00
+// royalty split between two recipients
+var (
+	fill = match.FillOrder{
+		Id:             5,
+		ArtworkId:      1,
+		BuyerId:        10,
+		SellerId:       20,
+		Price:          price.New(10000, 2),
+		Currency:       "USD",
+		QuantityFilled: 10,
+		BuyerFee:       price.New(300, 2),
+		SellerFee:      price.New(100, 2),
+	}
+	payouts = []royalty.Payout{
+		{FillId: 5, ArtworkId: 1, SellerId: 20, RecipientId: 30, Amount: price.New(3000, 2), Currency: "USD"},
+		{FillId: 5, ArtworkId: 1, SellerId: 20, RecipientId: 31, Amount: price.New(2000, 2), Currency: "USD"},
+	}
+)
+
+func TestPostFill(t *testing.T) {
+	books := New()
+	if _, err := books.PostFill(fill, payouts); err != nil {
+		t.Fatalf("failed to post fill: %v", err)
+	}
+
+	expected := map[Account]string{
+		Cash(10, "USD"):    "-1003.00",
+		Cash(20, "USD"):    "949.00",
+		Fees("USD"):        "4.00",
+		Royalty(30, "USD"): "30.00",
+		Royalty(31, "USD"): "20.00",
+		Position(10, 1):    "10",
+		Position(20, 1):    "-10",
+	}
+	for account, net := range expected {
+		if got := books.Balance(account).Net(); got != net {
+			t.Errorf("Expected %+v to net %s, got %s", account, net, got)
+		}
+	}
+
+	totals, err := books.Trial()
+	if err != nil {
+		t.Fatalf("failed to sum the books: %v", err)
+	}
+	for asset, total := range totals {
+		if total.Debits.Cmp(total.Credits) != 0 {
+			t.Errorf("Expected %s to balance, got %+v", asset, total)
+		}
+	}
+
+	balances := books.User(20)
+	if len(balances) != 2 || balances[0].Account.Kind != ACCOUNT_CASH || balances[1].Account.Kind != ACCOUNT_POSITION {
+		t.Errorf("Expected the seller's cash then position, got %+v", balances)
+	}
+}
+
+func TestPostRefusesUnbalancedPostings(t *testing.T) {
+	books := New()
+	_, err := books.Post(Posting{Entries: []Entry{
+		{Account: Cash(10, "USD"), Direction: DEBIT, Amount: price.New(100, 2)},
+		{Account: Cash(20, "USD"), Direction: CREDIT, Amount: price.New(99, 2)},
+	}})
+	if !errors.Is(err, ErrUnbalanced) {
+		t.Fatalf("Expected ErrUnbalanced, got %v", err)
+	}
+
+	// balancing in one currency does not balance another
+	_, err = books.Post(Posting{Entries: []Entry{
+		{Account: Cash(10, "USD"), Direction: DEBIT, Amount: price.New(100, 2)},
+		{Account: Cash(20, "EUR"), Direction: CREDIT, Amount: price.New(100, 2)},
+	}})
+	if !errors.Is(err, ErrUnbalanced) {
+		t.Fatalf("Expected ErrUnbalanced across currencies, got %v", err)
+	}
+
+	if balance := books.Balance(Cash(10, "USD")); !balance.Debits.IsZero() {
+		t.Errorf("Expected refused postings to leave balances alone, got %+v", balance)
+	}
+}
+
+func TestReverseUndoesFill(t *testing.T) {
+	books := New()
+	if _, err := books.PostFill(fill, payouts); err != nil {
+		t.Fatalf("failed to post fill: %v", err)
+	}
+	if _, err := books.Reverse(fill.Id); err != nil {
+		t.Fatalf("failed to reverse fill: %v", err)
+	}
+
+	for _, account := range []Account{Cash(10, "USD"), Cash(20, "USD"), Fees("USD"), Royalty(30, "USD"), Position(10, 1)} {
+		if balance := books.Balance(account); balance.Debits.Cmp(balance.Credits) != 0 {
+			t.Errorf("Expected %+v to net zero, got %s", account, balance.Net())
+		}
+	}
+
+	if _, err := books.Reverse(fill.Id); !errors.Is(err, ErrAlreadyReversed) {
+		t.Errorf("Expected ErrAlreadyReversed, got %v", err)
+	}
+	if _, err := books.Reverse(fill.Id + 1); !errors.Is(err, ErrNotPosted) {
+		t.Errorf("Expected ErrNotPosted, got %v", err)
+	}
+}
+
+func TestOpenReplaysJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+
+	books, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	if _, err := books.PostFill(fill, payouts); err != nil {
+		t.Fatalf("failed to post fill: %v", err)
+	}
+	books.Close()
+
+	// a crash mid-append leaves a torn final record
+	journal, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	journal.WriteString(`{"id":2,"fill_id":6,"entr`)
+	journal.Close()
+
+	books, err = Open(path)
+	if err != nil {
+		t.Fatalf("failed to reopen ledger: %v", err)
+	}
+	defer books.Close()
+
+	if net := books.Balance(Cash(20, "USD")).Net(); net != "949.00" {
+		t.Errorf("Expected the seller's cash to survive a restart, got %s", net)
+	}
+	posting, err := books.PostFill(fill, nil)
+	if err != nil {
+		t.Fatalf("failed to post after replay: %v", err)
+	}
+	if posting.Id != 2 {
+		t.Errorf("Expected posting ids to continue from the journal, got %d", posting.Id)
+	}
+}
@@ -0,0 +1,86 @@
+package libstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Journal is an append-only file of JSON records, one per line, for state
+// that must survive a restart without a round trip to the storage service.
+// Every append is synced before it returns. It is safe for concurrent use.
+type Journal struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+	return &Journal{file: file}, nil
+}
+
+// Replay calls fn with every record in the order it was appended. A final
+// record without its newline was torn by a crash mid-append; it is dropped
+// and the file truncated so later appends start on a clean line.
+func (j *Journal) Replay(fn func(record json.RawMessage) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var offset int64
+	reader := bufio.NewReader(j.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read journal: %v", err)
+		}
+
+		if record := bytes.TrimSpace(line); len(record) > 0 {
+			if err := fn(record); err != nil {
+				return fmt.Errorf("journal record at offset %d: %v", offset, err)
+			}
+		}
+		offset += int64(len(line))
+	}
+
+	if err := j.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (j *Journal) Append(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := j.file.Write(data); err != nil {
+		return fmt.Errorf("failed to append to journal: %v", err)
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
@@ -34,17 +34,24 @@ func (ls *Libstore) NewStorageServiceClient() (pb.StorageClient, error) {
 
 func (ls *Libstore) Put(
 	docType pb.Type,
-	id uint32,
-	userIds []uint32,
+	id uint64,
+	userIds []uint64,
 	primaryMarket bool,
 	artistName, artTitle string,
 	bidStatus *mcpb.BidStatus,
 	askStatus *mcpb.AskStatus,
 ) (*pb.PutResponse, error) {
+	// the storage proto still uses 32-bit ids
+	docId := uint32(id)
+	docUserIds := make([]uint32, len(userIds))
+	for i, userId := range userIds {
+		docUserIds[i] = uint32(userId)
+	}
+
 	req := &pb.PutRequest{
 		Type:          docType,
-		Id:            &id,
-		UserIds:       userIds,
+		Id:            &docId,
+		UserIds:       docUserIds,
 		PrimaryMarket: &primaryMarket,
 		ArtistName:    &artistName,
 		ArtTitle:      &artTitle,
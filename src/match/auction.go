@@ -0,0 +1,123 @@
+package match
+
+import (
+	"container/heap"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// clearingPrice returns the single price at which the most of the book
+// would trade, and that volume. Ties go to the price leaving the least
+// volume unmatched, then the one nearest the reference price if there is
+// one, then the lowest.
+func clearingPrice(bids pqueue.BidPriorityQueue, asks pqueue.AskPriorityQueue, ref price.Price, hasRef bool) (price.Price, uint64) {
+	var candidates []price.Price
+	for _, bid := range bids {
+		candidates = append(candidates, bid.Price)
+	}
+	for _, ask := range asks {
+		candidates = append(candidates, ask.Price)
+	}
+
+	var best price.Price
+	var bestVolume, bestImbalance uint64
+	for _, p := range candidates {
+		var demand, supply uint64
+		for _, bid := range bids {
+			if bid.Price.Cmp(p) >= 0 {
+				demand += bid.QuantityRemaining()
+			}
+		}
+		for _, ask := range asks {
+			if ask.Price.Cmp(p) <= 0 {
+				supply += ask.QuantityRemaining()
+			}
+		}
+		volume := minQuantity(demand, supply)
+		imbalance := demand + supply - 2*volume
+		if volume == 0 {
+			continue
+		}
+
+		better := volume > bestVolume ||
+			(volume == bestVolume && imbalance < bestImbalance) ||
+			(volume == bestVolume && imbalance == bestImbalance && closer(p, best, ref, hasRef))
+		if better {
+			best, bestVolume, bestImbalance = p, volume, imbalance
+		}
+	}
+	return best, bestVolume
+}
+
+// closer reports whether p beats the current best: nearer the reference if
+// there is one, and otherwise lower.
+func closer(p, best, ref price.Price, hasRef bool) bool {
+	if hasRef {
+		if d, bestD := distance(p, ref), distance(best, ref); d.Cmp(bestD) != 0 {
+			return d.Cmp(bestD) < 0
+		}
+	}
+	return p.Cmp(best) < 0
+}
+
+func distance(p, q price.Price) price.Price {
+	if p.Cmp(q) < 0 {
+		p, q = q, p
+	}
+	d, _ := p.Sub(q)
+	return d
+}
+
+// auction fills every crossing order at the book's clearing price, in
+// price-time priority on each side, and returns the fills. Each fill's taker
+// is whichever of its orders was placed later.
+func (ome *OrderMatchingEngine) auction(b *book, inst instrument.Instrument) ([]FillOrder, error) {
+	bids, asks := b.bids.pqueue, b.asks.pqueue
+
+	ref, hasRef := b.lastPrice()
+	clearing, volume := clearingPrice(*bids, *asks, ref, hasRef)
+	if volume == 0 {
+		return nil, nil
+	}
+
+	var fills []FillOrder
+	for bids.Len() > 0 && asks.Len() > 0 {
+		bid, ask := bids.Peek(), asks.Peek()
+		if bid.Price.Cmp(clearing) < 0 || ask.Price.Cmp(clearing) > 0 {
+			break
+		}
+
+		takerSide := uint32(SIDE_BID)
+		if bid.PlacedAt.Before(ask.PlacedAt) {
+			takerSide = SIDE_ASK
+		}
+		order, err := ome.fill(b, inst, bid, ask, clearing, minQuantity(bid.QuantityRemaining(), ask.QuantityRemaining()), takerSide)
+		if err != nil {
+			return fills, err
+		}
+
+		ome.jobs <- bid.Snapshot()
+		ome.jobs <- ask.Snapshot()
+		ome.orders <- order
+		fills = append(fills, order)
+
+		if bid.QuantityRemaining() == 0 {
+			heap.Pop(bids)
+		}
+		if ask.QuantityRemaining() == 0 {
+			heap.Pop(asks)
+		}
+	}
+	return fills, ome.repeg(b, inst)
+}
+
+// lastPrice returns the artwork's last trade price, or false before its
+// first trade.
+func (b *book) lastPrice() (price.Price, bool) {
+	if b.reference.traded {
+		return b.reference.last, true
+	}
+	return price.Price{}, false
+}
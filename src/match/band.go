@@ -0,0 +1,165 @@
+package match
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/price"
+)
+
+// ErrOutsidePriceBand is returned for a trade off the book priced outside
+// the artwork's price band.
+var ErrOutsidePriceBand = errors.New("price is outside the price band")
+
+// circuit breaker counters, keyed by artwork id
+var (
+	bandHalts          = expvar.NewMap("match_price_band_halts")
+	volatilityAuctions = expvar.NewMap("match_volatility_auctions")
+)
+
+// a trade kept towards an artwork's VWAP
+type print struct {
+	price    price.Price
+	quantity uint64
+	at       time.Time
+}
+
+// reference tracks the trades an artwork's price band is centred on.
+type reference struct {
+	last   price.Price
+	traded bool
+	prints []print // within the VWAP window, oldest first
+}
+
+func (ref *reference) record(inst instrument.Instrument, execPrice price.Price, qty uint64, now time.Time) {
+	ref.last, ref.traded = execPrice, true
+	if inst.BandReference != instrument.REFERENCE_VWAP {
+		ref.prints = nil
+		return
+	}
+	ref.prints = append(ref.prints, print{execPrice, qty, now})
+	ref.prune(inst, now)
+}
+
+func (ref *reference) prune(inst instrument.Instrument, now time.Time) {
+	cutoff := now.Add(-inst.VWAPWindowDuration())
+	i := 0
+	for i < len(ref.prints) && ref.prints[i].at.Before(cutoff) {
+		i++
+	}
+	ref.prints = ref.prints[i:]
+}
+
+// price returns the reference price, or false before the first trade. A
+// VWAP with no trades in its window falls back to the last trade.
+func (ref *reference) price(inst instrument.Instrument, now time.Time) (price.Price, bool) {
+	if !ref.traded {
+		return price.Price{}, false
+	}
+	if inst.BandReference != instrument.REFERENCE_VWAP {
+		return ref.last, true
+	}
+
+	ref.prune(inst, now)
+	var notional price.Price
+	var volume uint64
+	for _, p := range ref.prints {
+		value, err := p.price.Mul(p.quantity)
+		if err == nil {
+			notional, err = notional.Add(value)
+		}
+		if err != nil {
+			return ref.last, true
+		}
+		volume += p.quantity
+	}
+	if volume == 0 {
+		return ref.last, true
+	}
+	vwap, err := notional.MulDiv(1, volume)
+	if err != nil {
+		return ref.last, true
+	}
+	return vwap, true
+}
+
+// ReferencePrice returns the price the artwork's band is centred on, or
+// false before its first trade.
+func (ome *OrderMatchingEngine) ReferencePrice(artworkId uint64) (price.Price, bool) {
+	b := ome.book(artworkId)
+	if b == nil {
+		return price.Price{}, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.reference.price(ome.Instrument(artworkId), time.Now())
+}
+
+// LastPrice returns the artwork's last trade price, or false before its
+// first trade.
+func (ome *OrderMatchingEngine) LastPrice(artworkId uint64) (price.Price, bool) {
+	b := ome.book(artworkId)
+	if b == nil {
+		return price.Price{}, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastPrice()
+}
+
+// a price band fixed for the length of an all-or-none basket
+type pinnedBand struct {
+	low, high price.Price
+	ok        bool
+}
+
+// band returns the artwork's price band at now, or false if fills are not
+// limited to one. The caller holds b.mu.
+func (b *book) band(inst instrument.Instrument, now time.Time) (low, high price.Price, ok bool) {
+	if b.pinned != nil {
+		return b.pinned.low, b.pinned.high, b.pinned.ok
+	}
+	if inst.PriceBandBps == 0 {
+		return price.Price{}, price.Price{}, false
+	}
+	center, ok := b.reference.price(inst, now)
+	if !ok {
+		return price.Price{}, price.Price{}, false
+	}
+	low, high, err := inst.Band(center)
+	if err != nil {
+		return price.Price{}, price.Price{}, false
+	}
+	return low, high, true
+}
+
+// breaksBand reports whether a fill at execPrice falls outside the
+// artwork's price band, halting the artwork if it does.
+func (ome *OrderMatchingEngine) breaksBand(b *book, inst instrument.Instrument, execPrice price.Price) bool {
+	now := time.Now()
+	low, high, ok := b.band(inst, now)
+	if !ok || (execPrice.Cmp(low) >= 0 && execPrice.Cmp(high) <= 0) {
+		return false
+	}
+
+	ome.setTrading(b, TradingStatus{
+		Phase:     TRADING_HALTED,
+		Reason:    fmt.Sprintf("fill at %s outside price band %s-%s", execPrice, low, high),
+		Since:     now,
+		ReopensAt: now.Add(inst.HaltDuration()),
+	})
+	bandHalts.Add(fmt.Sprint(inst.ArtworkId), 1)
+	time.AfterFunc(inst.HaltDuration(), func() {
+		if ome.closeAuction(b, now, "volatility auction") {
+			volatilityAuctions.Add(fmt.Sprint(inst.ArtworkId), 1)
+		}
+	})
+	return true
+}
@@ -0,0 +1,201 @@
+package match
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// ErrNotFillable is returned for an all-or-none order that its book cannot
+// fill in full.
+var ErrNotFillable = errors.New("order cannot fill in full")
+
+// LegError is returned by FillAllOrNone for the order at fault.
+type LegError struct {
+	Index int // of the order
+	Err   error
+}
+
+func (e *LegError) Error() string {
+	return fmt.Sprintf("order %d: %v", e.Index, e.Err)
+}
+
+func (e *LegError) Unwrap() error {
+	return e.Err
+}
+
+// FillAllOrNone fills every order in full against its artwork's book, or
+// none of them, so nothing rests. The orders must be on different artworks
+// and not pegged. Their books stay locked together from the check to the
+// last fill, so no other order can take the liquidity in between, and each
+// book's price band is pinned at the check, so the basket's own fills
+// cannot move it and halt a later leg. Orders refused by the check come
+// back as a LegError with nothing filled; any other error means a fill
+// failed after earlier orders had filled, and the rest were cancelled.
+func (ome *OrderMatchingEngine) FillAllOrNone(orders []BidAsk) error {
+	artworkIds := make([]uint64, len(orders))
+	insts := make([]instrument.Instrument, len(orders))
+	books := make(map[uint64]*book)
+	for i, order := range orders {
+		artworkId := orderArtwork(order)
+		b := ome.book(artworkId)
+		if b == nil {
+			return &LegError{i, fmt.Errorf("%w: %d", ErrArtworkNotListed, artworkId)}
+		}
+		if books[artworkId] != nil {
+			return &LegError{i, fmt.Errorf("artwork %d has another order", artworkId)}
+		}
+		books[artworkId] = b
+		artworkIds[i] = artworkId
+		insts[i] = ome.Instrument(artworkId)
+	}
+
+	// reserve everything first, undoing what was reserved if one fails
+	for i, order := range orders {
+		inst := insts[i]
+		var err error
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			if err = checkOrder(inst, o.Quantity(), o.Price, nil); err == nil {
+				err = ome.reserveFunds(o, inst.Currency)
+			}
+		case *pqueue.Ask:
+			if err = checkOrder(inst, o.Quantity(), o.Price, nil); err == nil {
+				err = ome.lockHoldings(o)
+			}
+		}
+		if err != nil {
+			ome.unreserve(orders[:i])
+			return &LegError{i, err}
+		}
+	}
+
+	// lock in artwork order, so baskets locking the same books cannot
+	// deadlock
+	locked := append([]uint64(nil), artworkIds...)
+	sort.Slice(locked, func(i, j int) bool { return locked[i] < locked[j] })
+	for _, artworkId := range locked {
+		books[artworkId].mu.Lock()
+		defer books[artworkId].mu.Unlock()
+	}
+
+	now := time.Now()
+	for i, artworkId := range artworkIds {
+		b := books[artworkId]
+		low, high, ok := b.band(insts[i], now)
+		b.pinned = &pinnedBand{low, high, ok}
+		defer func() { b.pinned = nil }()
+	}
+	for i, order := range orders {
+		if err := books[artworkIds[i]].checkFillable(insts[i], order, now); err != nil {
+			ome.unreserve(orders)
+			return &LegError{i, err}
+		}
+	}
+
+	for i, order := range orders {
+		b, inst := books[artworkIds[i]], insts[i]
+		var err error
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			if _, err = ome.matchBid(b, inst, o); err == nil && o.QuantityRemaining() > 0 && b.bids.pqueue.Remove(o) {
+				ome.updateIndicative(b)
+				err = ome.releaseFunds(o)
+			}
+		case *pqueue.Ask:
+			if _, err = ome.matchAsk(b, inst, o); err == nil && o.QuantityRemaining() > 0 && b.asks.pqueue.Remove(o) {
+				ome.updateIndicative(b)
+				err = ome.unlockHoldings(o)
+			}
+		}
+		if err != nil {
+			ome.unreserve(orders[i+1:])
+			return fmt.Errorf("order %d failed after the check: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// checkFillable returns an error unless the order can fill in full against
+// its book now, at prices inside the artwork's price band. The caller holds
+// b.mu.
+func (b *book) checkFillable(inst instrument.Instrument, order BidAsk, now time.Time) error {
+	matching, err := b.checkTrading(inst)
+	if err != nil {
+		return err
+	}
+	if !matching {
+		return fmt.Errorf("%w: artwork %d is not matching continuously", ErrNotFillable, inst.ArtworkId)
+	}
+
+	// the prices and quantities of the resting orders it would cross,
+	// best first
+	type resting struct {
+		price    price.Price
+		quantity uint64
+	}
+	var crossed []resting
+	var quantity uint64
+	switch o := order.(type) {
+	case *pqueue.Bid:
+		quantity = o.QuantityRemaining()
+		for _, ask := range *b.asks.pqueue {
+			if ask.Price.Cmp(o.Price) <= 0 {
+				crossed = append(crossed, resting{ask.Price, ask.QuantityRemaining()})
+			}
+		}
+		sort.Slice(crossed, func(i, j int) bool { return crossed[i].price.Cmp(crossed[j].price) < 0 })
+	case *pqueue.Ask:
+		quantity = o.QuantityRemaining()
+		for _, bid := range *b.bids.pqueue {
+			if bid.Price.Cmp(o.Price) >= 0 {
+				crossed = append(crossed, resting{bid.Price, bid.QuantityRemaining()})
+			}
+		}
+		sort.Slice(crossed, func(i, j int) bool { return crossed[i].price.Cmp(crossed[j].price) > 0 })
+	}
+
+	low, high, banded := b.band(inst, now)
+	var fillable uint64
+	for _, r := range crossed {
+		if fillable >= quantity {
+			break
+		}
+		if banded && (r.price.Cmp(low) < 0 || r.price.Cmp(high) > 0) {
+			return fmt.Errorf("%w: only %d of %d fill inside the price band", ErrNotFillable, fillable, quantity)
+		}
+		fillable += r.quantity
+	}
+	if fillable < quantity {
+		return fmt.Errorf("%w: only %d of %d can fill", ErrNotFillable, fillable, quantity)
+	}
+	return nil
+}
+
+// unreserve releases the funds and holdings reserved for orders that will
+// not be placed.
+func (ome *OrderMatchingEngine) unreserve(orders []BidAsk) {
+	for _, order := range orders {
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			ome.releaseFunds(o)
+		case *pqueue.Ask:
+			ome.unlockHoldings(o)
+		}
+	}
+}
+
+func orderArtwork(order BidAsk) uint64 {
+	switch o := order.(type) {
+	case *pqueue.Bid:
+		return o.ArtworkId
+	case *pqueue.Ask:
+		return o.ArtworkId
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package match
+
+import (
+	"log"
+	"time"
+)
+
+// startBatches starts clearing the artwork's book in batches, unless it
+// already is.
+func (ome *OrderMatchingEngine) startBatches(artworkId uint64) {
+	ome.artworksMu.Lock()
+	defer ome.artworksMu.Unlock()
+
+	if ome.batching[artworkId] {
+		return
+	}
+	ome.batching[artworkId] = true
+	time.AfterFunc(ome.Instrument(artworkId).BatchIntervalDuration(), func() {
+		ome.clearBatch(artworkId)
+	})
+}
+
+// clearBatch fills the orders collected since the last batch at a single
+// clearing price and schedules the next batch. An artwork switched back to
+// continuous matching has its last batch cleared and is not scheduled
+// again.
+func (ome *OrderMatchingEngine) clearBatch(artworkId uint64) {
+	ome.artworksMu.Lock()
+	inst := ome.Instrument(artworkId)
+	if !inst.Batched() {
+		delete(ome.batching, artworkId)
+	}
+	ome.artworksMu.Unlock()
+
+	b := ome.book(artworkId)
+	b.mu.Lock()
+	if b.trading.Phase == TRADING_OPEN {
+		if _, err := ome.auction(b, inst); err != nil {
+			log.Printf("batch auction of artwork %d failed: %v", artworkId, err)
+		}
+	}
+	b.mu.Unlock()
+
+	if inst.Batched() {
+		time.AfterFunc(inst.BatchIntervalDuration(), func() {
+			ome.clearBatch(artworkId)
+		})
+	}
+}
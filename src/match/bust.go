@@ -0,0 +1,150 @@
+package match
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// BustFill unwinds a fill the engine made: the buyer's payment is refunded
+// and the fractions handed back to the seller. With restore set, the filled
+// quantity is put back on each of the fill's bid and ask still resting,
+// reserving funds or locking fractions for it again, and the restored
+// orders are returned. Should either restore fail, neither is restored.
+func (ome *OrderMatchingEngine) BustFill(fill FillOrder, restore bool) ([]BidAsk, error) {
+	if ome.holdings != nil {
+		if err := ome.holdings.Move(fill.BuyerId, fill.SellerId, fill.ArtworkId, fill.QuantityFilled); err != nil {
+			return nil, err
+		}
+	}
+	if ome.accounts != nil {
+		paid, err := fill.Notional()
+		if err != nil {
+			return nil, err
+		}
+		if err := ome.accounts.Refund(fill.BuyerId, paid, fill.Currency); err != nil {
+			return nil, err
+		}
+	}
+
+	b := ome.book(fill.ArtworkId)
+	if !restore || b == nil {
+		return nil, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a price-time fill completes one of its orders, but a pro-rata share
+	// can leave both partly unfilled and resting. The ask goes back first:
+	// the bid reserves its limit where the buyer was refunded the fill
+	// price, so it is the restore that can fail, and it takes the ask's
+	// back with it rather than leave the bust half restored.
+	var restored []BidAsk
+	ask := b.asks.pqueue.FindAsker(fill.AskId, fill.SellerId)
+	if ask != nil {
+		if err := ome.restoreAsk(ask, fill.QuantityFilled); err != nil {
+			return nil, err
+		}
+		restored = append(restored, ask)
+	}
+	if bid := b.bids.pqueue.FindBidder(fill.BidId, fill.BuyerId); bid != nil {
+		if err := ome.restoreBid(bid, fill.QuantityFilled); err != nil {
+			if len(restored) > 0 {
+				if undoErr := ome.unrestoreAsk(ask, fill.QuantityFilled); undoErr != nil {
+					return nil, fmt.Errorf("%w, then %v", err, undoErr)
+				}
+			}
+			return nil, err
+		}
+		restored = append([]BidAsk{bid}, restored...)
+	}
+	return restored, nil
+}
+
+func (ome *OrderMatchingEngine) restoreBid(bid *pqueue.Bid, qty uint64) error {
+	if ome.accounts != nil {
+		amount, err := bid.Limit().Mul(qty)
+		if err != nil {
+			return err
+		}
+		currency := ome.Instrument(bid.ArtworkId).Currency
+		if err := ome.accounts.Reserve(bid.BidderId, bid.Id, amount, currency); err != nil {
+			return err
+		}
+	}
+	return bid.UnfillQuantity(qty)
+}
+
+func (ome *OrderMatchingEngine) restoreAsk(ask *pqueue.Ask, qty uint64) error {
+	if ome.holdings != nil {
+		if err := ome.holdings.Lock(ask.AskerId, ask.ArtworkId, ask.Id, qty); err != nil {
+			return err
+		}
+	}
+	return ask.UnfillQuantity(qty)
+}
+
+// unrestoreAsk takes back a restore of the ask, unlocking the fractions
+// locked for it again.
+func (ome *OrderMatchingEngine) unrestoreAsk(ask *pqueue.Ask, qty uint64) error {
+	if ome.holdings != nil {
+		if err := ome.holdings.Unlock(ask.AskerId, ask.ArtworkId, ask.Id, qty); err != nil {
+			return err
+		}
+	}
+	return ask.FillQuantity(qty)
+}
+
+// CorrectFill books the replacement of a fill already unwound by BustFill:
+// a fill between the same orders at the corrected price and quantity. The
+// buyer is charged and the fractions moved outside the book, as neither
+// order is resting on the corrected terms.
+func (ome *OrderMatchingEngine) CorrectFill(fill FillOrder, execPrice price.Price, qty uint64) (FillOrder, error) {
+	inst := ome.Instrument(fill.ArtworkId)
+	if err := inst.CheckOrder(qty, execPrice); err != nil {
+		return FillOrder{}, err
+	}
+	execPrice, err := execPrice.Rescale(inst.PriceScale)
+	if err != nil {
+		return FillOrder{}, err
+	}
+
+	corrected := FillOrder{
+		Id:             atomic.AddUint64(&ome.lastFillId, 1),
+		BidId:          fill.BidId,
+		AskId:          fill.AskId,
+		ArtworkId:      fill.ArtworkId,
+		BuyerId:        fill.BuyerId,
+		SellerId:       fill.SellerId,
+		Price:          execPrice,
+		Currency:       fill.Currency,
+		QuantityFilled: qty,
+		Status:         ORDER_PENDING,
+		TakerSide:      fill.TakerSide,
+	}
+	if err := ome.chargeFees(&corrected); err != nil {
+		return FillOrder{}, err
+	}
+	paid, err := corrected.Notional()
+	if err != nil {
+		return FillOrder{}, err
+	}
+
+	if ome.holdings != nil {
+		if err := ome.holdings.Move(fill.SellerId, fill.BuyerId, fill.ArtworkId, qty); err != nil {
+			return FillOrder{}, err
+		}
+	}
+	if ome.accounts != nil {
+		if err := ome.accounts.Charge(fill.BuyerId, paid, fill.Currency); err != nil {
+			if ome.holdings != nil {
+				ome.holdings.Move(fill.BuyerId, fill.SellerId, fill.ArtworkId, qty)
+			}
+			return FillOrder{}, err
+		}
+	}
+	return corrected, nil
+}
@@ -0,0 +1,101 @@
+package match
+
+import (
+	"fmt"
+	"time"
+
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// Orders matched outside the book, such as by auction listings, reserve and
+// lock through the engine like book orders and trade with Cross, so their
+// fills are charged, settled and stored the same way.
+//
+// The gateway has users choose the ids of the orders they place up to
+// MaxOrderId. The orders the marketplace makes itself for trades outside the
+// book take ids above it, one range per kind, so they never share a lock, a
+// reservation or a storage record with a user's order, and still fit the
+// 32-bit ids of the storage protos.
+
+const MaxOrderId = 1<<30 - 1
+
+const (
+	auctionOrderIds = 1 << 30 // the block an auction sells
+	rfqOrderIds     = 2 << 30 // the requester's bid on an accepted quote
+	quoteOrderIds   = 3 << 30 // a maker's quote on a request
+)
+
+// AuctionOrderId is the id of the ask locking the auction's block.
+func AuctionOrderId(auctionId uint64) uint64 { return auctionOrderIds | auctionId }
+
+// RfqOrderId is the id of the bid that buys on the request's accepted quote.
+func RfqOrderId(requestId uint64) uint64 { return rfqOrderIds | requestId }
+
+// QuoteOrderId is the id of the ask locking a maker's quote.
+func QuoteOrderId(quoteId uint64) uint64 { return quoteOrderIds | quoteId }
+
+// ReserveFunds reserves the bid's full notional at its limit price.
+func (ome *OrderMatchingEngine) ReserveFunds(bid *pqueue.Bid) error {
+	return ome.reserveFunds(bid, ome.Instrument(bid.ArtworkId).Currency)
+}
+
+// ReleaseFunds releases what is still reserved for the bid's unfilled
+// quantity.
+func (ome *OrderMatchingEngine) ReleaseFunds(bid *pqueue.Bid) error {
+	return ome.releaseFunds(bid)
+}
+
+// LockHoldings locks the ask's full quantity against the seller's position.
+func (ome *OrderMatchingEngine) LockHoldings(ask *pqueue.Ask) error {
+	return ome.lockHoldings(ask)
+}
+
+// UnlockHoldings unlocks the fractions still locked for the ask's unfilled
+// quantity.
+func (ome *OrderMatchingEngine) UnlockHoldings(ask *pqueue.Ask) error {
+	return ome.unlockHoldings(ask)
+}
+
+// Cross executes qty between a bid and an ask matched outside the book at
+// execPrice, charging fees, capturing the bid's funds and transferring the
+// ask's fractions as a book match would. The fill and both orders are sent
+// to the worker like any other, and the fill counts towards the artwork's
+// reference price. Neither order is added to the book. It fails with
+// ErrTradingHalted unless the artwork is open, and with ErrOutsidePriceBand
+// if execPrice is outside its price band; a refused cross does not halt the
+// artwork.
+func (ome *OrderMatchingEngine) Cross(
+	bid *pqueue.Bid,
+	ask *pqueue.Ask,
+	execPrice price.Price,
+	qty uint64,
+	takerSide uint32,
+) (FillOrder, error) {
+	b := ome.book(ask.ArtworkId)
+	if b == nil {
+		return FillOrder{}, ErrArtworkNotListed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	inst := ome.Instrument(ask.ArtworkId)
+	if b.trading.Phase != TRADING_OPEN {
+		return FillOrder{}, fmt.Errorf("%w: artwork %d is %s: %s",
+			ErrTradingHalted, inst.ArtworkId, PhaseName(b.trading.Phase), b.trading.Reason)
+	}
+	if low, high, ok := b.band(inst, time.Now()); ok && (execPrice.Cmp(low) < 0 || execPrice.Cmp(high) > 0) {
+		return FillOrder{}, fmt.Errorf("%w: %s is outside %s-%s", ErrOutsidePriceBand, execPrice, low, high)
+	}
+
+	order, err := ome.fill(b, inst, bid, ask, execPrice, qty, takerSide)
+	if err != nil {
+		return FillOrder{}, err
+	}
+
+	ome.jobs <- bid.Snapshot()
+	ome.jobs <- ask.Snapshot()
+	ome.orders <- order
+	return order, nil
+}
@@ -4,31 +4,87 @@ import (
 	"container/heap"
 	crand "crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/fees"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
 	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
 )
 
 // possible statuses
 const (
 	ORDER_PENDING = iota
+	ORDER_SUBMITTED
 	ORDER_COMPLETE
 	ORDER_REJECTED
+	ORDER_BUSTED
+)
+
+var statusNames = map[uint32]string{
+	ORDER_PENDING:   "PENDING",
+	ORDER_SUBMITTED: "SUBMITTED",
+	ORDER_COMPLETE:  "COMPLETE",
+	ORDER_REJECTED:  "REJECTED",
+	ORDER_BUSTED:    "BUSTED",
+}
+
+func StatusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", status)
+}
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrNotOwner      = errors.New("order is another user's")
+)
+
+// sides of the book
+const (
+	SIDE_BID = iota
+	SIDE_ASK
 )
 
 type BidAsk interface {
-	Quantity() uint32
-	QuantityFilled() uint32
+	Quantity() uint64
+	QuantityFilled() uint64
 }
 
 type OrderMatchingEngine struct {
-	bids   map[uint32]*BidPriorityQueueMutex // key: artworkId
-	asks   map[uint32]*AskPriorityQueueMutex // key: artworkId
-	mu     map[uint32]*sync.Mutex
+	books  map[uint64]*book // key: artworkId; guarded by artworksMu
 	orders chan FillOrder
 	jobs   chan BidAsk
+
+	artworksMu  sync.RWMutex // guards creation of per-artwork books
+	instruments *instrument.Registry
+	fees        *fees.Schedule
+	accounts    account.AccountService // nil disables funds checks
+	holdings    holdings.Ledger        // nil disables holdings checks
+	lastFillId  uint64                 // accessed atomically
+
+	batching        map[uint64]bool // key: artworkId; guarded by artworksMu
+	tradingListener func(artworkId uint64, status TradingStatus)
+}
+
+// book is an artwork's order book and the state guarded by its lock. Books
+// are opened at runtime but never removed, so matching paths look one up
+// once under artworksMu and use it from then on.
+type book struct {
+	artworkId uint64
+	mu        sync.Mutex
+	bids      *BidPriorityQueueMutex
+	asks      *AskPriorityQueueMutex
+	trading   TradingStatus
+	reference reference   // trades the price band is centred on
+	pinned    *pinnedBand // the band while an all-or-none basket fills
 }
 
 type BidPriorityQueueMutex struct {
@@ -42,161 +98,754 @@ type AskPriorityQueueMutex struct {
 }
 
 type FillOrder struct {
-	BidId          uint32
-	AskId          uint32
-	ArtworkId      uint32
-	Price          uint32
-	QuantityFilled uint32
-	Status         uint32
+	Id             uint64      `json:"id"`
+	BidId          uint64      `json:"bid_id"`
+	AskId          uint64      `json:"ask_id"`
+	ArtworkId      uint64      `json:"artwork_id"`
+	BuyerId        uint64      `json:"buyer_id"`
+	SellerId       uint64      `json:"seller_id"`
+	Price          price.Price `json:"price"`
+	Currency       string      `json:"currency"`
+	QuantityFilled uint64      `json:"quantity_filled"`
+	Status         uint32      `json:"status"`
+
+	TakerSide uint32      `json:"taker_side"` // side of the incoming order
+	BuyerFee  price.Price `json:"buyer_fee"`
+	SellerFee price.Price `json:"seller_fee"`
+}
+
+// Notional is the value exchanged by the fill, price × quantity, at the
+// price's scale. It fails with price.ErrOverflow rather than wrapping.
+func (order FillOrder) Notional() (price.Price, error) {
+	return order.Price.Mul(order.QuantityFilled)
 }
 
 func New() *OrderMatchingEngine {
 	return &OrderMatchingEngine{
-		bids:   make(map[uint32]*BidPriorityQueueMutex),
-		asks:   make(map[uint32]*AskPriorityQueueMutex),
-		mu:     make(map[uint32]*sync.Mutex),
+		books:  make(map[uint64]*book),
 		orders: make(chan FillOrder),
+		jobs:   make(chan BidAsk),
+
+		instruments: instrument.NewRegistry(instrument.Default),
+		fees:        fees.NewSchedule(fees.Rates{}),
+		batching:    make(map[uint64]bool),
 	}
 }
 
-func (ome *OrderMatchingEngine) AddArtworkIfNotExists(artworkId uint32) {
-	if ome.mu[artworkId] == nil {
+func (ome *OrderMatchingEngine) AddArtworkIfNotExists(artworkId uint64) {
+	ome.addBook(artworkId)
+}
+
+// addBook returns the artwork's book, opening it if it does not exist yet.
+func (ome *OrderMatchingEngine) addBook(artworkId uint64) *book {
+	ome.artworksMu.Lock()
+	defer ome.artworksMu.Unlock()
+
+	if ome.books[artworkId] == nil {
 		bidPQ := make(pqueue.BidPriorityQueue, 0)
 		heap.Init(&bidPQ)
 		askPQ := make(pqueue.AskPriorityQueue, 0)
 		heap.Init(&askPQ)
 
-		ome.bids[artworkId] = &BidPriorityQueueMutex{pqueue: &bidPQ, mu: &sync.Mutex{}}
-		ome.asks[artworkId] = &AskPriorityQueueMutex{pqueue: &askPQ, mu: &sync.Mutex{}}
-		ome.mu[artworkId] = &sync.Mutex{}
+		ome.books[artworkId] = &book{
+			artworkId: artworkId,
+			bids:      &BidPriorityQueueMutex{pqueue: &bidPQ, mu: &sync.Mutex{}},
+			asks:      &AskPriorityQueueMutex{pqueue: &askPQ, mu: &sync.Mutex{}},
+			trading:   TradingStatus{Phase: TRADING_OPEN, Since: time.Now()},
+		}
 	}
+	return ome.books[artworkId]
+}
+
+// book returns the artwork's book, or nil if none has been opened.
+func (ome *OrderMatchingEngine) book(artworkId uint64) *book {
+	ome.artworksMu.RLock()
+	defer ome.artworksMu.RUnlock()
+
+	return ome.books[artworkId]
+}
+
+// HasArtwork reports whether an order book has been opened for the artwork.
+func (ome *OrderMatchingEngine) HasArtwork(artworkId uint64) bool {
+	return ome.book(artworkId) != nil
+}
+
+// SetInstrument configures the trading rules of an artwork, opening its order
+// book if it does not exist yet, with a call auction if the instrument has
+// an opening auction. Orders already resting are left untouched until the
+// next batch clears them, if the artwork is switched to batch matching.
+func (ome *OrderMatchingEngine) SetInstrument(inst instrument.Instrument) error {
+	if err := ome.instruments.Set(inst); err != nil {
+		return err
+	}
+	listed := ome.HasArtwork(inst.ArtworkId)
+	ome.AddArtworkIfNotExists(inst.ArtworkId)
+	if inst.Batched() {
+		ome.startBatches(inst.ArtworkId)
+	}
+	if listed || inst.OpeningAuction == 0 {
+		return nil
+	}
+	return ome.StartAuction(inst.ArtworkId, inst.OpeningAuctionDuration(), "opening auction")
+}
+
+// SetDefaultInstrument sets the instrument of artworks that have none of
+// their own. It must be called before orders are placed.
+func (ome *OrderMatchingEngine) SetDefaultInstrument(inst instrument.Instrument) error {
+	return ome.instruments.SetDefaults(inst)
+}
+
+func (ome *OrderMatchingEngine) Instrument(artworkId uint64) instrument.Instrument {
+	return ome.instruments.Get(artworkId)
+}
+
+// SetFeeSchedule sets the schedule used to charge fees on fills. It must be
+// called before orders are placed; rates can be changed at runtime through
+// the schedule itself.
+func (ome *OrderMatchingEngine) SetFeeSchedule(schedule *fees.Schedule) {
+	ome.fees = schedule
+}
+
+// SetAccountService makes the engine reserve a bid's funds before accepting
+// it. Like SetFeeSchedule, it must be called before orders are placed.
+func (ome *OrderMatchingEngine) SetAccountService(accounts account.AccountService) {
+	ome.accounts = accounts
+}
+
+// ResumeFillIds makes the engine number its fills after lastFillId, so fill
+// ids stay unique across restarts of a server that persists its fills. It
+// must be called before orders are placed.
+func (ome *OrderMatchingEngine) ResumeFillIds(lastFillId uint64) {
+	atomic.StoreUint64(&ome.lastFillId, lastFillId)
+}
+
+// SetHoldingsLedger makes the engine lock an ask's fractions against the
+// seller's position before accepting it. Like SetFeeSchedule, it must be
+// called before orders are placed.
+func (ome *OrderMatchingEngine) SetHoldingsLedger(ledger holdings.Ledger) {
+	ome.holdings = ledger
 }
 
 func (ome *OrderMatchingEngine) Orders() chan FillOrder {
 	return ome.orders
 }
 
+// Jobs returns the channel the engine sends every order on as it changes,
+// as a snapshot taken under its book's lock.
 func (ome *OrderMatchingEngine) Jobs() chan BidAsk {
 	return ome.jobs
 }
 
 func (ome *OrderMatchingEngine) AddAsk(ask *pqueue.Ask) {
-
-	if ome.asks[ask.ArtworkId] == nil {
-		askPQ := make(pqueue.AskPriorityQueue, 0)
-		heap.Init(&askPQ)
-		ome.asks[ask.ArtworkId] = &AskPriorityQueueMutex{pqueue: &askPQ, mu: &sync.Mutex{}}
-	}
-	heap.Push(ome.asks[ask.ArtworkId].pqueue, ask)
+	heap.Push(ome.addBook(ask.ArtworkId).asks.pqueue, ask)
 }
 
 func (ome *OrderMatchingEngine) AddBid(bid *pqueue.Bid) {
-	// check if queue exists
-	if ome.bids[bid.ArtworkId] == nil {
-		bidPQ := make(pqueue.BidPriorityQueue, 0)
-		heap.Init(&bidPQ)
-		ome.bids[bid.ArtworkId] = &BidPriorityQueueMutex{pqueue: &bidPQ, mu: &sync.Mutex{}}
-	}
-	heap.Push(ome.bids[bid.ArtworkId].pqueue, bid)
+	heap.Push(ome.addBook(bid.ArtworkId).bids.pqueue, bid)
 }
 
-func (ome *OrderMatchingEngine) FillAskOrder(ask *pqueue.Ask) *pqueue.Ask {
-	ome.AddArtworkIfNotExists(ask.ArtworkId)
+// FillAskOrder matches the ask against the book, resting what does not
+// fill, and returns a snapshot of it as placed. What rests keeps filling on
+// the book, not in the snapshot.
+func (ome *OrderMatchingEngine) FillAskOrder(ask *pqueue.Ask) (*pqueue.Ask, error) {
+	inst := ome.Instrument(ask.ArtworkId)
+	if err := checkOrder(inst, ask.Quantity(), ask.Price, ask.Peg); err != nil {
+		return ask, err
+	}
+	if err := ome.lockHoldings(ask); err != nil {
+		return ask, err
+	}
+	if ask.ExpiresAt.IsZero() {
+		ask.ExpiresAt = inst.Expiry(ask.PlacedAt)
+	}
 
-	ome.mu[ask.ArtworkId].Lock()
-	defer ome.mu[ask.ArtworkId].Unlock()
+	b := ome.addBook(ask.ArtworkId)
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	bid := ome.bids[ask.ArtworkId].pqueue.Peek()
-	for ome.bids[ask.ArtworkId].pqueue.Len() > 0 && ask.Price <= bid.Price {
+	placed, err := ome.matchAsk(b, inst, ask)
+	return placed.Snapshot(), err
+}
 
-		quantityToFill := math.Min(float64(ask.QuantityRemaining()), float64(bid.QuantityRemaining()))
-		ask.FillQuantity(uint32(quantityToFill))
-		bid.FillQuantity(uint32(quantityToFill))
+// matchAsk matches an ask whose holdings are locked against the book,
+// resting what does not fill. The caller holds b.mu.
+func (ome *OrderMatchingEngine) matchAsk(b *book, inst instrument.Instrument, ask *pqueue.Ask) (*pqueue.Ask, error) {
+	matching, err := b.checkTrading(inst)
+	if err == nil && ask.Peg != nil {
+		err = b.pegAsk(inst, ask)
+	}
+	if err != nil {
+		if unlockErr := ome.unlockHoldings(ask); unlockErr != nil {
+			return ask, unlockErr
+		}
+		return ask, err
+	}
+
+	bids := b.bids.pqueue
+	for matching && ask.QuantityRemaining() > 0 && bids.Len() > 0 && ask.Price.Cmp(bids.Peek().Price) <= 0 {
+		level := bids.Level()
 
-		fmt.Println("sending job...")
-		ome.jobs <- bid
+		// a fill outside the price band halts the artwork, leaving the ask to rest
+		if ome.breaksBand(b, inst, level[0].Price) {
+			break
+		}
 
-		order := FillOrder{
-			BidId:          bid.Id,
-			AskId:          ask.Id,
-			ArtworkId:      ask.ArtworkId,
-			Price:          bid.Price,
-			QuantityFilled: uint32(quantityToFill),
-			Status:         ORDER_PENDING,
+		resting := make([]uint64, len(level))
+		for i, bid := range level {
+			resting[i] = bid.QuantityRemaining()
+		}
+		for i, quantityToFill := range policy(inst).Allocate(ask.QuantityRemaining(), resting, inst.LotSize) {
+			if quantityToFill == 0 {
+				continue
+			}
+			bid := level[i]
+			order, err := ome.fill(b, inst, bid, ask, bid.Price, quantityToFill, SIDE_ASK)
+			if err != nil {
+				return ask, ome.abandonAsk(b, ask, bid, err)
+			}
+
+			fmt.Println("sending job...")
+			ome.jobs <- bid.Snapshot()
+
+			ome.orders <- order
+
+			if bid.QuantityRemaining() == 0 {
+				bids.Remove(bid)
+			}
 		}
+	}
+
+	if ask.QuantityRemaining() > 0 {
+		heap.Push(b.asks.pqueue, ask)
+	}
+	if !matching {
+		ome.updateIndicative(b)
+	}
+	if err := ome.repeg(b, inst); err != nil {
+		return ask, err
+	}
+
+	ome.jobs <- ask.Snapshot()
+
+	return ask, nil
+}
+
+// FillBidOrder matches the bid against the book, resting what does not
+// fill, and returns a snapshot of it as placed. What rests keeps filling on
+// the book, not in the snapshot.
+func (ome *OrderMatchingEngine) FillBidOrder(bid *pqueue.Bid) (*pqueue.Bid, error) {
+	inst := ome.Instrument(bid.ArtworkId)
+	if err := checkOrder(inst, bid.Quantity(), bid.Price, bid.Peg); err != nil {
+		return bid, err
+	}
+	if err := ome.reserveFunds(bid, inst.Currency); err != nil {
+		return bid, err
+	}
+	if bid.ExpiresAt.IsZero() {
+		bid.ExpiresAt = inst.Expiry(bid.PlacedAt)
+	}
 
-		ome.orders <- order
+	b := ome.addBook(bid.ArtworkId)
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-		if bid.QuantityRemaining() == 0 {
-			heap.Pop(ome.bids[ask.ArtworkId].pqueue)
+	placed, err := ome.matchBid(b, inst, bid)
+	return placed.Snapshot(), err
+}
+
+// matchBid matches a bid whose funds are reserved against the book, resting
+// what does not fill. The caller holds b.mu.
+func (ome *OrderMatchingEngine) matchBid(b *book, inst instrument.Instrument, bid *pqueue.Bid) (*pqueue.Bid, error) {
+	matching, err := b.checkTrading(inst)
+	if err == nil && bid.Peg != nil {
+		err = b.pegBid(inst, bid)
+	}
+	if err != nil {
+		if releaseErr := ome.releaseFunds(bid); releaseErr != nil {
+			return bid, releaseErr
 		}
-		bid = ome.bids[ask.ArtworkId].pqueue.Peek()
+		return bid, err
+	}
+
+	// match against the best ask level, sharing the bid among its asks by
+	// the artwork's policy, until the bid is complete or no longer crosses
+	asks := b.asks.pqueue
+	for matching && bid.QuantityRemaining() > 0 && asks.Len() > 0 && asks.Peek().Price.Cmp(bid.Price) <= 0 {
+		level := asks.Level()
 
-		if ask.QuantityRemaining() == 0 {
+		// a fill outside the price band halts the artwork, leaving the bid to rest
+		if ome.breaksBand(b, inst, level[0].Price) {
 			break
 		}
+
+		resting := make([]uint64, len(level))
+		for i, ask := range level {
+			resting[i] = ask.QuantityRemaining()
+		}
+		for i, quantityToFill := range policy(inst).Allocate(bid.QuantityRemaining(), resting, inst.LotSize) {
+			if quantityToFill == 0 {
+				continue
+			}
+			ask := level[i]
+			// create order transaction
+			order, err := ome.fill(b, inst, bid, ask, ask.Price, quantityToFill, SIDE_BID)
+			if err != nil {
+				return bid, ome.abandonBid(b, bid, ask, err)
+			}
+			// update storage
+			fmt.Println("sending job...")
+			ome.jobs <- ask.Snapshot()
+
+			ome.orders <- order
+
+			// remove ask from queue if ask is complete
+			if ask.QuantityRemaining() == 0 {
+				asks.Remove(ask)
+			}
+		}
 	}
 
-	if ask.QuantityRemaining() > 0 {
-		ome.AddAsk(ask)
+	// if the bid is not yet completely filled, insert into queue
+	if bid.QuantityRemaining() > 0 {
+		b.bids.mu.Lock()
+		defer b.bids.mu.Unlock()
+		heap.Push(b.bids.pqueue, bid)
+	}
+	if !matching {
+		ome.updateIndicative(b)
+	}
+	if err := ome.repeg(b, inst); err != nil {
+		return bid, err
 	}
 
-	ome.jobs <- ask
+	ome.jobs <- bid.Snapshot()
 
-	return ask
+	return bid, nil
 }
 
-func (ome *OrderMatchingEngine) FillBidOrder(bid *pqueue.Bid) *pqueue.Bid {
-	ome.AddArtworkIfNotExists(bid.ArtworkId)
+// CancelBid removes a resting bid from the book and releases the funds
+// reserved for its unfilled quantity.
+func (ome *OrderMatchingEngine) CancelBid(artworkId, bidId uint64) (*pqueue.Bid, error) {
+	return ome.cancelBid(artworkId, bidId, func(bids pqueue.BidPriorityQueue) *pqueue.Bid { return bids.Find(bidId) })
+}
 
-	ome.mu[bid.ArtworkId].Lock()
-	defer ome.mu[bid.ArtworkId].Unlock()
+// CancelUserBid cancels the bid like CancelBid, failing with ErrNotOwner and
+// leaving it on the book unless the user placed it.
+func (ome *OrderMatchingEngine) CancelUserBid(artworkId, bidId, userId uint64) (*pqueue.Bid, error) {
+	return ome.cancelBid(artworkId, bidId, func(bids pqueue.BidPriorityQueue) *pqueue.Bid {
+		return bids.FindBidder(bidId, userId)
+	})
+}
 
-	// TODO: What if the ask queue is empty?
-	ask := ome.asks[bid.ArtworkId].pqueue.Peek()
-	for ome.asks[bid.ArtworkId].pqueue.Len() > 0 && ask.Price <= bid.Price {
+// cancelBid cancels the bid that find picks out of the book, failing with
+// ErrNotOwner if it picks none but another user's bid has the id.
+func (ome *OrderMatchingEngine) cancelBid(artworkId, bidId uint64, find func(pqueue.BidPriorityQueue) *pqueue.Bid) (*pqueue.Bid, error) {
+	b := ome.book(artworkId)
+	if b == nil {
+		return nil, ErrOrderNotFound
+	}
 
-		quantityToFill := math.Min(float64(ask.QuantityRemaining()), float64(bid.QuantityRemaining()))
-		ask.FillQuantity(uint32(quantityToFill))
-		bid.FillQuantity(uint32(quantityToFill))
-		// update storage
-		fmt.Println("sending job...")
-		ome.jobs <- ask
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-		// create order transaction
-		order := FillOrder{
-			BidId:          bid.Id,
-			AskId:          ask.Id,
-			ArtworkId:      bid.ArtworkId,
-			Price:          ask.Price,
-			QuantityFilled: uint32(quantityToFill),
-			Status:         ORDER_PENDING,
+	bid := find(*b.bids.pqueue)
+	if bid == nil {
+		if b.bids.pqueue.Find(bidId) != nil {
+			return nil, fmt.Errorf("%w: bid %d", ErrNotOwner, bidId)
 		}
+		return nil, ErrOrderNotFound
+	}
+	b.bids.pqueue.Remove(bid)
+	ome.updateIndicative(b)
+	if err := ome.releaseFunds(bid); err != nil {
+		return bid, err
+	}
+	return bid, ome.repeg(b, ome.Instrument(artworkId))
+}
+
+// CancelAsk removes a resting ask from the book and unlocks the fractions
+// locked for its unfilled quantity.
+func (ome *OrderMatchingEngine) CancelAsk(artworkId, askId uint64) (*pqueue.Ask, error) {
+	return ome.cancelAsk(artworkId, askId, func(asks pqueue.AskPriorityQueue) *pqueue.Ask { return asks.Find(askId) })
+}
 
-		ome.orders <- order
+// CancelUserAsk cancels the ask like CancelAsk, failing with ErrNotOwner and
+// leaving it on the book unless the user placed it.
+func (ome *OrderMatchingEngine) CancelUserAsk(artworkId, askId, userId uint64) (*pqueue.Ask, error) {
+	return ome.cancelAsk(artworkId, askId, func(asks pqueue.AskPriorityQueue) *pqueue.Ask {
+		return asks.FindAsker(askId, userId)
+	})
+}
+
+// cancelAsk cancels the ask that find picks out of the book, failing with
+// ErrNotOwner if it picks none but another user's ask has the id.
+func (ome *OrderMatchingEngine) cancelAsk(artworkId, askId uint64, find func(pqueue.AskPriorityQueue) *pqueue.Ask) (*pqueue.Ask, error) {
+	b := ome.book(artworkId)
+	if b == nil {
+		return nil, ErrOrderNotFound
+	}
 
-		// remove ask from queue if ask is complete
-		if ask.QuantityRemaining() == 0 {
-			heap.Pop(ome.asks[bid.ArtworkId].pqueue)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ask := find(*b.asks.pqueue)
+	if ask == nil {
+		if b.asks.pqueue.Find(askId) != nil {
+			return nil, fmt.Errorf("%w: ask %d", ErrNotOwner, askId)
 		}
-		ask = ome.asks[bid.ArtworkId].pqueue.Peek()
+		return nil, ErrOrderNotFound
+	}
+	b.asks.pqueue.Remove(ask)
+	ome.updateIndicative(b)
+	if err := ome.unlockHoldings(ask); err != nil {
+		return ask, err
+	}
+	return ask, ome.repeg(b, ome.Instrument(artworkId))
+}
 
-		// finish up if the bid is complete
-		if bid.QuantityRemaining() == 0 {
-			break
+// ExpireOrders removes every resting order whose lifetime has run out at
+// now, releasing its funds or fractions, and returns the removed orders.
+func (ome *OrderMatchingEngine) ExpireOrders(now time.Time) ([]BidAsk, error) {
+	return ome.sweep(ome.artworkIds(),
+		func(bid *pqueue.Bid) bool { return bid.Expired(now) },
+		func(ask *pqueue.Ask) bool { return ask.Expired(now) },
+	)
+}
+
+// MassCancel removes every resting order of the given users on the given
+// artworks, releasing its funds or fractions, and returns the removed
+// orders. No users means every user's orders, and no artworks every
+// artwork's.
+func (ome *OrderMatchingEngine) MassCancel(userIds, artworkIds []uint64) ([]BidAsk, error) {
+	if len(artworkIds) == 0 {
+		artworkIds = ome.artworkIds()
+	}
+	for _, artworkId := range artworkIds {
+		if !ome.HasArtwork(artworkId) {
+			return nil, fmt.Errorf("%w: %d", ErrArtworkNotListed, artworkId)
 		}
 	}
+	users := make(map[uint64]bool, len(userIds))
+	for _, userId := range userIds {
+		users[userId] = true
+	}
 
-	// if the bid is not yet completely filled, insert into queue
-	if bid.QuantityRemaining() > 0 {
-		ome.bids[bid.ArtworkId].mu.Lock()
-		defer ome.bids[bid.ArtworkId].mu.Unlock()
-		ome.AddBid(bid)
+	return ome.sweep(artworkIds,
+		func(bid *pqueue.Bid) bool { return len(users) == 0 || users[bid.BidderId] },
+		func(ask *pqueue.Ask) bool { return len(users) == 0 || users[ask.AskerId] },
+	)
+}
+
+func (ome *OrderMatchingEngine) artworkIds() []uint64 {
+	ome.artworksMu.RLock()
+	defer ome.artworksMu.RUnlock()
+
+	artworkIds := make([]uint64, 0, len(ome.books))
+	for artworkId := range ome.books {
+		artworkIds = append(artworkIds, artworkId)
 	}
+	return artworkIds
+}
+
+// sweep removes the resting orders on the artworks' books that match,
+// releasing their funds or fractions. It carries on past a failed release
+// and returns the first error.
+func (ome *OrderMatchingEngine) sweep(
+	artworkIds []uint64,
+	bidMatches func(*pqueue.Bid) bool,
+	askMatches func(*pqueue.Ask) bool,
+) ([]BidAsk, error) {
+
+	var removed []BidAsk
+	var firstErr error
+	for _, artworkId := range artworkIds {
+		b := ome.book(artworkId)
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+
+		var bids []*pqueue.Bid
+		for _, bid := range *b.bids.pqueue {
+			if bidMatches(bid) {
+				bids = append(bids, bid)
+			}
+		}
+		var asks []*pqueue.Ask
+		for _, ask := range *b.asks.pqueue {
+			if askMatches(ask) {
+				asks = append(asks, ask)
+			}
+		}
+
+		for _, bid := range bids {
+			b.bids.pqueue.Remove(bid)
+			if err := ome.releaseFunds(bid); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			removed = append(removed, bid)
+		}
+		for _, ask := range asks {
+			b.asks.pqueue.Remove(ask)
+			if err := ome.unlockHoldings(ask); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			removed = append(removed, ask)
+		}
+		if len(bids)+len(asks) > 0 {
+			ome.updateIndicative(b)
+			if err := ome.repeg(b, ome.Instrument(artworkId)); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
 
-	ome.jobs <- bid
+		b.mu.Unlock()
+	}
 
-	return bid
+	return removed, firstErr
+}
+
+// reserveFunds reserves the bid's full notional at its limit price, or a
+// pegged bid's at its cap.
+func (ome *OrderMatchingEngine) reserveFunds(bid *pqueue.Bid, currency string) error {
+	if ome.accounts == nil {
+		return nil
+	}
+	if bid.Peg != nil && bid.Peg.Cap.IsZero() {
+		return &instrument.RuleError{ArtworkId: bid.ArtworkId, Violations: []instrument.Violation{{
+			Field:       "peg.cap",
+			Description: "a pegged bid needs a cap to reserve its funds at",
+		}}}
+	}
+	notional, err := bid.Limit().Mul(bid.Quantity())
+	if err != nil {
+		return err
+	}
+	return ome.accounts.Reserve(bid.BidderId, bid.Id, notional, currency)
+}
+
+// captureFunds takes payment for qty filled at execPrice out of the bid's
+// reservation and releases the difference to its limit price.
+func (ome *OrderMatchingEngine) captureFunds(bid *pqueue.Bid, execPrice price.Price, qty uint64) error {
+	if ome.accounts == nil {
+		return nil
+	}
+	paid, err := execPrice.Mul(qty)
+	if err != nil {
+		return err
+	}
+	reserved, err := bid.Limit().Mul(qty)
+	if err != nil {
+		return err
+	}
+	improvement, err := reserved.Sub(paid)
+	if err != nil {
+		return fmt.Errorf("bid %d filled at %s above its limit %s", bid.Id, execPrice, bid.Limit())
+	}
+
+	if err := ome.accounts.Capture(bid.BidderId, bid.Id, paid); err != nil {
+		return err
+	}
+	if improvement.IsZero() {
+		return nil
+	}
+	return ome.accounts.Release(bid.BidderId, bid.Id, improvement)
+}
+
+// lockHoldings locks the ask's full quantity against the seller's position.
+func (ome *OrderMatchingEngine) lockHoldings(ask *pqueue.Ask) error {
+	if ome.holdings == nil {
+		return nil
+	}
+	return ome.holdings.Lock(ask.AskerId, ask.ArtworkId, ask.Id, ask.Quantity())
+}
+
+// transferHoldings moves qty fractions from the ask's lock to the buyer.
+func (ome *OrderMatchingEngine) transferHoldings(bid *pqueue.Bid, ask *pqueue.Ask, qty uint64) error {
+	if ome.holdings == nil {
+		return nil
+	}
+	return ome.holdings.Transfer(ask.AskerId, bid.BidderId, ask.ArtworkId, ask.Id, qty)
+}
+
+// unlockHoldings unlocks the fractions still locked for the ask's unfilled
+// quantity.
+func (ome *OrderMatchingEngine) unlockHoldings(ask *pqueue.Ask) error {
+	if ome.holdings == nil || ask.QuantityRemaining() == 0 {
+		return nil
+	}
+	return ome.holdings.Unlock(ask.AskerId, ask.ArtworkId, ask.Id, ask.QuantityRemaining())
+}
+
+// releaseFunds releases what is still reserved for the bid's unfilled
+// quantity.
+func (ome *OrderMatchingEngine) releaseFunds(bid *pqueue.Bid) error {
+	if ome.accounts == nil || bid.QuantityRemaining() == 0 {
+		return nil
+	}
+	remaining, err := bid.Limit().Mul(bid.QuantityRemaining())
+	if err != nil {
+		return err
+	}
+	return ome.accounts.Release(bid.BidderId, bid.Id, remaining)
+}
+
+func minQuantity(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fill executes qty between bid and ask at the given price, charging each
+// side the fee for the liquidity it provided or took, and returns the
+// resulting fill order.
+func (ome *OrderMatchingEngine) fill(
+	b *book,
+	inst instrument.Instrument,
+	bid *pqueue.Bid,
+	ask *pqueue.Ask,
+	execPrice price.Price,
+	qty uint64,
+	takerSide uint32,
+) (FillOrder, error) {
+	order := FillOrder{
+		Id:             atomic.AddUint64(&ome.lastFillId, 1),
+		BidId:          bid.Id,
+		AskId:          ask.Id,
+		ArtworkId:      inst.ArtworkId,
+		BuyerId:        bid.BidderId,
+		SellerId:       ask.AskerId,
+		Price:          execPrice,
+		Currency:       inst.Currency,
+		QuantityFilled: qty,
+		Status:         ORDER_PENDING,
+		TakerSide:      takerSide,
+	}
+
+	if err := ome.chargeFees(&order); err != nil {
+		return FillOrder{}, err
+	}
+	// the fee totals are checked before anything moves, so a failed fill
+	// leaves both orders as they were
+	if _, err := bid.FeesPaid().Add(order.BuyerFee); err != nil {
+		return FillOrder{}, fmt.Errorf("bid %d: %v", bid.Id, err)
+	}
+	if _, err := ask.FeesPaid().Add(order.SellerFee); err != nil {
+		return FillOrder{}, fmt.Errorf("ask %d: %v", ask.Id, err)
+	}
+
+	if err := fillBoth(bid, ask, qty); err != nil {
+		return FillOrder{}, err
+	}
+	if err := ome.captureFunds(bid, execPrice, qty); err != nil {
+		return FillOrder{}, unfillBoth(bid, ask, qty, err)
+	}
+	if err := ome.transferHoldings(bid, ask, qty); err != nil {
+		return FillOrder{}, ome.refundFill(order, bid, ask, err)
+	}
+	if err := bid.AddFee(order.BuyerFee); err != nil {
+		return FillOrder{}, err
+	}
+	if err := ask.AddFee(order.SellerFee); err != nil {
+		return FillOrder{}, err
+	}
+	b.reference.record(inst, execPrice, qty, time.Now())
+
+	return order, nil
+}
+
+// chargeFees sets the fees each side of the order pays for the liquidity it
+// provided or took.
+func (ome *OrderMatchingEngine) chargeFees(order *FillOrder) error {
+	notional, err := order.Notional()
+	if err != nil {
+		return err
+	}
+	buyerLiquidity, sellerLiquidity := fees.MAKER, fees.TAKER
+	if order.TakerSide == SIDE_BID {
+		buyerLiquidity, sellerLiquidity = fees.TAKER, fees.MAKER
+	}
+	if order.BuyerFee, err = ome.fees.Fee(order.ArtworkId, order.BuyerId, buyerLiquidity, notional); err != nil {
+		return err
+	}
+	order.SellerFee, err = ome.fees.Fee(order.ArtworkId, order.SellerId, sellerLiquidity, notional)
+	return err
+}
+
+// fillBoth fills qty on both sides of a match, or neither if either side
+// cannot take it.
+func fillBoth(bid *pqueue.Bid, ask *pqueue.Ask, qty uint64) error {
+	if qty > bid.QuantityRemaining() || qty > ask.QuantityRemaining() {
+		return fmt.Errorf(
+			"cannot fill %d between bid %d (%d remaining) and ask %d (%d remaining)",
+			qty, bid.Id, bid.QuantityRemaining(), ask.Id, ask.QuantityRemaining(),
+		)
+	}
+	if err := bid.FillQuantity(qty); err != nil {
+		return err
+	}
+	return ask.FillQuantity(qty)
+}
+
+// unfillBoth takes qty back off both sides of a fill that failed, and
+// returns the failure.
+func unfillBoth(bid *pqueue.Bid, ask *pqueue.Ask, qty uint64, cause error) error {
+	if err := bid.UnfillQuantity(qty); err != nil {
+		return fmt.Errorf("%w, then %v", cause, err)
+	}
+	if err := ask.UnfillQuantity(qty); err != nil {
+		return fmt.Errorf("%w, then %v", cause, err)
+	}
+	return cause
+}
+
+// refundFill gives the buyer back what was captured for a fill whose
+// fractions could not be transferred, reserving it for the bid again, and
+// returns the failure.
+func (ome *OrderMatchingEngine) refundFill(order FillOrder, bid *pqueue.Bid, ask *pqueue.Ask, cause error) error {
+	if ome.accounts != nil {
+		paid, err := order.Notional()
+		if err != nil {
+			return fmt.Errorf("%w, then %v", cause, err)
+		}
+		if err := ome.accounts.Refund(order.BuyerId, paid, order.Currency); err != nil {
+			return fmt.Errorf("%w, then %v", cause, err)
+		}
+	}
+	if err := ome.restoreBid(bid, order.QuantityFilled); err != nil {
+		return fmt.Errorf("%w, then %v", cause, err)
+	}
+	if err := ask.UnfillQuantity(order.QuantityFilled); err != nil {
+		return fmt.Errorf("%w, then %v", cause, err)
+	}
+	return cause
+}
+
+// abandonBid withdraws a bid that failed to fill against ask, and the ask
+// with it so it cannot fail the next order too, releasing what both still
+// hold. The bid is the incoming order and was never added to the book.
+func (ome *OrderMatchingEngine) abandonBid(b *book, bid *pqueue.Bid, ask *pqueue.Ask, cause error) error {
+	b.asks.pqueue.Remove(ask)
+	return abandoned(cause, ome.unlockHoldings(ask), ome.releaseFunds(bid))
+}
+
+// abandonAsk is abandonBid for an incoming ask that failed to fill against
+// a resting bid.
+func (ome *OrderMatchingEngine) abandonAsk(b *book, ask *pqueue.Ask, bid *pqueue.Bid, cause error) error {
+	b.bids.pqueue.Remove(bid)
+	return abandoned(cause, ome.releaseFunds(bid), ome.unlockHoldings(ask))
+}
+
+// abandoned returns the failure that abandoned a fill, noting the first
+// error releasing its orders.
+func abandoned(cause error, releaseErrs ...error) error {
+	for _, err := range releaseErrs {
+		if err != nil {
+			return fmt.Errorf("%w, then %v", cause, err)
+		}
+	}
+	return cause
 }
 
 func randString(n int) string {
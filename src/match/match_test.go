@@ -1,37 +1,36 @@
 package match
 
 import (
-	"container/heap"
+	"errors"
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/fees"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
 	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
 	"sync"
 	"testing"
+	"testing/quick"
 	"time"
 )
 
-func SetupServerOneArtwork(artworkId uint32) *OrderMatchingEngine {
+func SetupServerOneArtwork(artworkId uint64) *OrderMatchingEngine {
 	server := OrderMatchingEngine{
-		bids:   make(map[uint32]*BidPriorityQueueMutex),
-		asks:   make(map[uint32]*AskPriorityQueueMutex),
-		mu:     make(map[uint32]*sync.Mutex),
+		books:  make(map[uint64]*book),
 		orders: make(chan FillOrder),
 		jobs:   make(chan BidAsk),
-	}
-
-	bidPQ := make(pqueue.BidPriorityQueue, 0)
-	heap.Init(&bidPQ)
-	askPQ := make(pqueue.AskPriorityQueue, 0)
-	heap.Init(&askPQ)
-
-	server.mu[artworkId] = &sync.Mutex{}
 
-	server.bids[artworkId] = &BidPriorityQueueMutex{pqueue: &bidPQ, mu: &sync.Mutex{}}
-	server.asks[artworkId] = &AskPriorityQueueMutex{pqueue: &askPQ, mu: &sync.Mutex{}}
+		instruments: instrument.NewRegistry(instrument.Default),
+		fees:        fees.NewSchedule(fees.Rates{}),
+		batching:    make(map[uint64]bool),
+	}
+	server.AddArtworkIfNotExists(artworkId)
 
 	return &server
 }
 
 func TestFillBidOrderHigherAndLowerAsks(t *testing.T) {
-	var artworkId uint32 = 0
+	var artworkId uint64 = 0
 
 	match := SetupServerOneArtwork(artworkId)
 
@@ -40,7 +39,7 @@ func TestFillBidOrderHigherAndLowerAsks(t *testing.T) {
 		3000,
 		artworkId,
 		100,
-		10,
+		price.New(10, 0),
 	)
 
 	ask0 := pqueue.NewAsk(
@@ -48,7 +47,7 @@ func TestFillBidOrderHigherAndLowerAsks(t *testing.T) {
 		4000,
 		artworkId,
 		50,
-		10,
+		price.New(10, 0),
 	)
 
 	ask1 := pqueue.NewAsk(
@@ -56,7 +55,7 @@ func TestFillBidOrderHigherAndLowerAsks(t *testing.T) {
 		4001,
 		artworkId,
 		100,
-		12,
+		price.New(12, 0),
 	)
 
 	ask2 := pqueue.NewAsk(
@@ -64,7 +63,7 @@ func TestFillBidOrderHigherAndLowerAsks(t *testing.T) {
 		4002,
 		artworkId,
 		20,
-		9,
+		price.New(9, 0),
 	)
 
 	match.AddAsk(ask0)
@@ -95,15 +94,896 @@ func TestFillBidOrderHigherAndLowerAsks(t *testing.T) {
 	}
 }
 
+func TestFillBidOrderInstrumentViolations(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	err := match.SetInstrument(instrument.Instrument{
+		ArtworkId:   artworkId,
+		Currency:    "USD",
+		PriceScale:  0,
+		TickSize:    5,
+		LotSize:     10,
+		MinQuantity: 10,
+		MaxQuantity: 1000,
+		MinPrice:    5,
+	})
+	if err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(10, 0))
+	match.AddAsk(ask)
+
+	// off-tick price and off-lot quantity are both reported, and nothing
+	// is matched against the resting ask
+	bid := pqueue.NewBid(1000, 3000, artworkId, 15, price.New(12, 0))
+	_, err = match.FillBidOrder(bid)
+	ruleErr, ok := err.(*instrument.RuleError)
+	if !ok {
+		t.Fatalf("Expected *instrument.RuleError, got %v", err)
+	}
+	if len(ruleErr.Violations) != 2 {
+		t.Fatalf("Expected 2 violations, got %+v", ruleErr.Violations)
+	}
+	if ask.QuantityFilled() != 0 || bid.QuantityFilled() != 0 {
+		t.Fatalf("Rejected bid must not be matched")
+	}
+
+	bid = pqueue.NewBid(1001, 3000, artworkId, 2000, price.New(10, 0))
+	if _, err := match.FillBidOrder(bid); err == nil {
+		t.Fatalf("Expected bid above maximum quantity to be rejected")
+	}
+}
+
+func TestFillBidOrderBeyond32BitQuantities(t *testing.T) {
+	artworkId := uint64(1) << 40
+
+	match := SetupServerOneArtwork(artworkId)
+	match.SetInstrument(instrument.Instrument{
+		ArtworkId:   artworkId,
+		Currency:    "USD",
+		TickSize:    1,
+		LotSize:     1,
+		MinQuantity: 1,
+		MinPrice:    1,
+	})
+
+	ask := pqueue.NewAsk(1<<33, 4000, artworkId, 5_000_000_000, price.New(2, 0))
+	match.AddAsk(ask)
+
+	go match.FillBidOrder(pqueue.NewBid(1<<34, 3000, artworkId, 6_000_000_000, price.New(2, 0)))
+
+	for {
+		select {
+		case order := <-match.Orders():
+			if order.QuantityFilled != 5_000_000_000 || order.AskId != 1<<33 {
+				t.Fatalf("Unexpected fill: %+v", order)
+			}
+			notional, err := order.Notional()
+			if err != nil || notional.Units != 10_000_000_000 {
+				t.Fatalf("Expected notional 10000000000, got %v (%v)", notional, err)
+			}
+		case <-match.Jobs():
+		case <-time.After(time.Second * 1):
+			if ask.QuantityRemaining() != 0 {
+				t.Fatalf("Expected ask to be completely filled, %d remaining", ask.QuantityRemaining())
+			}
+			return
+		}
+	}
+}
+
+func TestFillBidOrderChargesMakerAndTakerFees(t *testing.T) {
+	artworkId := uint64(7)
+
+	match := SetupServerOneArtwork(artworkId)
+	schedule := fees.NewSchedule(fees.Rates{MakerBps: 10, TakerBps: 50, MinFee: 2})
+	schedule.SetTier(fees.Tier{Name: "vip", MakerBps: 0, TakerBps: 20})
+	schedule.AssignTier(3001, "vip")
+	match.SetFeeSchedule(schedule)
+
+	// notional 100 × 10.00 = 1000.00
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 100, price.New(1000, 2))
+	match.AddAsk(ask)
+
+	bid := pqueue.NewBid(1000, 3000, artworkId, 100, price.New(1000, 2))
+	go match.FillBidOrder(bid)
+
+	var order FillOrder
+	for done := false; !done; {
+		select {
+		case order = <-match.Orders():
+		case job := <-match.Jobs():
+			done = isJobOf(job, bid)
+		case <-time.After(time.Second * 1):
+			t.Fatalf("Bid was not filled")
+		}
+	}
+
+	// the bidder took liquidity at 50 bps, the asker made it at 10 bps
+	if order.TakerSide != SIDE_BID {
+		t.Errorf("Expected bid to be the taker")
+	}
+	if order.BuyerFee.Cmp(price.New(500, 2)) != 0 {
+		t.Errorf("Expected buyer fee 5.00, got %v", order.BuyerFee)
+	}
+	if order.SellerFee.Cmp(price.New(100, 2)) != 0 {
+		t.Errorf("Expected seller fee 1.00, got %v", order.SellerFee)
+	}
+	if bid.FeesPaid().Cmp(order.BuyerFee) != 0 || ask.FeesPaid().Cmp(order.SellerFee) != 0 {
+		t.Errorf("Expected fees to be recorded on both orders")
+	}
+
+	// a vip taker pays the tier rate, and a tiny fill pays the minimum fee
+	ask = pqueue.NewAsk(2001, 4000, artworkId, 1, price.New(1, 2))
+	match.AddAsk(ask)
+	bid = pqueue.NewBid(1001, 3001, artworkId, 1, price.New(1, 2))
+	go match.FillBidOrder(bid)
+
+	for done := false; !done; {
+		select {
+		case order = <-match.Orders():
+		case job := <-match.Jobs():
+			done = isJobOf(job, bid)
+		case <-time.After(time.Second * 1):
+			t.Fatalf("Bid was not filled")
+		}
+	}
+	if order.BuyerFee.Cmp(price.New(1, 2)) != 0 {
+		t.Errorf("Expected buyer fee capped at the notional 0.01, got %v", order.BuyerFee)
+	}
+}
+
+// drain consumes the engine's channels until the order's final job has been
+// sent, returning the fills seen on the way.
+func drain(t *testing.T, match *OrderMatchingEngine, order BidAsk) []FillOrder {
+	var fills []FillOrder
+	for {
+		select {
+		case fill := <-match.Orders():
+			fills = append(fills, fill)
+		case job := <-match.Jobs():
+			if isJobOf(job, order) {
+				return fills
+			}
+		case <-time.After(time.Second * 1):
+			t.Fatalf("Order was not processed")
+		}
+	}
+}
+
+// isJobOf reports whether job is a snapshot of order.
+func isJobOf(job, order BidAsk) bool {
+	switch o := order.(type) {
+	case *pqueue.Bid:
+		bid, ok := job.(*pqueue.Bid)
+		return ok && bid.Id == o.Id && bid.BidderId == o.BidderId
+	case *pqueue.Ask:
+		ask, ok := job.(*pqueue.Ask)
+		return ok && ask.Id == o.Id && ask.AskerId == o.AskerId
+	}
+	return false
+}
+
+func TestFillBidOrderReservesFunds(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(100000, 2))
+	match.SetAccountService(accounts)
+
+	// a bid beyond the bidder's balance is rejected outright
+	_, err := match.FillBidOrder(pqueue.NewBid(999, 3000, artworkId, 200, price.New(1000, 2)))
+	if !errors.Is(err, account.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got %v", err)
+	}
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 40, price.New(800, 2))
+	match.AddAsk(ask)
+
+	// 100 × 10.00 reserved, 40 fill at 8.00 releasing 80.00 of improvement
+	bid := pqueue.NewBid(1000, 3000, artworkId, 100, price.New(1000, 2))
+	go match.FillBidOrder(bid)
+	drain(t, match, bid)
+
+	balance := accounts.Balance(3000, "USD")
+	if balance.Reserved.String() != "600.00" || balance.Available.String() != "80.00" {
+		t.Fatalf("Expected 600.00 reserved and 80.00 available, got %+v", balance)
+	}
+
+	if _, err := match.CancelBid(artworkId, bid.Id); err != nil {
+		t.Fatalf("failed to cancel bid: %v", err)
+	}
+	balance = accounts.Balance(3000, "USD")
+	if !balance.Reserved.IsZero() || balance.Available.String() != "680.00" {
+		t.Fatalf("Expected cancel to release the reservation, got %+v", balance)
+	}
+
+	if _, err := match.CancelBid(artworkId, bid.Id); err != ErrOrderNotFound {
+		t.Fatalf("Expected ErrOrderNotFound, got %v", err)
+	}
+}
+
+func TestFillAskOrderLocksHoldings(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 100)
+	match.SetHoldingsLedger(ledger)
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 80, price.New(800, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+
+	// the seller cannot list fractions already backing a resting ask
+	_, err := match.FillAskOrder(pqueue.NewAsk(2001, 4000, artworkId, 30, price.New(800, 2)))
+	if !errors.Is(err, holdings.ErrInsufficientHoldings) {
+		t.Fatalf("Expected ErrInsufficientHoldings, got %v", err)
+	}
+
+	bid := pqueue.NewBid(1000, 3000, artworkId, 50, price.New(1000, 2))
+	go match.FillBidOrder(bid)
+	drain(t, match, bid)
+
+	if pos := ledger.Position(4000, artworkId); pos.Available != 20 || pos.Locked != 30 {
+		t.Fatalf("Expected seller to have 20 available and 30 locked, got %+v", pos)
+	}
+	if pos := ledger.Position(3000, artworkId); pos.Available != 50 {
+		t.Fatalf("Expected buyer to receive 50 fractions, got %+v", pos)
+	}
+
+	if _, err := match.CancelAsk(artworkId, ask.Id); err != nil {
+		t.Fatalf("failed to cancel ask: %v", err)
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Available != 50 || pos.Locked != 0 {
+		t.Fatalf("Expected cancel to unlock the rest of the ask, got %+v", pos)
+	}
+}
+
+func TestExpireOrdersReleasesFundsAndHoldings(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	inst := instrument.Default
+	inst.ArtworkId = artworkId
+	inst.OrderTTL = 60
+	if err := match.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(10000, 2))
+	match.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 10)
+	match.SetHoldingsLedger(ledger)
+
+	bid := pqueue.NewBid(1000, 3000, artworkId, 10, price.New(500, 2))
+	go match.FillBidOrder(bid)
+	drain(t, match, bid)
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(900, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+
+	if expired, err := match.ExpireOrders(bid.PlacedAt.Add(59 * time.Second)); err != nil || len(expired) != 0 {
+		t.Fatalf("Expected nothing to expire before the TTL, got %v, %v", expired, err)
+	}
+
+	expired, err := match.ExpireOrders(ask.PlacedAt.Add(60 * time.Second))
+	if err != nil {
+		t.Fatalf("failed to expire orders: %v", err)
+	}
+	if len(expired) != 2 {
+		t.Fatalf("Expected both orders to expire, got %v", expired)
+	}
+
+	if balance := accounts.Balance(3000, "USD"); !balance.Reserved.IsZero() {
+		t.Fatalf("Expected expiry to release the bid's reservation, got %+v", balance)
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Available != 10 || pos.Locked != 0 {
+		t.Fatalf("Expected expiry to unlock the ask's fractions, got %+v", pos)
+	}
+	if _, err := match.CancelAsk(artworkId, ask.Id); err != ErrOrderNotFound {
+		t.Fatalf("Expected expired ask to leave the book, got %v", err)
+	}
+}
+
+func TestFailedFillReleasesBothOrders(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	// the ask rests without its fractions locked, so filling it fails
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 80, price.New(800, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(100000, 2))
+	match.SetAccountService(accounts)
+	match.SetHoldingsLedger(holdings.NewMemory())
+
+	bid := pqueue.NewBid(1000, 3000, artworkId, 50, price.New(1000, 2))
+	if _, err := match.FillBidOrder(bid); !errors.Is(err, holdings.ErrUnknownLock) {
+		t.Fatalf("Expected ErrUnknownLock, got %v", err)
+	}
+	if bid.QuantityRemaining() != 50 || ask.QuantityRemaining() != 80 {
+		t.Fatalf("Expected the failed fill to leave both orders unfilled, got %d and %d",
+			bid.QuantityRemaining(), ask.QuantityRemaining())
+	}
+	if balance := accounts.Balance(3000, "USD"); balance.Available.String() != "1000.00" || !balance.Reserved.IsZero() {
+		t.Fatalf("Expected the bid's funds to be released in full, got %+v", balance)
+	}
+	if _, err := match.CancelAsk(artworkId, ask.Id); err != ErrOrderNotFound {
+		t.Fatalf("Expected the ask that failed to fill to leave the book, got %v", err)
+	}
+}
+
+func TestBustFillRefundsAndRestoresAsk(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(100000, 2))
+	match.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 100)
+	match.SetHoldingsLedger(ledger)
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 80, price.New(800, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+	bid := pqueue.NewBid(1000, 3000, artworkId, 50, price.New(1000, 2))
+	go match.FillBidOrder(bid)
+	fills := drain(t, match, bid)
+	if len(fills) != 1 {
+		t.Fatalf("Expected one fill, got %v", fills)
+	}
+
+	restored, err := match.BustFill(fills[0], true)
+	if err != nil {
+		t.Fatalf("failed to bust fill: %v", err)
+	}
+	if len(restored) != 1 || restored[0] != ask {
+		t.Fatalf("Expected only the resting ask to be restored, got %v", restored)
+	}
+	if ask.QuantityRemaining() != 80 {
+		t.Fatalf("Expected the ask to rest with 80 again, got %d", ask.QuantityRemaining())
+	}
+
+	if balance := accounts.Balance(3000, "USD"); balance.Available.String() != "1000.00" || !balance.Reserved.IsZero() {
+		t.Fatalf("Expected the buyer to be refunded in full, got %+v", balance)
+	}
+	if pos := ledger.Position(3000, artworkId); pos.Available != 0 {
+		t.Fatalf("Expected the buyer to hand back the fractions, got %+v", pos)
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Available != 20 || pos.Locked != 80 {
+		t.Fatalf("Expected the restored ask to lock the fractions again, got %+v", pos)
+	}
+}
+
+// restingShare books a fill of qty at execPrice between a resting bid and
+// ask, as a pro-rata share leaves them both partly unfilled.
+func restingShare(t *testing.T, match *OrderMatchingEngine, bid *pqueue.Bid, ask *pqueue.Ask, execPrice price.Price, qty uint64) FillOrder {
+	t.Helper()
+	b := match.book(bid.ArtworkId)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := match.captureFunds(bid, execPrice, qty); err != nil {
+		t.Fatalf("failed to capture funds: %v", err)
+	}
+	if err := match.transferHoldings(bid, ask, qty); err != nil {
+		t.Fatalf("failed to transfer holdings: %v", err)
+	}
+	if err := bid.FillQuantity(qty); err != nil {
+		t.Fatalf("failed to fill bid: %v", err)
+	}
+	if err := ask.FillQuantity(qty); err != nil {
+		t.Fatalf("failed to fill ask: %v", err)
+	}
+	return FillOrder{
+		Id:             1,
+		BidId:          bid.Id,
+		AskId:          ask.Id,
+		ArtworkId:      bid.ArtworkId,
+		BuyerId:        bid.BidderId,
+		SellerId:       ask.AskerId,
+		Price:          execPrice,
+		Currency:       "USD",
+		QuantityFilled: qty,
+	}
+}
+
+func TestBustFillRestoresBothRestingOrders(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	inst := instrument.Default
+	inst.ArtworkId = artworkId
+	inst.Allocation = instrument.ALLOCATION_PRO_RATA
+	if err := match.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(10000, 2))
+	match.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 10)
+	match.SetHoldingsLedger(ledger)
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(1200, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+	bid := pqueue.NewBid(1000, 3000, artworkId, 10, price.New(1000, 2))
+	go match.FillBidOrder(bid)
+	drain(t, match, bid)
+
+	fill := restingShare(t, match, bid, ask, price.New(1000, 2), 4)
+	restored, err := match.BustFill(fill, true)
+	if err != nil {
+		t.Fatalf("failed to bust fill: %v", err)
+	}
+	if len(restored) != 2 || restored[0] != bid || restored[1] != ask {
+		t.Fatalf("Expected both resting orders to be restored, got %v", restored)
+	}
+	if bid.QuantityRemaining() != 10 || ask.QuantityRemaining() != 10 {
+		t.Fatalf("Expected both orders to rest with 10 again, got %d and %d", bid.QuantityRemaining(), ask.QuantityRemaining())
+	}
+	if balance := accounts.Balance(3000, "USD"); !balance.Available.IsZero() || balance.Reserved.String() != "100.00" {
+		t.Fatalf("Expected the restored bid to reserve the refund again, got %+v", balance)
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Available != 0 || pos.Locked != 10 {
+		t.Fatalf("Expected the restored ask to lock the fractions again, got %+v", pos)
+	}
+}
+
+func TestBustFillRestoresNeitherOrderWhenOneCannotBe(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(10000, 2))
+	match.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 10)
+	match.SetHoldingsLedger(ledger)
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(1200, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+	bid := pqueue.NewBid(1000, 3000, artworkId, 10, price.New(1000, 2))
+	go match.FillBidOrder(bid)
+	drain(t, match, bid)
+
+	// the buyer spends the 4.00 released by filling below the limit, so the
+	// 36.00 refunded cannot reserve the bid's 40.00 again
+	fill := restingShare(t, match, bid, ask, price.New(900, 2), 4)
+	if err := accounts.Charge(3000, price.New(400, 2), "USD"); err != nil {
+		t.Fatalf("failed to charge buyer: %v", err)
+	}
+
+	restored, err := match.BustFill(fill, true)
+	if !errors.Is(err, account.ErrInsufficientFunds) {
+		t.Fatalf("Expected the bid's restore to fail on funds, got %v", err)
+	}
+	if len(restored) != 0 {
+		t.Fatalf("Expected nothing restored, got %v", restored)
+	}
+	if bid.QuantityRemaining() != 6 || ask.QuantityRemaining() != 6 {
+		t.Fatalf("Expected both orders to rest with 6, got %d and %d", bid.QuantityRemaining(), ask.QuantityRemaining())
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Available != 4 || pos.Locked != 6 {
+		t.Fatalf("Expected the ask's restore to be taken back, got %+v", pos)
+	}
+}
+
+func TestHaltedBookReopensByUncrossing(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 20)
+	match.SetHoldingsLedger(ledger)
+
+	if _, err := match.SetTradingPhase(artworkId, TRADING_HALTED, "provenance dispute"); err != nil {
+		t.Fatalf("failed to halt: %v", err)
+	}
+
+	// while halted, crossing orders rest without matching
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(800, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+	bid := pqueue.NewBid(1000, 3000, artworkId, 6, price.New(1000, 2))
+	bid.PlacedAt = ask.PlacedAt.Add(time.Second)
+	go match.FillBidOrder(bid)
+	if fills := drain(t, match, bid); len(fills) != 0 {
+		t.Fatalf("Expected no fills while halted, got %v", fills)
+	}
+
+	if _, err := match.SetTradingPhase(artworkId, TRADING_CANCEL_ONLY, "provenance dispute"); err != nil {
+		t.Fatalf("failed to switch to cancel-only: %v", err)
+	}
+	_, err := match.FillAskOrder(pqueue.NewAsk(2001, 4000, artworkId, 10, price.New(800, 2)))
+	if !errors.Is(err, ErrTradingHalted) {
+		t.Fatalf("Expected ErrTradingHalted, got %v", err)
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Available != 10 || pos.Locked != 10 {
+		t.Fatalf("Expected the rejected ask to unlock its fractions, got %+v", pos)
+	}
+
+	type result struct {
+		fills []FillOrder
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		fills, err := match.SetTradingPhase(artworkId, TRADING_OPEN, "")
+		done <- result{fills, err}
+	}()
+	var res result
+	for waiting := true; waiting; {
+		select {
+		case <-match.Orders():
+		case <-match.Jobs():
+		case res = <-done:
+			waiting = false
+		case <-time.After(time.Second):
+			t.Fatalf("Book did not reopen")
+		}
+	}
+
+	if res.err != nil || len(res.fills) != 1 {
+		t.Fatalf("Expected one fill on reopening, got %v, %v", res.fills, res.err)
+	}
+	// the ask rested longer, so it sets the price
+	if fill := res.fills[0]; fill.QuantityFilled != 6 || fill.Price.String() != "8.00" || fill.TakerSide != SIDE_BID {
+		t.Fatalf("Expected 6 filled at 8.00 against the resting ask, got %+v", fill)
+	}
+	if ask.QuantityRemaining() != 4 || bid.QuantityRemaining() != 0 {
+		t.Fatalf("Expected 4 left on the ask and the bid complete, got %d and %d", ask.QuantityRemaining(), bid.QuantityRemaining())
+	}
+	if status := match.TradingStatus(artworkId); status.Phase != TRADING_OPEN {
+		t.Fatalf("Expected the book to be open, got %s", PhaseName(status.Phase))
+	}
+}
+
+func TestClearingPrice(t *testing.T) {
+	bids := pqueue.BidPriorityQueue{
+		pqueue.NewBid(1, 10, 0, 10, price.New(10500, 2)),
+		pqueue.NewBid(2, 10, 0, 5, price.New(10000, 2)),
+	}
+	asks := pqueue.AskPriorityQueue{
+		pqueue.NewAsk(3, 20, 0, 8, price.New(9800, 2)),
+		pqueue.NewAsk(4, 20, 0, 6, price.New(10200, 2)),
+	}
+
+	// 102.00 and 105.00 both trade 10 leaving 4 unmatched
+	clearing, volume := clearingPrice(bids, asks, price.Price{}, false)
+	if volume != 10 || clearing.String() != "102.00" {
+		t.Errorf("Expected 10 at the lower price 102.00, got %d at %s", volume, clearing)
+	}
+	clearing, volume = clearingPrice(bids, asks, price.New(10400, 2), true)
+	if volume != 10 || clearing.String() != "105.00" {
+		t.Errorf("Expected 10 at 105.00 nearest the reference, got %d at %s", volume, clearing)
+	}
+	if _, volume := clearingPrice(bids[1:], asks[1:], price.Price{}, false); volume != 0 {
+		t.Errorf("Expected an uncrossed book not to clear, got %d", volume)
+	}
+}
+
+func TestPriceBandHaltsAndReopensWithAuction(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	inst := instrument.Default
+	inst.ArtworkId = artworkId
+	inst.PriceBandBps = 1000
+	inst.HaltSeconds = 1
+	if err := match.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+	var statuses []TradingStatus
+	var statusesMu sync.Mutex
+	match.SetTradingListener(func(_ uint64, status TradingStatus) {
+		statusesMu.Lock()
+		defer statusesMu.Unlock()
+		statuses = append(statuses, status)
+	})
+
+	ask := pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(10000, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+	bid := pqueue.NewBid(1000, 3000, artworkId, 5, price.New(10000, 2))
+	go match.FillBidOrder(bid)
+	drain(t, match, bid)
+
+	// 120.00 is outside 10% of the last trade at 100.00
+	ask = pqueue.NewAsk(2001, 4000, artworkId, 5, price.New(12000, 2))
+	go match.FillAskOrder(ask)
+	drain(t, match, ask)
+	bid = pqueue.NewBid(1001, 3000, artworkId, 10, price.New(12500, 2))
+	go match.FillBidOrder(bid)
+	if fills := drain(t, match, bid); len(fills) != 1 || fills[0].Price.String() != "100.00" {
+		t.Fatalf("Expected only the fill within the band, got %v", fills)
+	}
+	status := match.TradingStatus(artworkId)
+	if status.Phase != TRADING_HALTED || status.ReopensAt.IsZero() {
+		t.Fatalf("Expected a volatility halt, got %+v", status)
+	}
+
+	late := pqueue.NewBid(1002, 3001, artworkId, 5, price.New(11000, 2))
+	go match.FillBidOrder(late)
+	if fills := drain(t, match, late); len(fills) != 0 {
+		t.Fatalf("Expected no fills while halted, got %v", fills)
+	}
+
+	var auctioned FillOrder
+	for auctioned.Id == 0 {
+		select {
+		case auctioned = <-match.Orders():
+		case <-match.Jobs():
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Artwork did not reopen")
+		}
+	}
+	// both 120.00 and 125.00 clear 5; 120.00 is nearer the last trade
+	if auctioned.Price.String() != "120.00" || auctioned.QuantityFilled != 5 || auctioned.BidId != bid.Id {
+		t.Fatalf("Expected the auction to fill 5 at 120.00, got %+v", auctioned)
+	}
+	if status := match.TradingStatus(artworkId); status.Phase != TRADING_OPEN {
+		t.Fatalf("Expected the artwork to reopen, got %+v", status)
+	}
+
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+	if len(statuses) != 2 || statuses[0].Phase != TRADING_HALTED || statuses[1].Phase != TRADING_OPEN {
+		t.Errorf("Expected the listener to see the halt and reopening, got %+v", statuses)
+	}
+	if halts := bandHalts.Get("0"); halts == nil || halts.String() != "1" {
+		t.Errorf("Expected one band halt counted, got %v", halts)
+	}
+}
+
+func TestCallAuctionClearsAtSinglePrice(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	var last TradingStatus
+	match.SetTradingListener(func(_ uint64, status TradingStatus) {
+		last = status
+	})
+	if _, err := match.SetTradingPhase(artworkId, TRADING_AUCTION, "listing"); err != nil {
+		t.Fatalf("failed to start auction: %v", err)
+	}
+
+	orders := []BidAsk{
+		pqueue.NewBid(1, 10, artworkId, 10, price.New(10500, 2)),
+		pqueue.NewBid(2, 11, artworkId, 5, price.New(10000, 2)),
+		pqueue.NewAsk(3, 20, artworkId, 8, price.New(9800, 2)),
+		pqueue.NewAsk(4, 21, artworkId, 6, price.New(10200, 2)),
+	}
+	for _, order := range orders {
+		switch ord := order.(type) {
+		case *pqueue.Bid:
+			go match.FillBidOrder(ord)
+		case *pqueue.Ask:
+			go match.FillAskOrder(ord)
+		}
+		if fills := drain(t, match, order); len(fills) != 0 {
+			t.Fatalf("Expected no fills during the auction, got %v", fills)
+		}
+	}
+	if last.IndicativePrice.String() != "102.00" || last.IndicativeVolume != 10 {
+		t.Fatalf("Expected 10 indicated at 102.00, got %+v", last)
+	}
+
+	type result struct {
+		fills []FillOrder
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		fills, err := match.SetTradingPhase(artworkId, TRADING_OPEN, "")
+		done <- result{fills, err}
+	}()
+	var res result
+	for waiting := true; waiting; {
+		select {
+		case <-match.Orders():
+		case <-match.Jobs():
+		case res = <-done:
+			waiting = false
+		case <-time.After(time.Second):
+			t.Fatalf("Auction did not close")
+		}
+	}
+
+	var volume uint64
+	for _, fill := range res.fills {
+		if fill.Price.String() != "102.00" {
+			t.Errorf("Expected every fill at the clearing price, got %+v", fill)
+		}
+		volume += fill.QuantityFilled
+	}
+	if res.err != nil || volume != 10 {
+		t.Fatalf("Expected 10 to clear, got %d (%v)", volume, res.err)
+	}
+	if orders[1].(*pqueue.Bid).QuantityRemaining() != 5 || orders[3].(*pqueue.Ask).QuantityRemaining() != 4 {
+		t.Errorf("Expected the bid below and the rest of the ask at the clearing price to keep resting")
+	}
+}
+
+func TestBatchMatchingClearsPeriodically(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	inst := instrument.Default
+	inst.ArtworkId = artworkId
+	inst.MatchingMode = instrument.MATCHING_BATCH
+	inst.BatchInterval = 50
+	if err := match.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+
+	orders := []BidAsk{
+		pqueue.NewAsk(1, 20, artworkId, 5, price.New(9000, 2)),
+		pqueue.NewAsk(2, 21, artworkId, 5, price.New(10000, 2)),
+		pqueue.NewBid(3, 10, artworkId, 8, price.New(11000, 2)),
+	}
+	for _, order := range orders {
+		switch ord := order.(type) {
+		case *pqueue.Bid:
+			go match.FillBidOrder(ord)
+		case *pqueue.Ask:
+			go match.FillAskOrder(ord)
+		}
+		if fills := drain(t, match, order); len(fills) != 0 {
+			t.Fatalf("Expected orders to wait for the batch, got %v", fills)
+		}
+	}
+
+	// 100.00 and 110.00 both clear 8; the lower wins without a reference
+	var volume uint64
+	for volume < 8 {
+		select {
+		case fill := <-match.Orders():
+			if fill.Price.String() != "100.00" {
+				t.Fatalf("Expected the batch to clear at 100.00, got %+v", fill)
+			}
+			volume += fill.QuantityFilled
+		case <-match.Jobs():
+		case <-time.After(time.Second):
+			t.Fatalf("Batch did not clear, %d filled", volume)
+		}
+	}
+
+	inst.MatchingMode = instrument.MATCHING_CONTINUOUS
+	if err := match.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+	bid := pqueue.NewBid(4, 11, artworkId, 2, price.New(10000, 2))
+	go match.FillBidOrder(bid)
+	if fills := drain(t, match, bid); len(fills) != 1 || fills[0].QuantityFilled != 2 {
+		t.Fatalf("Expected continuous matching to resume, got %v", fills)
+	}
+}
+
+func TestAllocationNeverExceedsIncoming(t *testing.T) {
+	for _, policy := range []MatchingPolicy{PriceTime{}, ProRata{}} {
+		property := func(incoming uint32, sizes []uint32, lot uint8) bool {
+			resting := make([]uint64, len(sizes))
+			var total uint64
+			for i, size := range sizes {
+				resting[i] = uint64(size)
+				total += uint64(size)
+			}
+
+			allocations := policy.Allocate(uint64(incoming), resting, uint64(lot))
+			if len(allocations) != len(resting) {
+				return false
+			}
+			var allocated uint64
+			for i, allocation := range allocations {
+				if allocation > resting[i] {
+					return false
+				}
+				allocated += allocation
+			}
+			// the whole level trades, or the whole incoming order
+			return allocated == minQuantity(uint64(incoming), total)
+		}
+		if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+			t.Errorf("%T: %v", policy, err)
+		}
+	}
+}
+
+func TestProRataRounding(t *testing.T) {
+	tests := []struct {
+		incoming uint64
+		resting  []uint64
+		lot      uint64
+		expected []uint64
+	}{
+		{50, []uint64{10, 30, 60}, 1, []uint64{5, 15, 30}},
+		// 1.67, 3.33 and 5 round down, leaving one for the earliest order
+		{10, []uint64{5, 10, 15}, 1, []uint64{2, 3, 5}},
+		// shares of 2, 2 and 2 leave nothing over
+		{6, []uint64{4, 4, 4}, 1, []uint64{2, 2, 2}},
+		// shares round down to lots of 5, the rest going in time priority
+		{20, []uint64{10, 10, 10}, 5, []uint64{10, 5, 5}},
+		{7, []uint64{100, 1}, 1, []uint64{7, 0}},
+		{200, []uint64{10, 30}, 1, []uint64{10, 30}},
+	}
+	for _, test := range tests {
+		allocations := ProRata{}.Allocate(test.incoming, test.resting, test.lot)
+		if len(allocations) != len(test.expected) {
+			t.Fatalf("Allocate(%d, %v, %d) = %v, expected %v", test.incoming, test.resting, test.lot, allocations, test.expected)
+		}
+		for i := range allocations {
+			if allocations[i] != test.expected[i] {
+				t.Fatalf("Allocate(%d, %v, %d) = %v, expected %v", test.incoming, test.resting, test.lot, allocations, test.expected)
+			}
+		}
+	}
+}
+
+func TestFillBidOrderProRata(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	inst := instrument.Default
+	inst.ArtworkId = artworkId
+	inst.Allocation = instrument.ALLOCATION_PRO_RATA
+	if err := match.SetInstrument(inst); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+
+	asks := []*pqueue.Ask{
+		pqueue.NewAsk(1, 20, artworkId, 10, price.New(10000, 2)),
+		pqueue.NewAsk(2, 21, artworkId, 30, price.New(10000, 2)),
+		pqueue.NewAsk(3, 22, artworkId, 60, price.New(10000, 2)),
+		pqueue.NewAsk(4, 23, artworkId, 10, price.New(9900, 2)),
+	}
+	for _, ask := range asks {
+		go match.FillAskOrder(ask)
+		drain(t, match, ask)
+	}
+
+	// the better priced ask fills first, then the 100.00 level shares the
+	// remaining 50 in proportion to its asks
+	bid := pqueue.NewBid(5, 10, artworkId, 60, price.New(10000, 2))
+	go match.FillBidOrder(bid)
+	fills := drain(t, match, bid)
+
+	expected := map[uint64]uint64{4: 10, 1: 5, 2: 15, 3: 30}
+	if len(fills) != len(expected) {
+		t.Fatalf("Expected %d fills, got %v", len(expected), fills)
+	}
+	for _, fill := range fills {
+		if fill.QuantityFilled != expected[fill.AskId] {
+			t.Errorf("Expected ask %d to fill %d, got %d", fill.AskId, expected[fill.AskId], fill.QuantityFilled)
+		}
+	}
+	if fills[0].AskId != 4 {
+		t.Errorf("Expected the better priced ask to fill first, got %v", fills)
+	}
+	if bid.QuantityRemaining() != 0 {
+		t.Errorf("Expected the bid to complete, %d remaining", bid.QuantityRemaining())
+	}
+}
+
 type ExpectedJob struct {
-	id             uint32
-	quantity       uint32
-	price          uint32
-	quantityFilled uint32
+	id             uint64
+	quantity       uint64
+	price          uint64
+	quantityFilled uint64
 }
 
 func TestFillBidOrderAskPartiallyUnfilled(t *testing.T) {
-	artworkId := uint32(0)
+	artworkId := uint64(0)
 
 	match := SetupServerOneArtwork(artworkId)
 
@@ -112,7 +992,7 @@ func TestFillBidOrderAskPartiallyUnfilled(t *testing.T) {
 		3000,
 		artworkId,
 		100,
-		10,
+		price.New(10, 0),
 	)
 
 	ask0 := pqueue.NewAsk(
@@ -120,7 +1000,7 @@ func TestFillBidOrderAskPartiallyUnfilled(t *testing.T) {
 		4000,
 		artworkId,
 		50,
-		8,
+		price.New(8, 0),
 	)
 
 	ask1 := pqueue.NewAsk(
@@ -128,7 +1008,7 @@ func TestFillBidOrderAskPartiallyUnfilled(t *testing.T) {
 		4001,
 		artworkId,
 		20,
-		9,
+		price.New(9, 0),
 	)
 
 	ask2 := pqueue.NewAsk(
@@ -136,7 +1016,7 @@ func TestFillBidOrderAskPartiallyUnfilled(t *testing.T) {
 		4002,
 		artworkId,
 		100,
-		10,
+		price.New(10, 0),
 	)
 
 	match.AddAsk(ask0)
@@ -169,7 +1049,7 @@ func TestFillBidOrderAskPartiallyUnfilled(t *testing.T) {
 }
 
 func TestFillAskOrderHigherAndLowerBids(t *testing.T) {
-	artworkId := uint32(0)
+	artworkId := uint64(0)
 
 	match := SetupServerOneArtwork(artworkId)
 
@@ -178,7 +1058,7 @@ func TestFillAskOrderHigherAndLowerBids(t *testing.T) {
 		3000,
 		artworkId,
 		100,
-		10,
+		price.New(10, 0),
 	)
 
 	bid0 := pqueue.NewBid(
@@ -186,7 +1066,7 @@ func TestFillAskOrderHigherAndLowerBids(t *testing.T) {
 		4000,
 		artworkId,
 		50,
-		10,
+		price.New(10, 0),
 	)
 
 	bid1 := pqueue.NewBid(
@@ -194,7 +1074,7 @@ func TestFillAskOrderHigherAndLowerBids(t *testing.T) {
 		4001,
 		artworkId,
 		30,
-		12,
+		price.New(12, 0),
 	)
 
 	bid2 := pqueue.NewBid(
@@ -202,7 +1082,7 @@ func TestFillAskOrderHigherAndLowerBids(t *testing.T) {
 		4002,
 		artworkId,
 		20,
-		9,
+		price.New(9, 0),
 	)
 
 	match.AddBid(bid0)
@@ -405,3 +1285,167 @@ func TestFillAskOrderHigherAndLowerBids(t *testing.T) {
 // 	}
 
 // }
+
+func TestMassCancelByUser(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	ledger := holdings.NewMemory()
+	ledger.Credit(4000, artworkId, 10)
+	match.SetHoldingsLedger(ledger)
+
+	orders := []BidAsk{
+		pqueue.NewBid(1000, 3000, artworkId, 10, price.New(500, 2)),
+		pqueue.NewBid(1001, 3001, artworkId, 10, price.New(400, 2)),
+		pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(900, 2)),
+	}
+	for _, order := range orders {
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			go match.FillBidOrder(o)
+		case *pqueue.Ask:
+			go match.FillAskOrder(o)
+		}
+		drain(t, match, order)
+	}
+
+	if _, err := match.MassCancel(nil, []uint64{7}); !errors.Is(err, ErrArtworkNotListed) {
+		t.Fatalf("Expected an unlisted artwork to be refused, got %v", err)
+	}
+	cancelled, err := match.MassCancel([]uint64{3000, 4000}, nil)
+	if err != nil {
+		t.Fatalf("failed to mass cancel: %v", err)
+	}
+	if len(cancelled) != 2 || cancelled[0] != orders[0] || cancelled[1] != orders[2] {
+		t.Fatalf("Expected users 3000 and 4000's orders to be cancelled, got %v", cancelled)
+	}
+	if pos := ledger.Position(4000, artworkId); pos.Locked != 0 {
+		t.Fatalf("Expected the ask's fractions to be unlocked, got %+v", pos)
+	}
+
+	if cancelled, err := match.MassCancel(nil, nil); err != nil || len(cancelled) != 1 || cancelled[0] != orders[1] {
+		t.Fatalf("Expected the rest of the book to be cancelled, got %v, %v", cancelled, err)
+	}
+}
+
+func TestCancelUserBidPicksTheUsersOrder(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+
+	first := pqueue.NewBid(1000, 3000, artworkId, 10, price.New(500, 2))
+	second := pqueue.NewBid(1000, 3001, artworkId, 10, price.New(400, 2))
+	for _, bid := range []*pqueue.Bid{first, second} {
+		go match.FillBidOrder(bid)
+		drain(t, match, bid)
+	}
+
+	if _, err := match.CancelUserBid(artworkId, 1000, 3002); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("Expected another user's cancel to be refused, got %v", err)
+	}
+	cancelled, err := match.CancelUserBid(artworkId, 1000, 3001)
+	if err != nil || cancelled != second {
+		t.Fatalf("Expected user 3001's bid to be cancelled, got %v, %v", cancelled, err)
+	}
+	if resting, err := match.MassCancel(nil, nil); err != nil || len(resting) != 1 || resting[0] != first {
+		t.Fatalf("Expected user 3000's bid to keep resting, got %v, %v", resting, err)
+	}
+}
+
+func TestPeggedOrdersTrackTheBook(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+
+	midpoint := pqueue.NewAsk(2001, 4001, artworkId, 10, price.Price{})
+	midpoint.Peg = &pqueue.Peg{Type: pqueue.PEG_MIDPOINT, Offset: price.New(1, 2)}
+	if _, err := match.FillAskOrder(midpoint); !errors.Is(err, ErrNoPegReference) {
+		t.Fatalf("Expected a midpoint peg on an empty book to be refused, got %v", err)
+	}
+
+	orders := []BidAsk{
+		pqueue.NewBid(1000, 3000, artworkId, 10, price.New(500, 2)),
+		pqueue.NewAsk(2000, 4000, artworkId, 10, price.New(900, 2)),
+	}
+	primary := pqueue.NewBid(1001, 3001, artworkId, 10, price.Price{})
+	primary.Peg = &pqueue.Peg{Type: pqueue.PEG_PRIMARY, Cap: price.New(800, 2)}
+	orders = append(orders, primary, midpoint)
+	for _, order := range orders {
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			go match.FillBidOrder(o)
+		case *pqueue.Ask:
+			go match.FillAskOrder(o)
+		}
+		drain(t, match, order)
+	}
+	if primary.Price.String() != "5.00" || midpoint.Price.String() != "7.01" {
+		t.Fatalf("Expected the pegs at 5.00 and 7.01, got %s and %s", primary.Price, midpoint.Price)
+	}
+
+	// a better bid moves both pegs
+	better := pqueue.NewBid(1002, 3002, artworkId, 10, price.New(600, 2))
+	go match.FillBidOrder(better)
+	drain(t, match, better)
+	if primary.Price.String() != "6.00" || midpoint.Price.String() != "7.51" {
+		t.Fatalf("Expected the pegs at 6.00 and 7.51, got %s and %s", primary.Price, midpoint.Price)
+	}
+
+	// a market peg takes the best ask that is not pegged, so it crosses the
+	// midpoint ask resting below it
+	market := pqueue.NewBid(1003, 3003, artworkId, 4, price.Price{})
+	market.Peg = &pqueue.Peg{Type: pqueue.PEG_MARKET, Cap: price.New(950, 2)}
+	go match.FillBidOrder(market)
+	fills := drain(t, match, market)
+	if len(fills) != 1 || fills[0].AskId != 2001 || fills[0].Price.String() != "7.51" || fills[0].QuantityFilled != 4 {
+		t.Fatalf("Expected the market peg to fill 4 against the midpoint ask at 7.51, got %+v", fills)
+	}
+}
+
+func TestPeggedBidNeedsCapToReserveFunds(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+	accounts := account.NewMemory()
+	accounts.Deposit(3000, "USD", price.New(100000, 2))
+	match.SetAccountService(accounts)
+
+	bid := pqueue.NewBid(1000, 3000, artworkId, 10, price.Price{})
+	bid.Peg = &pqueue.Peg{Type: pqueue.PEG_PRIMARY}
+	var ruleErr *instrument.RuleError
+	if _, err := match.FillBidOrder(bid); !errors.As(err, &ruleErr) || ruleErr.Violations[0].Field != "peg.cap" {
+		t.Fatalf("Expected an uncapped pegged bid to be refused, got %v", err)
+	}
+}
+
+func TestListingArtworksWhileMatching(t *testing.T) {
+	artworkId := uint64(0)
+
+	match := SetupServerOneArtwork(artworkId)
+
+	// books opened at runtime must not race with matching on the others;
+	// run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := uint64(1); id <= 100; id++ {
+			inst := instrument.Default
+			inst.ArtworkId = id
+			if err := match.SetInstrument(inst); err != nil {
+				t.Errorf("failed to list artwork %d: %v", id, err)
+			}
+		}
+	}()
+
+	for i := uint64(0); i < 20; i++ {
+		ask := pqueue.NewAsk(2000+i, 4000, artworkId, 1, price.New(500, 2))
+		go match.FillAskOrder(ask)
+		drain(t, match, ask)
+		bid := pqueue.NewBid(1000+i, 3000, artworkId, 1, price.New(500, 2))
+		go match.FillBidOrder(bid)
+		if fills := drain(t, match, bid); len(fills) != 1 {
+			t.Fatalf("Expected bid %d to fill, got %v", bid.Id, fills)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,211 @@
+package match
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// ErrNoPegReference is returned for a pegged order placed when the book has
+// no price for it to track.
+var ErrNoPegReference = errors.New("no price to peg to")
+
+// the best prices of the orders that are not pegged, which pegged orders
+// track; pegged orders tracking each other could walk the book away
+type top struct {
+	bid, ask       price.Price
+	hasBid, hasAsk bool
+}
+
+func bookTop(bids pqueue.BidPriorityQueue, asks pqueue.AskPriorityQueue) top {
+	var t top
+	for _, bid := range bids {
+		if bid.Peg == nil && (!t.hasBid || bid.Price.Cmp(t.bid) > 0) {
+			t.bid, t.hasBid = bid.Price, true
+		}
+	}
+	for _, ask := range asks {
+		if ask.Peg == nil && (!t.hasAsk || ask.Price.Cmp(t.ask) < 0) {
+			t.ask, t.hasAsk = ask.Price, true
+		}
+	}
+	return t
+}
+
+// checkOrder returns a *RuleError if the order breaks its instrument's
+// rules. A pegged order's price is set by the book, so its peg and cap are
+// checked instead.
+func checkOrder(inst instrument.Instrument, quantity uint64, limit price.Price, peg *pqueue.Peg) error {
+	if peg == nil {
+		return inst.CheckOrder(quantity, limit)
+	}
+
+	var violations []instrument.Violation
+	limit = peg.Cap
+	if limit.IsZero() {
+		limit = inst.Price(inst.MinPrice)
+	}
+	var ruleErr *instrument.RuleError
+	if err := inst.CheckOrder(quantity, limit); errors.As(err, &ruleErr) {
+		for _, v := range ruleErr.Violations {
+			if v.Field == "price" {
+				v.Field = "peg.cap"
+			}
+			violations = append(violations, v)
+		}
+	}
+	if peg.Type > pqueue.PEG_MIDPOINT {
+		violations = append(violations, instrument.Violation{
+			Field:       "peg.type",
+			Description: fmt.Sprintf("unknown peg type %d", peg.Type),
+		})
+	}
+	if offset, err := peg.Offset.Rescale(inst.PriceScale); err != nil || offset.Units%inst.TickSize != 0 {
+		violations = append(violations, instrument.Violation{
+			Field:       "peg.offset",
+			Description: fmt.Sprintf("offset %s is not a multiple of tick size %s", peg.Offset, inst.Price(inst.TickSize)),
+		})
+	}
+
+	if len(violations) > 0 {
+		return &instrument.RuleError{ArtworkId: inst.ArtworkId, Violations: violations}
+	}
+	return nil
+}
+
+// pegPrice returns the price a pegged order on side takes with the book's
+// top at t, or false if the book has no price for it to track. Bids round
+// down to the tick and asks up, and neither goes past its cap.
+func pegPrice(inst instrument.Instrument, t top, side uint32, peg pqueue.Peg) (price.Price, bool) {
+	scaled := func(p price.Price) uint64 {
+		// book prices and checked offsets are all quotable at the scale
+		p, _ = p.Rescale(inst.PriceScale)
+		return p.Units
+	}
+
+	own, hasOwn, other, hasOther := t.bid, t.hasBid, t.ask, t.hasAsk
+	if side == SIDE_ASK {
+		own, hasOwn, other, hasOther = t.ask, t.hasAsk, t.bid, t.hasBid
+	}
+
+	var ref, odd uint64
+	switch {
+	case peg.Type == pqueue.PEG_PRIMARY && hasOwn:
+		ref = scaled(own)
+	case peg.Type == pqueue.PEG_MARKET && hasOther:
+		ref = scaled(other)
+	case peg.Type == pqueue.PEG_MIDPOINT && t.hasBid && t.hasAsk:
+		bid, ask := scaled(t.bid), scaled(t.ask)
+		ref, odd = bid/2+ask/2+bid&ask&1, (bid^ask)&1
+	default:
+		return price.Price{}, false
+	}
+	offset, tick := scaled(peg.Offset), inst.TickSize
+
+	var units uint64
+	if side == SIDE_BID {
+		units = inst.MinPrice
+		if ref >= offset && ref-offset > units {
+			units = ref - offset
+		}
+		units -= units % tick
+		if units < inst.MinPrice {
+			units += tick
+		}
+		if !peg.Cap.IsZero() && units > scaled(peg.Cap) {
+			units = scaled(peg.Cap)
+		}
+	} else {
+		// half a unit above a midpoint rounds up to the next
+		units = ref + odd + offset
+		if units < ref {
+			return price.Price{}, false
+		}
+		if rem := units % tick; rem != 0 {
+			if units+tick-rem < units {
+				return price.Price{}, false
+			}
+			units += tick - rem
+		}
+		if units < scaled(peg.Cap) {
+			units = scaled(peg.Cap)
+		}
+	}
+	return inst.Price(units), true
+}
+
+// pegBid prices a pegged bid off the book before it is matched.
+func (b *book) pegBid(inst instrument.Instrument, bid *pqueue.Bid) error {
+	t := bookTop(*b.bids.pqueue, *b.asks.pqueue)
+	p, ok := pegPrice(inst, t, SIDE_BID, *bid.Peg)
+	if !ok {
+		return fmt.Errorf("%w: artwork %d has no %s price for bid %d", ErrNoPegReference, inst.ArtworkId, pqueue.PegName(bid.Peg.Type), bid.Id)
+	}
+	bid.Price = p
+	return nil
+}
+
+// pegAsk prices a pegged ask off the book before it is matched.
+func (b *book) pegAsk(inst instrument.Instrument, ask *pqueue.Ask) error {
+	t := bookTop(*b.bids.pqueue, *b.asks.pqueue)
+	p, ok := pegPrice(inst, t, SIDE_ASK, *ask.Peg)
+	if !ok {
+		return fmt.Errorf("%w: artwork %d has no %s price for ask %d", ErrNoPegReference, inst.ArtworkId, pqueue.PegName(ask.Peg.Type), ask.Id)
+	}
+	ask.Price = p
+	return nil
+}
+
+// repeg reprices the artwork's resting pegged orders after its book has
+// changed, and matches those that became marketable. A pegged order whose
+// price has gone from the book keeps its last price. The caller holds b.mu.
+func (ome *OrderMatchingEngine) repeg(b *book, inst instrument.Instrument) error {
+	bids, asks := b.bids.pqueue, b.asks.pqueue
+
+	for {
+		t := bookTop(*bids, *asks)
+		moved := false
+		for _, bid := range *bids {
+			if bid.Peg == nil {
+				continue
+			}
+			if p, ok := pegPrice(inst, t, SIDE_BID, *bid.Peg); ok && p.Cmp(bid.Price) != 0 {
+				bid.Price, moved = p, true
+			}
+		}
+		for _, ask := range *asks {
+			if ask.Peg == nil {
+				continue
+			}
+			if p, ok := pegPrice(inst, t, SIDE_ASK, *ask.Peg); ok && p.Cmp(ask.Price) != 0 {
+				ask.Price, moved = p, true
+			}
+		}
+		if !moved {
+			return nil
+		}
+		heap.Init(bids)
+		heap.Init(asks)
+		ome.updateIndicative(b)
+
+		matching, _ := b.checkTrading(inst)
+		if !matching || bids.Len() == 0 || asks.Len() == 0 || asks.Peek().Price.Cmp(bids.Peek().Price) > 0 {
+			return nil
+		}
+		// the earlier order sets the price, as when the book is reopened
+		execPrice := asks.Peek().Price
+		if bids.Peek().PlacedAt.Before(asks.Peek().PlacedAt) {
+			execPrice = bids.Peek().Price
+		}
+		if ome.breaksBand(b, inst, execPrice) {
+			return nil
+		}
+		if _, err := ome.uncross(b, inst); err != nil {
+			return err
+		}
+	}
+}
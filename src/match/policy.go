@@ -0,0 +1,80 @@
+package match
+
+import (
+	"math/bits"
+
+	"fractr-marketplace-secondary/instrument"
+)
+
+// MatchingPolicy shares an incoming order among the orders resting at the
+// best price. Price always decides which level trades first; the policy only
+// decides who trades within the level.
+type MatchingPolicy interface {
+	// Allocate splits incoming among resting, the remaining quantities of
+	// the level's orders in time priority, and returns how much each fills.
+	// No order is given more than it has resting, and the allocations never
+	// add up to more than incoming. Shares are rounded to multiples of lot
+	// where the policy rounds at all.
+	Allocate(incoming uint64, resting []uint64, lot uint64) []uint64
+}
+
+// PriceTime fills the earliest order at the level first.
+type PriceTime struct{}
+
+func (PriceTime) Allocate(incoming uint64, resting []uint64, lot uint64) []uint64 {
+	allocations := make([]uint64, len(resting))
+	for i, size := range resting {
+		allocations[i] = minQuantity(incoming, size)
+		incoming -= allocations[i]
+	}
+	return allocations
+}
+
+// ProRata fills every order at the level in proportion to its resting size,
+// rounding each share down to a whole lot. What rounding leaves over goes a
+// lot at a time to the orders in time priority.
+type ProRata struct{}
+
+func (ProRata) Allocate(incoming uint64, resting []uint64, lot uint64) []uint64 {
+	if lot == 0 {
+		lot = 1
+	}
+	var total, carry uint64
+	for _, size := range resting {
+		total, carry = bits.Add64(total, size, 0)
+		if carry != 0 {
+			// a level this deep cannot be shared out in 64 bits
+			return PriceTime{}.Allocate(incoming, resting, lot)
+		}
+	}
+	allocations := make([]uint64, len(resting))
+	if incoming >= total {
+		copy(allocations, resting)
+		return allocations
+	}
+
+	left := incoming
+	for i, size := range resting {
+		// incoming < total, so the quotient fits in 64 bits
+		hi, lo := bits.Mul64(incoming, size)
+		share, _ := bits.Div64(hi, lo, total)
+		allocations[i] = share - share%lot
+		left -= allocations[i]
+	}
+	for left > 0 {
+		for i, size := range resting {
+			extra := minQuantity(minQuantity(lot, size-allocations[i]), left)
+			allocations[i] += extra
+			left -= extra
+		}
+	}
+	return allocations
+}
+
+// policy returns the artwork's matching policy.
+func policy(inst instrument.Instrument) MatchingPolicy {
+	if inst.Allocation == instrument.ALLOCATION_PRO_RATA {
+		return ProRata{}
+	}
+	return PriceTime{}
+}
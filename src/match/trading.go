@@ -0,0 +1,250 @@
+package match
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/price"
+)
+
+// trading phases of an artwork's book
+const (
+	TRADING_OPEN = iota
+	// new orders rest on the book without matching until trading resumes
+	TRADING_HALTED
+	// new orders are rejected; resting orders can still be cancelled
+	TRADING_CANCEL_ONLY
+	// orders accumulate without matching and fill at a single clearing
+	// price when the call auction closes
+	TRADING_AUCTION
+)
+
+var phaseNames = map[uint32]string{
+	TRADING_OPEN:        "OPEN",
+	TRADING_HALTED:      "HALTED",
+	TRADING_CANCEL_ONLY: "CANCEL_ONLY",
+	TRADING_AUCTION:     "AUCTION",
+}
+
+func PhaseName(phase uint32) string {
+	if name, ok := phaseNames[phase]; ok {
+		return name
+	}
+	return fmt.Sprintf("Phase(%d)", phase)
+}
+
+// ParsePhase returns the phase named name, ignoring case.
+func ParsePhase(name string) (uint32, error) {
+	for phase, phaseName := range phaseNames {
+		if strings.EqualFold(name, phaseName) {
+			return phase, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown trading phase %q", name)
+}
+
+var (
+	ErrTradingHalted    = errors.New("trading is halted")
+	ErrArtworkNotListed = errors.New("artwork is not listed")
+)
+
+type TradingStatus struct {
+	Phase  uint32    `json:"phase"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	// ReopensAt is when a halt tripped by the price band or a timed call
+	// auction ends, with the book filling at a single clearing price.
+	ReopensAt time.Time `json:"reopens_at"`
+	// the price and volume a call auction would clear if it closed now
+	IndicativePrice  price.Price `json:"indicative_price"`
+	IndicativeVolume uint64      `json:"indicative_volume"`
+}
+
+// SetTradingListener makes the engine call listener whenever an artwork's
+// trading status changes, including halts tripped by its price band. It is
+// called with the artwork's book locked, so it must not call back into the
+// engine. Like SetFeeSchedule, it must be called before orders are placed.
+func (ome *OrderMatchingEngine) SetTradingListener(listener func(artworkId uint64, status TradingStatus)) {
+	ome.tradingListener = listener
+}
+
+// TradingStatus returns the artwork's trading phase. Artworks without a
+// book are reported open, as their book opens with the first order.
+func (ome *OrderMatchingEngine) TradingStatus(artworkId uint64) TradingStatus {
+	b := ome.book(artworkId)
+	if b == nil {
+		return TradingStatus{Phase: TRADING_OPEN}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.trading
+}
+
+// SetTradingPhase moves the artwork's book to phase. Reopening a book
+// matches the orders left crossed by those placed while it was halted and
+// returns the fills: a call auction fills them at its clearing price, and
+// otherwise each fill is priced by the order that rested longer.
+func (ome *OrderMatchingEngine) SetTradingPhase(artworkId uint64, phase uint32, reason string) ([]FillOrder, error) {
+	if _, ok := phaseNames[phase]; !ok {
+		return nil, fmt.Errorf("unknown trading phase %d", phase)
+	}
+	b := ome.book(artworkId)
+	if b == nil {
+		return nil, ErrArtworkNotListed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous := b.trading.Phase
+	if phase == TRADING_AUCTION {
+		ome.startAuction(b, 0, reason)
+		return nil, nil
+	}
+	ome.setTrading(b, TradingStatus{Phase: phase, Reason: reason, Since: time.Now()})
+
+	inst := ome.Instrument(artworkId)
+	switch {
+	case phase != TRADING_OPEN || previous == TRADING_OPEN:
+		return nil, nil
+	case previous == TRADING_AUCTION:
+		return ome.auction(b, inst)
+	case inst.Batched():
+		// the next batch clears the book
+		return nil, nil
+	default:
+		fills, err := ome.uncross(b, inst)
+		if err != nil {
+			return fills, err
+		}
+		return fills, ome.repeg(b, inst)
+	}
+}
+
+// StartAuction moves the artwork's book to a call auction that closes after
+// closesIn, or when the book is reopened if closesIn is 0.
+func (ome *OrderMatchingEngine) StartAuction(artworkId uint64, closesIn time.Duration, reason string) error {
+	b := ome.book(artworkId)
+	if b == nil {
+		return ErrArtworkNotListed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ome.startAuction(b, closesIn, reason)
+	return nil
+}
+
+func (ome *OrderMatchingEngine) startAuction(b *book, closesIn time.Duration, reason string) {
+	now := time.Now()
+	status := TradingStatus{Phase: TRADING_AUCTION, Reason: reason, Since: now}
+	if closesIn > 0 {
+		status.ReopensAt = now.Add(closesIn)
+		time.AfterFunc(closesIn, func() {
+			ome.closeAuction(b, now, "call auction closed")
+		})
+	}
+	ome.setTrading(b, status)
+	ome.updateIndicative(b)
+}
+
+// closeAuction reopens the artwork, filling its crossed orders at a single
+// clearing price, unless the halt or auction begun at since has already
+// ended or been replaced. It reports whether it reopened the artwork.
+func (ome *OrderMatchingEngine) closeAuction(b *book, since time.Time, reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := b.trading
+	if (status.Phase != TRADING_HALTED && status.Phase != TRADING_AUCTION) || !status.Since.Equal(since) {
+		return false
+	}
+	ome.setTrading(b, TradingStatus{Phase: TRADING_OPEN, Reason: reason, Since: time.Now()})
+
+	if _, err := ome.auction(b, ome.Instrument(b.artworkId)); err != nil {
+		log.Printf("auction of artwork %d failed: %v", b.artworkId, err)
+	}
+	return true
+}
+
+// updateIndicative publishes the price and volume a call auction in
+// progress would clear at, if they have changed.
+func (ome *OrderMatchingEngine) updateIndicative(b *book) {
+	status := b.trading
+	if status.Phase != TRADING_AUCTION {
+		return
+	}
+	ref, hasRef := b.lastPrice()
+	clearing, volume := clearingPrice(*b.bids.pqueue, *b.asks.pqueue, ref, hasRef)
+	if clearing.Cmp(status.IndicativePrice) == 0 && volume == status.IndicativeVolume {
+		return
+	}
+	status.IndicativePrice, status.IndicativeVolume = clearing, volume
+	ome.setTrading(b, status)
+}
+
+func (ome *OrderMatchingEngine) setTrading(b *book, status TradingStatus) {
+	b.trading = status
+	if ome.tradingListener != nil {
+		ome.tradingListener(b.artworkId, status)
+	}
+}
+
+// checkTrading reports whether new orders for the artwork may match on
+// arrival, failing with ErrTradingHalted if they are not accepted at all.
+func (b *book) checkTrading(inst instrument.Instrument) (bool, error) {
+	artworkId := inst.ArtworkId
+	status := b.trading
+	switch status.Phase {
+	case TRADING_OPEN:
+		return !inst.Batched(), nil
+	case TRADING_HALTED, TRADING_AUCTION:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: artwork %d is %s: %s",
+			ErrTradingHalted, artworkId, PhaseName(status.Phase), status.Reason)
+	}
+}
+
+// uncross matches the best bid and ask until the book no longer crosses.
+func (ome *OrderMatchingEngine) uncross(b *book, inst instrument.Instrument) ([]FillOrder, error) {
+	bids, asks := b.bids.pqueue, b.asks.pqueue
+
+	var fills []FillOrder
+	for bids.Len() > 0 && asks.Len() > 0 {
+		bid, ask := bids.Peek(), asks.Peek()
+		if ask.Price.Cmp(bid.Price) > 0 {
+			break
+		}
+
+		execPrice, takerSide := ask.Price, uint32(SIDE_BID)
+		if bid.PlacedAt.Before(ask.PlacedAt) {
+			execPrice, takerSide = bid.Price, SIDE_ASK
+		}
+		order, err := ome.fill(b, inst, bid, ask, execPrice, minQuantity(bid.QuantityRemaining(), ask.QuantityRemaining()), takerSide)
+		if err != nil {
+			return fills, err
+		}
+
+		ome.jobs <- bid.Snapshot()
+		ome.jobs <- ask.Snapshot()
+		ome.orders <- order
+		fills = append(fills, order)
+
+		if bid.QuantityRemaining() == 0 {
+			heap.Pop(bids)
+		}
+		if ask.QuantityRemaining() == 0 {
+			heap.Pop(asks)
+		}
+	}
+	return fills, nil
+}
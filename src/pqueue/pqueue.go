@@ -3,48 +3,146 @@ package pqueue
 import (
 	"container/heap"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"fractr-marketplace-secondary/price"
+
 	mcpb "github.com/blidd/fractr-proto/marketplace_common"
 )
 
+// peg types
+const (
+	// the best price on the order's own side
+	PEG_PRIMARY = iota
+	// the best price on the other side
+	PEG_MARKET
+	// halfway between the best bid and the best ask
+	PEG_MIDPOINT
+)
+
+var pegNames = map[uint32]string{
+	PEG_PRIMARY:  "PRIMARY",
+	PEG_MARKET:   "MARKET",
+	PEG_MIDPOINT: "MIDPOINT",
+}
+
+func PegName(pegType uint32) string {
+	if name, ok := pegNames[pegType]; ok {
+		return name
+	}
+	return fmt.Sprintf("Peg(%d)", pegType)
+}
+
+// ParsePeg returns the peg type named name, ignoring case.
+func ParsePeg(name string) (uint32, error) {
+	for pegType, pegName := range pegNames {
+		if strings.EqualFold(name, pegName) {
+			return pegType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown peg type %q", name)
+}
+
+// Peg makes an order's price float with the top of its artwork's book.
+// Offset moves the price away from the market, a bid lower and an ask
+// higher, and a non-zero Cap is as far as the price may float towards it.
+type Peg struct {
+	Type   uint32
+	Offset price.Price
+	Cap    price.Price
+}
+
 type Bid struct {
-	Id        uint32
-	BidderId  uint32
-	ArtworkId uint32
-	quantity  uint32
-	Price     uint32
+	Id        uint64
+	BidderId  uint64
+	ArtworkId uint64
+	quantity  uint64
+	Price     price.Price
 	PlacedAt  time.Time
+	ExpiresAt time.Time // zero for good-till-cancelled
+	Peg       *Peg      // nil unless the price floats with the book
 
-	quantityFilled uint32
+	quantityFilled uint64
+	feesPaid       price.Price
 
 	index int // for heap interface
 }
 
-func NewBid(id, bidderId, artworkId, quantity, price uint32) *Bid {
+func NewBid(id, bidderId, artworkId, quantity uint64, limit price.Price) *Bid {
 	return &Bid{
 		Id:             id,
 		BidderId:       bidderId,
 		ArtworkId:      artworkId,
 		quantity:       quantity,
-		Price:          price,
+		Price:          limit,
 		PlacedAt:       time.Now(),
 		quantityFilled: 0,
 	}
 }
 
-func (bid *Bid) Quantity() uint32       { return bid.quantity }
-func (bid *Bid) QuantityFilled() uint32 { return bid.quantityFilled }
+func (bid *Bid) Quantity() uint64       { return bid.quantity }
+func (bid *Bid) QuantityFilled() uint64 { return bid.quantityFilled }
 
-func (bid *Bid) QuantityRemaining() uint32 {
+// Limit is the most the bid pays for a fraction, which its funds are
+// reserved at: its price, or the cap of a pegged bid.
+func (bid *Bid) Limit() price.Price {
+	if bid.Peg != nil && !bid.Peg.Cap.IsZero() {
+		return bid.Peg.Cap
+	}
+	return bid.Price
+}
+
+func (bid *Bid) QuantityRemaining() uint64 {
 	if bid.QuantityFilled() > bid.Quantity() {
 		return 0
 	}
 	return bid.Quantity() - bid.QuantityFilled()
 }
 
-func (bid *Bid) FillQuantity(qty uint32) {
+// FillQuantity records qty more units as filled. It refuses fills that would
+// take the bid past its quantity, which also rules out overflow.
+func (bid *Bid) FillQuantity(qty uint64) error {
+	if qty > bid.QuantityRemaining() {
+		return fmt.Errorf("bid %d: cannot fill %d, only %d remaining", bid.Id, qty, bid.QuantityRemaining())
+	}
 	bid.quantityFilled += qty
+	return nil
+}
+
+// UnfillQuantity takes qty units back off the filled quantity when one of
+// the bid's fills is busted.
+func (bid *Bid) UnfillQuantity(qty uint64) error {
+	if qty > bid.quantityFilled {
+		return fmt.Errorf("bid %d: cannot unfill %d, only %d filled", bid.Id, qty, bid.quantityFilled)
+	}
+	bid.quantityFilled -= qty
+	return nil
+}
+
+// Expired reports whether the bid's lifetime has run out at now.
+func (bid *Bid) Expired(now time.Time) bool {
+	return !bid.ExpiresAt.IsZero() && !now.Before(bid.ExpiresAt)
+}
+
+func (bid *Bid) FeesPaid() price.Price { return bid.feesPaid }
+
+// Snapshot returns a copy of the bid as it stands, which its later fills
+// leave unchanged, for readers that do not hold its book's lock.
+func (bid *Bid) Snapshot() *Bid {
+	snapshot := *bid
+	return &snapshot
+}
+
+// AddFee adds the fee charged on one of the bid's fills to its running total.
+func (bid *Bid) AddFee(fee price.Price) error {
+	total, err := bid.feesPaid.Add(fee)
+	if err != nil {
+		return fmt.Errorf("bid %d: %v", bid.Id, err)
+	}
+	bid.feesPaid = total
+	return nil
 }
 
 func (bid *Bid) Status() mcpb.Status {
@@ -63,9 +161,9 @@ type BidPriorityQueue []*Bid
 func (bpq BidPriorityQueue) Len() int { return len(bpq) }
 
 func (bpq BidPriorityQueue) Less(i, j int) bool {
-	if bpq[i].Price > bpq[j].Price {
+	if cmp := bpq[i].Price.Cmp(bpq[j].Price); cmp > 0 {
 		return true
-	} else if bpq[i].Price < bpq[j].Price {
+	} else if cmp < 0 {
 		return false
 	} else { // if prices are equal, prioritize earlier order
 		return bpq[i].PlacedAt.Before(bpq[j].PlacedAt)
@@ -102,43 +200,138 @@ func (bpq BidPriorityQueue) Peek() *Bid {
 	return bpq[0]
 }
 
+// Find returns the queued bid with the given id, or nil.
+func (bpq BidPriorityQueue) Find(id uint64) *Bid {
+	for _, bid := range bpq {
+		if bid.Id == id {
+			return bid
+		}
+	}
+	return nil
+}
+
+// FindBidder returns the queued bid with the given id placed by
+// bidderId, or nil. Ids are chosen by the users placing orders, so
+// two users' bids can share one.
+func (bpq BidPriorityQueue) FindBidder(id, bidderId uint64) *Bid {
+	for _, bid := range bpq {
+		if bid.Id == id && bid.BidderId == bidderId {
+			return bid
+		}
+	}
+	return nil
+}
+
+// Level returns the queued bids at the best price, earliest first. Bids
+// placed at the same instant are ordered by id.
+func (bpq BidPriorityQueue) Level() []*Bid {
+	var level []*Bid
+	best := bpq.Peek().Price
+	for _, bid := range bpq {
+		if bid.Price.Cmp(best) == 0 {
+			level = append(level, bid)
+		}
+	}
+	sort.Slice(level, func(i, j int) bool {
+		if !level[i].PlacedAt.Equal(level[j].PlacedAt) {
+			return level[i].PlacedAt.Before(level[j].PlacedAt)
+		}
+		return level[i].Id < level[j].Id
+	})
+	return level
+}
+
+// Remove takes bid out of the queue, reporting whether it was queued.
+func (bpq *BidPriorityQueue) Remove(bid *Bid) bool {
+	for i, queued := range *bpq {
+		if queued == bid {
+			heap.Remove(bpq, i)
+			return true
+		}
+	}
+	return false
+}
+
 type Ask struct {
-	Id        uint32
-	AskerId   uint32
-	ArtworkId uint32
-	quantity  uint32
-	Price     uint32
+	Id        uint64
+	AskerId   uint64
+	ArtworkId uint64
+	quantity  uint64
+	Price     price.Price
 	PlacedAt  time.Time
+	ExpiresAt time.Time // zero for good-till-cancelled
+	Peg       *Peg      // nil unless the price floats with the book
 
-	quantityFilled uint32
+	quantityFilled uint64
+	feesPaid       price.Price
 
 	index int
 }
 
-func NewAsk(id, askerId, artworkId, quantity, price uint32) *Ask {
+func NewAsk(id, askerId, artworkId, quantity uint64, limit price.Price) *Ask {
 	return &Ask{
 		Id:             id,
 		AskerId:        askerId,
 		ArtworkId:      artworkId,
 		quantity:       quantity,
-		Price:          price,
+		Price:          limit,
 		PlacedAt:       time.Now(),
 		quantityFilled: 0,
 	}
 }
 
-func (ask *Ask) Quantity() uint32       { return ask.quantity }
-func (ask *Ask) QuantityFilled() uint32 { return ask.quantityFilled }
+func (ask *Ask) Quantity() uint64       { return ask.quantity }
+func (ask *Ask) QuantityFilled() uint64 { return ask.quantityFilled }
 
-func (ask *Ask) QuantityRemaining() uint32 {
+func (ask *Ask) QuantityRemaining() uint64 {
 	if ask.QuantityFilled() > ask.Quantity() {
 		return 0
 	}
 	return ask.Quantity() - ask.QuantityFilled()
 }
 
-func (ask *Ask) FillQuantity(qty uint32) {
+// FillQuantity records qty more units as filled. It refuses fills that would
+// take the ask past its quantity, which also rules out overflow.
+func (ask *Ask) FillQuantity(qty uint64) error {
+	if qty > ask.QuantityRemaining() {
+		return fmt.Errorf("ask %d: cannot fill %d, only %d remaining", ask.Id, qty, ask.QuantityRemaining())
+	}
 	ask.quantityFilled += qty
+	return nil
+}
+
+// UnfillQuantity takes qty units back off the filled quantity when one of
+// the ask's fills is busted.
+func (ask *Ask) UnfillQuantity(qty uint64) error {
+	if qty > ask.quantityFilled {
+		return fmt.Errorf("ask %d: cannot unfill %d, only %d filled", ask.Id, qty, ask.quantityFilled)
+	}
+	ask.quantityFilled -= qty
+	return nil
+}
+
+// Expired reports whether the ask's lifetime has run out at now.
+func (ask *Ask) Expired(now time.Time) bool {
+	return !ask.ExpiresAt.IsZero() && !now.Before(ask.ExpiresAt)
+}
+
+func (ask *Ask) FeesPaid() price.Price { return ask.feesPaid }
+
+// Snapshot returns a copy of the ask as it stands, which its later fills
+// leave unchanged, for readers that do not hold its book's lock.
+func (ask *Ask) Snapshot() *Ask {
+	snapshot := *ask
+	return &snapshot
+}
+
+// AddFee adds the fee charged on one of the ask's fills to its running total.
+func (ask *Ask) AddFee(fee price.Price) error {
+	total, err := ask.feesPaid.Add(fee)
+	if err != nil {
+		return fmt.Errorf("ask %d: %v", ask.Id, err)
+	}
+	ask.feesPaid = total
+	return nil
 }
 
 func (ask *Ask) Status() mcpb.Status {
@@ -157,9 +350,9 @@ type AskPriorityQueue []*Ask
 func (apq AskPriorityQueue) Len() int { return len(apq) }
 
 func (apq AskPriorityQueue) Less(i, j int) bool {
-	if apq[i].Price < apq[j].Price {
+	if cmp := apq[i].Price.Cmp(apq[j].Price); cmp < 0 {
 		return true
-	} else if apq[i].Price > apq[j].Price {
+	} else if cmp > 0 {
 		return false
 	} else { // if prices are equal, prioritize earlier order
 		return apq[i].PlacedAt.Before(apq[j].PlacedAt)
@@ -196,6 +389,58 @@ func (apq AskPriorityQueue) Peek() *Ask {
 	return apq[0]
 }
 
+// Find returns the queued ask with the given id, or nil.
+func (apq AskPriorityQueue) Find(id uint64) *Ask {
+	for _, ask := range apq {
+		if ask.Id == id {
+			return ask
+		}
+	}
+	return nil
+}
+
+// FindAsker returns the queued ask with the given id placed by
+// askerId, or nil. Ids are chosen by the users placing orders, so
+// two users' asks can share one.
+func (apq AskPriorityQueue) FindAsker(id, askerId uint64) *Ask {
+	for _, ask := range apq {
+		if ask.Id == id && ask.AskerId == askerId {
+			return ask
+		}
+	}
+	return nil
+}
+
+// Level returns the queued asks at the best price, earliest first. Asks
+// placed at the same instant are ordered by id.
+func (apq AskPriorityQueue) Level() []*Ask {
+	var level []*Ask
+	best := apq.Peek().Price
+	for _, ask := range apq {
+		if ask.Price.Cmp(best) == 0 {
+			level = append(level, ask)
+		}
+	}
+	sort.Slice(level, func(i, j int) bool {
+		if !level[i].PlacedAt.Equal(level[j].PlacedAt) {
+			return level[i].PlacedAt.Before(level[j].PlacedAt)
+		}
+		return level[i].Id < level[j].Id
+	})
+	return level
+}
+
+// Remove takes ask out of the queue, reporting whether it was queued.
+func (apq *AskPriorityQueue) Remove(ask *Ask) bool {
+	for i, queued := range *apq {
+		if queued == ask {
+			heap.Remove(apq, i)
+			return true
+		}
+	}
+	return false
+}
+
 func TestAsk() {
 	time0, _ := time.Parse(time.RFC822, "01 Jan 14 10:00 UTC")
 	time1, _ := time.Parse(time.RFC822, "01 Jan 14 10:01 UTC")
@@ -206,32 +451,32 @@ func TestAsk() {
 	asks := map[string]*Ask{
 		"0": {
 			quantity: 20,
-			Price:    10,
+			Price:    price.New(10, 0),
 			PlacedAt: time0,
 		},
 		"1": {
 			quantity: 30,
-			Price:    11,
+			Price:    price.New(11, 0),
 			PlacedAt: time1,
 		},
 		"2": {
 			quantity: 30,
-			Price:    8,
+			Price:    price.New(8, 0),
 			PlacedAt: time2,
 		},
 		"3": {
 			quantity: 30,
-			Price:    7,
+			Price:    price.New(7, 0),
 			PlacedAt: time3,
 		},
 		"4": {
 			quantity: 30,
-			Price:    12,
+			Price:    price.New(12, 0),
 			PlacedAt: time4,
 		},
 		"5": {
 			quantity: 30,
-			Price:    10,
+			Price:    price.New(10, 0),
 			PlacedAt: time5,
 		},
 	}
@@ -247,7 +492,7 @@ func TestAsk() {
 	time6, _ := time.Parse(time.RFC822, "01 Jan 15 11:00 UTC")
 	heap.Push(&apq, &Ask{
 		quantity: 30,
-		Price:    9,
+		Price:    price.New(9, 0),
 		PlacedAt: time6,
 	})
 
@@ -269,32 +514,32 @@ func TestBid() {
 	bids := map[string]*Bid{
 		"0": {
 			quantity: 20,
-			Price:    10,
+			Price:    price.New(10, 0),
 			PlacedAt: time0,
 		},
 		"1": {
 			quantity: 30,
-			Price:    11,
+			Price:    price.New(11, 0),
 			PlacedAt: time1,
 		},
 		"2": {
 			quantity: 30,
-			Price:    8,
+			Price:    price.New(8, 0),
 			PlacedAt: time2,
 		},
 		"3": {
 			quantity: 30,
-			Price:    7,
+			Price:    price.New(7, 0),
 			PlacedAt: time3,
 		},
 		"4": {
 			quantity: 30,
-			Price:    12,
+			Price:    price.New(12, 0),
 			PlacedAt: time4,
 		},
 		"5": {
 			quantity: 30,
-			Price:    10,
+			Price:    price.New(10, 0),
 			PlacedAt: time5,
 		},
 	}
@@ -310,7 +555,7 @@ func TestBid() {
 	time6, _ := time.Parse(time.RFC822, "01 Jan 15 11:00 UTC")
 	heap.Push(&bpq, &Bid{
 		quantity: 30,
-		Price:    9,
+		Price:    price.New(9, 0),
 		PlacedAt: time6,
 	})
 
@@ -0,0 +1,197 @@
+// prices are fixed-point decimals: an integer number of units and a scale
+// giving the number of those units' decimal places, so 1250 at scale 2 is
+// 12.50. All arithmetic is checked and returns ErrOverflow rather than
+// wrapping.
+
+package price
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// MaxScale is the largest supported number of decimal places; 10^MaxScale
+// still fits in a uint64.
+const MaxScale = 18
+
+var (
+	ErrOverflow  = errors.New("price: arithmetic overflow")
+	ErrPrecision = errors.New("price: value not representable at scale")
+	ErrNegative  = errors.New("price: result would be negative")
+)
+
+type Price struct {
+	Units uint64
+	Scale uint8
+}
+
+func New(units uint64, scale uint8) Price {
+	return Price{Units: units, Scale: scale}
+}
+
+var pow10 = func() [MaxScale + 1]uint64 {
+	var p [MaxScale + 1]uint64
+	p[0] = 1
+	for i := 1; i <= MaxScale; i++ {
+		p[i] = p[i-1] * 10
+	}
+	return p
+}()
+
+func (p Price) IsZero() bool { return p.Units == 0 }
+
+// Rescale converts p to the given scale. Scaling down fails with
+// ErrPrecision if digits would be lost.
+func (p Price) Rescale(scale uint8) (Price, error) {
+	if scale > MaxScale || p.Scale > MaxScale {
+		return Price{}, ErrOverflow
+	}
+	switch {
+	case scale == p.Scale:
+		return p, nil
+	case scale > p.Scale:
+		hi, lo := bits.Mul64(p.Units, pow10[scale-p.Scale])
+		if hi != 0 {
+			return Price{}, ErrOverflow
+		}
+		return Price{Units: lo, Scale: scale}, nil
+	default:
+		factor := pow10[p.Scale-scale]
+		if p.Units%factor != 0 {
+			return Price{}, ErrPrecision
+		}
+		return Price{Units: p.Units / factor, Scale: scale}, nil
+	}
+}
+
+// wide returns p's units at the given (larger or equal) scale as a 128-bit
+// value, which cannot overflow for scales up to MaxScale.
+func (p Price) wide(scale uint8) (hi, lo uint64) {
+	return bits.Mul64(p.Units, pow10[scale-p.Scale])
+}
+
+// Cmp returns -1, 0 or +1 as p is less than, equal to or greater than q.
+// Prices of different scales are compared by value.
+func (p Price) Cmp(q Price) int {
+	scale := p.Scale
+	if q.Scale > scale {
+		scale = q.Scale
+	}
+	phi, plo := p.wide(scale)
+	qhi, qlo := q.wide(scale)
+
+	switch {
+	case phi < qhi || (phi == qhi && plo < qlo):
+		return -1
+	case phi > qhi || (phi == qhi && plo > qlo):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// align rescales p and q to the larger of their scales.
+func align(p, q Price) (Price, Price, error) {
+	var err error
+	if p.Scale < q.Scale {
+		p, err = p.Rescale(q.Scale)
+	} else if q.Scale < p.Scale {
+		q, err = q.Rescale(p.Scale)
+	}
+	return p, q, err
+}
+
+func (p Price) Add(q Price) (Price, error) {
+	p, q, err := align(p, q)
+	if err != nil {
+		return Price{}, err
+	}
+	sum, carry := bits.Add64(p.Units, q.Units, 0)
+	if carry != 0 {
+		return Price{}, ErrOverflow
+	}
+	return Price{Units: sum, Scale: p.Scale}, nil
+}
+
+func (p Price) Sub(q Price) (Price, error) {
+	p, q, err := align(p, q)
+	if err != nil {
+		return Price{}, err
+	}
+	if q.Units > p.Units {
+		return Price{}, ErrNegative
+	}
+	return Price{Units: p.Units - q.Units, Scale: p.Scale}, nil
+}
+
+// Mul returns the notional value of quantity units at price p, at p's scale.
+func (p Price) Mul(quantity uint64) (Price, error) {
+	hi, lo := bits.Mul64(p.Units, quantity)
+	if hi != 0 {
+		return Price{}, ErrOverflow
+	}
+	return Price{Units: lo, Scale: p.Scale}, nil
+}
+
+// MulDiv returns p × num / den rounded down, computed in 128 bits so the
+// intermediate product cannot overflow.
+func (p Price) MulDiv(num, den uint64) (Price, error) {
+	if den == 0 {
+		return Price{}, errors.New("price: division by zero")
+	}
+	hi, lo := bits.Mul64(p.Units, num)
+	if hi >= den {
+		return Price{}, ErrOverflow
+	}
+	quo, _ := bits.Div64(hi, lo, den)
+	return Price{Units: quo, Scale: p.Scale}, nil
+}
+
+func (p Price) String() string {
+	digits := strconv.FormatUint(p.Units, 10)
+	if p.Scale == 0 {
+		return digits
+	}
+	if len(digits) <= int(p.Scale) {
+		digits = strings.Repeat("0", int(p.Scale)-len(digits)+1) + digits
+	}
+	point := len(digits) - int(p.Scale)
+	return digits[:point] + "." + digits[point:]
+}
+
+// Parse reads a decimal such as "12.50"; the scale is the number of digits
+// after the decimal point.
+func Parse(s string) (Price, error) {
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	if whole == "" || (hasPoint && frac == "") {
+		return Price{}, fmt.Errorf("price: invalid decimal %q", s)
+	}
+	if len(frac) > MaxScale {
+		return Price{}, ErrPrecision
+	}
+	units, err := strconv.ParseUint(whole+frac, 10, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return Price{}, ErrOverflow
+		}
+		return Price{}, fmt.Errorf("price: invalid decimal %q", s)
+	}
+	return Price{Units: units, Scale: uint8(len(frac))}, nil
+}
+
+// prices encode as decimal strings in JSON so no precision is lost
+func (p Price) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
@@ -0,0 +1,94 @@
+package price
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestCmpAcrossScales(t *testing.T) {
+	tests := []struct {
+		p, q Price
+		want int
+	}{
+		{New(1250, 2), New(125, 1), 0},
+		{New(1250, 2), New(13, 0), -1},
+		{New(13, 0), New(1250, 2), 1},
+		{New(math.MaxUint64, 0), New(1, MaxScale), 1},
+	}
+
+	for _, test := range tests {
+		if got := test.p.Cmp(test.q); got != test.want {
+			t.Errorf("%v.Cmp(%v) = %d, want %d", test.p, test.q, got, test.want)
+		}
+	}
+}
+
+func TestMulOverflow(t *testing.T) {
+	notional, err := New(1250, 2).Mul(4)
+	if err != nil || notional != New(5000, 2) {
+		t.Fatalf("Expected 50.00, got %v (%v)", notional, err)
+	}
+
+	if _, err := New(math.MaxUint64/2+1, 0).Mul(2); err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow, got %v", err)
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	// 2.5% of 1000.00 without the intermediate product fitting in 64 bits
+	fee, err := New(math.MaxUint64/10, 2).MulDiv(250, 10000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := uint64(math.MaxUint64 / 10 / 40); fee.Units != want {
+		t.Fatalf("Expected %d units, got %d", want, fee.Units)
+	}
+}
+
+func TestRescale(t *testing.T) {
+	if _, err := New(1255, 2).Rescale(1); err != ErrPrecision {
+		t.Errorf("Expected ErrPrecision, got %v", err)
+	}
+	if p, err := New(1250, 2).Rescale(1); err != nil || p != New(125, 1) {
+		t.Errorf("Expected 12.5, got %v (%v)", p, err)
+	}
+	if _, err := New(math.MaxUint64, 0).Rescale(1); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+}
+
+func TestAddSub(t *testing.T) {
+	sum, err := New(150, 2).Add(New(2, 0))
+	if err != nil || sum != New(350, 2) {
+		t.Errorf("Expected 3.50, got %v (%v)", sum, err)
+	}
+	if _, err := New(1, 0).Sub(New(2, 0)); err != ErrNegative {
+		t.Errorf("Expected ErrNegative, got %v", err)
+	}
+	if _, err := New(math.MaxUint64, 0).Add(New(1, 0)); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+}
+
+func TestStringAndJSON(t *testing.T) {
+	for _, s := range []string{"0.05", "12.50", "7", "0.000001"} {
+		p, err := Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+		if p.String() != s {
+			t.Errorf("Expected %q, got %q", s, p.String())
+		}
+	}
+
+	data, err := json.Marshal(struct{ Price Price }{New(1250, 2)})
+	if err != nil || string(data) != `{"Price":"12.50"}` {
+		t.Fatalf("unexpected JSON %s (%v)", data, err)
+	}
+
+	var decoded struct{ Price Price }
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Price != New(1250, 2) {
+		t.Fatalf("unexpected decoded price %v (%v)", decoded.Price, err)
+	}
+}
@@ -0,0 +1,280 @@
+// quotes let market makers keep a bid and an ask resting on many artworks
+// and replace them all with one mass quote. Each two-sided quote rests on
+// the book as an ordinary bid and ask carrying the quote's id, and a new
+// quote on an artwork cancels the maker's previous pair there first. A mass
+// quote is checked in full before any book is touched, so a bad entry
+// rejects the whole of it; if a book then refuses a side, for lack of funds
+// say, the maker's quotes on every artwork in the mass quote are pulled
+// rather than left half replaced.
+
+package quote
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// DefaultLimit is how many artworks a maker may quote at once unless given
+// a limit of their own.
+const DefaultLimit = 50
+
+var (
+	ErrInvalidQuote = errors.New("invalid quote")
+	ErrQuoteLimit   = errors.New("quote limit exceeded")
+)
+
+// EntryError is returned for the entry of a mass quote that was refused.
+// Side is "bid" or "ask" when the failure was on one side of the quote.
+type EntryError struct {
+	Index int
+	Side  string
+	Err   error
+}
+
+func (err *EntryError) Error() string {
+	if err.Side == "" {
+		return fmt.Sprintf("quote %d: %v", err.Index, err.Err)
+	}
+	return fmt.Sprintf("quote %d %s: %v", err.Index, err.Side, err.Err)
+}
+
+func (err *EntryError) Unwrap() error { return err.Err }
+
+// Quote is one artwork's entry in a mass quote. Both quantities zero
+// withdraws the maker's quote on the artwork.
+type Quote struct {
+	ArtworkId   uint64
+	QuoteId     uint64 // id of both the bid and the ask
+	BidPrice    price.Price
+	BidQuantity uint64
+	AskPrice    price.Price
+	AskQuantity uint64
+}
+
+func (q Quote) withdraws() bool {
+	return q.BidQuantity == 0 && q.AskQuantity == 0
+}
+
+// Placed is a quote as it went onto the book, including what it filled on
+// arrival.
+type Placed struct {
+	ArtworkId         uint64
+	QuoteId           uint64
+	BidQuantityFilled uint64
+	AskQuantityFilled uint64
+}
+
+// a maker's live quote on one artwork
+type pair struct {
+	quoteId uint64
+	bid     *pqueue.Bid
+	ask     *pqueue.Ask
+}
+
+// Board keeps track of every maker's live quotes. It is safe for
+// concurrent use.
+type Board struct {
+	engine *match.OrderMatchingEngine
+	mu     sync.Mutex
+	limits map[uint64]int              // key: makerId
+	live   map[uint64]map[uint64]*pair // key: makerId, then artworkId
+}
+
+func New(engine *match.OrderMatchingEngine) *Board {
+	return &Board{
+		engine: engine,
+		limits: make(map[uint64]int),
+		live:   make(map[uint64]map[uint64]*pair),
+	}
+}
+
+// SetLimit sets how many artworks the maker may quote at once.
+func (board *Board) SetLimit(makerId uint64, limit int) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+
+	board.limits[makerId] = limit
+}
+
+func (board *Board) limit(makerId uint64) int {
+	if limit, ok := board.limits[makerId]; ok {
+		return limit
+	}
+	return DefaultLimit
+}
+
+// Live returns the ids of the maker's live quotes, keyed by artwork.
+func (board *Board) Live(makerId uint64) map[uint64]uint64 {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+
+	live := make(map[uint64]uint64, len(board.live[makerId]))
+	for artworkId, p := range board.live[makerId] {
+		live[artworkId] = p.quoteId
+	}
+	return live
+}
+
+// Forget drops the quotes of which an order was removed from the book
+// other than through the board, by a mass cancel say, so they no longer
+// count against their maker's limit. A quote left one-sided is pulled.
+func (board *Board) Forget(removed []match.BidAsk) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+
+	for _, order := range removed {
+		var makerId, artworkId uint64
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			makerId, artworkId = o.BidderId, o.ArtworkId
+		case *pqueue.Ask:
+			makerId, artworkId = o.AskerId, o.ArtworkId
+		default:
+			continue
+		}
+		p := board.live[makerId][artworkId]
+		if p != nil && (match.BidAsk(p.bid) == order || match.BidAsk(p.ask) == order) {
+			board.cancel(artworkId, p)
+			delete(board.live[makerId], artworkId)
+		}
+	}
+}
+
+// MassQuote replaces the maker's quotes on each artwork in quotes,
+// cancelling the previous pair there, and returns what was placed and the
+// ids of the quotes it cancelled. Artworks not in quotes keep their quotes.
+func (board *Board) MassQuote(makerId uint64, quotes []Quote) ([]Placed, []uint64, error) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+
+	if err := board.check(makerId, quotes); err != nil {
+		return nil, nil, err
+	}
+
+	live := board.live[makerId]
+	if live == nil {
+		live = make(map[uint64]*pair)
+		board.live[makerId] = live
+	}
+
+	var placed []Placed
+	var cancelled []uint64
+	for i, q := range quotes {
+		if previous := live[q.ArtworkId]; previous != nil {
+			board.cancel(q.ArtworkId, previous)
+			delete(live, q.ArtworkId)
+			cancelled = append(cancelled, previous.quoteId)
+		}
+		if q.withdraws() {
+			continue
+		}
+
+		p, err := board.place(makerId, q)
+		if err != nil {
+			// pull the rest too rather than leave the mass quote half done
+			for _, rest := range quotes[i:] {
+				if previous := live[rest.ArtworkId]; previous != nil {
+					board.cancel(rest.ArtworkId, previous)
+					delete(live, rest.ArtworkId)
+					cancelled = append(cancelled, previous.quoteId)
+				}
+			}
+			for _, done := range quotes[:i] {
+				if current := live[done.ArtworkId]; current != nil {
+					board.cancel(done.ArtworkId, current)
+					delete(live, done.ArtworkId)
+				}
+			}
+			err.Index = i
+			return nil, cancelled, err
+		}
+		live[q.ArtworkId] = p
+		placed = append(placed, Placed{
+			ArtworkId:         q.ArtworkId,
+			QuoteId:           q.QuoteId,
+			BidQuantityFilled: p.bid.QuantityFilled(),
+			AskQuantityFilled: p.ask.QuantityFilled(),
+		})
+	}
+	return placed, cancelled, nil
+}
+
+// check refuses the whole mass quote if any entry is malformed, breaks its
+// artwork's rules or would take the maker past their limit.
+func (board *Board) check(makerId uint64, quotes []Quote) error {
+	seen := make(map[uint64]bool, len(quotes))
+	quoted := make(map[uint64]bool, len(board.live[makerId]))
+	for artworkId := range board.live[makerId] {
+		quoted[artworkId] = true
+	}
+
+	for i, q := range quotes {
+		if seen[q.ArtworkId] {
+			return &EntryError{i, "", fmt.Errorf("%w: artwork %d is quoted twice", ErrInvalidQuote, q.ArtworkId)}
+		}
+		seen[q.ArtworkId] = true
+		if q.withdraws() {
+			delete(quoted, q.ArtworkId)
+			continue
+		}
+		quoted[q.ArtworkId] = true
+
+		if !board.engine.HasArtwork(q.ArtworkId) {
+			return &EntryError{i, "", match.ErrArtworkNotListed}
+		}
+		if q.BidQuantity == 0 || q.AskQuantity == 0 {
+			return &EntryError{i, "", fmt.Errorf("%w: a quote needs both a bid and an ask", ErrInvalidQuote)}
+		}
+		if q.BidPrice.Cmp(q.AskPrice) >= 0 {
+			return &EntryError{i, "", fmt.Errorf("%w: bid %s is not below ask %s", ErrInvalidQuote, q.BidPrice, q.AskPrice)}
+		}
+		inst := board.engine.Instrument(q.ArtworkId)
+		if err := inst.CheckOrder(q.BidQuantity, q.BidPrice); err != nil {
+			return &EntryError{i, "bid", err}
+		}
+		if err := inst.CheckOrder(q.AskQuantity, q.AskPrice); err != nil {
+			return &EntryError{i, "ask", err}
+		}
+	}
+
+	if limit := board.limit(makerId); len(quoted) > limit {
+		return fmt.Errorf("%w: maker %d would quote %d artworks, limit %d", ErrQuoteLimit, makerId, len(quoted), limit)
+	}
+	return nil
+}
+
+// place puts both sides of the quote on the book, taking the bid back off
+// if the ask is refused.
+func (board *Board) place(makerId uint64, q Quote) (*pair, *EntryError) {
+	bid := pqueue.NewBid(q.QuoteId, makerId, q.ArtworkId, q.BidQuantity, q.BidPrice)
+	if _, err := board.engine.FillBidOrder(bid); err != nil {
+		return nil, &EntryError{Side: "bid", Err: err}
+	}
+	ask := pqueue.NewAsk(q.QuoteId, makerId, q.ArtworkId, q.AskQuantity, q.AskPrice)
+	if _, err := board.engine.FillAskOrder(ask); err != nil {
+		board.cancel(q.ArtworkId, &pair{quoteId: q.QuoteId, bid: bid})
+		return nil, &EntryError{Side: "ask", Err: err}
+	}
+	return &pair{quoteId: q.QuoteId, bid: bid, ask: ask}, nil
+}
+
+// cancel takes whatever is left of the pair off the book. A side that has
+// filled completely is no longer there.
+func (board *Board) cancel(artworkId uint64, p *pair) {
+	if p.bid != nil {
+		if _, err := board.engine.CancelUserBid(artworkId, p.bid.Id, p.bid.BidderId); err != nil && !errors.Is(err, match.ErrOrderNotFound) {
+			log.Printf("failed to cancel quote %d bid on artwork %d: %v", p.quoteId, artworkId, err)
+		}
+	}
+	if p.ask != nil {
+		if _, err := board.engine.CancelUserAsk(artworkId, p.ask.Id, p.ask.AskerId); err != nil && !errors.Is(err, match.ErrOrderNotFound) {
+			log.Printf("failed to cancel quote %d ask on artwork %d: %v", p.quoteId, artworkId, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package quote
+
+import (
+	"errors"
+	"testing"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+const makerId = 20
+
+// setupBoard returns a board on an engine listing artworks 1 to 3, with the
+// maker holding 100 fractions of each and 50.00 USD.
+func setupBoard() (*Board, *match.OrderMatchingEngine, *account.Memory) {
+	engine := match.New()
+	accounts := account.NewMemory()
+	accounts.Deposit(makerId, "USD", price.New(5000, 2))
+	engine.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	for artworkId := uint64(1); artworkId <= 3; artworkId++ {
+		engine.AddArtworkIfNotExists(artworkId)
+		ledger.Credit(makerId, artworkId, 100)
+	}
+	engine.SetHoldingsLedger(ledger)
+
+	go func() {
+		for {
+			select {
+			case <-engine.Orders():
+			case <-engine.Jobs():
+			}
+		}
+	}()
+	return New(engine), engine, accounts
+}
+
+func twoSided(artworkId, quoteId uint64) Quote {
+	return Quote{
+		ArtworkId:   artworkId,
+		QuoteId:     quoteId,
+		BidPrice:    price.New(100, 2),
+		BidQuantity: 5,
+		AskPrice:    price.New(120, 2),
+		AskQuantity: 5,
+	}
+}
+
+func TestMassQuoteReplacesPreviousPair(t *testing.T) {
+	board, engine, _ := setupBoard()
+
+	if _, _, err := board.MassQuote(makerId, []Quote{twoSided(1, 10), twoSided(2, 11)}); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	placed, cancelled, err := board.MassQuote(makerId, []Quote{twoSided(1, 12), {ArtworkId: 2, QuoteId: 13}})
+	if err != nil {
+		t.Fatalf("failed to requote: %v", err)
+	}
+	if len(placed) != 1 || placed[0].QuoteId != 12 {
+		t.Fatalf("Expected quote 12 to be placed, got %+v", placed)
+	}
+	if len(cancelled) != 2 || cancelled[0] != 10 || cancelled[1] != 11 {
+		t.Fatalf("Expected quotes 10 and 11 to be cancelled, got %v", cancelled)
+	}
+
+	if _, err := engine.CancelBid(1, 10); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected the replaced bid to be off the book, got %v", err)
+	}
+	if _, err := engine.CancelAsk(2, 11); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected the withdrawn ask to be off the book, got %v", err)
+	}
+	if live := board.Live(makerId); len(live) != 1 || live[1] != 12 {
+		t.Errorf("Expected only quote 12 to be live, got %v", live)
+	}
+}
+
+func TestMassQuoteLeavesOtherUsersOrdersWithTheSameId(t *testing.T) {
+	board, engine, accounts := setupBoard()
+	accounts.Deposit(makerId+1, "USD", price.New(5000, 2))
+
+	other := pqueue.NewBid(12, makerId+1, 1, 5, price.New(110, 2))
+	if _, err := engine.FillBidOrder(other); err != nil {
+		t.Fatalf("failed to place the other user's bid: %v", err)
+	}
+	if _, _, err := board.MassQuote(makerId, []Quote{twoSided(1, 12)}); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if _, _, err := board.MassQuote(makerId, []Quote{{ArtworkId: 1, QuoteId: 13}}); err != nil {
+		t.Fatalf("failed to pull the quote: %v", err)
+	}
+
+	if cancelled, err := engine.CancelUserBid(1, 12, makerId+1); err != nil || cancelled != other {
+		t.Errorf("Expected the other user's bid to keep resting, got %v, %v", cancelled, err)
+	}
+}
+
+func TestMassQuoteIsAllOrNothing(t *testing.T) {
+	board, _, accounts := setupBoard()
+
+	if _, _, err := board.MassQuote(makerId, []Quote{twoSided(1, 10)}); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+
+	crossed := twoSided(2, 11)
+	crossed.AskPrice = crossed.BidPrice
+	_, _, err := board.MassQuote(makerId, []Quote{twoSided(1, 12), crossed})
+	var entryErr *EntryError
+	if !errors.As(err, &entryErr) || entryErr.Index != 1 || !errors.Is(err, ErrInvalidQuote) {
+		t.Fatalf("Expected the crossed quote to be refused, got %v", err)
+	}
+	if live := board.Live(makerId); live[1] != 10 {
+		t.Fatalf("Expected a refused mass quote to leave quote 10 live, got %v", live)
+	}
+
+	// the second bid cannot be funded once the first has reserved 44.80
+	large := twoSided(2, 13)
+	large.BidQuantity = 40
+	first := twoSided(1, 14)
+	first.BidQuantity = 40
+	first.BidPrice = price.New(112, 2)
+	if _, _, err := board.MassQuote(makerId, []Quote{first, large}); !errors.Is(err, account.ErrInsufficientFunds) {
+		t.Fatalf("Expected the mass quote to run out of funds, got %v", err)
+	}
+	if live := board.Live(makerId); len(live) != 0 {
+		t.Errorf("Expected the maker to be left unquoted, got %v", live)
+	}
+	if balance := accounts.Balance(makerId, "USD"); !balance.Reserved.IsZero() {
+		t.Errorf("Expected every reservation to be released, got %+v", balance)
+	}
+
+	board.SetLimit(makerId, 1)
+	if _, _, err := board.MassQuote(makerId, []Quote{twoSided(1, 15), twoSided(2, 16)}); !errors.Is(err, ErrQuoteLimit) {
+		t.Errorf("Expected quoting two artworks to exceed the limit, got %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+// requests for quote let a buyer trade a large block off the book. The
+// buyer asks for a quantity of an artwork, registered market makers answer
+// with firm quotes until the request's window closes, and the buyer may
+// accept one of them while it is open. Each quote locks its maker's
+// fractions so it can always be filled, and an accepted quote crosses
+// through the matching engine, so the trade is reported and settled like
+// any other.
+
+package rfq
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// request statuses
+const (
+	RFQ_OPEN = iota
+	RFQ_FILLED
+	// the window closed without a quote being accepted
+	RFQ_EXPIRED
+	RFQ_CANCELLED
+)
+
+var statusNames = map[uint32]string{
+	RFQ_OPEN:      "OPEN",
+	RFQ_FILLED:    "FILLED",
+	RFQ_EXPIRED:   "EXPIRED",
+	RFQ_CANCELLED: "CANCELLED",
+}
+
+func StatusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", status)
+}
+
+var (
+	ErrInvalidRequest  = errors.New("invalid quote request")
+	ErrRequestExists   = errors.New("quote request already exists")
+	ErrRequestNotFound = errors.New("quote request not found")
+	ErrRequestClosed   = errors.New("quote request is closed")
+	ErrQuoteNotFound   = errors.New("quote not found")
+	ErrNotMarketMaker  = errors.New("not a registered market maker")
+)
+
+// Request is what a buyer asks to be quoted. Its id is also the id of the
+// bid that pays for an accepted quote.
+type Request struct {
+	Id          uint64
+	RequesterId uint64
+	ArtworkId   uint64
+	Quantity    uint64
+	// how long makers have to quote, and the buyer to accept
+	Window time.Duration
+}
+
+// Quote is a market maker's firm offer to sell a request's whole quantity.
+// Its id is also the id of the ask that holds the maker's fractions locked.
+type Quote struct {
+	Id       uint64
+	MakerId  uint64
+	Price    price.Price
+	QuotedAt time.Time
+
+	ask *pqueue.Ask
+}
+
+type Rfq struct {
+	Request
+	Status      uint32
+	RequestedAt time.Time
+	ExpiresAt   time.Time
+	// best price first, then earliest
+	Quotes   []Quote
+	Accepted uint64           // id of the accepted quote
+	Fill     *match.FillOrder // the trade made accepting it
+}
+
+// snapshot copies the request for callers outside the desk.
+func (r *Rfq) snapshot() Rfq {
+	snapshot := *r
+	snapshot.Quotes = make([]Quote, len(r.Quotes))
+	for i, quote := range r.Quotes {
+		quote.ask = nil
+		snapshot.Quotes[i] = quote
+	}
+	if r.Fill != nil {
+		fill := *r.Fill
+		snapshot.Fill = &fill
+	}
+	return snapshot
+}
+
+// Desk runs requests for quote against the engine's funds and holdings. It
+// is safe for concurrent use.
+type Desk struct {
+	engine   *match.OrderMatchingEngine
+	mu       sync.Mutex
+	makers   map[uint64]bool // key: userId
+	requests map[uint64]*Rfq // key: request id
+	listener func(Rfq)
+}
+
+func New(engine *match.OrderMatchingEngine) *Desk {
+	return &Desk{
+		engine:   engine,
+		makers:   make(map[uint64]bool),
+		requests: make(map[uint64]*Rfq),
+	}
+}
+
+// SetRequestListener makes the desk call listener with every new request,
+// so it can be broadcast to market makers. It is called with the desk
+// locked, so it must not call back into the desk.
+func (desk *Desk) SetRequestListener(listener func(Rfq)) {
+	desk.listener = listener
+}
+
+// SetMarketMaker registers the user as a market maker, or withdraws their
+// registration. Quotes already given stay firm.
+func (desk *Desk) SetMarketMaker(userId uint64, registered bool) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	if registered {
+		desk.makers[userId] = true
+	} else {
+		delete(desk.makers, userId)
+	}
+}
+
+// MarketMakers returns the registered market makers in id order.
+func (desk *Desk) MarketMakers() []uint64 {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	makers := make([]uint64, 0, len(desk.makers))
+	for userId := range desk.makers {
+		makers = append(makers, userId)
+	}
+	sort.Slice(makers, func(i, j int) bool { return makers[i] < makers[j] })
+	return makers
+}
+
+// Get returns the request with the given id.
+func (desk *Desk) Get(requestId uint64) (Rfq, error) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	r, ok := desk.requests[requestId]
+	if !ok {
+		return Rfq{}, ErrRequestNotFound
+	}
+	return r.snapshot(), nil
+}
+
+// Open broadcasts a request for quote, which stays open for its window.
+// Block trades are exempt from the artwork's maximum order quantity.
+func (desk *Desk) Open(req Request) (Rfq, error) {
+	if !desk.engine.HasArtwork(req.ArtworkId) {
+		return Rfq{}, match.ErrArtworkNotListed
+	}
+	if req.Window <= 0 {
+		return Rfq{}, fmt.Errorf("%w: window must be positive", ErrInvalidRequest)
+	}
+	if req.Id > match.MaxOrderId {
+		return Rfq{}, fmt.Errorf("%w: request id %d exceeds maximum %d", ErrInvalidRequest, req.Id, match.MaxOrderId)
+	}
+	inst := desk.engine.Instrument(req.ArtworkId)
+	inst.MaxQuantity = 0
+	if err := inst.CheckOrder(req.Quantity, inst.Price(inst.MinPrice)); err != nil {
+		return Rfq{}, err
+	}
+
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	if _, ok := desk.requests[req.Id]; ok {
+		return Rfq{}, fmt.Errorf("%w: %d", ErrRequestExists, req.Id)
+	}
+	now := time.Now()
+	r := &Rfq{
+		Request:     req,
+		Status:      RFQ_OPEN,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(req.Window),
+	}
+	desk.requests[req.Id] = r
+	time.AfterFunc(req.Window, func() { desk.expire(req.Id) })
+
+	if desk.listener != nil {
+		desk.listener(r.snapshot())
+	}
+	return r.snapshot(), nil
+}
+
+// Respond quotes the request's whole quantity at quotePrice for a
+// registered market maker, locking the maker's fractions until the request
+// closes. A maker quoting again replaces their earlier quote.
+func (desk *Desk) Respond(requestId, quoteId, makerId uint64, quotePrice price.Price) (Rfq, error) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	if !desk.makers[makerId] {
+		return Rfq{}, fmt.Errorf("%w: user %d", ErrNotMarketMaker, makerId)
+	}
+	if quoteId > match.MaxOrderId {
+		return Rfq{}, fmt.Errorf("%w: quote id %d exceeds maximum %d", ErrInvalidRequest, quoteId, match.MaxOrderId)
+	}
+	r, err := desk.open(requestId)
+	if err != nil {
+		return Rfq{}, err
+	}
+	inst := desk.engine.Instrument(r.ArtworkId)
+	inst.MaxQuantity = 0
+	if err := inst.CheckOrder(r.Quantity, quotePrice); err != nil {
+		return Rfq{}, err
+	}
+	for _, quote := range r.Quotes {
+		if quote.Id == quoteId && quote.MakerId != makerId {
+			return Rfq{}, fmt.Errorf("%w: quote %d is another maker's", ErrInvalidRequest, quoteId)
+		}
+	}
+
+	// the maker's earlier quote stops holding fractions the new one needs,
+	// and stands if the new one cannot be locked
+	previous, replacing := desk.withdraw(r, makerId)
+	ask := pqueue.NewAsk(match.QuoteOrderId(quoteId), makerId, r.ArtworkId, r.Quantity, quotePrice)
+	if err := desk.engine.LockHoldings(ask); err != nil {
+		if replacing {
+			if relockErr := desk.engine.LockHoldings(previous.ask); relockErr != nil {
+				log.Printf("failed to restore quote %d on request %d: %v", previous.Id, r.Id, relockErr)
+			} else {
+				add(r, previous)
+			}
+		}
+		return Rfq{}, err
+	}
+	add(r, Quote{Id: quoteId, MakerId: makerId, Price: quotePrice, QuotedAt: ask.PlacedAt, ask: ask})
+	return r.snapshot(), nil
+}
+
+// Accept buys the request's quantity on the given quote, reserving the
+// requester's funds and crossing the trade through the engine. Every other
+// quote is released.
+func (desk *Desk) Accept(requestId, quoteId uint64) (Rfq, error) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	r, err := desk.open(requestId)
+	if err != nil {
+		return Rfq{}, err
+	}
+	var quote *Quote
+	for i := range r.Quotes {
+		if r.Quotes[i].Id == quoteId {
+			quote = &r.Quotes[i]
+		}
+	}
+	if quote == nil {
+		return Rfq{}, fmt.Errorf("%w: %d on request %d", ErrQuoteNotFound, quoteId, requestId)
+	}
+
+	bid := pqueue.NewBid(match.RfqOrderId(r.Id), r.RequesterId, r.ArtworkId, r.Quantity, quote.Price)
+	if err := desk.engine.ReserveFunds(bid); err != nil {
+		return Rfq{}, err
+	}
+	fill, err := desk.engine.Cross(bid, quote.ask, quote.Price, r.Quantity, match.SIDE_BID)
+	if err != nil {
+		if releaseErr := desk.engine.ReleaseFunds(bid); releaseErr != nil {
+			log.Printf("failed to release request %d: %v", r.Id, releaseErr)
+		}
+		return Rfq{}, err
+	}
+
+	r.Status, r.Accepted, r.Fill = RFQ_FILLED, quoteId, &fill
+	desk.release(r)
+	return r.snapshot(), nil
+}
+
+// Cancel withdraws an open request, releasing its quotes.
+func (desk *Desk) Cancel(requestId uint64) (Rfq, error) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	r, err := desk.open(requestId)
+	if err != nil {
+		return Rfq{}, err
+	}
+	r.Status = RFQ_CANCELLED
+	desk.release(r)
+	return r.snapshot(), nil
+}
+
+func (desk *Desk) expire(requestId uint64) {
+	desk.mu.Lock()
+	defer desk.mu.Unlock()
+
+	if r := desk.requests[requestId]; r.Status == RFQ_OPEN {
+		r.Status = RFQ_EXPIRED
+		desk.release(r)
+	}
+}
+
+// open returns the request if it can still be quoted and accepted.
+func (desk *Desk) open(requestId uint64) (*Rfq, error) {
+	r, ok := desk.requests[requestId]
+	if !ok {
+		return nil, ErrRequestNotFound
+	}
+	if r.Status != RFQ_OPEN || !time.Now().Before(r.ExpiresAt) {
+		return nil, fmt.Errorf("%w: request %d is %s", ErrRequestClosed, requestId, StatusName(r.Status))
+	}
+	return r, nil
+}
+
+// withdraw removes the maker's quote from the request, unlocking it, and
+// returns it if there was one.
+func (desk *Desk) withdraw(r *Rfq, makerId uint64) (Quote, bool) {
+	for i, quote := range r.Quotes {
+		if quote.MakerId != makerId {
+			continue
+		}
+		if err := desk.engine.UnlockHoldings(quote.ask); err != nil {
+			log.Printf("failed to unlock quote %d on request %d: %v", quote.Id, r.Id, err)
+		}
+		r.Quotes = append(r.Quotes[:i], r.Quotes[i+1:]...)
+		return quote, true
+	}
+	return Quote{}, false
+}
+
+// add puts the quote among the request's, best price first, then earliest.
+func add(r *Rfq, quote Quote) {
+	r.Quotes = append(r.Quotes, quote)
+	sort.SliceStable(r.Quotes, func(i, j int) bool {
+		if cmp := r.Quotes[i].Price.Cmp(r.Quotes[j].Price); cmp != 0 {
+			return cmp < 0
+		}
+		return r.Quotes[i].QuotedAt.Before(r.Quotes[j].QuotedAt)
+	})
+}
+
+// release unlocks every quote on a closed request; an accepted quote has
+// nothing left locked.
+func (desk *Desk) release(r *Rfq) {
+	for _, quote := range r.Quotes {
+		if err := desk.engine.UnlockHoldings(quote.ask); err != nil {
+			log.Printf("failed to unlock quote %d on request %d: %v", quote.Id, r.Id, err)
+		}
+	}
+}
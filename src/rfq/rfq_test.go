@@ -0,0 +1,222 @@
+package rfq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+const (
+	artworkId   = 1
+	requesterId = 10
+	makerA      = 20
+	makerB      = 21
+)
+
+// setupDesk returns a desk on an engine whose fills are sent to the
+// returned channel, with both makers registered and holding 100 fractions
+// and the requester 5000.00 USD.
+func setupDesk() (*Desk, *account.Memory, *holdings.Memory, chan match.FillOrder) {
+	engine := match.New()
+	inst := instrument.Default
+	inst.ArtworkId = artworkId
+	inst.MaxQuantity = 10
+	engine.SetInstrument(inst)
+
+	accounts := account.NewMemory()
+	accounts.Deposit(requesterId, "USD", price.New(500000, 2))
+	engine.SetAccountService(accounts)
+	ledger := holdings.NewMemory()
+	ledger.Credit(makerA, artworkId, 100)
+	ledger.Credit(makerB, artworkId, 100)
+	engine.SetHoldingsLedger(ledger)
+
+	fills := make(chan match.FillOrder, 8)
+	go func() {
+		for {
+			select {
+			case fill := <-engine.Orders():
+				fills <- fill
+			case <-engine.Jobs():
+			}
+		}
+	}()
+
+	desk := New(engine)
+	desk.SetMarketMaker(makerA, true)
+	desk.SetMarketMaker(makerB, true)
+	return desk, accounts, ledger, fills
+}
+
+func TestAcceptQuoteCrossesBlock(t *testing.T) {
+	desk, accounts, ledger, fills := setupDesk()
+
+	var broadcast []Rfq
+	desk.SetRequestListener(func(r Rfq) { broadcast = append(broadcast, r) })
+
+	// the block is larger than the artwork's maximum order
+	if _, err := desk.Open(Request{Id: 1, RequesterId: requesterId, ArtworkId: artworkId, Quantity: 50, Window: time.Second}); err != nil {
+		t.Fatalf("failed to open request: %v", err)
+	}
+	if len(broadcast) != 1 || broadcast[0].Quantity != 50 {
+		t.Fatalf("Expected the request to be broadcast, got %+v", broadcast)
+	}
+
+	if _, err := desk.Respond(1, 100, requesterId, price.New(2000, 2)); !errors.Is(err, ErrNotMarketMaker) {
+		t.Fatalf("Expected quotes from unregistered users to fail, got %v", err)
+	}
+	if _, err := desk.Respond(1, 101, makerA, price.New(2100, 2)); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if _, err := desk.Respond(1, 102, makerB, price.New(2000, 2)); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	// requoting replaces the maker's quote without locking the block twice
+	r, err := desk.Respond(1, 103, makerA, price.New(1950, 2))
+	if err != nil {
+		t.Fatalf("failed to requote: %v", err)
+	}
+	if len(r.Quotes) != 2 || r.Quotes[0].Id != 103 || r.Quotes[1].Id != 102 {
+		t.Fatalf("Expected the requote to replace the first and lead, got %+v", r.Quotes)
+	}
+	if pos := ledger.Position(makerA, artworkId); pos.Locked != 50 {
+		t.Fatalf("Expected one block locked for maker A, got %+v", pos)
+	}
+
+	r, err = desk.Accept(1, 103)
+	if err != nil {
+		t.Fatalf("failed to accept quote: %v", err)
+	}
+	if r.Status != RFQ_FILLED || r.Accepted != 103 || r.Fill == nil {
+		t.Fatalf("Expected the request to fill on quote 103, got %+v", r)
+	}
+
+	select {
+	case fill := <-fills:
+		if fill.BuyerId != requesterId || fill.SellerId != makerA || fill.QuantityFilled != 50 || fill.Price.String() != "19.50" {
+			t.Fatalf("Expected maker A to sell 50 at 19.50, got %+v", fill)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("fill was not sent")
+	}
+	if balance := accounts.Balance(requesterId, "USD"); balance.Available.String() != "4025.00" || !balance.Reserved.IsZero() {
+		t.Errorf("Expected the requester to pay 975.00, got %+v", balance)
+	}
+	if pos := ledger.Position(makerB, artworkId); pos.Locked != 0 || pos.Available != 100 {
+		t.Errorf("Expected maker B's quote to be released, got %+v", pos)
+	}
+	if _, err := desk.Accept(1, 102); !errors.Is(err, ErrRequestClosed) {
+		t.Errorf("Expected a filled request not to be accepted again, got %v", err)
+	}
+}
+
+func TestRequestExpiresReleasingQuotes(t *testing.T) {
+	desk, _, ledger, _ := setupDesk()
+
+	if _, err := desk.Open(Request{Id: 1, RequesterId: requesterId, ArtworkId: artworkId, Quantity: 50, Window: 30 * time.Millisecond}); err != nil {
+		t.Fatalf("failed to open request: %v", err)
+	}
+	if _, err := desk.Respond(1, 101, makerA, price.New(2000, 2)); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if _, err := desk.Accept(1, 999); !errors.Is(err, ErrQuoteNotFound) {
+		t.Fatalf("Expected an unknown quote not to be accepted, got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		r, err := desk.Get(1)
+		if err != nil {
+			t.Fatalf("failed to get request: %v", err)
+		}
+		if r.Status == RFQ_EXPIRED {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the request to expire, got %+v", r)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if pos := ledger.Position(makerA, artworkId); pos.Locked != 0 {
+		t.Errorf("Expected the quote to be released, got %+v", pos)
+	}
+	if _, err := desk.Respond(1, 102, makerB, price.New(2000, 2)); !errors.Is(err, ErrRequestClosed) {
+		t.Errorf("Expected quotes after the window to fail, got %v", err)
+	}
+}
+
+func TestAcceptRefusedWhileHalted(t *testing.T) {
+	desk, accounts, ledger, _ := setupDesk()
+
+	if _, err := desk.Open(Request{Id: 1, RequesterId: requesterId, ArtworkId: artworkId, Quantity: 50, Window: time.Second}); err != nil {
+		t.Fatalf("failed to open request: %v", err)
+	}
+	if _, err := desk.Respond(1, 101, makerA, price.New(2000, 2)); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if _, err := desk.engine.SetTradingPhase(artworkId, match.TRADING_HALTED, "news pending"); err != nil {
+		t.Fatalf("failed to halt artwork: %v", err)
+	}
+
+	if _, err := desk.Accept(1, 101); !errors.Is(err, match.ErrTradingHalted) {
+		t.Fatalf("Expected the quote not to be accepted while halted, got %v", err)
+	}
+	if balance := accounts.Balance(requesterId, "USD"); balance.Available.String() != "5000.00" || !balance.Reserved.IsZero() {
+		t.Errorf("Expected the requester's funds to be released, got %+v", balance)
+	}
+	if pos := ledger.Position(makerA, artworkId); pos.Locked != 50 {
+		t.Errorf("Expected the quote to stay firm, got %+v", pos)
+	}
+
+	if _, err := desk.engine.SetTradingPhase(artworkId, match.TRADING_OPEN, "news out"); err != nil {
+		t.Fatalf("failed to reopen artwork: %v", err)
+	}
+	if r, err := desk.Accept(1, 101); err != nil || r.Status != RFQ_FILLED {
+		t.Fatalf("Expected the quote to be accepted once reopened, got %+v (%v)", r, err)
+	}
+}
+
+func TestQuoteLockIsApartFromBookAsks(t *testing.T) {
+	desk, _, ledger, fills := setupDesk()
+	otherArtworkId := uint64(artworkId + 1)
+	desk.engine.AddArtworkIfNotExists(otherArtworkId)
+	ledger.Credit(makerA, otherArtworkId, 5)
+
+	// the maker's own ask with the quote's id locks another artwork
+	if _, err := desk.engine.FillAskOrder(pqueue.NewAsk(101, makerA, otherArtworkId, 5, price.New(2000, 2))); err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+
+	if _, err := desk.Open(Request{Id: 1, RequesterId: requesterId, ArtworkId: artworkId, Quantity: 50, Window: time.Second}); err != nil {
+		t.Fatalf("failed to open request: %v", err)
+	}
+	if _, err := desk.Respond(1, 101, makerA, price.New(2000, 2)); err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if _, err := desk.Accept(1, 101); err != nil {
+		t.Fatalf("failed to accept quote: %v", err)
+	}
+	select {
+	case fill := <-fills:
+		if fill.BidId != match.RfqOrderId(1) || fill.AskId != match.QuoteOrderId(101) {
+			t.Fatalf("Expected the fill between the desk's orders, got %+v", fill)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("fill was not sent")
+	}
+	if pos := ledger.Position(makerA, otherArtworkId); pos.Locked != 5 {
+		t.Errorf("Expected the book ask to stay locked, got %+v", pos)
+	}
+
+	if _, err := desk.Respond(1, match.MaxOrderId+1, makerB, price.New(2000, 2)); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected a quote id above the order ids to be refused, got %v", err)
+	}
+}
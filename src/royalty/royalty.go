@@ -0,0 +1,350 @@
+// royalties pay an artwork's artists a share of every resale of its
+// fractions. Each artwork has a royalty rate in basis points of the fill's
+// notional, paid out of the seller's proceeds and split between one or more
+// recipients by their share of the royalty. The royalty only takes what the
+// seller's fee leaves of the proceeds, so together they never exceed the
+// notional.
+
+package royalty
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"fractr-marketplace-secondary/libstore"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+)
+
+const maxBps = 10000
+
+var ErrAlreadyReversed = errors.New("royalty: fill already reversed")
+
+type Recipient struct {
+	UserId   uint64 `json:"user_id"`
+	ShareBps uint32 `json:"share_bps"` // share of the royalty, not of the notional
+}
+
+type Terms struct {
+	ArtworkId  uint64      `json:"artwork_id"`
+	RateBps    uint32      `json:"rate_bps"`
+	Recipients []Recipient `json:"recipients"`
+}
+
+func (terms Terms) Validate() error {
+	if terms.RateBps > maxBps {
+		return fmt.Errorf("royalty rate %d bps exceeds %d", terms.RateBps, maxBps)
+	}
+	if terms.RateBps > 0 && len(terms.Recipients) == 0 {
+		return fmt.Errorf("royalty has no recipients")
+	}
+
+	var total uint32
+	for _, recipient := range terms.Recipients {
+		total += recipient.ShareBps
+	}
+	if len(terms.Recipients) > 0 && total != maxBps {
+		return fmt.Errorf("recipient shares add up to %d bps, not %d", total, maxBps)
+	}
+	return nil
+}
+
+// Payout is the royalty owed to one recipient on one fill.
+type Payout struct {
+	FillId      uint64      `json:"fill_id"`
+	ArtworkId   uint64      `json:"artwork_id"`
+	SellerId    uint64      `json:"seller_id"`
+	RecipientId uint64      `json:"recipient_id"`
+	Amount      price.Price `json:"amount"`
+	Currency    string      `json:"currency"`
+}
+
+// Registry holds the royalty terms of every artwork. It is safe for
+// concurrent use.
+type Registry struct {
+	terms map[uint64]Terms // key: artworkId
+	mu    sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		terms: make(map[uint64]Terms),
+	}
+}
+
+func (r *Registry) Set(terms Terms) error {
+	if err := terms.Validate(); err != nil {
+		return fmt.Errorf("artwork %d: %v", terms.ArtworkId, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.terms[terms.ArtworkId] = terms
+	return nil
+}
+
+func (r *Registry) Get(artworkId uint64) (Terms, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	terms, ok := r.terms[artworkId]
+	return terms, ok
+}
+
+// LoadFile reads royalty terms from a JSON file laid out as
+//
+//	{"royalties": [{"artwork_id": 1, "rate_bps": 500, "recipients": [{"user_id": 9, "share_bps": 10000}]}]}
+func LoadFile(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read royalty config: %v", err)
+	}
+
+	var cfg struct {
+		Royalties []Terms `json:"royalties"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse royalty config: %v", err)
+	}
+
+	registry := NewRegistry()
+	for _, terms := range cfg.Royalties {
+		if err := registry.Set(terms); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// Split computes the payouts owed on a fill. The royalty is rounded down
+// and capped at what the seller's fee leaves of the notional, and each recipient's share of it is rounded down with the units left over
+// going to the first recipient, so the payouts always add up to the royalty.
+// Artworks without terms owe nothing.
+func (r *Registry) Split(order match.FillOrder) ([]Payout, error) {
+	terms, ok := r.Get(order.ArtworkId)
+	if !ok || terms.RateBps == 0 {
+		return nil, nil
+	}
+
+	notional, err := order.Notional()
+	if err != nil {
+		return nil, err
+	}
+	royalty, err := notional.MulDiv(uint64(terms.RateBps), maxBps)
+	if err != nil {
+		return nil, err
+	}
+	proceeds, err := notional.Sub(order.SellerFee)
+	if err != nil {
+		return nil, fmt.Errorf("seller fee %s exceeds notional %s", order.SellerFee, notional)
+	}
+	if royalty.Cmp(proceeds) > 0 {
+		royalty = proceeds
+	}
+
+	payouts := make([]Payout, len(terms.Recipients))
+	remaining := royalty
+	for i, recipient := range terms.Recipients {
+		share, err := royalty.MulDiv(uint64(recipient.ShareBps), maxBps)
+		if err != nil {
+			return nil, err
+		}
+		if remaining, err = remaining.Sub(share); err != nil {
+			return nil, err
+		}
+		payouts[i] = Payout{
+			FillId:      order.Id,
+			ArtworkId:   order.ArtworkId,
+			SellerId:    order.SellerId,
+			RecipientId: recipient.UserId,
+			Amount:      share,
+			Currency:    order.Currency,
+		}
+	}
+	if payouts[0].Amount, err = payouts[0].Amount.Add(remaining); err != nil {
+		return nil, err
+	}
+
+	return payouts, nil
+}
+
+// Total is what one artist has earned from one artwork in one currency.
+type Total struct {
+	ArtworkId uint64      `json:"artwork_id"`
+	Currency  string      `json:"currency"`
+	Amount    price.Price `json:"amount"`
+	Fills     uint64      `json:"fills"`
+}
+
+type totalKey struct {
+	recipientId uint64
+	artworkId   uint64
+	currency    string
+}
+
+// Report accumulates payouts per artist. It is safe for concurrent use. A
+// report opened on a journal appends the payouts it records or reverses to
+// it before applying them and replays it on open.
+type Report struct {
+	totals   map[totalKey]*Total
+	reversed map[uint64]bool   // fills whose payouts have been reversed
+	journal  *libstore.Journal // nil keeps the report in memory only
+	mu       sync.Mutex
+}
+
+// reportRecord is one journal record: payouts recorded, or reversed.
+type reportRecord struct {
+	Payouts  []Payout `json:"payouts"`
+	Reversed bool     `json:"reversed,omitempty"`
+}
+
+func NewReport() *Report {
+	return &Report{
+		totals:   make(map[totalKey]*Total),
+		reversed: make(map[uint64]bool),
+	}
+}
+
+func OpenReport(path string) (*Report, error) {
+	journal, err := libstore.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := NewReport()
+	err = journal.Replay(func(record json.RawMessage) error {
+		var rec reportRecord
+		if err := json.Unmarshal(record, &rec); err != nil {
+			return err
+		}
+		totals, err := report.applied(rec.Payouts, rec.Reversed)
+		if err != nil {
+			return err
+		}
+		report.commit(totals, rec.Payouts, rec.Reversed)
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to replay royalty report: %v", err)
+	}
+
+	report.journal = journal
+	return report, nil
+}
+
+func (report *Report) Close() error {
+	if report.journal == nil {
+		return nil
+	}
+	return report.journal.Close()
+}
+
+func (report *Report) Record(payouts []Payout) error {
+	return report.update(payouts, false)
+}
+
+// Artist returns the artist's totals ordered by artwork and currency.
+func (report *Report) Artist(recipientId uint64) []Total {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	var totals []Total
+	for key, total := range report.totals {
+		if key.recipientId == recipientId {
+			totals = append(totals, *total)
+		}
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].ArtworkId != totals[j].ArtworkId {
+			return totals[i].ArtworkId < totals[j].ArtworkId
+		}
+		return totals[i].Currency < totals[j].Currency
+	})
+	return totals
+}
+
+// Reverse takes payouts recorded earlier back out of the totals, e.g. when
+// the fill they were paid on is busted. It fails with ErrAlreadyReversed if
+// a fill's payouts have been reversed before.
+func (report *Report) Reverse(payouts []Payout) error {
+	return report.update(payouts, true)
+}
+
+// update applies the payouts to the totals only once they are safely in the
+// journal.
+func (report *Report) update(payouts []Payout, reversed bool) error {
+	if len(payouts) == 0 {
+		return nil
+	}
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	totals, err := report.applied(payouts, reversed)
+	if err != nil {
+		return err
+	}
+	if report.journal != nil {
+		if err := report.journal.Append(reportRecord{Payouts: payouts, Reversed: reversed}); err != nil {
+			return err
+		}
+	}
+	report.commit(totals, payouts, reversed)
+	return nil
+}
+
+// applied returns the totals the payouts would leave, without changing the
+// report, so payouts that cannot all be applied are refused whole.
+func (report *Report) applied(payouts []Payout, reversed bool) (map[totalKey]Total, error) {
+	totals := make(map[totalKey]Total, len(payouts))
+	for _, payout := range payouts {
+		key := totalKey{payout.RecipientId, payout.ArtworkId, payout.Currency}
+		total, ok := totals[key]
+		if !ok {
+			total = Total{ArtworkId: payout.ArtworkId, Currency: payout.Currency}
+			if current, ok := report.totals[key]; ok {
+				total = *current
+			}
+		}
+
+		var amount price.Price
+		var err error
+		if reversed {
+			if report.reversed[payout.FillId] {
+				return nil, fmt.Errorf("%w: %d", ErrAlreadyReversed, payout.FillId)
+			}
+			if total.Fills == 0 {
+				return nil, fmt.Errorf("no royalties of user %d on artwork %d to reverse", payout.RecipientId, payout.ArtworkId)
+			}
+			amount, err = total.Amount.Sub(payout.Amount)
+			total.Fills--
+		} else {
+			amount, err = total.Amount.Add(payout.Amount)
+			total.Fills++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("royalty total of user %d on artwork %d: %v", payout.RecipientId, payout.ArtworkId, err)
+		}
+		total.Amount = amount
+		totals[key] = total
+	}
+	return totals, nil
+}
+
+func (report *Report) commit(totals map[totalKey]Total, payouts []Payout, reversed bool) {
+	for key, total := range totals {
+		total := total
+		report.totals[key] = &total
+	}
+	if reversed {
+		for _, payout := range payouts {
+			report.reversed[payout.FillId] = true
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package royalty
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+)
+
+func TestSplitRoundsDeterministically(t *testing.T) {
+	registry := NewRegistry()
+	err := registry.Set(Terms{
+		ArtworkId: 1,
+		RateBps:   1000, // 10%
+		Recipients: []Recipient{
+			{UserId: 10, ShareBps: 3334},
+			{UserId: 11, ShareBps: 3333},
+			{UserId: 12, ShareBps: 3333},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to set terms: %v", err)
+	}
+
+	// notional 1.00, royalty 0.10 split three ways
+	fill := match.FillOrder{Id: 5, ArtworkId: 1, SellerId: 20, Price: price.New(100, 2), QuantityFilled: 1, Currency: "USD"}
+	payouts, err := registry.Split(fill)
+	if err != nil {
+		t.Fatalf("failed to split royalty: %v", err)
+	}
+	if len(payouts) != 3 {
+		t.Fatalf("Expected 3 payouts, got %d", len(payouts))
+	}
+
+	total := price.New(0, 2)
+	for _, payout := range payouts {
+		total, _ = total.Add(payout.Amount)
+		if payout.FillId != 5 || payout.SellerId != 20 {
+			t.Errorf("Payout not traced to its fill: %+v", payout)
+		}
+	}
+	if total.Cmp(price.New(10, 2)) != 0 {
+		t.Errorf("Expected payouts to add up to 0.10, got %v", total)
+	}
+	if payouts[0].Amount.Cmp(price.New(4, 2)) != 0 {
+		t.Errorf("Expected the first recipient to receive the remainder 0.04, got %v", payouts[0].Amount)
+	}
+}
+
+func TestSplitWithoutTerms(t *testing.T) {
+	payouts, err := NewRegistry().Split(match.FillOrder{ArtworkId: 1, Price: price.New(100, 2), QuantityFilled: 1})
+	if err != nil || payouts != nil {
+		t.Errorf("Expected no payouts, got %v (%v)", payouts, err)
+	}
+}
+
+func TestValidateShares(t *testing.T) {
+	terms := Terms{ArtworkId: 1, RateBps: 500, Recipients: []Recipient{{UserId: 1, ShareBps: 9000}}}
+	if err := terms.Validate(); err == nil {
+		t.Errorf("Expected shares not adding up to 100%% to be rejected")
+	}
+	if err := (Terms{ArtworkId: 1, RateBps: 500}).Validate(); err == nil {
+		t.Errorf("Expected royalty without recipients to be rejected")
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := NewReport()
+	report.Record([]Payout{
+		{ArtworkId: 2, RecipientId: 9, Amount: price.New(150, 2), Currency: "USD"},
+		{ArtworkId: 1, RecipientId: 9, Amount: price.New(100, 2), Currency: "USD"},
+		{ArtworkId: 1, RecipientId: 9, Amount: price.New(50, 2), Currency: "USD"},
+		{ArtworkId: 1, RecipientId: 8, Amount: price.New(50, 2), Currency: "USD"},
+	})
+
+	totals := report.Artist(9)
+	if len(totals) != 2 {
+		t.Fatalf("Expected totals for 2 artworks, got %+v", totals)
+	}
+	if totals[0].ArtworkId != 1 || totals[0].Amount.String() != "1.50" || totals[0].Fills != 2 {
+		t.Errorf("Unexpected total for artwork 1: %+v", totals[0])
+	}
+}
+
+func TestSplitLeavesRoomForSellerFee(t *testing.T) {
+	registry := NewRegistry()
+	err := registry.Set(Terms{
+		ArtworkId:  1,
+		RateBps:    6000, // 60%
+		Recipients: []Recipient{{UserId: 10, ShareBps: 10000}},
+	})
+	if err != nil {
+		t.Fatalf("failed to set terms: %v", err)
+	}
+
+	// notional 1.00 less a 0.50 minimum fee leaves 0.50 of the 0.60 royalty
+	fill := match.FillOrder{Id: 5, ArtworkId: 1, SellerId: 20, Price: price.New(100, 2), QuantityFilled: 1, Currency: "USD", SellerFee: price.New(50, 2)}
+	payouts, err := registry.Split(fill)
+	if err != nil {
+		t.Fatalf("failed to split royalty: %v", err)
+	}
+	if len(payouts) != 1 || payouts[0].Amount.String() != "0.50" {
+		t.Errorf("Expected the royalty capped at 0.50, got %+v", payouts)
+	}
+}
+
+func TestOpenReportReplaysJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "royalties.jsonl")
+
+	report, err := OpenReport(path)
+	if err != nil {
+		t.Fatalf("failed to open report: %v", err)
+	}
+	paid := []Payout{{FillId: 5, ArtworkId: 1, RecipientId: 9, Amount: price.New(100, 2), Currency: "USD"}}
+	busted := []Payout{{FillId: 6, ArtworkId: 1, RecipientId: 9, Amount: price.New(40, 2), Currency: "USD"}}
+	for _, payouts := range [][]Payout{paid, busted} {
+		if err := report.Record(payouts); err != nil {
+			t.Fatalf("failed to record payouts: %v", err)
+		}
+	}
+	if err := report.Reverse(busted); err != nil {
+		t.Fatalf("failed to reverse payouts: %v", err)
+	}
+	report.Close()
+
+	report, err = OpenReport(path)
+	if err != nil {
+		t.Fatalf("failed to reopen report: %v", err)
+	}
+	defer report.Close()
+
+	// a retried bust does not take the payouts out twice
+	if err := report.Reverse(busted); !errors.Is(err, ErrAlreadyReversed) {
+		t.Errorf("Expected reversing the payouts again to be refused, got %v", err)
+	}
+	totals := report.Artist(9)
+	if len(totals) != 1 || totals[0].Amount.String() != "1.00" || totals[0].Fills != 1 {
+		t.Errorf("Expected the artist's total to survive a restart, got %+v", totals)
+	}
+}
@@ -0,0 +1,100 @@
+// account RPCs let operators fund buyers and credit sellers with fractions,
+// e.g. from a primary sale, while balances and positions are kept in
+// memory. They are served through the admin gateway.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/price"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type DepositRequest struct {
+	UserId   uint64      `json:"user_id"`
+	Currency string      `json:"currency"`
+	Amount   price.Price `json:"amount"`
+	Operator string      `json:"operator"`
+	Reason   string      `json:"reason"`
+}
+
+type DepositResponse struct {
+	Balance account.Balance `json:"balance"`
+}
+
+type CreditHoldingsRequest struct {
+	UserId    uint64 `json:"user_id"`
+	ArtworkId uint64 `json:"artwork_id"`
+	Quantity  uint64 `json:"quantity"`
+	Operator  string `json:"operator"`
+	Reason    string `json:"reason"`
+}
+
+type CreditHoldingsResponse struct {
+	Position holdings.Position `json:"position"`
+}
+
+// Deposit adds funds to a user's available balance for bidding.
+func (server *Server) Deposit(
+	ctx context.Context,
+	req *DepositRequest,
+) (*DepositResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+	if server.accounts == nil {
+		return nil, status.Error(codes.FailedPrecondition, "funds are not checked, so cannot be deposited")
+	}
+	if req.Currency == "" {
+		return nil, invalidArgument(fieldViolation("currency", "currency is required"))
+	}
+	if err := server.accounts.Deposit(req.UserId, req.Currency, req.Amount); err != nil {
+		return nil, invalidArgument(fieldViolation("amount", err.Error()))
+	}
+
+	server.recordAudit(audit.Entry{
+		Action:   "DEPOSIT",
+		Operator: req.Operator,
+		Reason:   req.Reason,
+		Detail:   fmt.Sprintf("user %d: %s %s", req.UserId, req.Amount, req.Currency),
+	})
+	return &DepositResponse{Balance: server.accounts.Balance(req.UserId, req.Currency)}, nil
+}
+
+// CreditHoldings adds fractions of an artwork to a user's position for
+// selling.
+func (server *Server) CreditHoldings(
+	ctx context.Context,
+	req *CreditHoldingsRequest,
+) (*CreditHoldingsResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+	if server.positions == nil {
+		return nil, status.Error(codes.FailedPrecondition, "holdings are not checked, so cannot be credited")
+	}
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, artworkNotListed("artwork_id", req.ArtworkId)
+	}
+	if err := server.positions.Credit(req.UserId, req.ArtworkId, req.Quantity); err != nil {
+		return nil, invalidArgument(fieldViolation("quantity", err.Error()))
+	}
+
+	server.recordAudit(audit.Entry{
+		Action:    "CREDIT_HOLDINGS",
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+		ArtworkId: req.ArtworkId,
+		Detail:    fmt.Sprintf("user %d: %d fractions", req.UserId, req.Quantity),
+	})
+	return &CreditHoldingsResponse{Position: server.positions.Position(req.UserId, req.ArtworkId)}, nil
+}
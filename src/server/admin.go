@@ -0,0 +1,174 @@
+// admin RPCs let operators change market configuration while the server is
+// running. They are served through the admin gateway.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type SetInstrumentRequest struct {
+	Instrument instrument.Instrument `json:"instrument"`
+}
+
+type SetInstrumentResponse struct {
+	Instrument instrument.Instrument `json:"instrument"`
+}
+
+type GetInstrumentRequest struct {
+	ArtworkId uint64 `json:"artwork_id"`
+}
+
+type GetInstrumentResponse struct {
+	Instrument instrument.Instrument `json:"instrument"`
+}
+
+// SetInstrument replaces the trading rules of an artwork, listing the artwork
+// if it was not listed before.
+func (server *Server) SetInstrument(
+	ctx context.Context,
+	req *SetInstrumentRequest,
+) (*SetInstrumentResponse, error) {
+
+	if err := server.match.SetInstrument(req.Instrument); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &SetInstrumentResponse{
+		Instrument: server.match.Instrument(req.Instrument.ArtworkId),
+	}, nil
+}
+
+func (server *Server) GetInstrument(
+	ctx context.Context,
+	req *GetInstrumentRequest,
+) (*GetInstrumentResponse, error) {
+
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, status.Errorf(codes.NotFound, "artwork %d is not listed for trading", req.ArtworkId)
+	}
+
+	return &GetInstrumentResponse{
+		Instrument: server.match.Instrument(req.ArtworkId),
+	}, nil
+}
+
+type SetTradingPhaseRequest struct {
+	ArtworkId uint64 `json:"artwork_id"`
+	Phase     string `json:"phase"` // OPEN, HALTED, CANCEL_ONLY or AUCTION
+	// AuctionSeconds closes an AUCTION after that long; 0 leaves it open
+	// until the phase is set to OPEN.
+	AuctionSeconds uint64 `json:"auction_seconds"`
+	Operator       string `json:"operator"`
+	Reason         string `json:"reason"`
+}
+
+type TradingPhase struct {
+	ArtworkId uint64    `json:"artwork_id"`
+	Phase     string    `json:"phase"`
+	Reason    string    `json:"reason,omitempty"`
+	Since     time.Time `json:"since"`
+	ReopensAt time.Time `json:"reopens_at"` // when a price band halt or timed auction ends
+
+	IndicativePrice  price.Price `json:"indicative_price"` // while in AUCTION
+	IndicativeVolume uint64      `json:"indicative_volume"`
+}
+
+type SetTradingPhaseResponse struct {
+	TradingPhase TradingPhase `json:"trading_phase"`
+	// Fills are the trades made reopening the book, if it was reopened.
+	Fills []match.FillOrder `json:"fills"`
+}
+
+type GetTradingPhaseRequest struct {
+	ArtworkId uint64 `json:"artwork_id"`
+}
+
+type GetTradingPhaseResponse struct {
+	TradingPhase TradingPhase `json:"trading_phase"`
+}
+
+// SetTradingPhase halts or resumes trading in an artwork. A HALTED book
+// keeps accepting orders without matching them; a CANCEL_ONLY book rejects
+// new orders; an AUCTION book accumulates orders, publishing the price it
+// would clear at, until it closes. Reopening a book matches the orders
+// crossed while it was halted, and closing an auction fills them at its
+// clearing price.
+func (server *Server) SetTradingPhase(
+	ctx context.Context,
+	req *SetTradingPhaseRequest,
+) (*SetTradingPhaseResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+	phase, err := match.ParsePhase(req.Phase)
+	if err != nil {
+		return nil, invalidArgument(fieldViolation("phase", err.Error()))
+	}
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, status.Errorf(codes.NotFound, "artwork %d is not listed for trading", req.ArtworkId)
+	}
+
+	previous := server.match.TradingStatus(req.ArtworkId)
+	var fills []match.FillOrder
+	if phase == match.TRADING_AUCTION {
+		err = server.match.StartAuction(req.ArtworkId, time.Duration(req.AuctionSeconds)*time.Second, req.Reason)
+	} else {
+		fills, err = server.match.SetTradingPhase(req.ArtworkId, phase, req.Reason)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to set trading phase of artwork %d: %v", req.ArtworkId, err)
+	}
+
+	server.recordAudit(audit.Entry{
+		Action:    "SET_TRADING_PHASE",
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+		ArtworkId: req.ArtworkId,
+		Detail: fmt.Sprintf("%s to %s, %d fills on reopening",
+			match.PhaseName(previous.Phase), match.PhaseName(phase), len(fills)),
+	})
+
+	return &SetTradingPhaseResponse{
+		TradingPhase: tradingPhase(req.ArtworkId, server.match.TradingStatus(req.ArtworkId)),
+		Fills:        fills,
+	}, nil
+}
+
+func (server *Server) GetTradingPhase(
+	ctx context.Context,
+	req *GetTradingPhaseRequest,
+) (*GetTradingPhaseResponse, error) {
+
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, status.Errorf(codes.NotFound, "artwork %d is not listed for trading", req.ArtworkId)
+	}
+
+	return &GetTradingPhaseResponse{
+		TradingPhase: tradingPhase(req.ArtworkId, server.match.TradingStatus(req.ArtworkId)),
+	}, nil
+}
+
+func tradingPhase(artworkId uint64, trading match.TradingStatus) TradingPhase {
+	return TradingPhase{
+		ArtworkId: artworkId,
+		Phase:     match.PhaseName(trading.Phase),
+		Reason:    trading.Reason,
+		Since:     trading.Since,
+		ReopensAt: trading.ReopensAt,
+
+		IndicativePrice:  trading.IndicativePrice,
+		IndicativeVolume: trading.IndicativeVolume,
+	}
+}
@@ -0,0 +1,265 @@
+// auction RPCs let sellers run timed English or Dutch auctions for a block
+// of fractions alongside the order book. They are served through the
+// gateway, and their sales reach the trade stream, ledger and settlement
+// like any other fill.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/auction"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type CreateAuctionRequest struct {
+	AuctionId       uint64      `json:"auction_id"`
+	SellerId        uint64      `json:"seller_id"`
+	ArtworkId       uint64      `json:"artwork_id"`
+	Quantity        uint64      `json:"quantity"`
+	Format          string      `json:"format"` // ENGLISH or DUTCH
+	DurationSeconds uint64      `json:"duration_seconds"`
+	StartPrice      price.Price `json:"start_price"`
+	ReservePrice    price.Price `json:"reserve_price"`
+
+	// English only
+	Increment        price.Price `json:"increment"` // one tick if unset
+	ExtensionSeconds uint64      `json:"extension_seconds"`
+
+	// Dutch only
+	Decrement   price.Price `json:"decrement"`
+	StepSeconds uint64      `json:"step_seconds"`
+}
+
+type AuctionListing struct {
+	AuctionId    uint64      `json:"auction_id"`
+	SellerId     uint64      `json:"seller_id"`
+	ArtworkId    uint64      `json:"artwork_id"`
+	Quantity     uint64      `json:"quantity"`
+	Format       string      `json:"format"`
+	Status       string      `json:"status"`
+	StartedAt    time.Time   `json:"started_at"`
+	EndsAt       time.Time   `json:"ends_at"`
+	CurrentPrice price.Price `json:"current_price"` // high bid, or the Dutch clock
+	HighBidderId uint64      `json:"high_bidder_id,omitempty"`
+	QuantitySold uint64      `json:"quantity_sold"`
+
+	Fills []match.FillOrder `json:"fills"`
+}
+
+type CreateAuctionResponse struct {
+	Auction AuctionListing `json:"auction"`
+}
+
+type PlaceAuctionBidRequest struct {
+	AuctionId uint64 `json:"auction_id"`
+	BidId     uint64 `json:"bid_id"`
+	BidderId  uint64 `json:"bidder_id"`
+	// English bids are for the whole block; Dutch bids take Quantity at the
+	// clock price if Price is at or above it.
+	Quantity uint64      `json:"quantity"`
+	Price    price.Price `json:"price"`
+}
+
+type PlaceAuctionBidResponse struct {
+	Auction AuctionListing `json:"auction"`
+}
+
+type CancelAuctionRequest struct {
+	AuctionId uint64 `json:"auction_id"`
+	SellerId  uint64 `json:"seller_id"`
+}
+
+type CancelAuctionResponse struct {
+	Auction AuctionListing `json:"auction"`
+}
+
+type GetAuctionRequest struct {
+	AuctionId uint64 `json:"auction_id"`
+}
+
+type GetAuctionResponse struct {
+	Auction AuctionListing `json:"auction"`
+}
+
+// CreateAuction lists a block of the seller's fractions for auction,
+// locking them until it closes.
+func (server *Server) CreateAuction(
+	ctx context.Context,
+	req *CreateAuctionRequest,
+) (*CreateAuctionResponse, error) {
+
+	format, err := auction.ParseFormat(req.Format)
+	if err != nil {
+		return nil, invalidArgument(fieldViolation("format", err.Error()))
+	}
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, artworkNotListed("artwork_id", req.ArtworkId)
+	}
+	if err := checkOrderIds(protoField{"auction_id", req.AuctionId}); err != nil {
+		return nil, err
+	}
+	err = checkProtoRange(
+		protoField{"seller_id", req.SellerId},
+		protoField{"artwork_id", req.ArtworkId},
+		protoField{"quantity", req.Quantity},
+		protoField{"start_price", server.protoUnits(req.ArtworkId, req.StartPrice)},
+		protoField{"reserve_price", server.protoUnits(req.ArtworkId, req.ReservePrice)},
+		protoField{"increment", server.protoUnits(req.ArtworkId, req.Increment)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := server.auctions.Create(auction.Listing{
+		Id:         req.AuctionId,
+		SellerId:   req.SellerId,
+		ArtworkId:  req.ArtworkId,
+		Quantity:   req.Quantity,
+		Format:     format,
+		Duration:   time.Duration(req.DurationSeconds) * time.Second,
+		StartPrice: req.StartPrice,
+		Reserve:    req.ReservePrice,
+		Increment:  req.Increment,
+		Extension:  time.Duration(req.ExtensionSeconds) * time.Second,
+		Decrement:  req.Decrement,
+		Step:       time.Duration(req.StepSeconds) * time.Second,
+	})
+	if err != nil {
+		return nil, auctionRejected(req.AuctionId, err)
+	}
+	return &CreateAuctionResponse{Auction: auctionListing(a)}, nil
+}
+
+// PlaceAuctionBid bids on an open auction. An English bid reserves its
+// funds until it is outbid or the auction closes; a Dutch bid buys at the
+// clock price at once.
+func (server *Server) PlaceAuctionBid(
+	ctx context.Context,
+	req *PlaceAuctionBidRequest,
+) (*PlaceAuctionBidResponse, error) {
+
+	var units uint64
+	if a, err := server.auctions.Get(req.AuctionId); err == nil {
+		units = server.protoUnits(a.ArtworkId, req.Price)
+	}
+	if err := checkOrderIds(protoField{"bid_id", req.BidId}); err != nil {
+		return nil, err
+	}
+	err := checkProtoRange(
+		protoField{"bidder_id", req.BidderId},
+		protoField{"quantity", req.Quantity},
+		protoField{"price", units},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bid := pqueue.NewBid(req.BidId, req.BidderId, 0, req.Quantity, req.Price)
+	a, err := server.auctions.Bid(req.AuctionId, bid)
+	if err != nil {
+		return nil, auctionRejected(req.AuctionId, err)
+	}
+	return &PlaceAuctionBidResponse{Auction: auctionListing(a)}, nil
+}
+
+// CancelAuction withdraws an auction that has not been bid on, unlocking
+// its unsold fractions.
+func (server *Server) CancelAuction(
+	ctx context.Context,
+	req *CancelAuctionRequest,
+) (*CancelAuctionResponse, error) {
+
+	a, err := server.auctions.Get(req.AuctionId)
+	if err != nil {
+		return nil, auctionRejected(req.AuctionId, err)
+	}
+	if a.SellerId != req.SellerId {
+		return nil, status.Errorf(codes.PermissionDenied, "auction %d was not listed by seller %d", req.AuctionId, req.SellerId)
+	}
+
+	a, err = server.auctions.Cancel(req.AuctionId)
+	if err != nil {
+		return nil, auctionRejected(req.AuctionId, err)
+	}
+	return &CancelAuctionResponse{Auction: auctionListing(a)}, nil
+}
+
+func (server *Server) GetAuction(
+	ctx context.Context,
+	req *GetAuctionRequest,
+) (*GetAuctionResponse, error) {
+
+	a, err := server.auctions.Get(req.AuctionId)
+	if err != nil {
+		return nil, auctionRejected(req.AuctionId, err)
+	}
+	return &GetAuctionResponse{Auction: auctionListing(a)}, nil
+}
+
+func auctionListing(a auction.Auction) AuctionListing {
+	return AuctionListing{
+		AuctionId:    a.Id,
+		SellerId:     a.SellerId,
+		ArtworkId:    a.ArtworkId,
+		Quantity:     a.Quantity,
+		Format:       auction.FormatName(a.Format),
+		Status:       auction.StatusName(a.Status),
+		StartedAt:    a.StartedAt,
+		EndsAt:       a.EndsAt,
+		CurrentPrice: a.Price(time.Now()),
+		HighBidderId: a.HighBidderId,
+		QuantitySold: a.QuantitySold,
+		Fills:        a.Fills,
+	}
+}
+
+// auctionRejected maps auction failures to gRPC errors, naming the request
+// fields at fault like orderRejected does for orders on the book.
+func auctionRejected(auctionId uint64, err error) error {
+	var ruleErr *instrument.RuleError
+
+	switch {
+	case errors.As(err, &ruleErr):
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(ruleErr.Violations))
+		for i, v := range ruleErr.Violations {
+			violations[i] = fieldViolation(v.Field, v.Description)
+		}
+		return invalidArgument(violations...)
+	case errors.Is(err, account.ErrInsufficientFunds):
+		return preconditionFailure("INSUFFICIENT_FUNDS", "bidder_id", err.Error())
+	case errors.Is(err, holdings.ErrInsufficientHoldings):
+		return preconditionFailure("INSUFFICIENT_HOLDINGS", "seller_id", err.Error())
+	case errors.Is(err, match.ErrTradingHalted):
+		return preconditionFailure("TRADING_HALTED", "artwork_id", err.Error())
+	case errors.Is(err, match.ErrOutsidePriceBand):
+		return preconditionFailure("OUTSIDE_PRICE_BAND", "price", err.Error())
+	case errors.Is(err, auction.ErrAuctionNotFound):
+		return status.Errorf(codes.NotFound, "auction %d does not exist", auctionId)
+	case errors.Is(err, auction.ErrAuctionExists):
+		return status.Errorf(codes.AlreadyExists, "auction %d already exists", auctionId)
+	case errors.Is(err, auction.ErrInvalidListing):
+		return invalidArgument(fieldViolation("auction", err.Error()))
+	case errors.Is(err, auction.ErrInvalidBid):
+		return invalidArgument(fieldViolation("quantity", err.Error()))
+	case errors.Is(err, auction.ErrBidTooLow):
+		return preconditionFailure("BID_TOO_LOW", "price", err.Error())
+	case errors.Is(err, auction.ErrAuctionClosed):
+		return preconditionFailure("AUCTION_CLOSED", "auction_id", err.Error())
+	case errors.Is(err, auction.ErrHasBids):
+		return preconditionFailure("AUCTION_HAS_BIDS", "auction_id", err.Error())
+	default:
+		return status.Errorf(codes.Internal, "auction %d failed: %v", auctionId, err)
+	}
+}
@@ -0,0 +1,215 @@
+// basket RPCs place orders on several artworks as one instruction. They
+// are served through the gateway; each leg rests and fills on its artwork's
+// book like any other order.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"fractr-marketplace-secondary/basket"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type BasketLeg struct {
+	ArtworkId uint64      `json:"artwork_id"`
+	OrderId   uint64      `json:"order_id"` // distinct for each leg
+	Side      uint32      `json:"side"`     // match.SIDE_BID or match.SIDE_ASK
+	Quantity  uint64      `json:"quantity"`
+	Price     price.Price `json:"price"`
+}
+
+type PlaceBasketRequest struct {
+	BasketId uint64      `json:"basket_id"`
+	UserId   uint64      `json:"user_id"`
+	Legs     []BasketLeg `json:"legs"`
+	// fills every leg in full at once or none of them; nothing rests
+	AllOrNone bool `json:"all_or_none"`
+}
+
+type BasketLegStatus struct {
+	ArtworkId      uint64 `json:"artwork_id"`
+	OrderId        uint64 `json:"order_id"`
+	Side           uint32 `json:"side"`
+	Status         string `json:"status"`
+	Quantity       uint64 `json:"quantity"`
+	QuantityFilled uint64 `json:"quantity_filled"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+type BasketStatus struct {
+	BasketId       uint64            `json:"basket_id"`
+	UserId         uint64            `json:"user_id"`
+	AllOrNone      bool              `json:"all_or_none"`
+	Status         string            `json:"status"`
+	Reason         string            `json:"reason,omitempty"`
+	Quantity       uint64            `json:"quantity"`
+	QuantityFilled uint64            `json:"quantity_filled"`
+	LegsFilled     int               `json:"legs_filled"`
+	Legs           []BasketLegStatus `json:"legs"`
+	PlacedAt       time.Time         `json:"placed_at"`
+}
+
+type PlaceBasketResponse struct {
+	Basket BasketStatus `json:"basket"`
+}
+
+type CancelBasketRequest struct {
+	BasketId uint64 `json:"basket_id"`
+	UserId   uint64 `json:"user_id"`
+}
+
+type CancelBasketResponse struct {
+	Basket BasketStatus `json:"basket"`
+}
+
+type GetBasketRequest struct {
+	BasketId uint64 `json:"basket_id"`
+}
+
+type GetBasketResponse struct {
+	Basket BasketStatus `json:"basket"`
+}
+
+// PlaceBasket places one order on each artwork in the basket. If a book
+// refuses a leg, the legs placed before it are cancelled and the rest are
+// not placed; the response reports what each leg did rather than failing.
+func (server *Server) PlaceBasket(
+	ctx context.Context,
+	req *PlaceBasketRequest,
+) (*PlaceBasketResponse, error) {
+
+	fields := []protoField{{"basket_id", req.BasketId}, {"user_id", req.UserId}}
+	var orderIds []protoField
+	for i, leg := range req.Legs {
+		field := fmt.Sprintf("legs[%d]", i)
+		orderIds = append(orderIds, protoField{field + ".order_id", leg.OrderId})
+		fields = append(fields,
+			protoField{field + ".artwork_id", leg.ArtworkId},
+			protoField{field + ".quantity", leg.Quantity},
+			protoField{field + ".price", server.protoUnits(leg.ArtworkId, leg.Price)},
+		)
+	}
+	if err := checkOrderIds(orderIds...); err != nil {
+		return nil, err
+	}
+	if err := checkProtoRange(fields...); err != nil {
+		return nil, err
+	}
+
+	b := basket.Basket{Id: req.BasketId, UserId: req.UserId, AllOrNone: req.AllOrNone}
+	for _, leg := range req.Legs {
+		b.Legs = append(b.Legs, basket.Leg{
+			ArtworkId: leg.ArtworkId,
+			OrderId:   leg.OrderId,
+			Side:      leg.Side,
+			Quantity:  leg.Quantity,
+			Price:     leg.Price,
+		})
+	}
+
+	placed, err := server.baskets.Place(b)
+	if err != nil {
+		return nil, basketRejected(req.BasketId, req.Legs, err)
+	}
+	return &PlaceBasketResponse{Basket: basketStatus(placed)}, nil
+}
+
+// CancelBasket cancels the legs of a basket that are still resting.
+func (server *Server) CancelBasket(
+	ctx context.Context,
+	req *CancelBasketRequest,
+) (*CancelBasketResponse, error) {
+
+	b, err := server.baskets.Cancel(req.BasketId, req.UserId)
+	if err != nil {
+		return nil, basketRejected(req.BasketId, nil, err)
+	}
+	return &CancelBasketResponse{Basket: basketStatus(b)}, nil
+}
+
+func (server *Server) GetBasket(
+	ctx context.Context,
+	req *GetBasketRequest,
+) (*GetBasketResponse, error) {
+
+	b, err := server.baskets.Get(req.BasketId)
+	if err != nil {
+		return nil, basketRejected(req.BasketId, nil, err)
+	}
+	return &GetBasketResponse{Basket: basketStatus(b)}, nil
+}
+
+func basketStatus(b basket.Basket) BasketStatus {
+	status := BasketStatus{
+		BasketId:       b.Id,
+		UserId:         b.UserId,
+		AllOrNone:      b.AllOrNone,
+		Status:         basket.StatusName(b.Status),
+		Reason:         b.Reason,
+		Quantity:       b.Quantity(),
+		QuantityFilled: b.QuantityFilled(),
+		PlacedAt:       b.PlacedAt,
+	}
+	for _, leg := range b.Legs {
+		if leg.Status == basket.STATUS_FILLED {
+			status.LegsFilled++
+		}
+		status.Legs = append(status.Legs, BasketLegStatus{
+			ArtworkId:      leg.ArtworkId,
+			OrderId:        leg.OrderId,
+			Side:           leg.Side,
+			Status:         basket.StatusName(leg.Status),
+			Quantity:       leg.Quantity,
+			QuantityFilled: leg.QuantityFilled,
+			Reason:         leg.Reason,
+		})
+	}
+	return status
+}
+
+// basketRejected maps basket failures to gRPC errors, naming the leg at
+// fault.
+func basketRejected(basketId uint64, legs []BasketLeg, err error) error {
+	var legErr *basket.LegError
+	if !errors.As(err, &legErr) {
+		switch {
+		case errors.Is(err, basket.ErrInvalidBasket):
+			return invalidArgument(fieldViolation("legs", err.Error()))
+		case errors.Is(err, basket.ErrBasketExists):
+			return status.Errorf(codes.AlreadyExists, "basket %d already exists", basketId)
+		case errors.Is(err, basket.ErrBasketNotFound):
+			return status.Errorf(codes.NotFound, "basket %d does not exist", basketId)
+		case errors.Is(err, basket.ErrNotOwner):
+			return status.Errorf(codes.PermissionDenied, "%v", err)
+		case errors.Is(err, basket.ErrBasketDone):
+			return preconditionFailure("BASKET_DONE", "basket_id", err.Error())
+		default:
+			return status.Errorf(codes.Internal, "basket %d failed: %v", basketId, err)
+		}
+	}
+
+	field := fmt.Sprintf("legs[%d]", legErr.Index)
+	var ruleErr *instrument.RuleError
+	switch {
+	case errors.As(err, &ruleErr):
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(ruleErr.Violations))
+		for i, v := range ruleErr.Violations {
+			violations[i] = fieldViolation(field+"."+v.Field, v.Description)
+		}
+		return invalidArgument(violations...)
+	case errors.Is(err, match.ErrArtworkNotListed):
+		return artworkNotListed(field+".artwork_id", legs[legErr.Index].ArtworkId)
+	default:
+		return invalidArgument(fieldViolation(field, legErr.Err.Error()))
+	}
+}
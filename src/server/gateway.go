@@ -0,0 +1,164 @@
+// the gateway serves RPCs that are not part of the marketplace proto as
+// JSON over HTTP. Each endpoint takes the same request and response types
+// as its handler on Server, so handlers keep the gRPC signature and report
+// failures as gRPC status errors. Admin RPCs are served by a separate
+// gateway on its own listener, and only to callers holding the operators'
+// token.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fractr-marketplace-secondary/feed"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rpcEndpoint adapts a gRPC-style handler to an HTTP handler that decodes
+// the request from the JSON body and encodes the response as JSON.
+func rpcEndpoint[Req any, Resp any](
+	handler func(context.Context, *Req) (*Resp, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, status.Errorf(codes.Unimplemented, "method %s not allowed", r.Method))
+			return
+		}
+
+		req := new(Req)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "malformed request: %v", err))
+			return
+		}
+
+		resp, err := handler(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	json.NewEncoder(w).Encode(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{
+		Code:    st.Code().String(),
+		Message: st.Message(),
+	})
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusMethodNotAllowed
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Gateway returns the HTTP handler serving the server's public non-proto
+// RPCs and event streams.
+func (server *Server) Gateway() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/PlacePeggedOrder", rpcEndpoint(server.PlacePeggedOrder))
+	mux.Handle("/v1/CancelOrder", rpcEndpoint(server.CancelOrder))
+	mux.Handle("/v1/PlaceTrailingStop", rpcEndpoint(server.PlaceTrailingStop))
+	mux.Handle("/v1/CancelTrailingStop", rpcEndpoint(server.CancelTrailingStop))
+	mux.Handle("/v1/GetTrailingStop", rpcEndpoint(server.GetTrailingStop))
+	mux.Handle("/v1/PlaceBasket", rpcEndpoint(server.PlaceBasket))
+	mux.Handle("/v1/CancelBasket", rpcEndpoint(server.CancelBasket))
+	mux.Handle("/v1/GetBasket", rpcEndpoint(server.GetBasket))
+	mux.Handle("/v1/MassCancel", rpcEndpoint(server.MassCancel))
+	mux.Handle("/v1/OpenSession", rpcEndpoint(server.OpenSession))
+	mux.Handle("/v1/Heartbeat", rpcEndpoint(server.Heartbeat))
+	mux.Handle("/v1/CloseSession", rpcEndpoint(server.CloseSession))
+	mux.Handle("/v1/GetRoyaltyReport", rpcEndpoint(server.GetRoyaltyReport))
+	mux.Handle("/v1/GetBalances", rpcEndpoint(server.GetBalances))
+	mux.Handle("/v1/GetSettlement", rpcEndpoint(server.GetSettlement))
+	mux.Handle("/v1/CreateAuction", rpcEndpoint(server.CreateAuction))
+	mux.Handle("/v1/PlaceAuctionBid", rpcEndpoint(server.PlaceAuctionBid))
+	mux.Handle("/v1/CancelAuction", rpcEndpoint(server.CancelAuction))
+	mux.Handle("/v1/GetAuction", rpcEndpoint(server.GetAuction))
+	mux.Handle("/v1/RequestQuote", rpcEndpoint(server.RequestQuote))
+	mux.Handle("/v1/SubmitQuote", rpcEndpoint(server.SubmitQuote))
+	mux.Handle("/v1/AcceptQuote", rpcEndpoint(server.AcceptQuote))
+	mux.Handle("/v1/CancelRfq", rpcEndpoint(server.CancelRfq))
+	mux.Handle("/v1/GetRfq", rpcEndpoint(server.GetRfq))
+	mux.Handle("/v1/MassQuote", rpcEndpoint(server.MassQuote))
+	mux.Handle("/v1/StreamSession", http.HandlerFunc(server.streamSession))
+	mux.Handle("/v1/StreamTrades", server.streamEvents(feed.EVENT_TRADE, feed.EVENT_BUST, feed.EVENT_CORRECTION))
+	mux.Handle("/v1/StreamRoyalties", server.streamEvents(feed.EVENT_ROYALTY))
+	mux.Handle("/v1/StreamQuoteRequests", server.streamEvents(feed.EVENT_QUOTE_REQUEST))
+	mux.Handle("/v1/StreamMarketData", server.streamEvents(
+		feed.EVENT_TRADE, feed.EVENT_BUST, feed.EVENT_CORRECTION, feed.EVENT_TRADING_STATUS))
+
+	// engine counters, e.g. price band halts per artwork
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// AdminGateway returns the HTTP handler serving the admin RPCs to callers
+// holding token.
+func (server *Server) AdminGateway(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/admin/SetInstrument", rpcEndpoint(server.SetInstrument))
+	mux.Handle("/v1/admin/GetInstrument", rpcEndpoint(server.GetInstrument))
+	mux.Handle("/v1/admin/SetTradingPhase", rpcEndpoint(server.SetTradingPhase))
+	mux.Handle("/v1/admin/GetTradingPhase", rpcEndpoint(server.GetTradingPhase))
+	mux.Handle("/v1/admin/BustTrade", rpcEndpoint(server.BustTrade))
+	mux.Handle("/v1/admin/CorrectTrade", rpcEndpoint(server.CorrectTrade))
+	mux.Handle("/v1/admin/SetMarketMaker", rpcEndpoint(server.SetMarketMaker))
+	mux.Handle("/v1/admin/SetQuoteLimit", rpcEndpoint(server.SetQuoteLimit))
+	mux.Handle("/v1/admin/Deposit", rpcEndpoint(server.Deposit))
+	mux.Handle("/v1/admin/CreditHoldings", rpcEndpoint(server.CreditHoldings))
+	mux.Handle("/v1/admin/MassCancel", rpcEndpoint(server.AdminMassCancel))
+	return requireToken(token, mux)
+}
+
+// requireToken refuses requests that do not carry token as a bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		presented := strings.TrimPrefix(header, "Bearer ")
+		if presented == header || token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			writeError(w, status.Error(codes.Unauthenticated, "admin RPCs need a valid operator token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
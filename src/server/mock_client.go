@@ -29,3 +29,255 @@ func (client *MockClient) PlaceAsk(
 ) (*msproto.PlaceAskResponse, error) {
 	return client.inMemServer.PlaceAsk(ctx, req)
 }
+
+func (client *MockClient) SetInstrument(
+	ctx context.Context,
+	req *SetInstrumentRequest,
+) (*SetInstrumentResponse, error) {
+	return client.inMemServer.SetInstrument(ctx, req)
+}
+
+func (client *MockClient) GetInstrument(
+	ctx context.Context,
+	req *GetInstrumentRequest,
+) (*GetInstrumentResponse, error) {
+	return client.inMemServer.GetInstrument(ctx, req)
+}
+
+func (client *MockClient) GetRoyaltyReport(
+	ctx context.Context,
+	req *GetRoyaltyReportRequest,
+) (*GetRoyaltyReportResponse, error) {
+	return client.inMemServer.GetRoyaltyReport(ctx, req)
+}
+
+func (client *MockClient) PlacePeggedOrder(
+	ctx context.Context,
+	req *PlacePeggedOrderRequest,
+) (*PlacePeggedOrderResponse, error) {
+	return client.inMemServer.PlacePeggedOrder(ctx, req)
+}
+
+func (client *MockClient) CancelOrder(
+	ctx context.Context,
+	req *CancelOrderRequest,
+) (*CancelOrderResponse, error) {
+	return client.inMemServer.CancelOrder(ctx, req)
+}
+
+func (client *MockClient) PlaceTrailingStop(
+	ctx context.Context,
+	req *PlaceTrailingStopRequest,
+) (*PlaceTrailingStopResponse, error) {
+	return client.inMemServer.PlaceTrailingStop(ctx, req)
+}
+
+func (client *MockClient) CancelTrailingStop(
+	ctx context.Context,
+	req *CancelTrailingStopRequest,
+) (*CancelTrailingStopResponse, error) {
+	return client.inMemServer.CancelTrailingStop(ctx, req)
+}
+
+func (client *MockClient) GetTrailingStop(
+	ctx context.Context,
+	req *GetTrailingStopRequest,
+) (*GetTrailingStopResponse, error) {
+	return client.inMemServer.GetTrailingStop(ctx, req)
+}
+
+func (client *MockClient) PlaceBasket(
+	ctx context.Context,
+	req *PlaceBasketRequest,
+) (*PlaceBasketResponse, error) {
+	return client.inMemServer.PlaceBasket(ctx, req)
+}
+
+func (client *MockClient) CancelBasket(
+	ctx context.Context,
+	req *CancelBasketRequest,
+) (*CancelBasketResponse, error) {
+	return client.inMemServer.CancelBasket(ctx, req)
+}
+
+func (client *MockClient) GetBasket(
+	ctx context.Context,
+	req *GetBasketRequest,
+) (*GetBasketResponse, error) {
+	return client.inMemServer.GetBasket(ctx, req)
+}
+
+func (client *MockClient) GetBalances(
+	ctx context.Context,
+	req *GetBalancesRequest,
+) (*GetBalancesResponse, error) {
+	return client.inMemServer.GetBalances(ctx, req)
+}
+
+func (client *MockClient) GetSettlement(
+	ctx context.Context,
+	req *GetSettlementRequest,
+) (*GetSettlementResponse, error) {
+	return client.inMemServer.GetSettlement(ctx, req)
+}
+
+func (client *MockClient) BustTrade(
+	ctx context.Context,
+	req *BustTradeRequest,
+) (*BustTradeResponse, error) {
+	return client.inMemServer.BustTrade(ctx, req)
+}
+
+func (client *MockClient) CorrectTrade(
+	ctx context.Context,
+	req *CorrectTradeRequest,
+) (*CorrectTradeResponse, error) {
+	return client.inMemServer.CorrectTrade(ctx, req)
+}
+
+func (client *MockClient) SetTradingPhase(
+	ctx context.Context,
+	req *SetTradingPhaseRequest,
+) (*SetTradingPhaseResponse, error) {
+	return client.inMemServer.SetTradingPhase(ctx, req)
+}
+
+func (client *MockClient) GetTradingPhase(
+	ctx context.Context,
+	req *GetTradingPhaseRequest,
+) (*GetTradingPhaseResponse, error) {
+	return client.inMemServer.GetTradingPhase(ctx, req)
+}
+
+func (client *MockClient) CreateAuction(
+	ctx context.Context,
+	req *CreateAuctionRequest,
+) (*CreateAuctionResponse, error) {
+	return client.inMemServer.CreateAuction(ctx, req)
+}
+
+func (client *MockClient) PlaceAuctionBid(
+	ctx context.Context,
+	req *PlaceAuctionBidRequest,
+) (*PlaceAuctionBidResponse, error) {
+	return client.inMemServer.PlaceAuctionBid(ctx, req)
+}
+
+func (client *MockClient) CancelAuction(
+	ctx context.Context,
+	req *CancelAuctionRequest,
+) (*CancelAuctionResponse, error) {
+	return client.inMemServer.CancelAuction(ctx, req)
+}
+
+func (client *MockClient) GetAuction(
+	ctx context.Context,
+	req *GetAuctionRequest,
+) (*GetAuctionResponse, error) {
+	return client.inMemServer.GetAuction(ctx, req)
+}
+
+func (client *MockClient) SetMarketMaker(
+	ctx context.Context,
+	req *SetMarketMakerRequest,
+) (*SetMarketMakerResponse, error) {
+	return client.inMemServer.SetMarketMaker(ctx, req)
+}
+
+func (client *MockClient) RequestQuote(
+	ctx context.Context,
+	req *RequestQuoteRequest,
+) (*RequestQuoteResponse, error) {
+	return client.inMemServer.RequestQuote(ctx, req)
+}
+
+func (client *MockClient) SubmitQuote(
+	ctx context.Context,
+	req *SubmitQuoteRequest,
+) (*SubmitQuoteResponse, error) {
+	return client.inMemServer.SubmitQuote(ctx, req)
+}
+
+func (client *MockClient) AcceptQuote(
+	ctx context.Context,
+	req *AcceptQuoteRequest,
+) (*AcceptQuoteResponse, error) {
+	return client.inMemServer.AcceptQuote(ctx, req)
+}
+
+func (client *MockClient) CancelRfq(
+	ctx context.Context,
+	req *CancelRfqRequest,
+) (*CancelRfqResponse, error) {
+	return client.inMemServer.CancelRfq(ctx, req)
+}
+
+func (client *MockClient) GetRfq(
+	ctx context.Context,
+	req *GetRfqRequest,
+) (*GetRfqResponse, error) {
+	return client.inMemServer.GetRfq(ctx, req)
+}
+
+func (client *MockClient) MassQuote(
+	ctx context.Context,
+	req *MassQuoteRequest,
+) (*MassQuoteResponse, error) {
+	return client.inMemServer.MassQuote(ctx, req)
+}
+
+func (client *MockClient) SetQuoteLimit(
+	ctx context.Context,
+	req *SetQuoteLimitRequest,
+) (*SetQuoteLimitResponse, error) {
+	return client.inMemServer.SetQuoteLimit(ctx, req)
+}
+
+func (client *MockClient) MassCancel(
+	ctx context.Context,
+	req *MassCancelRequest,
+) (*MassCancelResponse, error) {
+	return client.inMemServer.MassCancel(ctx, req)
+}
+
+func (client *MockClient) AdminMassCancel(
+	ctx context.Context,
+	req *MassCancelRequest,
+) (*MassCancelResponse, error) {
+	return client.inMemServer.AdminMassCancel(ctx, req)
+}
+
+func (client *MockClient) OpenSession(
+	ctx context.Context,
+	req *OpenSessionRequest,
+) (*OpenSessionResponse, error) {
+	return client.inMemServer.OpenSession(ctx, req)
+}
+
+func (client *MockClient) Heartbeat(
+	ctx context.Context,
+	req *HeartbeatRequest,
+) (*HeartbeatResponse, error) {
+	return client.inMemServer.Heartbeat(ctx, req)
+}
+
+func (client *MockClient) CloseSession(
+	ctx context.Context,
+	req *CloseSessionRequest,
+) (*CloseSessionResponse, error) {
+	return client.inMemServer.CloseSession(ctx, req)
+}
+
+func (client *MockClient) Deposit(
+	ctx context.Context,
+	req *DepositRequest,
+) (*DepositResponse, error) {
+	return client.inMemServer.Deposit(ctx, req)
+}
+
+func (client *MockClient) CreditHoldings(
+	ctx context.Context,
+	req *CreditHoldingsRequest,
+) (*CreditHoldingsResponse, error) {
+	return client.inMemServer.CreditHoldings(ctx, req)
+}
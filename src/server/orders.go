@@ -0,0 +1,168 @@
+// order management RPCs that are not part of the marketplace proto
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/session"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type CancelOrderRequest struct {
+	UserId    uint64 `json:"user_id"` // who placed the order
+	ArtworkId uint64 `json:"artwork_id"`
+	Side      uint32 `json:"side"` // match.SIDE_BID or match.SIDE_ASK
+	OrderId   uint64 `json:"order_id"`
+}
+
+type CancelOrderResponse struct {
+	ArtworkId         uint64 `json:"artwork_id"`
+	Side              uint32 `json:"side"`
+	OrderId           uint64 `json:"order_id"`
+	QuantityFilled    uint64 `json:"quantity_filled"`
+	QuantityCancelled uint64 `json:"quantity_cancelled"`
+}
+
+// CancelOrder removes one of the user's resting bids or asks from its
+// artwork's book.
+func (server *Server) CancelOrder(
+	ctx context.Context,
+	req *CancelOrderRequest,
+) (*CancelOrderResponse, error) {
+
+	resp := &CancelOrderResponse{
+		ArtworkId: req.ArtworkId,
+		Side:      req.Side,
+		OrderId:   req.OrderId,
+	}
+
+	var err error
+	switch req.Side {
+	case match.SIDE_BID:
+		bid, cancelErr := server.match.CancelUserBid(req.ArtworkId, req.OrderId, req.UserId)
+		if bid != nil {
+			resp.QuantityFilled, resp.QuantityCancelled = bid.QuantityFilled(), bid.QuantityRemaining()
+		}
+		err = cancelErr
+	case match.SIDE_ASK:
+		ask, cancelErr := server.match.CancelUserAsk(req.ArtworkId, req.OrderId, req.UserId)
+		if ask != nil {
+			resp.QuantityFilled, resp.QuantityCancelled = ask.QuantityFilled(), ask.QuantityRemaining()
+		}
+		err = cancelErr
+	default:
+		return nil, invalidArgument(fieldViolation("side", "side must be BID (0) or ASK (1)"))
+	}
+
+	switch {
+	case errors.Is(err, match.ErrOrderNotFound):
+		return nil, status.Errorf(codes.NotFound, "order %d is not resting on artwork %d", req.OrderId, req.ArtworkId)
+	case errors.Is(err, match.ErrNotOwner):
+		return nil, status.Errorf(codes.PermissionDenied, "order %d was not placed by user %d", req.OrderId, req.UserId)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to cancel order %d: %v", req.OrderId, err)
+	}
+	return resp, nil
+}
+
+type PlacePeggedOrderRequest struct {
+	OrderId   uint64 `json:"order_id"`
+	UserId    uint64 `json:"user_id"`
+	ArtworkId uint64 `json:"artwork_id"`
+	Side      uint32 `json:"side"` // match.SIDE_BID or match.SIDE_ASK
+	Quantity  uint64 `json:"quantity"`
+	Peg       string `json:"peg"` // PRIMARY, MARKET or MIDPOINT
+	// moves the price away from the market, a bid lower and an ask higher
+	Offset price.Price `json:"offset"`
+	// the most a bid pays or the least an ask takes; bids need one to
+	// reserve their funds
+	Cap price.Price `json:"cap"`
+	// orders placed through a session with cancel on disconnect are pulled
+	// when it closes
+	SessionId uint64 `json:"session_id,omitempty"`
+}
+
+type PlacePeggedOrderResponse struct {
+	ArtworkId      uint64      `json:"artwork_id"`
+	Side           uint32      `json:"side"`
+	OrderId        uint64      `json:"order_id"`
+	Price          price.Price `json:"price"` // where the order was placed
+	QuantityFilled uint64      `json:"quantity_filled"`
+}
+
+// PlacePeggedOrder places a bid or ask whose price follows the best bid,
+// the best ask or the midpoint between them for as long as it rests.
+func (server *Server) PlacePeggedOrder(
+	ctx context.Context,
+	req *PlacePeggedOrderRequest,
+) (*PlacePeggedOrderResponse, error) {
+
+	pegType, err := pqueue.ParsePeg(req.Peg)
+	if err != nil {
+		return nil, invalidArgument(fieldViolation("peg", err.Error()))
+	}
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, artworkNotListed("artwork_id", req.ArtworkId)
+	}
+	if err := checkOrderIds(protoField{"order_id", req.OrderId}); err != nil {
+		return nil, err
+	}
+	err = checkProtoRange(
+		protoField{"user_id", req.UserId},
+		protoField{"artwork_id", req.ArtworkId},
+		protoField{"quantity", req.Quantity},
+		protoField{"offset", server.protoUnits(req.ArtworkId, req.Offset)},
+		protoField{"cap", server.protoUnits(req.ArtworkId, req.Cap)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if req.SessionId != 0 {
+		if err := server.sessions.Check(req.SessionId, req.UserId); err != nil {
+			return nil, sessionRejected("session_id", err)
+		}
+	}
+	peg := &pqueue.Peg{Type: pegType, Offset: req.Offset, Cap: req.Cap}
+
+	resp := &PlacePeggedOrderResponse{ArtworkId: req.ArtworkId, Side: req.Side, OrderId: req.OrderId}
+	var remaining uint64
+	switch req.Side {
+	case match.SIDE_BID:
+		bid := pqueue.NewBid(req.OrderId, req.UserId, req.ArtworkId, req.Quantity, price.Price{})
+		bid.Peg = peg
+		bid, err = server.match.FillBidOrder(bid)
+		if err == nil {
+			resp.Price, resp.QuantityFilled, remaining = bid.Price, bid.QuantityFilled(), bid.QuantityRemaining()
+		}
+	case match.SIDE_ASK:
+		ask := pqueue.NewAsk(req.OrderId, req.UserId, req.ArtworkId, req.Quantity, price.Price{})
+		ask.Peg = peg
+		ask, err = server.match.FillAskOrder(ask)
+		if err == nil {
+			resp.Price, resp.QuantityFilled, remaining = ask.Price, ask.QuantityFilled(), ask.QuantityRemaining()
+		}
+	default:
+		return nil, invalidArgument(fieldViolation("side", "side must be BID (0) or ASK (1)"))
+	}
+	switch {
+	case errors.Is(err, match.ErrNoPegReference):
+		return nil, preconditionFailure("NO_PEG_REFERENCE", "peg", err.Error())
+	case err != nil:
+		return nil, orderRejected("order", err)
+	}
+
+	if req.SessionId != 0 && remaining > 0 {
+		order := session.Order{ArtworkId: req.ArtworkId, Side: req.Side, OrderId: req.OrderId}
+		if err := server.sessions.Track(req.SessionId, order); err != nil {
+			return nil, sessionRejected("session_id", err)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,183 @@
+// mass quote RPCs let market makers replace their two-sided quotes on many
+// artworks in one call. They are served through the gateway; quotes rest
+// on the order book as ordinary bids and asks, so they match and settle
+// like any other order.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/quote"
+	"fractr-marketplace-secondary/session"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type TwoSidedQuote struct {
+	ArtworkId uint64 `json:"artwork_id"`
+	QuoteId   uint64 `json:"quote_id"` // id of both the bid and the ask
+	// both quantities zero withdraws the maker's quote on the artwork
+	BidPrice    price.Price `json:"bid_price"`
+	BidQuantity uint64      `json:"bid_quantity"`
+	AskPrice    price.Price `json:"ask_price"`
+	AskQuantity uint64      `json:"ask_quantity"`
+}
+
+type MassQuoteRequest struct {
+	MakerId uint64          `json:"maker_id"`
+	Quotes  []TwoSidedQuote `json:"quotes"`
+	// quotes placed through a session with cancel on disconnect are pulled
+	// when it closes
+	SessionId uint64 `json:"session_id,omitempty"`
+}
+
+type PlacedQuote struct {
+	ArtworkId         uint64 `json:"artwork_id"`
+	QuoteId           uint64 `json:"quote_id"`
+	BidQuantityFilled uint64 `json:"bid_quantity_filled"`
+	AskQuantityFilled uint64 `json:"ask_quantity_filled"`
+}
+
+type MassQuoteResponse struct {
+	Quotes    []PlacedQuote `json:"quotes"`
+	Cancelled []uint64      `json:"cancelled"` // ids of the quotes replaced
+}
+
+type SetQuoteLimitRequest struct {
+	MakerId  uint64 `json:"maker_id"`
+	Limit    uint32 `json:"limit"` // artworks the maker may quote at once
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+}
+
+type SetQuoteLimitResponse struct{}
+
+// MassQuote replaces the maker's bid and ask on every artwork in the
+// request, cancelling the quotes they had there. Nothing is placed if any
+// quote is invalid; if a book refuses one, the maker is left without quotes
+// on the request's artworks rather than half updated.
+func (server *Server) MassQuote(
+	ctx context.Context,
+	req *MassQuoteRequest,
+) (*MassQuoteResponse, error) {
+
+	fields := []protoField{{"maker_id", req.MakerId}}
+	var orderIds []protoField
+	for i, q := range req.Quotes {
+		field := fmt.Sprintf("quotes[%d]", i)
+		orderIds = append(orderIds, protoField{field + ".quote_id", q.QuoteId})
+		fields = append(fields,
+			protoField{field + ".artwork_id", q.ArtworkId},
+			protoField{field + ".bid_price", server.protoUnits(q.ArtworkId, q.BidPrice)},
+			protoField{field + ".bid_quantity", q.BidQuantity},
+			protoField{field + ".ask_price", server.protoUnits(q.ArtworkId, q.AskPrice)},
+			protoField{field + ".ask_quantity", q.AskQuantity},
+		)
+	}
+	if err := checkOrderIds(orderIds...); err != nil {
+		return nil, err
+	}
+	if err := checkProtoRange(fields...); err != nil {
+		return nil, err
+	}
+
+	quotes := make([]quote.Quote, len(req.Quotes))
+	for i, q := range req.Quotes {
+		quotes[i] = quote.Quote{
+			ArtworkId:   q.ArtworkId,
+			QuoteId:     q.QuoteId,
+			BidPrice:    q.BidPrice,
+			BidQuantity: q.BidQuantity,
+			AskPrice:    q.AskPrice,
+			AskQuantity: q.AskQuantity,
+		}
+	}
+
+	if req.SessionId != 0 {
+		if err := server.sessions.Check(req.SessionId, req.MakerId); err != nil {
+			return nil, sessionRejected("session_id", err)
+		}
+	}
+
+	placed, cancelled, err := server.quotes.MassQuote(req.MakerId, quotes)
+	if err != nil {
+		return nil, quoteRejected(req.Quotes, err)
+	}
+	if req.SessionId != 0 {
+		// a session that closed meanwhile cancels every quote tracked on it
+		var trackErr error
+		for _, p := range placed {
+			for _, side := range []uint32{match.SIDE_BID, match.SIDE_ASK} {
+				order := session.Order{ArtworkId: p.ArtworkId, Side: side, OrderId: p.QuoteId}
+				if err := server.sessions.Track(req.SessionId, order); err != nil && trackErr == nil {
+					trackErr = err
+				}
+			}
+		}
+		if trackErr != nil {
+			return nil, sessionRejected("session_id", trackErr)
+		}
+	}
+
+	res := &MassQuoteResponse{Cancelled: cancelled}
+	for _, p := range placed {
+		res.Quotes = append(res.Quotes, PlacedQuote{
+			ArtworkId:         p.ArtworkId,
+			QuoteId:           p.QuoteId,
+			BidQuantityFilled: p.BidQuantityFilled,
+			AskQuantityFilled: p.AskQuantityFilled,
+		})
+	}
+	return res, nil
+}
+
+// SetQuoteLimit sets how many artworks a market maker may quote at once.
+func (server *Server) SetQuoteLimit(
+	ctx context.Context,
+	req *SetQuoteLimitRequest,
+) (*SetQuoteLimitResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+	server.quotes.SetLimit(req.MakerId, int(req.Limit))
+
+	server.recordAudit(audit.Entry{
+		Action:   "SET_QUOTE_LIMIT",
+		Operator: req.Operator,
+		Reason:   req.Reason,
+		Detail:   fmt.Sprintf("maker %d limit: %d", req.MakerId, req.Limit),
+	})
+	return &SetQuoteLimitResponse{}, nil
+}
+
+// quoteRejected maps mass quote failures to gRPC errors, naming the quote
+// at fault.
+func quoteRejected(quotes []TwoSidedQuote, err error) error {
+	var entryErr *quote.EntryError
+	if !errors.As(err, &entryErr) {
+		if errors.Is(err, quote.ErrQuoteLimit) {
+			return status.Errorf(codes.ResourceExhausted, "%v", err)
+		}
+		return status.Errorf(codes.Internal, "mass quote failed: %v", err)
+	}
+
+	field := fmt.Sprintf("quotes[%d]", entryErr.Index)
+	switch {
+	case errors.Is(err, quote.ErrInvalidQuote):
+		return invalidArgument(fieldViolation(field, entryErr.Err.Error()))
+	case errors.Is(err, match.ErrArtworkNotListed):
+		return artworkNotListed(field+".artwork_id", quotes[entryErr.Index].ArtworkId)
+	case entryErr.Side != "":
+		return orderRejected(field+"."+entryErr.Side, entryErr.Err)
+	default:
+		return orderRejected(field, entryErr.Err)
+	}
+}
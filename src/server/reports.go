@@ -0,0 +1,53 @@
+// reports summarise trading activity for participants.
+
+package main
+
+import (
+	"context"
+	"fractr-marketplace-secondary/ledger"
+	"fractr-marketplace-secondary/royalty"
+)
+
+type GetRoyaltyReportRequest struct {
+	ArtistId uint64 `json:"artist_id"`
+}
+
+type GetRoyaltyReportResponse struct {
+	ArtistId uint64          `json:"artist_id"`
+	Totals   []royalty.Total `json:"totals"`
+}
+
+// GetRoyaltyReport returns the royalties an artist has earned on secondary
+// sales since the server started, per artwork and currency.
+func (server *Server) GetRoyaltyReport(
+	ctx context.Context,
+	req *GetRoyaltyReportRequest,
+) (*GetRoyaltyReportResponse, error) {
+
+	return &GetRoyaltyReportResponse{
+		ArtistId: req.ArtistId,
+		Totals:   server.royaltyReport.Artist(req.ArtistId),
+	}, nil
+}
+
+type GetBalancesRequest struct {
+	UserId uint64 `json:"user_id"`
+}
+
+type GetBalancesResponse struct {
+	UserId   uint64                  `json:"user_id"`
+	Balances []ledger.AccountBalance `json:"balances"`
+}
+
+// GetBalances returns the user's cash, positions and royalties owed as
+// recorded by the ledger, one entry per currency or artwork.
+func (server *Server) GetBalances(
+	ctx context.Context,
+	req *GetBalancesRequest,
+) (*GetBalancesResponse, error) {
+
+	return &GetBalancesResponse{
+		UserId:   req.UserId,
+		Balances: server.ledger.User(req.UserId),
+	}, nil
+}
@@ -0,0 +1,319 @@
+// request-for-quote RPCs let buyers trade large blocks off the book with
+// registered market makers. They are served through the gateway; requests
+// are broadcast on the quote request stream, and accepted quotes reach the
+// trade stream, ledger and settlement like any other fill.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/rfq"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type SetMarketMakerRequest struct {
+	UserId     uint64 `json:"user_id"`
+	Registered bool   `json:"registered"`
+	Operator   string `json:"operator"`
+	Reason     string `json:"reason"`
+}
+
+type SetMarketMakerResponse struct {
+	MarketMakers []uint64 `json:"market_makers"`
+}
+
+type RequestQuoteRequest struct {
+	RfqId         uint64 `json:"rfq_id"`
+	RequesterId   uint64 `json:"requester_id"`
+	ArtworkId     uint64 `json:"artwork_id"`
+	Quantity      uint64 `json:"quantity"`
+	WindowSeconds uint64 `json:"window_seconds"` // how long quotes can be given and accepted
+}
+
+type BlockQuote struct {
+	QuoteId  uint64      `json:"quote_id"`
+	MakerId  uint64      `json:"maker_id"`
+	Price    price.Price `json:"price"`
+	QuotedAt time.Time   `json:"quoted_at"`
+}
+
+type QuoteRequest struct {
+	RfqId       uint64       `json:"rfq_id"`
+	RequesterId uint64       `json:"requester_id"`
+	ArtworkId   uint64       `json:"artwork_id"`
+	Quantity    uint64       `json:"quantity"`
+	Status      string       `json:"status"`
+	RequestedAt time.Time    `json:"requested_at"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+	Quotes      []BlockQuote `json:"quotes"` // best first
+
+	AcceptedQuoteId uint64           `json:"accepted_quote_id,omitempty"`
+	Fill            *match.FillOrder `json:"fill,omitempty"`
+}
+
+type RequestQuoteResponse struct {
+	Rfq QuoteRequest `json:"rfq"`
+}
+
+type SubmitQuoteRequest struct {
+	RfqId   uint64      `json:"rfq_id"`
+	QuoteId uint64      `json:"quote_id"`
+	MakerId uint64      `json:"maker_id"`
+	Price   price.Price `json:"price"`
+}
+
+type SubmitQuoteResponse struct {
+	Rfq QuoteRequest `json:"rfq"` // with the maker's own quote only
+}
+
+type AcceptQuoteRequest struct {
+	RfqId       uint64 `json:"rfq_id"`
+	QuoteId     uint64 `json:"quote_id"`
+	RequesterId uint64 `json:"requester_id"`
+}
+
+type AcceptQuoteResponse struct {
+	Rfq QuoteRequest `json:"rfq"`
+}
+
+type CancelRfqRequest struct {
+	RfqId       uint64 `json:"rfq_id"`
+	RequesterId uint64 `json:"requester_id"`
+}
+
+type CancelRfqResponse struct {
+	Rfq QuoteRequest `json:"rfq"`
+}
+
+type GetRfqRequest struct {
+	RfqId  uint64 `json:"rfq_id"`
+	UserId uint64 `json:"user_id"`
+}
+
+type GetRfqResponse struct {
+	Rfq QuoteRequest `json:"rfq"`
+}
+
+// SetMarketMaker registers a user to quote requests for quote, or
+// withdraws their registration.
+func (server *Server) SetMarketMaker(
+	ctx context.Context,
+	req *SetMarketMakerRequest,
+) (*SetMarketMakerResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+	server.rfqs.SetMarketMaker(req.UserId, req.Registered)
+
+	server.recordAudit(audit.Entry{
+		Action:   "SET_MARKET_MAKER",
+		Operator: req.Operator,
+		Reason:   req.Reason,
+		Detail:   fmt.Sprintf("user %d registered: %t", req.UserId, req.Registered),
+	})
+	return &SetMarketMakerResponse{MarketMakers: server.rfqs.MarketMakers()}, nil
+}
+
+// RequestQuote broadcasts a request for market makers to quote a block.
+func (server *Server) RequestQuote(
+	ctx context.Context,
+	req *RequestQuoteRequest,
+) (*RequestQuoteResponse, error) {
+
+	if !server.match.HasArtwork(req.ArtworkId) {
+		return nil, artworkNotListed("artwork_id", req.ArtworkId)
+	}
+	if err := checkOrderIds(protoField{"rfq_id", req.RfqId}); err != nil {
+		return nil, err
+	}
+	err := checkProtoRange(
+		protoField{"requester_id", req.RequesterId},
+		protoField{"artwork_id", req.ArtworkId},
+		protoField{"quantity", req.Quantity},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := server.rfqs.Open(rfq.Request{
+		Id:          req.RfqId,
+		RequesterId: req.RequesterId,
+		ArtworkId:   req.ArtworkId,
+		Quantity:    req.Quantity,
+		Window:      time.Duration(req.WindowSeconds) * time.Second,
+	})
+	if err != nil {
+		return nil, rfqRejected(req.RfqId, err)
+	}
+	return &RequestQuoteResponse{Rfq: quoteRequest(r, req.RequesterId)}, nil
+}
+
+// SubmitQuote gives a firm quote for the whole block, locking the maker's
+// fractions until the request closes. Quoting again replaces the maker's
+// earlier quote.
+func (server *Server) SubmitQuote(
+	ctx context.Context,
+	req *SubmitQuoteRequest,
+) (*SubmitQuoteResponse, error) {
+
+	var units uint64
+	if r, err := server.rfqs.Get(req.RfqId); err == nil {
+		units = server.protoUnits(r.ArtworkId, req.Price)
+	}
+	if err := checkOrderIds(protoField{"quote_id", req.QuoteId}); err != nil {
+		return nil, err
+	}
+	err := checkProtoRange(
+		protoField{"maker_id", req.MakerId},
+		protoField{"price", units},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := server.rfqs.Respond(req.RfqId, req.QuoteId, req.MakerId, req.Price)
+	if err != nil {
+		return nil, rfqRejected(req.RfqId, err)
+	}
+	return &SubmitQuoteResponse{Rfq: quoteRequest(r, req.MakerId)}, nil
+}
+
+// AcceptQuote buys the block on one of the request's quotes.
+func (server *Server) AcceptQuote(
+	ctx context.Context,
+	req *AcceptQuoteRequest,
+) (*AcceptQuoteResponse, error) {
+
+	if err := server.checkRequester(req.RfqId, req.RequesterId); err != nil {
+		return nil, err
+	}
+	r, err := server.rfqs.Accept(req.RfqId, req.QuoteId)
+	if err != nil {
+		return nil, rfqRejected(req.RfqId, err)
+	}
+	return &AcceptQuoteResponse{Rfq: quoteRequest(r, req.RequesterId)}, nil
+}
+
+// CancelRfq withdraws an open request for quote, releasing its quotes.
+func (server *Server) CancelRfq(
+	ctx context.Context,
+	req *CancelRfqRequest,
+) (*CancelRfqResponse, error) {
+
+	if err := server.checkRequester(req.RfqId, req.RequesterId); err != nil {
+		return nil, err
+	}
+	r, err := server.rfqs.Cancel(req.RfqId)
+	if err != nil {
+		return nil, rfqRejected(req.RfqId, err)
+	}
+	return &CancelRfqResponse{Rfq: quoteRequest(r, req.RequesterId)}, nil
+}
+
+// GetRfq returns a request for quote as the user may see it: the requester
+// sees every quote, and a market maker only their own.
+func (server *Server) GetRfq(
+	ctx context.Context,
+	req *GetRfqRequest,
+) (*GetRfqResponse, error) {
+
+	r, err := server.rfqs.Get(req.RfqId)
+	if err != nil {
+		return nil, rfqRejected(req.RfqId, err)
+	}
+	return &GetRfqResponse{Rfq: quoteRequest(r, req.UserId)}, nil
+}
+
+func (server *Server) checkRequester(rfqId, requesterId uint64) error {
+	r, err := server.rfqs.Get(rfqId)
+	if err != nil {
+		return rfqRejected(rfqId, err)
+	}
+	if r.RequesterId != requesterId {
+		return status.Errorf(codes.PermissionDenied, "request for quote %d was not made by user %d", rfqId, requesterId)
+	}
+	return nil
+}
+
+// quoteRequest shows the request to userId, hiding other makers' quotes
+// from everyone but the requester.
+func quoteRequest(r rfq.Rfq, userId uint64) QuoteRequest {
+	view := QuoteRequest{
+		RfqId:       r.Id,
+		RequesterId: r.RequesterId,
+		ArtworkId:   r.ArtworkId,
+		Quantity:    r.Quantity,
+		Status:      rfq.StatusName(r.Status),
+		RequestedAt: r.RequestedAt,
+		ExpiresAt:   r.ExpiresAt,
+
+		AcceptedQuoteId: r.Accepted,
+		Fill:            r.Fill,
+	}
+	for _, quote := range r.Quotes {
+		if userId != r.RequesterId && userId != quote.MakerId {
+			continue
+		}
+		view.Quotes = append(view.Quotes, BlockQuote{
+			QuoteId:  quote.Id,
+			MakerId:  quote.MakerId,
+			Price:    quote.Price,
+			QuotedAt: quote.QuotedAt,
+		})
+	}
+	if userId != r.RequesterId && (r.Fill == nil || r.Fill.SellerId != userId) {
+		view.AcceptedQuoteId, view.Fill = 0, nil
+	}
+	return view
+}
+
+// rfqRejected maps request-for-quote failures to gRPC errors, naming the
+// request fields at fault like orderRejected does for orders on the book.
+func rfqRejected(rfqId uint64, err error) error {
+	var ruleErr *instrument.RuleError
+
+	switch {
+	case errors.As(err, &ruleErr):
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(ruleErr.Violations))
+		for i, v := range ruleErr.Violations {
+			violations[i] = fieldViolation(v.Field, v.Description)
+		}
+		return invalidArgument(violations...)
+	case errors.Is(err, account.ErrInsufficientFunds):
+		return preconditionFailure("INSUFFICIENT_FUNDS", "requester_id", err.Error())
+	case errors.Is(err, holdings.ErrInsufficientHoldings):
+		return preconditionFailure("INSUFFICIENT_HOLDINGS", "maker_id", err.Error())
+	case errors.Is(err, match.ErrTradingHalted):
+		return preconditionFailure("TRADING_HALTED", "artwork_id", err.Error())
+	case errors.Is(err, match.ErrOutsidePriceBand):
+		return preconditionFailure("OUTSIDE_PRICE_BAND", "price", err.Error())
+	case errors.Is(err, rfq.ErrRequestNotFound):
+		return status.Errorf(codes.NotFound, "request for quote %d does not exist", rfqId)
+	case errors.Is(err, rfq.ErrQuoteNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	case errors.Is(err, rfq.ErrRequestExists):
+		return status.Errorf(codes.AlreadyExists, "request for quote %d already exists", rfqId)
+	case errors.Is(err, rfq.ErrInvalidRequest):
+		return invalidArgument(fieldViolation("rfq", err.Error()))
+	case errors.Is(err, rfq.ErrNotMarketMaker):
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	case errors.Is(err, rfq.ErrRequestClosed):
+		return preconditionFailure("RFQ_CLOSED", "rfq_id", err.Error())
+	default:
+		return status.Errorf(codes.Internal, "request for quote %d failed: %v", rfqId, err)
+	}
+}
@@ -2,7 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
 	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/session"
+	"math"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	mcproto "github.com/blidd/fractr-proto/marketplace_common"
 	msproto "github.com/blidd/fractr-proto/marketplace_secondary"
@@ -13,29 +28,44 @@ func (server *Server) PlaceBid(
 	req *msproto.PlaceBidRequest,
 ) (*msproto.PlaceBidResponse, error) {
 
+	if req.Bid == nil {
+		return nil, invalidArgument(fieldViolation("bid", "bid is required"))
+	}
+	if !server.match.HasArtwork(uint64(req.Bid.ArtworkId)) {
+		return nil, artworkNotListed("bid.artwork_id", uint64(req.Bid.ArtworkId))
+	}
+	if err := checkOrderIds(protoField{"bid.id", uint64(req.Bid.Id)}); err != nil {
+		return nil, err
+	}
+
 	bid := pqueue.NewBid(
-		req.Bid.Id,
-		req.Bid.BidderId,
-		req.Bid.ArtworkId,
-		req.Bid.Quantity,
-		req.Bid.Price,
+		uint64(req.Bid.Id),
+		uint64(req.Bid.BidderId),
+		uint64(req.Bid.ArtworkId),
+		uint64(req.Bid.Quantity),
+		server.priceFromProto(uint64(req.Bid.ArtworkId), req.Bid.Price),
 	)
+	if err := server.validateOrder("bid", bid.ArtworkId, bid.Quantity(), bid.Price); err != nil {
+		return nil, err
+	}
+
+	sessionId, err := server.orderSession(ctx, bid.BidderId)
+	if err != nil {
+		return nil, err
+	}
 
-	bidPlaced := server.match.FillBidOrder(bid)
-	bidProto := &mcproto.Bid{
-		Id:        bidPlaced.Id,
-		ArtworkId: bidPlaced.ArtworkId,
-		BidderId:  bidPlaced.BidderId,
-		Quantity:  bidPlaced.Quantity(),
-		Price:     bidPlaced.Price,
+	bidPlaced, err := server.match.FillBidOrder(bid)
+	if err != nil {
+		return nil, orderRejected("bid", err)
+	}
+	order := session.Order{ArtworkId: bid.ArtworkId, Side: match.SIDE_BID, OrderId: bid.Id}
+	if err := server.trackOrder(sessionId, order, bidPlaced.QuantityRemaining()); err != nil {
+		return nil, err
 	}
+	server.sendFeeHeader(ctx, bidPlaced.ArtworkId, bidPlaced.FeesPaid())
 
 	return &msproto.PlaceBidResponse{
-		BidStatus: &mcproto.BidStatus{
-			Bid:            bidProto,
-			QuantityFilled: bidPlaced.QuantityFilled(),
-			Status:         bidPlaced.Status(),
-		},
+		BidStatus: server.bidStatusToProto(bidPlaced),
 	}, nil
 }
 
@@ -44,28 +74,223 @@ func (server *Server) PlaceAsk(
 	req *msproto.PlaceAskRequest,
 ) (*msproto.PlaceAskResponse, error) {
 
+	if req.Ask == nil {
+		return nil, invalidArgument(fieldViolation("ask", "ask is required"))
+	}
+	if !server.match.HasArtwork(uint64(req.Ask.ArtworkId)) {
+		return nil, artworkNotListed("ask.artwork_id", uint64(req.Ask.ArtworkId))
+	}
+	if err := checkOrderIds(protoField{"ask.id", uint64(req.Ask.Id)}); err != nil {
+		return nil, err
+	}
+
 	ask := pqueue.NewAsk(
-		req.Ask.Id,
-		req.Ask.AskerId,
-		req.Ask.ArtworkId,
-		req.Ask.Quantity,
-		req.Ask.Price,
+		uint64(req.Ask.Id),
+		uint64(req.Ask.AskerId),
+		uint64(req.Ask.ArtworkId),
+		uint64(req.Ask.Quantity),
+		server.priceFromProto(uint64(req.Ask.ArtworkId), req.Ask.Price),
 	)
+	if err := server.validateOrder("ask", ask.ArtworkId, ask.Quantity(), ask.Price); err != nil {
+		return nil, err
+	}
+
+	sessionId, err := server.orderSession(ctx, ask.AskerId)
+	if err != nil {
+		return nil, err
+	}
 
-	askPlaced := server.match.FillAskOrder(ask)
-	askProto := &mcproto.Ask{
-		Id:        askPlaced.Id,
-		ArtworkId: askPlaced.ArtworkId,
-		AskerId:   askPlaced.AskerId,
-		Quantity:  askPlaced.Quantity(),
-		Price:     askPlaced.Price,
+	askPlaced, err := server.match.FillAskOrder(ask)
+	if err != nil {
+		return nil, orderRejected("ask", err)
+	}
+	order := session.Order{ArtworkId: ask.ArtworkId, Side: match.SIDE_ASK, OrderId: ask.Id}
+	if err := server.trackOrder(sessionId, order, askPlaced.QuantityRemaining()); err != nil {
+		return nil, err
 	}
+	server.sendFeeHeader(ctx, askPlaced.ArtworkId, askPlaced.FeesPaid())
 
 	return &msproto.PlaceAskResponse{
-		AskStatus: &mcproto.AskStatus{
-			Ask:            askProto,
-			QuantityFilled: askPlaced.QuantityFilled(),
-			Status:         askPlaced.Status(),
-		},
+		AskStatus: server.askStatusToProto(askPlaced),
 	}, nil
 }
+
+// the marketplace proto carries prices as integer units of the artwork's
+// price scale, e.g. cents for an artwork quoted in USD at scale 2, and ids
+// and quantities as 32-bit integers, as does the storage proto every order
+// is written through. Orders placed through the proto fit by construction;
+// the gateway's requests carry 64-bit values, so it refuses any that do not
+// fit with checkProtoRange before they reach the engine.
+
+func (server *Server) priceFromProto(artworkId uint64, units uint32) price.Price {
+	return server.match.Instrument(artworkId).Price(uint64(units))
+}
+
+// priceToProto is the inverse of priceFromProto.
+func (server *Server) priceToProto(artworkId uint64, p price.Price) uint32 {
+	return uint32(server.protoUnits(artworkId, p))
+}
+
+// protoUnits returns the units of p at the artwork's price scale. Prices
+// the scale cannot express are refused by the engine, not here, so they
+// count as zero.
+func (server *Server) protoUnits(artworkId uint64, p price.Price) uint64 {
+	scaled, err := p.Rescale(server.match.Instrument(artworkId).PriceScale)
+	if err != nil {
+		return 0
+	}
+	return scaled.Units
+}
+
+// protoField is a request field that the protos carry in 32 bits.
+type protoField struct {
+	name  string
+	value uint64
+}
+
+// checkProtoRange refuses a request with an InvalidArgument error naming
+// every field too large for the protos.
+func checkProtoRange(fields ...protoField) error {
+	return checkMaximum(math.MaxUint32, fields)
+}
+
+// checkOrderIds refuses a request with an InvalidArgument error naming
+// every order id above match.MaxOrderId, as the ids above it are kept for
+// the orders the marketplace makes itself, such as an auction's block.
+func checkOrderIds(fields ...protoField) error {
+	return checkMaximum(match.MaxOrderId, fields)
+}
+
+func checkMaximum(max uint64, fields []protoField) error {
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, f := range fields {
+		if f.value > max {
+			violations = append(violations, fieldViolation(f.name, fmt.Sprintf("%s %d exceeds maximum %d", f.name, f.value, max)))
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return invalidArgument(violations...)
+}
+
+// sendFeeHeader reports the fees charged on an order's fills in the
+// "fees-paid" and "fee-currency" response headers, since the marketplace
+// proto has no field for them. Per-fill fees are on the trade stream.
+func (server *Server) sendFeeHeader(ctx context.Context, artworkId uint64, feesPaid price.Price) {
+	header := metadata.Pairs(
+		"fees-paid", feesPaid.String(),
+		"fee-currency", server.match.Instrument(artworkId).Currency,
+	)
+	// fails only when called outside a gRPC call, e.g. from the mock client
+	grpc.SetHeader(ctx, header)
+}
+
+func (server *Server) bidStatusToProto(bid *pqueue.Bid) *mcproto.BidStatus {
+	return &mcproto.BidStatus{
+		Bid: &mcproto.Bid{
+			Id:        uint32(bid.Id),
+			ArtworkId: uint32(bid.ArtworkId),
+			BidderId:  uint32(bid.BidderId),
+			Quantity:  uint32(bid.Quantity()),
+			Price:     server.priceToProto(bid.ArtworkId, bid.Price),
+		},
+		QuantityFilled: uint32(bid.QuantityFilled()),
+		Status:         bid.Status(),
+	}
+}
+
+func (server *Server) askStatusToProto(ask *pqueue.Ask) *mcproto.AskStatus {
+	return &mcproto.AskStatus{
+		Ask: &mcproto.Ask{
+			Id:        uint32(ask.Id),
+			ArtworkId: uint32(ask.ArtworkId),
+			AskerId:   uint32(ask.AskerId),
+			Quantity:  uint32(ask.Quantity()),
+			Price:     server.priceToProto(ask.ArtworkId, ask.Price),
+		},
+		QuantityFilled: uint32(ask.QuantityFilled()),
+		Status:         ask.Status(),
+	}
+}
+
+// validateOrder checks the quantity and price of a bid or ask against its
+// artwork's instrument before it reaches the engine. field is the name of
+// the order in the request ("bid" or "ask") and prefixes every violation.
+func (server *Server) validateOrder(field string, artworkId, quantity uint64, limit price.Price) error {
+	if err := server.match.Instrument(artworkId).CheckOrder(quantity, limit); err != nil {
+		return orderRejected(field, err)
+	}
+	return nil
+}
+
+// orderRejected converts an error returned by the matching engine into a
+// gRPC status error. field is the name of the order in the request ("bid" or
+// "ask") and prefixes the fields named in the error details.
+func orderRejected(field string, err error) error {
+	var ruleErr *instrument.RuleError
+
+	switch {
+	case errors.As(err, &ruleErr):
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(ruleErr.Violations))
+		for i, v := range ruleErr.Violations {
+			violations[i] = fieldViolation(field+"."+v.Field, v.Description)
+		}
+		return invalidArgument(violations...)
+	case errors.Is(err, account.ErrInsufficientFunds):
+		return preconditionFailure("INSUFFICIENT_FUNDS", field+".bidder_id", err.Error())
+	case errors.Is(err, holdings.ErrInsufficientHoldings):
+		return preconditionFailure("INSUFFICIENT_HOLDINGS", field+".asker_id", err.Error())
+	case errors.Is(err, match.ErrTradingHalted):
+		return preconditionFailure("TRADING_HALTED", field+".artwork_id", err.Error())
+	default:
+		return status.Errorf(codes.Internal, "failed to place %s: %v", field, err)
+	}
+}
+
+func fieldViolation(field, description string) *errdetails.BadRequest_FieldViolation {
+	return &errdetails.BadRequest_FieldViolation{Field: field, Description: description}
+}
+
+// invalidArgument builds an InvalidArgument error carrying a google.rpc.BadRequest
+// detail that lists every offending field.
+func invalidArgument(violations ...*errdetails.BadRequest_FieldViolation) error {
+	st := status.New(codes.InvalidArgument, violations[0].Description)
+	if len(violations) > 1 {
+		st = status.Newf(codes.InvalidArgument, "%s (and %d more)", violations[0].Description, len(violations)-1)
+	}
+
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// artworkNotListed builds a FailedPrecondition error for orders placed against
+// an artwork that has no order book.
+func artworkNotListed(field string, artworkId uint64) error {
+	return preconditionFailure(
+		"ARTWORK_NOT_LISTED",
+		field,
+		fmt.Sprintf("artwork %d is not listed for trading", artworkId),
+	)
+}
+
+// preconditionFailure builds a FailedPrecondition error carrying a
+// google.rpc.PreconditionFailure detail naming the offending field.
+func preconditionFailure(violationType, field, description string) error {
+	st := status.New(codes.FailedPrecondition, description)
+
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        violationType,
+			Subject:     field,
+			Description: description,
+		}},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
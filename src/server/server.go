@@ -3,101 +3,173 @@ package main
 import (
 	"flag"
 	"fmt"
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/auction"
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/basket"
+	"fractr-marketplace-secondary/chain"
+	"fractr-marketplace-secondary/feed"
+	"fractr-marketplace-secondary/fees"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/ledger"
 	"fractr-marketplace-secondary/libstore"
 	"fractr-marketplace-secondary/match"
-	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/quote"
+	"fractr-marketplace-secondary/rfq"
+	"fractr-marketplace-secondary/royalty"
+	"fractr-marketplace-secondary/session"
+	"fractr-marketplace-secondary/settlement"
+	"fractr-marketplace-secondary/stop"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 
 	"google.golang.org/grpc"
 
-	mcproto "github.com/blidd/fractr-proto/marketplace_common"
 	msproto "github.com/blidd/fractr-proto/marketplace_secondary"
-	"github.com/blidd/fractr-proto/storage"
 )
 
 type Server struct {
 	msproto.UnimplementedMarketplaceSecondaryServer
-	match *match.OrderMatchingEngine
-	ls    *libstore.Libstore
+	match    *match.OrderMatchingEngine
+	auctions *auction.House
+	rfqs     *rfq.Desk
+	quotes   *quote.Board
+	sessions *session.Manager
+	stops    *stop.Watcher
+	baskets  *basket.Desk
+	ls       *libstore.Libstore
+	feed     *feed.Feed
+
+	royalties     *royalty.Registry
+	royaltyReport *royalty.Report
+	ledger        *ledger.Ledger
+	settlements   *settlement.Pipeline
+	audit         *audit.Log
+	accounts      *account.Memory  // nil if buyers' funds are not checked
+	positions     *holdings.Memory // nil if sellers' holdings are not checked
+
+	// until a contract executor exists, fills settle on a simulated chain
+	chain *chain.Simulated
 }
 
 func New() *Server {
 
+	sim := chain.DefaultSimulatedConfig
+	sim.Latency = *chainLatency
+	sim.FailureRate = *chainFailureRate
+
 	server := &Server{
 		match: match.New(),
 		ls:    libstore.NewLibstore(string(fmt.Sprintf("[::1]:%d", *storageServicePort))),
-	}
+		feed:  feed.New(),
 
-	go func(server *Server) {
-		log.Printf("spinning up worker routine")
-		for {
-			select {
-			case tx := <-server.match.Orders():
-				fmt.Printf("%+v\n", tx)
-				// send order to smart contract for execution
-
-			case order := <-server.match.Jobs():
-
-				var status mcproto.Status
-				if order.QuantityFilled() == order.Quantity() {
-					status = mcproto.Status_COMPLETE
-				} else if order.QuantityFilled() > 0 {
-					status = mcproto.Status_PARTIALLY_FILLED
-				} else {
-					status = mcproto.Status_NEW
-				}
-
-				switch ord := order.(type) {
-				case *pqueue.Bid:
-					bidUpdate := &mcproto.BidStatus{
-						Bid: &mcproto.Bid{
-							Id:        ord.Id,
-							ArtworkId: ord.ArtworkId,
-							BidderId:  ord.BidderId,
-							Quantity:  ord.Quantity(),
-							Price:     ord.Price,
-						},
-						QuantityFilled: ord.QuantityFilled(),
-						Status:         status,
-					}
-					server.ls.Put(
-						storage.Type_BID,
-						ord.Id,
-						[]uint32{},
-						false,
-						"",
-						"",
-						bidUpdate,
-						nil,
-					)
-				case *pqueue.Ask:
-					askUpdate := &mcproto.AskStatus{
-						Ask: &mcproto.Ask{
-							Id:        ord.Id,
-							ArtworkId: ord.ArtworkId,
-							AskerId:   ord.AskerId,
-							Quantity:  ord.Quantity(),
-							Price:     ord.Price,
-						},
-						QuantityFilled: ord.QuantityFilled(),
-						Status:         status,
-					}
-					server.ls.Put(
-						storage.Type_ASK,
-						ord.Id,
-						[]uint32{},
-						false,
-						"",
-						"",
-						nil,
-						askUpdate,
-					)
-				}
+		royalties:     royalty.NewRegistry(),
+		royaltyReport: royalty.NewReport(),
+		ledger:        ledger.New(),
+		audit:         audit.New(),
+		chain:         chain.NewSimulated(sim),
+	}
+	server.settlements = settlement.New(chain.NewSettler(server.chain), settlement.DefaultConfig)
+	if *checkFunds {
+		server.accounts = account.NewMemory()
+		server.match.SetAccountService(server.accounts)
+	}
+	if *checkHoldings {
+		server.positions = holdings.NewMemory()
+		server.match.SetHoldingsLedger(server.positions)
+	}
+	server.match.SetTradingListener(server.feed.PublishTradingStatus)
+	server.auctions = auction.New(server.match)
+	server.rfqs = rfq.New(server.match)
+	server.rfqs.SetRequestListener(server.feed.PublishQuoteRequest)
+	server.quotes = quote.New(server.match)
+	server.sessions = session.New(server.match)
+	server.sessions.SetCloseListener(func(s session.Session, cancelled []match.BidAsk) {
+		server.quotes.Forget(cancelled)
+	})
+	server.stops = stop.New(server.match)
+	server.baskets = basket.New(server.match)
 
+	defaults := instrument.Default
+	defaults.TickSize, defaults.LotSize, defaults.MaxQuantity = *tickSize, *lotSize, *maxOrderQuantity
+	if err := server.match.SetDefaultInstrument(defaults); err != nil {
+		log.Fatalf("failed to configure default instrument: %v", err)
+	}
+	for _, artworkId := range parseArtworkIds(*listedArtworks) {
+		server.match.AddArtworkIfNotExists(artworkId)
+	}
+	if *instrumentConfig != "" {
+		instruments, err := instrument.LoadFileWithDefaults(*instrumentConfig, defaults)
+		if err != nil {
+			log.Fatalf("failed to load instruments: %v", err)
+		}
+		for _, inst := range instruments {
+			if err := server.match.SetInstrument(inst); err != nil {
+				log.Fatalf("failed to configure instrument: %v", err)
 			}
 		}
-	}(server)
+	}
+	if *feeSchedule != "" {
+		schedule, err := fees.LoadFile(*feeSchedule)
+		if err != nil {
+			log.Fatalf("failed to load fee schedule: %v", err)
+		}
+		server.match.SetFeeSchedule(schedule)
+	}
+	if *royaltyConfig != "" {
+		royalties, err := royalty.LoadFile(*royaltyConfig)
+		if err != nil {
+			log.Fatalf("failed to load royalties: %v", err)
+		}
+		server.royalties = royalties
+	}
+	if *ledgerJournal != "" {
+		books, err := ledger.Open(*ledgerJournal)
+		if err != nil {
+			log.Fatalf("failed to open ledger: %v", err)
+		}
+		server.ledger = books
+	}
+	if *royaltyJournal != "" {
+		report, err := royalty.OpenReport(*royaltyJournal)
+		if err != nil {
+			log.Fatalf("failed to open royalty report: %v", err)
+		}
+		server.royaltyReport = report
+	}
+	if *settlementJournal != "" {
+		settlements, err := settlement.Open(*settlementJournal, chain.NewSettler(server.chain), settlement.DefaultConfig)
+		if err != nil {
+			log.Fatalf("failed to open settlements: %v", err)
+		}
+		server.settlements = settlements
+		server.match.ResumeFillIds(settlements.LastFillId())
+	}
+
+	if *stopJournal != "" {
+		stops, err := stop.Open(*stopJournal, server.match, server.settlements.OrderFilled)
+		if err != nil {
+			log.Fatalf("failed to open trailing stops: %v", err)
+		}
+		server.stops = stops
+	}
+
+	if *auditJournal != "" {
+		auditLog, err := audit.Open(*auditJournal)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+		server.audit = auditLog
+	}
+
+	go server.Worker()
+	go server.ExpirySweeper()
+	go server.settlements.Run()
 
 	return server
 }
@@ -105,18 +177,76 @@ func New() *Server {
 var (
 	port               = flag.Int("port", 8082, "Server port")
 	storageServicePort = flag.Int("storage-port", 8083, "Server port")
+	listedArtworks     = flag.String("artworks", "", "Comma-separated ids of artworks listed for trading")
+	tickSize           = flag.Uint64("tick-size", instrument.Default.TickSize, "Price increment orders must be placed at, in units of the price scale, unless the artwork's instrument sets its own")
+	lotSize            = flag.Uint64("lot-size", instrument.Default.LotSize, "Quantity increment orders must be placed in, unless the artwork's instrument sets its own")
+	maxOrderQuantity   = flag.Uint64("max-order-quantity", instrument.Default.MaxQuantity, "Largest quantity accepted on a single order, 0 for unbounded, unless the artwork's instrument sets its own")
+	instrumentConfig   = flag.String("instruments", "", "Path to the JSON instrument config of listed artworks; fields left out take the -tick-size, -lot-size and -max-order-quantity values")
+	feeSchedule        = flag.String("fees", "", "Path to the JSON fee schedule")
+	royaltyConfig      = flag.String("royalties", "", "Path to the JSON royalty terms of listed artworks")
+	httpPort           = flag.Int("http-port", 8084, "Port of the JSON gateway serving public non-proto RPCs and streams")
+	adminAddr          = flag.String("admin-addr", "localhost:8085", "Address of the JSON gateway serving admin RPCs")
+	adminTokenFile     = flag.String("admin-token-file", "", "Path to the file holding the bearer token admin RPCs require; admin RPCs are not served if unset")
+	ledgerJournal      = flag.String("ledger", "", "Path to the ledger journal; the ledger is kept in memory if unset")
+	royaltyJournal     = flag.String("royalty-report", "", "Path to the journal of royalties paid to artists; the royalty report is kept in memory if unset")
+	settlementJournal  = flag.String("settlements", "", "Path to the settlement journal; settlements are kept in memory if unset")
+	stopJournal        = flag.String("stops", "", "Path to the trailing stop journal; stops are kept in memory if unset")
+	auditJournal       = flag.String("audit", "", "Path to the audit log of operator actions; kept in memory if unset")
+	chainLatency       = flag.Duration("chain-latency", 0, "How long the simulated chain takes to mine each settlement")
+	chainFailureRate   = flag.Float64("chain-failure-rate", 0, "Share of settlements the simulated chain fails to accept, for testing retries")
+	checkFunds         = flag.Bool("check-funds", true, "Reserve buyers' funds for their bids, refusing bids beyond their balance; funds are deposited through the admin gateway")
+	checkHoldings      = flag.Bool("check-holdings", true, "Lock sellers' fractions for their asks, refusing asks beyond their position; fractions are credited through the admin gateway")
 )
 
+func parseArtworkIds(list string) []uint64 {
+	var artworkIds []uint64
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		artworkId, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid artwork id %q: %v", field, err)
+		}
+		artworkIds = append(artworkIds, artworkId)
+	}
+	return artworkIds
+}
+
 func main() {
+	flag.Parse()
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
+	server := New()
+
+	go func() {
+		log.Printf("gateway listening at :%d", *httpPort)
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), server.Gateway()); err != nil {
+			log.Fatalf("failed to serve gateway: %v", err)
+		}
+	}()
+	if *adminTokenFile != "" {
+		token, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read admin token: %v", err)
+		}
+		go func() {
+			log.Printf("admin gateway listening at %s", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, server.AdminGateway(strings.TrimSpace(string(token)))); err != nil {
+				log.Fatalf("failed to serve admin gateway: %v", err)
+			}
+		}()
+	}
+
 	s := grpc.NewServer()
 	msproto.RegisterMarketplaceSecondaryServer(
 		s,
-		New(),
+		server,
 	)
 	log.Printf("server listening at %v", listener.Addr())
 	if err := s.Serve(listener); err != nil {
@@ -1,16 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"flag"
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/chain"
+	"fractr-marketplace-secondary/feed"
+	"fractr-marketplace-secondary/fees"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/royalty"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	mcproto "github.com/blidd/fractr-proto/marketplace_common"
 	msproto "github.com/blidd/fractr-proto/marketplace_secondary"
 )
 
+// most tests trade between users with no deposits or positions, so only
+// the tests of the funds and holdings checks turn them on
+func TestMain(m *testing.M) {
+	*checkFunds, *checkHoldings = false, false
+	os.Exit(m.Run())
+}
+
 func TestPlaceBidAndAsk(t *testing.T) {
 
 	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
 
 	reqBid := &msproto.PlaceBidRequest{
 		Bid: &mcproto.Bid{
@@ -51,3 +81,1191 @@ func TestPlaceBidAndAsk(t *testing.T) {
 	t.Logf("PlaceAsk() response quantity filled: %v\n", respAsk.QuantityFilled)
 
 }
+
+func TestPlaceBidValidation(t *testing.T) {
+
+	client := NewMockClient()
+	_, err := client.SetInstrument(context.Background(), &SetInstrumentRequest{
+		Instrument: instrument.Instrument{
+			ArtworkId:   1234,
+			Currency:    "USD",
+			PriceScale:  2,
+			TickSize:    5,
+			LotSize:     10,
+			MinQuantity: 10,
+			MaxQuantity: 1000,
+			MinPrice:    5,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		bid   *mcproto.Bid
+		code  codes.Code
+		field string
+	}{
+		{"missing bid", nil, codes.InvalidArgument, "bid"},
+		{"zero quantity", &mcproto.Bid{ArtworkId: 1234, Quantity: 0, Price: 10}, codes.InvalidArgument, "bid.quantity"},
+		{"quantity too large", &mcproto.Bid{ArtworkId: 1234, Quantity: 1 << 30, Price: 10}, codes.InvalidArgument, "bid.quantity"},
+		{"quantity off lot", &mcproto.Bid{ArtworkId: 1234, Quantity: 15, Price: 10}, codes.InvalidArgument, "bid.quantity"},
+		{"zero price", &mcproto.Bid{ArtworkId: 1234, Quantity: 10, Price: 0}, codes.InvalidArgument, "bid.price"},
+		{"price off tick", &mcproto.Bid{ArtworkId: 1234, Quantity: 10, Price: 12}, codes.InvalidArgument, "bid.price"},
+		{"unknown artwork", &mcproto.Bid{ArtworkId: 9999, Quantity: 10, Price: 10}, codes.FailedPrecondition, "bid.artwork_id"},
+		{"id kept for auctions", &mcproto.Bid{Id: uint32(match.AuctionOrderId(1)), ArtworkId: 1234, Quantity: 10, Price: 10}, codes.InvalidArgument, "bid.id"},
+	}
+
+	for _, test := range tests {
+		_, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{Bid: test.bid})
+		st, ok := status.FromError(err)
+		if err == nil || !ok {
+			t.Fatalf("%s: expected gRPC status error, got %v", test.name, err)
+		}
+		if st.Code() != test.code {
+			t.Errorf("%s: expected code %v, got %v", test.name, test.code, st.Code())
+		}
+		if field := violatedField(st); field != test.field {
+			t.Errorf("%s: expected violation on %q, got %q", test.name, test.field, field)
+		}
+	}
+}
+
+func TestOrderFlagsSetDefaultInstrument(t *testing.T) {
+	*tickSize, *lotSize, *maxOrderQuantity = 5, 10, 100
+	defer func() {
+		*tickSize, *lotSize, *maxOrderQuantity = instrument.Default.TickSize, instrument.Default.LotSize, instrument.Default.MaxQuantity
+	}()
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	tests := []struct {
+		name  string
+		bid   *mcproto.Bid
+		field string
+	}{
+		{"price off tick", &mcproto.Bid{ArtworkId: 1234, Quantity: 10, Price: 12}, "bid.price"},
+		{"quantity off lot", &mcproto.Bid{ArtworkId: 1234, Quantity: 15, Price: 10}, "bid.quantity"},
+		{"quantity too large", &mcproto.Bid{ArtworkId: 1234, Quantity: 110, Price: 10}, "bid.quantity"},
+	}
+	for _, test := range tests {
+		_, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{Bid: test.bid})
+		if st := status.Convert(err); st.Code() != codes.InvalidArgument || violatedField(st) != test.field {
+			t.Errorf("%s: expected InvalidArgument on %q, got %v", test.name, test.field, err)
+		}
+	}
+	if _, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{ArtworkId: 1234, BidderId: 1, Quantity: 20, Price: 10},
+	}); err != nil {
+		t.Errorf("expected a bid on the default increments to be placed, got %v", err)
+	}
+}
+
+func TestPlaceAskValidation(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	_, err := client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for missing ask, got %v", err)
+	}
+
+	_, err = client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{ArtworkId: 1234, AskerId: 2345, Quantity: 0, Price: 0},
+	})
+	st, _ := status.FromError(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok && len(badRequest.FieldViolations) != 2 {
+			t.Errorf("expected violations on quantity and price, got %v", badRequest.FieldViolations)
+		}
+	}
+}
+
+// violatedField returns the first field named in the error details of st.
+func violatedField(st *status.Status) string {
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			return d.FieldViolations[0].Field
+		case *errdetails.PreconditionFailure:
+			return d.Violations[0].Subject
+		}
+	}
+	return ""
+}
+
+func TestGatewaySetInstrument(t *testing.T) {
+
+	client := NewMockClient()
+	gateway := httptest.NewServer(client.inMemServer.AdminGateway("operator-token"))
+	defer gateway.Close()
+
+	setInstrument := func(token, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/v1/admin/SetInstrument", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to call gateway: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	valid := `{"instrument": {"artwork_id": 42, "currency": "ETH", "price_scale": 4, "tick_size": 5, "lot_size": 1, "min_quantity": 1, "min_price": 5}}`
+
+	for _, token := range []string{"", "guess"} {
+		if code := setInstrument(token, valid); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 from SetInstrument with token %q, got %d", token, code)
+		}
+	}
+	if client.inMemServer.match.HasArtwork(42) {
+		t.Fatalf("expected an unauthenticated SetInstrument to list nothing")
+	}
+
+	// the public gateway does not serve admin RPCs at all
+	public := httptest.NewRecorder()
+	client.inMemServer.Gateway().ServeHTTP(public, httptest.NewRequest(http.MethodPost, "/v1/admin/SetInstrument", strings.NewReader(valid)))
+	if public.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 from the public gateway, got %d", public.Code)
+	}
+
+	if code := setInstrument("operator-token", valid); code != http.StatusOK {
+		t.Fatalf("expected 200 from SetInstrument, got %d", code)
+	}
+
+	got, err := client.GetInstrument(context.Background(), &GetInstrumentRequest{ArtworkId: 42})
+	if err != nil {
+		t.Fatalf("failed to get instrument: %v", err)
+	}
+	if got.Instrument.TickSize != 5 {
+		t.Errorf("expected tick size 5, got %d", got.Instrument.TickSize)
+	}
+
+	if code := setInstrument("operator-token", `{"instrument": {"artwork_id": 42, "tick_size": 0}}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid instrument, got %d", code)
+	}
+}
+
+func TestTradeStreamCarriesFees(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	client.inMemServer.match.SetFeeSchedule(fees.NewSchedule(fees.Rates{MakerBps: 10, TakerBps: 20}))
+
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	_, err := client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 100, Price: 10000},
+	})
+	if err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+	_, err = client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 100, Price: 10000},
+	})
+	if err != nil {
+		t.Fatalf("failed to place bid: %v", err)
+	}
+
+	select {
+	case ev := <-trades.C:
+		// notional 100 × 100.00 = 10000.00
+		if ev.Trade.BuyerFee.String() != "20.00" || ev.Trade.SellerFee.String() != "10.00" {
+			t.Errorf("expected buyer fee 20.00 and seller fee 10.00, got %+v", ev.Trade)
+		}
+		if ev.Trade.Currency != "USD" {
+			t.Errorf("expected trade in USD, got %q", ev.Trade.Currency)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no trade published")
+	}
+}
+
+func TestRoyaltiesPaidOnResale(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	client.inMemServer.royalties.Set(royalty.Terms{
+		ArtworkId:  1234,
+		RateBps:    500,
+		Recipients: []royalty.Recipient{{UserId: 77, ShareBps: 10000}},
+	})
+
+	events := client.inMemServer.feed.Subscribe(8)
+	defer events.Close()
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 10000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+
+	for {
+		select {
+		case ev := <-events.C:
+			if ev.Type != feed.EVENT_ROYALTY {
+				continue
+			}
+			// 5% of 10 × 100.00
+			if ev.Royalty.RecipientId != 77 || ev.Royalty.Amount.String() != "50.00" {
+				t.Fatalf("unexpected royalty payout %+v", ev.Royalty)
+			}
+
+			report, err := client.GetRoyaltyReport(context.Background(), &GetRoyaltyReportRequest{ArtistId: 77})
+			if err != nil {
+				t.Fatalf("failed to get royalty report: %v", err)
+			}
+			if len(report.Totals) != 1 || report.Totals[0].Amount.String() != "50.00" {
+				t.Fatalf("unexpected royalty report %+v", report.Totals)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("no royalty published")
+		}
+	}
+}
+
+func TestPlaceBidInsufficientFunds(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	accounts := account.NewMemory()
+	accounts.Deposit(1234, "USD", price.New(500, 2))
+	client.inMemServer.match.SetAccountService(accounts)
+
+	_, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 1, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 100},
+	})
+	st, _ := status.FromError(err)
+	if st.Code() != codes.FailedPrecondition || violatedField(st) != "bid.bidder_id" {
+		t.Fatalf("expected FailedPrecondition on bid.bidder_id, got %v", err)
+	}
+
+	_, err = client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 5, Price: 100},
+	})
+	if err != nil {
+		t.Fatalf("failed to place funded bid: %v", err)
+	}
+
+	_, err = client.CancelOrder(context.Background(), &CancelOrderRequest{UserId: 2345, ArtworkId: 1234, Side: match.SIDE_BID, OrderId: 2})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected another user's cancel to be refused, got %v", err)
+	}
+
+	resp, err := client.CancelOrder(context.Background(), &CancelOrderRequest{UserId: 1234, ArtworkId: 1234, Side: match.SIDE_BID, OrderId: 2})
+	if err != nil || resp.QuantityCancelled != 5 {
+		t.Fatalf("failed to cancel bid: %+v (%v)", resp, err)
+	}
+	if balance := accounts.Balance(1234, "USD"); balance.Available.String() != "5.00" {
+		t.Fatalf("expected funds to be released on cancel, got %+v", balance)
+	}
+
+	_, err = client.CancelOrder(context.Background(), &CancelOrderRequest{UserId: 1234, ArtworkId: 1234, Side: match.SIDE_BID, OrderId: 2})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound cancelling twice, got %v", err)
+	}
+}
+
+func TestPlaceAskInsufficientHoldings(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	ledger := holdings.NewMemory()
+	ledger.Credit(1234, 1234, 10)
+	client.inMemServer.match.SetHoldingsLedger(ledger)
+
+	_, err := client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 1234, Quantity: 8, Price: 100},
+	})
+	if err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+
+	_, err = client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 2, ArtworkId: 1234, AskerId: 1234, Quantity: 5, Price: 100},
+	})
+	st, _ := status.FromError(err)
+	if st.Code() != codes.FailedPrecondition || violatedField(st) != "ask.asker_id" {
+		t.Fatalf("expected FailedPrecondition on ask.asker_id, got %v", err)
+	}
+}
+
+func TestFundsAndHoldingsCheckedByDefault(t *testing.T) {
+
+	for _, name := range []string{"check-funds", "check-holdings"} {
+		if f := flag.Lookup(name); f.DefValue != "true" {
+			t.Errorf("expected -%s to default on, got %s", name, f.DefValue)
+		}
+	}
+	defer func(funds, holdings bool) {
+		*checkFunds, *checkHoldings = funds, holdings
+	}(*checkFunds, *checkHoldings)
+	*checkFunds, *checkHoldings = true, true
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	bid := &msproto.PlaceBidRequest{Bid: &mcproto.Bid{Id: 1, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 100}}
+	ask := &msproto.PlaceAskRequest{Ask: &mcproto.Ask{Id: 2, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 100}}
+
+	if _, err := client.PlaceBid(context.Background(), bid); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected an unfunded bid to be refused, got %v", err)
+	}
+	if _, err := client.PlaceAsk(context.Background(), ask); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected an ask without holdings to be refused, got %v", err)
+	}
+
+	_, err := client.Deposit(context.Background(), &DepositRequest{
+		UserId: 1234, Currency: "USD", Amount: price.New(1000, 2), Operator: "ops", Reason: "wire received",
+	})
+	if err != nil {
+		t.Fatalf("failed to deposit: %v", err)
+	}
+	_, err = client.CreditHoldings(context.Background(), &CreditHoldingsRequest{
+		UserId: 2345, ArtworkId: 1234, Quantity: 10, Operator: "ops", Reason: "primary sale",
+	})
+	if err != nil {
+		t.Fatalf("failed to credit holdings: %v", err)
+	}
+
+	if _, err := client.PlaceAsk(context.Background(), ask); err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+	resp, err := client.PlaceBid(context.Background(), bid)
+	if err != nil || resp.BidStatus.QuantityFilled != 10 {
+		t.Fatalf("expected the funded bid to fill, got %+v (%v)", resp, err)
+	}
+	if pos := client.inMemServer.positions.Position(1234, 1234); pos.Available != 10 {
+		t.Errorf("expected the buyer to hold the 10 fractions, got %+v", pos)
+	}
+}
+
+func TestGetBalancesAfterTrade(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	events := client.inMemServer.feed.Subscribe(8)
+	defer events.Close()
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 10000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+
+	select {
+	case <-events.C:
+	case <-time.After(time.Second):
+		t.Fatalf("no trade published")
+	}
+
+	// the trade is posted right after it is published
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := client.GetBalances(context.Background(), &GetBalancesRequest{UserId: 1234})
+		if err != nil {
+			t.Fatalf("failed to get balances: %v", err)
+		}
+		if len(resp.Balances) == 2 {
+			if resp.Balances[0].Net != "-1000.00" || resp.Balances[1].Net != "10" {
+				t.Fatalf("unexpected buyer balances %+v", resp.Balances)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("trade was not posted to the ledger")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetSettlement(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	_, err := client.GetSettlement(context.Background(), &GetSettlementRequest{FillId: 99})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for an unknown fill, got %v", err)
+	}
+
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 10000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+
+	var fillId uint64
+	select {
+	case ev := <-trades.C:
+		fillId = ev.Trade.Id
+	case <-time.After(time.Second):
+		t.Fatalf("no trade published")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := client.GetSettlement(context.Background(), &GetSettlementRequest{FillId: fillId})
+		if err == nil && resp.Status == "COMPLETE" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fill %d was not settled: %+v (%v)", fillId, resp, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTradeSettlesOnChain(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	// the first submission fails and is retried
+	client.inMemServer.chain.FailNext(chain.ErrUnavailable)
+
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 10000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+
+	var fillId uint64
+	select {
+	case ev := <-trades.C:
+		fillId = ev.Trade.Id
+	case <-time.After(time.Second):
+		t.Fatalf("no trade published")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		resp, err := client.GetSettlement(context.Background(), &GetSettlementRequest{FillId: fillId})
+		if err == nil && resp.Status == "COMPLETE" {
+			if resp.Settlement.Attempts != 2 {
+				t.Errorf("expected settlement after a retry, got %d attempts", resp.Settlement.Attempts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fill %d was not settled: %+v (%v)", fillId, resp, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sim := client.inMemServer.chain
+	if got := sim.Balance(chain.UserAddress(1234), chain.FractionToken(1234)).String(); got != "10" {
+		t.Errorf("expected buyer to hold 10 fractions on chain, got %s", got)
+	}
+	if got := sim.Balance(chain.UserAddress(2345), "USD").String(); got != "1000.00" {
+		t.Errorf("expected seller to be paid 1000.00 on chain, got %s", got)
+	}
+}
+
+// rejectedTrade makes a trade whose settlement reverts on chain and returns
+// its fill id once it is REJECTED.
+func rejectedTrade(t *testing.T, client *MockClient) uint64 {
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	client.inMemServer.chain.FailNext(chain.ErrReverted)
+
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 10000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+
+	var fillId uint64
+	select {
+	case ev := <-trades.C:
+		fillId = ev.Trade.Id
+	case <-time.After(time.Second):
+		t.Fatalf("no trade published")
+	}
+	awaitSettlement(t, client, fillId, "REJECTED")
+	return fillId
+}
+
+func awaitSettlement(t *testing.T, client *MockClient, fillId uint64, status string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := client.GetSettlement(context.Background(), &GetSettlementRequest{FillId: fillId})
+		if err == nil && resp.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fill %d did not become %s: %+v (%v)", fillId, status, resp, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBustTrade(t *testing.T) {
+
+	client := NewMockClient()
+	fillId := rejectedTrade(t, client)
+
+	_, err := client.BustTrade(context.Background(), &BustTradeRequest{FillId: fillId, Reason: "reverted"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument without an operator, got %v", err)
+	}
+
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	resp, err := client.BustTrade(context.Background(), &BustTradeRequest{
+		FillId: fillId, Operator: "ops", Reason: "reverted on chain",
+	})
+	if err != nil {
+		t.Fatalf("failed to bust trade: %v", err)
+	}
+	if resp.Fill.Status != match.ORDER_BUSTED {
+		t.Errorf("expected the fill to be BUSTED, got %s", match.StatusName(resp.Fill.Status))
+	}
+
+	select {
+	case ev := <-trades.C:
+		if ev.Type != feed.EVENT_BUST || ev.Trade.Id != fillId || !ev.Involves(1234) || !ev.Involves(2345) {
+			t.Errorf("expected a bust of fill %d to both counterparties, got %+v", fillId, ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no bust published")
+	}
+
+	if entries := client.inMemServer.audit.Fill(fillId); len(entries) != 1 || entries[0].Operator != "ops" {
+		t.Errorf("expected the bust in the audit log, got %+v", entries)
+	}
+	for _, balance := range client.inMemServer.ledger.User(1234) {
+		if balance.Balance.Debits.Cmp(balance.Balance.Credits) != 0 {
+			t.Errorf("expected the buyer's postings to be reversed, got %+v", balance)
+		}
+	}
+
+	_, err = client.BustTrade(context.Background(), &BustTradeRequest{FillId: fillId, Operator: "ops", Reason: "again"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition busting twice, got %v", err)
+	}
+}
+
+func TestCorrectTrade(t *testing.T) {
+
+	client := NewMockClient()
+	fillId := rejectedTrade(t, client)
+
+	resp, err := client.CorrectTrade(context.Background(), &CorrectTradeRequest{
+		FillId: fillId, Price: price.New(9000, 2), Quantity: 10, Operator: "ops", Reason: "mispriced",
+	})
+	if err != nil {
+		t.Fatalf("failed to correct trade: %v", err)
+	}
+	if resp.Busted.Status != match.ORDER_BUSTED || resp.Corrected.Id == fillId {
+		t.Fatalf("expected the original busted and a new fill, got %+v", resp)
+	}
+
+	awaitSettlement(t, client, resp.Corrected.Id, "COMPLETE")
+	if got := client.inMemServer.chain.Balance(chain.UserAddress(2345), "USD").String(); got != "900.00" {
+		t.Errorf("expected seller to be paid the corrected 900.00 on chain, got %s", got)
+	}
+}
+
+func TestHaltAndResumeTrading(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	setPhase := func(phase string) *SetTradingPhaseResponse {
+		resp, err := client.SetTradingPhase(context.Background(), &SetTradingPhaseRequest{
+			ArtworkId: 1234, Phase: phase, Operator: "ops", Reason: "provenance dispute",
+		})
+		if err != nil {
+			t.Fatalf("failed to set trading phase %s: %v", phase, err)
+		}
+		return resp
+	}
+
+	setPhase("HALTED")
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 10000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+	for waiting := true; waiting; {
+		select {
+		case ev := <-trades.C:
+			if ev.Type == feed.EVENT_TRADE {
+				t.Fatalf("expected no trade while halted, got %+v", ev)
+			}
+		case <-time.After(50 * time.Millisecond):
+			waiting = false
+		}
+	}
+
+	setPhase("CANCEL_ONLY")
+	_, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 3, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 10000},
+	})
+	st := status.Convert(err)
+	if st.Code() != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition in cancel-only, got %v", err)
+	}
+	if details := st.Details(); len(details) != 1 || details[0].(*errdetails.PreconditionFailure).Violations[0].Type != "TRADING_HALTED" {
+		t.Errorf("expected a TRADING_HALTED violation, got %v", details)
+	}
+
+	resp := setPhase("OPEN")
+	if resp.TradingPhase.Phase != "OPEN" || len(resp.Fills) != 1 || resp.Fills[0].QuantityFilled != 10 {
+		t.Fatalf("expected reopening to fill the crossed orders, got %+v", resp)
+	}
+	for {
+		select {
+		case ev := <-trades.C:
+			if ev.Type != feed.EVENT_TRADE {
+				continue
+			}
+			if ev.Trade.Id != resp.Fills[0].Id {
+				t.Errorf("expected the reopening fill on the trade stream, got %+v", ev)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("no trade published on reopening")
+		}
+	}
+}
+
+func TestPriceBandHaltOnMarketData(t *testing.T) {
+
+	client := NewMockClient()
+	inst := instrument.Default
+	inst.ArtworkId = 1234
+	inst.PriceBandBps = 500
+	inst.HaltSeconds = 60
+	if _, err := client.SetInstrument(context.Background(), &SetInstrumentRequest{Instrument: inst}); err != nil {
+		t.Fatalf("failed to set instrument: %v", err)
+	}
+
+	events := client.inMemServer.feed.Subscribe(8)
+	defer events.Close()
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 5, Price: 10000},
+	})
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 2, ArtworkId: 1234, AskerId: 2345, Quantity: 5, Price: 11000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 3, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 11000},
+	})
+
+	var types []feed.EventType
+	var halt *feed.TradingStatus
+	for len(types) < 2 {
+		select {
+		case ev := <-events.C:
+			types = append(types, ev.Type)
+			if ev.Type == feed.EVENT_TRADING_STATUS {
+				halt = ev.Trading
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a trade and a halt, got %v", types)
+		}
+	}
+	if halt == nil || halt.Phase != "HALTED" || halt.ReopensAt.IsZero() {
+		t.Fatalf("expected a price band halt on the feed, got %v (%+v)", types, halt)
+	}
+
+	resp, err := client.GetTradingPhase(context.Background(), &GetTradingPhaseRequest{ArtworkId: 1234})
+	if err != nil || resp.TradingPhase.Phase != "HALTED" {
+		t.Fatalf("expected artwork 1234 to be halted, got %+v (%v)", resp, err)
+	}
+
+	rec := httptest.NewRecorder()
+	client.inMemServer.Gateway().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if !strings.Contains(rec.Body.String(), `"match_price_band_halts": {"1234": 1}`) {
+		t.Errorf("expected the halt in the metrics, got %s", rec.Body.String())
+	}
+}
+
+func TestOpeningAuction(t *testing.T) {
+
+	client := NewMockClient()
+	events := client.inMemServer.feed.Subscribe(16)
+	defer events.Close()
+
+	inst := instrument.Default
+	inst.ArtworkId = 1234
+	inst.OpeningAuction = 1
+	if _, err := client.SetInstrument(context.Background(), &SetInstrumentRequest{Instrument: inst}); err != nil {
+		t.Fatalf("failed to list artwork: %v", err)
+	}
+
+	client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 2345, Quantity: 10, Price: 9000},
+	})
+	client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 1234, Quantity: 10, Price: 11000},
+	})
+
+	var indicated *feed.TradingStatus
+	for {
+		select {
+		case ev := <-events.C:
+			switch ev.Type {
+			case feed.EVENT_TRADING_STATUS:
+				if ev.Trading.Phase == "AUCTION" {
+					indicated = ev.Trading
+				}
+			case feed.EVENT_TRADE:
+				if indicated == nil || indicated.IndicativeVolume != 10 || indicated.IndicativePrice.String() != "90.00" {
+					t.Fatalf("expected 10 indicated at 90.00 before the auction closed, got %+v", indicated)
+				}
+				if ev.Trade.Price.String() != "90.00" || ev.Trade.QuantityFilled != 10 {
+					t.Errorf("expected the auction to fill 10 at 90.00, got %+v", ev.Trade)
+				}
+				return
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("opening auction did not close")
+		}
+	}
+}
+
+func TestDutchAuctionSaleIsTraded(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	trades := client.inMemServer.feed.Subscribe(8)
+	defer trades.Close()
+
+	_, err := client.CreateAuction(context.Background(), &CreateAuctionRequest{
+		AuctionId: 7, SellerId: 2345, ArtworkId: 1234, Quantity: 10,
+		Format: "VICKREY", DurationSeconds: 60,
+		StartPrice: price.New(2000, 2), ReservePrice: price.New(1000, 2),
+	})
+	if violatedField(status.Convert(err)) != "format" {
+		t.Fatalf("expected an unknown format to be rejected, got %v", err)
+	}
+
+	resp, err := client.CreateAuction(context.Background(), &CreateAuctionRequest{
+		AuctionId: 7, SellerId: 2345, ArtworkId: 1234, Quantity: 10,
+		Format: "DUTCH", DurationSeconds: 60,
+		StartPrice: price.New(2000, 2), ReservePrice: price.New(1000, 2),
+		Decrement: price.New(100, 2), StepSeconds: 60,
+	})
+	if err != nil {
+		t.Fatalf("failed to create auction: %v", err)
+	}
+	if resp.Auction.Status != "OPEN" || resp.Auction.CurrentPrice.String() != "20.00" {
+		t.Fatalf("unexpected auction %+v", resp.Auction)
+	}
+
+	_, err = client.PlaceAuctionBid(context.Background(), &PlaceAuctionBidRequest{
+		AuctionId: 7, BidId: 8, BidderId: 1234, Quantity: 4, Price: price.New(1900, 2),
+	})
+	if st := status.Convert(err); st.Code() != codes.FailedPrecondition || violatedField(st) != "price" {
+		t.Fatalf("expected a bid under the clock to be too low, got %v", err)
+	}
+	bid, err := client.PlaceAuctionBid(context.Background(), &PlaceAuctionBidRequest{
+		AuctionId: 7, BidId: 9, BidderId: 1234, Quantity: 4, Price: price.New(2000, 2),
+	})
+	if err != nil {
+		t.Fatalf("failed to bid: %v", err)
+	}
+	if bid.Auction.QuantitySold != 4 || len(bid.Auction.Fills) != 1 {
+		t.Fatalf("expected 4 sold, got %+v", bid.Auction)
+	}
+
+	select {
+	case ev := <-trades.C:
+		if ev.Type != feed.EVENT_TRADE || ev.Trade.AskId != match.AuctionOrderId(7) || ev.Trade.BidId != 9 || ev.Trade.QuantityFilled != 4 {
+			t.Fatalf("expected the sale on the trade stream, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no trade published")
+	}
+
+	_, err = client.CancelAuction(context.Background(), &CancelAuctionRequest{AuctionId: 7, SellerId: 1234})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected only the seller to cancel, got %v", err)
+	}
+	cancelled, err := client.CancelAuction(context.Background(), &CancelAuctionRequest{AuctionId: 7, SellerId: 2345})
+	if err != nil || cancelled.Auction.Status != "CANCELLED" {
+		t.Fatalf("failed to cancel auction: %+v (%v)", cancelled, err)
+	}
+}
+
+func TestRequestForQuoteSettlesBlock(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	events := client.inMemServer.feed.Subscribe(8)
+	defer events.Close()
+
+	for _, makerId := range []uint64{2345, 3456} {
+		_, err := client.SetMarketMaker(context.Background(), &SetMarketMakerRequest{
+			UserId: makerId, Registered: true, Operator: "ops", Reason: "onboarding",
+		})
+		if err != nil {
+			t.Fatalf("failed to register market maker: %v", err)
+		}
+	}
+
+	_, err := client.RequestQuote(context.Background(), &RequestQuoteRequest{
+		RfqId: 1, RequesterId: 1234, ArtworkId: 1234, Quantity: 500, WindowSeconds: 60,
+	})
+	if err != nil {
+		t.Fatalf("failed to request quote: %v", err)
+	}
+	select {
+	case ev := <-events.C:
+		if ev.Type != feed.EVENT_QUOTE_REQUEST || ev.Rfq.RfqId != 1 || ev.Rfq.Quantity != 500 {
+			t.Fatalf("expected the request to be broadcast, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request was not broadcast")
+	}
+
+	client.SubmitQuote(context.Background(), &SubmitQuoteRequest{RfqId: 1, QuoteId: 10, MakerId: 2345, Price: price.New(9900, 2)})
+	client.SubmitQuote(context.Background(), &SubmitQuoteRequest{RfqId: 1, QuoteId: 11, MakerId: 3456, Price: price.New(9800, 2)})
+
+	seen, err := client.GetRfq(context.Background(), &GetRfqRequest{RfqId: 1, UserId: 2345})
+	if err != nil || len(seen.Rfq.Quotes) != 1 || seen.Rfq.Quotes[0].QuoteId != 10 {
+		t.Fatalf("expected a maker to see only their own quote, got %+v (%v)", seen, err)
+	}
+
+	_, err = client.AcceptQuote(context.Background(), &AcceptQuoteRequest{RfqId: 1, QuoteId: 11, RequesterId: 2345})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected only the requester to accept, got %v", err)
+	}
+	accepted, err := client.AcceptQuote(context.Background(), &AcceptQuoteRequest{RfqId: 1, QuoteId: 11, RequesterId: 1234})
+	if err != nil {
+		t.Fatalf("failed to accept quote: %v", err)
+	}
+	if accepted.Rfq.Status != "FILLED" || len(accepted.Rfq.Quotes) != 2 || accepted.Rfq.Fill == nil {
+		t.Fatalf("unexpected accepted request %+v", accepted.Rfq)
+	}
+
+	select {
+	case ev := <-events.C:
+		if ev.Type != feed.EVENT_TRADE || ev.Trade.SellerId != 3456 || ev.Trade.QuantityFilled != 500 || ev.Trade.Price.String() != "98.00" {
+			t.Fatalf("expected the block on the trade tape, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("block trade was not published")
+	}
+	awaitSettlement(t, client, accepted.Rfq.Fill.Id, "COMPLETE")
+}
+
+func TestMassQuote(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	client.inMemServer.match.AddArtworkIfNotExists(5678)
+
+	quotes := []TwoSidedQuote{
+		{ArtworkId: 1234, QuoteId: 1, BidPrice: price.New(100, 2), BidQuantity: 5, AskPrice: price.New(110, 2), AskQuantity: 5},
+		{ArtworkId: 5678, QuoteId: 2, BidPrice: price.New(200, 2), BidQuantity: 5, AskPrice: price.New(210, 2), AskQuantity: 5},
+	}
+	if _, err := client.MassQuote(context.Background(), &MassQuoteRequest{MakerId: 2345, Quotes: quotes}); err != nil {
+		t.Fatalf("failed to mass quote: %v", err)
+	}
+
+	quotes[0].QuoteId, quotes[1].QuoteId = 3, 4
+	resp, err := client.MassQuote(context.Background(), &MassQuoteRequest{MakerId: 2345, Quotes: quotes})
+	if err != nil || len(resp.Quotes) != 2 || len(resp.Cancelled) != 2 || resp.Cancelled[0] != 1 {
+		t.Fatalf("expected the requote to replace quotes 1 and 2, got %+v (%v)", resp, err)
+	}
+
+	quotes[1].QuoteId, quotes[1].AskPrice = 5, quotes[1].BidPrice
+	_, err = client.MassQuote(context.Background(), &MassQuoteRequest{MakerId: 2345, Quotes: quotes})
+	st, _ := status.FromError(err)
+	if st.Code() != codes.InvalidArgument || violatedField(st) != "quotes[1]" {
+		t.Fatalf("expected InvalidArgument on quotes[1], got %v", err)
+	}
+
+	// the storage proto only carries 32-bit ids
+	quotes[0].QuoteId = 1 << 32
+	_, err = client.MassQuote(context.Background(), &MassQuoteRequest{MakerId: 2345, Quotes: quotes})
+	st, _ = status.FromError(err)
+	if st.Code() != codes.InvalidArgument || violatedField(st) != "quotes[0].quote_id" {
+		t.Fatalf("expected InvalidArgument on quotes[0].quote_id, got %v", err)
+	}
+	quotes[0].QuoteId = 3
+
+	_, err = client.SetQuoteLimit(context.Background(), &SetQuoteLimitRequest{MakerId: 2345, Limit: 1, Operator: "ops", Reason: "risk"})
+	if err != nil {
+		t.Fatalf("failed to set quote limit: %v", err)
+	}
+	quotes[1].AskPrice = price.New(210, 2)
+	_, err = client.MassQuote(context.Background(), &MassQuoteRequest{MakerId: 2345, Quotes: quotes})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted over the quote limit, got %v", err)
+	}
+
+	_, err = client.CancelOrder(context.Background(), &CancelOrderRequest{UserId: 2345, ArtworkId: 5678, Side: match.SIDE_ASK, OrderId: 4})
+	if err != nil {
+		t.Fatalf("expected refused mass quotes to leave quote 4 resting, got %v", err)
+	}
+}
+
+func TestMassCancel(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	for i, bidderId := range []uint32{2345, 2345, 3456} {
+		_, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+			Bid: &mcproto.Bid{Id: uint32(i + 1), ArtworkId: 1234, BidderId: bidderId, Quantity: 5, Price: 100},
+		})
+		if err != nil {
+			t.Fatalf("failed to place bid: %v", err)
+		}
+	}
+
+	resp, err := client.MassCancel(context.Background(), &MassCancelRequest{UserId: 2345, ArtworkIds: []uint64{1234}})
+	if err != nil || len(resp.Cancelled) != 2 || resp.Cancelled[0].QuantityCancelled != 5 {
+		t.Fatalf("expected user 2345's two bids to be cancelled, got %+v (%v)", resp, err)
+	}
+
+	_, err = client.MassCancel(context.Background(), &MassCancelRequest{AllUsers: true, Operator: "ops", Reason: "incident"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected cancelling every user's orders to be an admin RPC, got %v", err)
+	}
+	_, err = client.AdminMassCancel(context.Background(), &MassCancelRequest{AllUsers: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected cancelling every user's orders to need an operator, got %v", err)
+	}
+
+	// neither gateway cancels every user's orders without the operators' token
+	allUsers := `{"all_users": true, "operator": "ops", "reason": "incident"}`
+	public := httptest.NewRecorder()
+	client.inMemServer.Gateway().ServeHTTP(public, httptest.NewRequest(http.MethodPost, "/v1/MassCancel", strings.NewReader(allUsers)))
+	if public.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 from the public gateway, got %d", public.Code)
+	}
+	admin := httptest.NewRecorder()
+	client.inMemServer.AdminGateway("operator-token").ServeHTTP(admin, httptest.NewRequest(http.MethodPost, "/v1/admin/MassCancel", strings.NewReader(allUsers)))
+	if admin.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 from the admin gateway without a token, got %d", admin.Code)
+	}
+
+	resp, err = client.AdminMassCancel(context.Background(), &MassCancelRequest{AllUsers: true, Operator: "ops", Reason: "incident"})
+	if err != nil || len(resp.Cancelled) != 1 || resp.Cancelled[0].UserId != 3456 {
+		t.Fatalf("expected the remaining bid to be cancelled, got %+v (%v)", resp, err)
+	}
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	gateway := httptest.NewServer(client.inMemServer.Gateway())
+	defer gateway.Close()
+
+	opened, err := client.OpenSession(context.Background(), &OpenSessionRequest{UserId: 2345, CancelOnDisconnect: true})
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	sessionId := strconv.FormatUint(opened.Session.SessionId, 10)
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, gateway.URL+"/v1/StreamSession?session_id="+sessionId, nil)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open session stream: %v", err)
+	}
+	if _, err := bufio.NewReader(stream.Body).ReadString('\n'); err != nil {
+		t.Fatalf("failed to read session stream: %v", err)
+	}
+
+	_, err = client.PlaceBid(
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs("session-id", sessionId)),
+		&msproto.PlaceBidRequest{Bid: &mcproto.Bid{Id: 1, ArtworkId: 1234, BidderId: 3456, Quantity: 5, Price: 100}},
+	)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected another user's session to be refused, got %v", err)
+	}
+	_, err = client.PlaceBid(
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs("session-id", sessionId)),
+		&msproto.PlaceBidRequest{Bid: &mcproto.Bid{Id: 2, ArtworkId: 1234, BidderId: 2345, Quantity: 5, Price: 100}},
+	)
+	if err != nil {
+		t.Fatalf("failed to place bid through session: %v", err)
+	}
+
+	disconnect()
+	stream.Body.Close()
+
+	// the session closes once the server notices the stream has ended
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := client.Heartbeat(context.Background(), &HeartbeatRequest{SessionId: opened.Session.SessionId})
+		if st, _ := status.FromError(err); st.Code() == codes.FailedPrecondition && violatedField(st) == "session_id" {
+			break
+		}
+		if err != nil || time.Now().After(deadline) {
+			t.Fatalf("expected the session to close on disconnect, got %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	_, err = client.CancelOrder(context.Background(), &CancelOrderRequest{UserId: 2345, ArtworkId: 1234, Side: match.SIDE_BID, OrderId: 2})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected the bid to be cancelled on disconnect, got %v", err)
+	}
+}
+
+func TestPlacePeggedOrder(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	client.inMemServer.match.AddArtworkIfNotExists(5678)
+
+	_, err := client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+		Bid: &mcproto.Bid{Id: 1, ArtworkId: 1234, BidderId: 2345, Quantity: 5, Price: 100},
+	})
+	if err != nil {
+		t.Fatalf("failed to place bid: %v", err)
+	}
+	_, err = client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+		Ask: &mcproto.Ask{Id: 1, ArtworkId: 1234, AskerId: 3456, Quantity: 5, Price: 120},
+	})
+	if err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+
+	req := &PlacePeggedOrderRequest{OrderId: 2, UserId: 4567, ArtworkId: 1234, Side: match.SIDE_BID, Quantity: 5, Peg: "midpoint", Cap: price.New(150, 2)}
+	resp, err := client.PlacePeggedOrder(context.Background(), req)
+	if err != nil || resp.Price.String() != "1.10" || resp.QuantityFilled != 0 {
+		t.Fatalf("expected the bid pegged to the midpoint at 1.10, got %+v (%v)", resp, err)
+	}
+
+	req.OrderId, req.Peg = 3, "last"
+	_, err = client.PlacePeggedOrder(context.Background(), req)
+	st, _ := status.FromError(err)
+	if st.Code() != codes.InvalidArgument || violatedField(st) != "peg" {
+		t.Fatalf("expected InvalidArgument on peg, got %v", err)
+	}
+
+	req.ArtworkId, req.Peg = 5678, "primary"
+	_, err = client.PlacePeggedOrder(context.Background(), req)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition on an empty book, got %v", err)
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+
+	trade := func(id uint32, p uint32) {
+		_, err := client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+			Ask: &mcproto.Ask{Id: id, ArtworkId: 1234, AskerId: 3456, Quantity: 1, Price: p},
+		})
+		if err != nil {
+			t.Fatalf("failed to place ask: %v", err)
+		}
+		_, err = client.PlaceBid(context.Background(), &msproto.PlaceBidRequest{
+			Bid: &mcproto.Bid{Id: id, ArtworkId: 1234, BidderId: 4567, Quantity: 1, Price: p},
+		})
+		if err != nil {
+			t.Fatalf("failed to place bid: %v", err)
+		}
+	}
+
+	req := &PlaceTrailingStopRequest{StopId: 9, UserId: 2345, ArtworkId: 1234, Side: match.SIDE_ASK, Quantity: 2, TrailBps: 1000, Limit: price.New(50, 2)}
+	_, err := client.PlaceTrailingStop(context.Background(), req)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition before the first trade, got %v", err)
+	}
+
+	trade(1, 100)
+	resp, err := client.PlaceTrailingStop(context.Background(), req)
+	if err != nil || resp.Stop.Trigger.String() != "0.90" || resp.Stop.Status != "ACTIVE" {
+		t.Fatalf("expected the stop to trigger at 0.90, got %+v (%v)", resp, err)
+	}
+
+	trade(2, 80)
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, err := client.GetTrailingStop(context.Background(), &GetTrailingStopRequest{StopId: 9})
+		if err != nil {
+			t.Fatalf("failed to get stop: %v", err)
+		}
+		if got.Stop.Status == "PLACED" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stop to be placed as a limit ask, got %+v", got.Stop)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	_, err = client.CancelOrder(context.Background(), &CancelOrderRequest{UserId: 2345, ArtworkId: 1234, Side: match.SIDE_ASK, OrderId: 9})
+	if err != nil {
+		t.Fatalf("expected the limit ask to rest on the book, got %v", err)
+	}
+}
+
+func TestPlaceBasket(t *testing.T) {
+
+	client := NewMockClient()
+	client.inMemServer.match.AddArtworkIfNotExists(1234)
+	client.inMemServer.match.AddArtworkIfNotExists(5678)
+
+	for i, artworkId := range []uint32{1234, 5678} {
+		_, err := client.PlaceAsk(context.Background(), &msproto.PlaceAskRequest{
+			Ask: &mcproto.Ask{Id: uint32(i + 1), ArtworkId: artworkId, AskerId: 3456, Quantity: 1, Price: 100},
+		})
+		if err != nil {
+			t.Fatalf("failed to place ask: %v", err)
+		}
+	}
+
+	req := &PlaceBasketRequest{BasketId: 7, UserId: 2345, AllOrNone: true, Legs: []BasketLeg{
+		{ArtworkId: 1234, OrderId: 71, Side: match.SIDE_BID, Quantity: 1, Price: price.New(100, 2)},
+		{ArtworkId: 5678, OrderId: 72, Side: match.SIDE_BID, Quantity: 0, Price: price.New(100, 2)},
+	}}
+	_, err := client.PlaceBasket(context.Background(), req)
+	st, _ := status.FromError(err)
+	if st.Code() != codes.InvalidArgument || violatedField(st) != "legs[1].quantity" {
+		t.Fatalf("expected InvalidArgument on legs[1].quantity, got %v", err)
+	}
+
+	req.Legs[1].Quantity = 1
+	resp, err := client.PlaceBasket(context.Background(), req)
+	if err != nil || resp.Basket.Status != "FILLED" || resp.Basket.LegsFilled != 2 || resp.Basket.QuantityFilled != 2 {
+		t.Fatalf("expected both legs to fill, got %+v (%v)", resp, err)
+	}
+
+	_, err = client.CancelBasket(context.Background(), &CancelBasketRequest{BasketId: 7, UserId: 2345})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition cancelling a filled basket, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+// session RPCs let trading systems pull their orders in bulk and tie them
+// to their connection. They are served through the gateway; orders are
+// placed through a session by sending its id in the "session-id" request
+// header, since the marketplace proto has no field for it.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/session"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// how often a session stream checks whether its session has closed
+const sessionPoll = time.Second
+
+type MassCancelRequest struct {
+	UserId uint64 `json:"user_id"`
+	// cancels every user's orders instead, which only operators may do
+	// through AdminMassCancel
+	AllUsers   bool     `json:"all_users"`
+	ArtworkIds []uint64 `json:"artwork_ids"` // every artwork if empty
+	Operator   string   `json:"operator,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+}
+
+type CancelledOrder struct {
+	ArtworkId         uint64 `json:"artwork_id"`
+	Side              uint32 `json:"side"`
+	OrderId           uint64 `json:"order_id"`
+	UserId            uint64 `json:"user_id"`
+	QuantityFilled    uint64 `json:"quantity_filled"`
+	QuantityCancelled uint64 `json:"quantity_cancelled"`
+}
+
+type MassCancelResponse struct {
+	Cancelled []CancelledOrder `json:"cancelled"`
+}
+
+type OpenSessionRequest struct {
+	UserId             uint64 `json:"user_id"`
+	CancelOnDisconnect bool   `json:"cancel_on_disconnect"`
+	// the session closes if no heartbeat arrives for this long; 0 leaves it
+	// open until it is closed or its stream ends
+	HeartbeatSeconds uint64 `json:"heartbeat_seconds"`
+}
+
+type TradingSession struct {
+	SessionId          uint64    `json:"session_id"`
+	UserId             uint64    `json:"user_id"`
+	CancelOnDisconnect bool      `json:"cancel_on_disconnect"`
+	HeartbeatSeconds   uint64    `json:"heartbeat_seconds"`
+	OpenedAt           time.Time `json:"opened_at"`
+	LastSeen           time.Time `json:"last_seen"`
+	Closed             bool      `json:"closed"`
+	Reason             string    `json:"reason,omitempty"`
+	Orders             int       `json:"orders"`
+}
+
+type OpenSessionResponse struct {
+	Session TradingSession `json:"session"`
+}
+
+type HeartbeatRequest struct {
+	SessionId uint64 `json:"session_id"`
+}
+
+type HeartbeatResponse struct {
+	Session TradingSession `json:"session"`
+}
+
+type CloseSessionRequest struct {
+	SessionId uint64 `json:"session_id"`
+}
+
+type CloseSessionResponse struct {
+	Session   TradingSession   `json:"session"`
+	Cancelled []CancelledOrder `json:"cancelled"`
+}
+
+// MassCancel removes every resting order of a user on the given artworks
+// or all of them.
+func (server *Server) MassCancel(
+	ctx context.Context,
+	req *MassCancelRequest,
+) (*MassCancelResponse, error) {
+
+	if req.AllUsers {
+		return nil, status.Error(codes.PermissionDenied, "only operators may cancel every user's orders")
+	}
+	return server.massCancel(req)
+}
+
+// AdminMassCancel is MassCancel for operators, who may also cancel every
+// user's orders. Doing so is audited.
+func (server *Server) AdminMassCancel(
+	ctx context.Context,
+	req *MassCancelRequest,
+) (*MassCancelResponse, error) {
+
+	return server.massCancel(req)
+}
+
+func (server *Server) massCancel(req *MassCancelRequest) (*MassCancelResponse, error) {
+	userIds := []uint64{req.UserId}
+	if req.AllUsers {
+		if err := checkOperator(req.Operator, req.Reason); err != nil {
+			return nil, err
+		}
+		userIds = nil
+	}
+
+	removed, err := server.match.MassCancel(userIds, req.ArtworkIds)
+	switch {
+	case errors.Is(err, match.ErrArtworkNotListed):
+		return nil, preconditionFailure("ARTWORK_NOT_LISTED", "artwork_ids", err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to cancel orders: %v", err)
+	}
+	server.quotes.Forget(removed)
+
+	if req.AllUsers {
+		scope := "every artwork"
+		if len(req.ArtworkIds) > 0 {
+			scope = fmt.Sprintf("artworks %v", req.ArtworkIds)
+		}
+		server.recordAudit(audit.Entry{
+			Action:   "MASS_CANCEL",
+			Operator: req.Operator,
+			Reason:   req.Reason,
+			Detail:   fmt.Sprintf("%d orders cancelled on %s", len(removed), scope),
+		})
+	}
+	return &MassCancelResponse{Cancelled: cancelledOrders(removed)}, nil
+}
+
+// OpenSession starts a session for placing orders. With cancel on
+// disconnect, the session's orders are cancelled when it closes.
+func (server *Server) OpenSession(
+	ctx context.Context,
+	req *OpenSessionRequest,
+) (*OpenSessionResponse, error) {
+
+	s := server.sessions.Open(req.UserId, req.CancelOnDisconnect, time.Duration(req.HeartbeatSeconds)*time.Second)
+	return &OpenSessionResponse{Session: tradingSession(s)}, nil
+}
+
+// Heartbeat keeps a session with a heartbeat interval open.
+func (server *Server) Heartbeat(
+	ctx context.Context,
+	req *HeartbeatRequest,
+) (*HeartbeatResponse, error) {
+
+	s, err := server.sessions.Heartbeat(req.SessionId)
+	if err != nil {
+		return nil, sessionRejected("session_id", err)
+	}
+	return &HeartbeatResponse{Session: tradingSession(s)}, nil
+}
+
+func (server *Server) CloseSession(
+	ctx context.Context,
+	req *CloseSessionRequest,
+) (*CloseSessionResponse, error) {
+
+	s, cancelled, err := server.sessions.Close(req.SessionId, "closed by client")
+	if err != nil {
+		return nil, sessionRejected("session_id", err)
+	}
+	return &CloseSessionResponse{Session: tradingSession(s), Cancelled: cancelledOrders(cancelled)}, nil
+}
+
+// streamSession holds a session open for as long as the client stays
+// connected, writing the session when the stream starts and when it ends.
+// The session closes when the client disconnects.
+func (server *Server) streamSession(w http.ResponseWriter, r *http.Request) {
+	sessionId, err := strconv.ParseUint(r.URL.Query().Get("session_id"), 10, 64)
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "invalid session_id %q", r.URL.Query().Get("session_id")))
+		return
+	}
+	s, err := server.sessions.Get(sessionId)
+	if err == nil && s.Closed {
+		err = fmt.Errorf("%w: session %d: %s", session.ErrSessionClosed, sessionId, s.Reason)
+	}
+	if err != nil {
+		writeError(w, sessionRejected("session_id", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	write := func(s session.Session) {
+		enc.Encode(tradingSession(s))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	write(s)
+
+	ticker := time.NewTicker(sessionPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			server.sessions.Close(sessionId, "stream ended")
+			return
+		case <-ticker.C:
+			s, err := server.sessions.Get(sessionId)
+			if err != nil {
+				return
+			}
+			if s.Closed {
+				write(s)
+				return
+			}
+		}
+	}
+}
+
+// orderSession returns the session an order is placed through, from the
+// "session-id" request header, or 0 if there is none. userId must own the
+// session.
+func (server *Server) orderSession(ctx context.Context, userId uint64) (uint64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("session-id")
+	if len(values) == 0 {
+		return 0, nil
+	}
+	sessionId, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, invalidArgument(fieldViolation("session-id", fmt.Sprintf("invalid session id %q", values[0])))
+	}
+	if err := server.sessions.Check(sessionId, userId); err != nil {
+		return 0, sessionRejected("session-id", err)
+	}
+	return sessionId, nil
+}
+
+// trackOrder records an order placed through a session if it is still on
+// the book.
+func (server *Server) trackOrder(sessionId uint64, order session.Order, remaining uint64) error {
+	if sessionId == 0 || remaining == 0 {
+		return nil
+	}
+	if err := server.sessions.Track(sessionId, order); err != nil {
+		return sessionRejected("session-id", err)
+	}
+	return nil
+}
+
+func tradingSession(s session.Session) TradingSession {
+	return TradingSession{
+		SessionId:          s.Id,
+		UserId:             s.UserId,
+		CancelOnDisconnect: s.CancelOnDisconnect,
+		HeartbeatSeconds:   uint64(s.Heartbeat / time.Second),
+		OpenedAt:           s.OpenedAt,
+		LastSeen:           s.LastSeen,
+		Closed:             s.Closed,
+		Reason:             s.Reason,
+		Orders:             s.Orders,
+	}
+}
+
+func cancelledOrders(removed []match.BidAsk) []CancelledOrder {
+	cancelled := make([]CancelledOrder, 0, len(removed))
+	for _, order := range removed {
+		switch o := order.(type) {
+		case *pqueue.Bid:
+			cancelled = append(cancelled, CancelledOrder{
+				ArtworkId:         o.ArtworkId,
+				Side:              match.SIDE_BID,
+				OrderId:           o.Id,
+				UserId:            o.BidderId,
+				QuantityFilled:    o.QuantityFilled(),
+				QuantityCancelled: o.QuantityRemaining(),
+			})
+		case *pqueue.Ask:
+			cancelled = append(cancelled, CancelledOrder{
+				ArtworkId:         o.ArtworkId,
+				Side:              match.SIDE_ASK,
+				OrderId:           o.Id,
+				UserId:            o.AskerId,
+				QuantityFilled:    o.QuantityFilled(),
+				QuantityCancelled: o.QuantityRemaining(),
+			})
+		}
+	}
+	return cancelled
+}
+
+func sessionRejected(field string, err error) error {
+	switch {
+	case errors.Is(err, session.ErrSessionNotFound):
+		return status.Errorf(codes.NotFound, "%v", err)
+	case errors.Is(err, session.ErrNotOwner):
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	case errors.Is(err, session.ErrSessionClosed):
+		return preconditionFailure("SESSION_CLOSED", field, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "session failed: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+// settlement RPCs that are not part of the marketplace proto
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/settlement"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type GetSettlementRequest struct {
+	FillId uint64 `json:"fill_id"`
+}
+
+type GetSettlementResponse struct {
+	FillId     uint64                `json:"fill_id"`
+	Status     string                `json:"status"`
+	Settlement settlement.Settlement `json:"settlement"`
+}
+
+// GetSettlement returns where a fill is in settlement and, if its last
+// attempt failed, why.
+func (server *Server) GetSettlement(
+	ctx context.Context,
+	req *GetSettlementRequest,
+) (*GetSettlementResponse, error) {
+
+	settled, err := server.settlements.Get(req.FillId)
+	if errors.Is(err, settlement.ErrUnknownFill) {
+		return nil, status.Errorf(codes.NotFound, "fill %d has not been submitted for settlement", req.FillId)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get settlement of fill %d: %v", req.FillId, err)
+	}
+
+	return &GetSettlementResponse{
+		FillId:     req.FillId,
+		Status:     match.StatusName(settled.Status()),
+		Settlement: settled,
+	}, nil
+}
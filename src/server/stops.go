@@ -0,0 +1,186 @@
+// trailing stop RPCs are served through the gateway. A stop waits off the
+// book, trailing the artwork's trade prices, until a print reaches its
+// trigger and it is placed as an ordinary bid or ask.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/stop"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type PlaceTrailingStopRequest struct {
+	StopId    uint64 `json:"stop_id"` // also the id of the order it triggers
+	UserId    uint64 `json:"user_id"`
+	ArtworkId uint64 `json:"artwork_id"`
+	Side      uint32 `json:"side"` // match.SIDE_BID or match.SIDE_ASK
+	Quantity  uint64 `json:"quantity"`
+	// how far the trigger trails the price, as an amount or in basis
+	// points; exactly one is set
+	Trail    price.Price `json:"trail"`
+	TrailBps uint32      `json:"trail_bps"`
+	// the triggered order's limit price; zero places a market order
+	Limit price.Price `json:"limit"`
+}
+
+type TrailingStop struct {
+	StopId         uint64      `json:"stop_id"`
+	UserId         uint64      `json:"user_id"`
+	ArtworkId      uint64      `json:"artwork_id"`
+	Side           uint32      `json:"side"`
+	Quantity       uint64      `json:"quantity"`
+	Trail          price.Price `json:"trail"`
+	TrailBps       uint32      `json:"trail_bps"`
+	Limit          price.Price `json:"limit"`
+	Extreme        price.Price `json:"extreme"` // highest print for asks, lowest for bids
+	Trigger        price.Price `json:"trigger"`
+	Status         string      `json:"status"`
+	Reason         string      `json:"reason,omitempty"`
+	PlacedAt       time.Time   `json:"placed_at"`
+	TriggeredAt    time.Time   `json:"triggered_at,omitempty"`
+	QuantityFilled uint64      `json:"quantity_filled"`
+}
+
+type PlaceTrailingStopResponse struct {
+	Stop TrailingStop `json:"stop"`
+}
+
+type CancelTrailingStopRequest struct {
+	StopId uint64 `json:"stop_id"`
+	UserId uint64 `json:"user_id"`
+}
+
+type CancelTrailingStopResponse struct {
+	Stop TrailingStop `json:"stop"`
+}
+
+type GetTrailingStopRequest struct {
+	StopId uint64 `json:"stop_id"`
+}
+
+type GetTrailingStopResponse struct {
+	Stop TrailingStop `json:"stop"`
+}
+
+// PlaceTrailingStop starts a trailing stop from the artwork's last trade
+// price.
+func (server *Server) PlaceTrailingStop(
+	ctx context.Context,
+	req *PlaceTrailingStopRequest,
+) (*PlaceTrailingStopResponse, error) {
+
+	if err := checkOrderIds(protoField{"stop_id", req.StopId}); err != nil {
+		return nil, err
+	}
+	err := checkProtoRange(
+		protoField{"user_id", req.UserId},
+		protoField{"artwork_id", req.ArtworkId},
+		protoField{"quantity", req.Quantity},
+		protoField{"trail", server.protoUnits(req.ArtworkId, req.Trail)},
+		protoField{"limit", server.protoUnits(req.ArtworkId, req.Limit)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := server.stops.Place(stop.Stop{
+		Id:        req.StopId,
+		UserId:    req.UserId,
+		ArtworkId: req.ArtworkId,
+		Side:      req.Side,
+		Quantity:  req.Quantity,
+		Trail:     req.Trail,
+		TrailBps:  req.TrailBps,
+		Limit:     req.Limit,
+	})
+	if err != nil {
+		return nil, stopRejected(req.StopId, req.ArtworkId, err)
+	}
+	return &PlaceTrailingStopResponse{Stop: trailingStop(s)}, nil
+}
+
+// CancelTrailingStop withdraws a stop that has not triggered.
+func (server *Server) CancelTrailingStop(
+	ctx context.Context,
+	req *CancelTrailingStopRequest,
+) (*CancelTrailingStopResponse, error) {
+
+	s, err := server.stops.Cancel(req.StopId, req.UserId)
+	if err != nil {
+		return nil, stopRejected(req.StopId, 0, err)
+	}
+	return &CancelTrailingStopResponse{Stop: trailingStop(s)}, nil
+}
+
+func (server *Server) GetTrailingStop(
+	ctx context.Context,
+	req *GetTrailingStopRequest,
+) (*GetTrailingStopResponse, error) {
+
+	s, err := server.stops.Get(req.StopId)
+	if err != nil {
+		return nil, stopRejected(req.StopId, 0, err)
+	}
+	return &GetTrailingStopResponse{Stop: trailingStop(s)}, nil
+}
+
+func trailingStop(s stop.Stop) TrailingStop {
+	return TrailingStop{
+		StopId:         s.Id,
+		UserId:         s.UserId,
+		ArtworkId:      s.ArtworkId,
+		Side:           s.Side,
+		Quantity:       s.Quantity,
+		Trail:          s.Trail,
+		TrailBps:       s.TrailBps,
+		Limit:          s.Limit,
+		Extreme:        s.Extreme,
+		Trigger:        s.Trigger,
+		Status:         stop.StatusName(s.Status),
+		Reason:         s.Reason,
+		PlacedAt:       s.PlacedAt,
+		TriggeredAt:    s.TriggeredAt,
+		QuantityFilled: s.QuantityFilled,
+	}
+}
+
+// stopRejected maps trailing stop failures to gRPC errors, naming the
+// request fields at fault.
+func stopRejected(stopId, artworkId uint64, err error) error {
+	var ruleErr *instrument.RuleError
+
+	switch {
+	case errors.As(err, &ruleErr):
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(ruleErr.Violations))
+		for i, v := range ruleErr.Violations {
+			violations[i] = fieldViolation(v.Field, v.Description)
+		}
+		return invalidArgument(violations...)
+	case errors.Is(err, match.ErrArtworkNotListed):
+		return artworkNotListed("artwork_id", artworkId)
+	case errors.Is(err, stop.ErrInvalidStop):
+		return invalidArgument(fieldViolation("stop", err.Error()))
+	case errors.Is(err, stop.ErrNoLastPrice):
+		return preconditionFailure("NO_LAST_TRADE", "artwork_id", err.Error())
+	case errors.Is(err, stop.ErrStopExists):
+		return status.Errorf(codes.AlreadyExists, "trailing stop %d already exists", stopId)
+	case errors.Is(err, stop.ErrStopNotFound):
+		return status.Errorf(codes.NotFound, "trailing stop %d does not exist", stopId)
+	case errors.Is(err, stop.ErrNotOwner):
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	case errors.Is(err, stop.ErrNotActive):
+		return preconditionFailure("STOP_NOT_ACTIVE", "stop_id", err.Error())
+	default:
+		return status.Errorf(codes.Internal, "trailing stop %d failed: %v", stopId, err)
+	}
+}
@@ -0,0 +1,95 @@
+// streams push feed events to clients over the gateway as newline-delimited
+// JSON, one event per line, until the client disconnects or falls too far
+// behind and is dropped by the feed.
+
+package main
+
+import (
+	"encoding/json"
+	"fractr-marketplace-secondary/feed"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// events buffered per stream before a slow client is dropped
+const streamBuffer = 256
+
+// eventFilter narrows a stream by the optional artwork_id and user_id query
+// parameters.
+func eventFilter(r *http.Request) (func(feed.Event) bool, error) {
+	query := r.URL.Query()
+
+	var artworkId, userId uint64
+	var err error
+	if v := query.Get("artwork_id"); v != "" {
+		if artworkId, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid artwork_id %q", v)
+		}
+	}
+	if v := query.Get("user_id"); v != "" {
+		if userId, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid user_id %q", v)
+		}
+	}
+
+	return func(ev feed.Event) bool {
+		if query.Has("artwork_id") && ev.ArtworkId != artworkId {
+			return false
+		}
+		if query.Has("user_id") && !ev.Involves(userId) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// streamEvents writes every event of the given types that passes the
+// request's filter.
+func (server *Server) streamEvents(types ...feed.EventType) http.HandlerFunc {
+	wanted := make(map[feed.EventType]bool, len(types))
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := eventFilter(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		sub := server.feed.Subscribe(streamBuffer)
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if !wanted[ev.Type] || !filter(ev) {
+					continue
+				}
+				if err := enc.Encode(ev); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// trade bust and correction RPCs let operators reverse a trade that failed
+// to settle or should never have happened. They are served through the
+// admin gateway, and every use is recorded in the audit log.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/audit"
+	"fractr-marketplace-secondary/holdings"
+	"fractr-marketplace-secondary/ledger"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+	"fractr-marketplace-secondary/royalty"
+	"fractr-marketplace-secondary/settlement"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type BustTradeRequest struct {
+	FillId uint64 `json:"fill_id"`
+	// RestoreOrders puts the busted quantity back on the fill's bid and ask
+	// if they are still resting.
+	RestoreOrders bool   `json:"restore_orders"`
+	Operator      string `json:"operator"`
+	Reason        string `json:"reason"`
+}
+
+type RestoredOrder struct {
+	Side              uint32 `json:"side"`
+	OrderId           uint64 `json:"order_id"`
+	QuantityRemaining uint64 `json:"quantity_remaining"`
+}
+
+type BustTradeResponse struct {
+	Fill           match.FillOrder `json:"fill"`
+	RestoredOrders []RestoredOrder `json:"restored_orders"`
+}
+
+type CorrectTradeRequest struct {
+	FillId   uint64      `json:"fill_id"`
+	Price    price.Price `json:"price"`
+	Quantity uint64      `json:"quantity"`
+	Operator string      `json:"operator"`
+	Reason   string      `json:"reason"`
+}
+
+type CorrectTradeResponse struct {
+	Busted    match.FillOrder `json:"busted"`
+	Corrected match.FillOrder `json:"corrected"`
+}
+
+// BustTrade reverses a fill that has not settled: the payment and fractions
+// go back, its ledger postings and royalties are reversed and both
+// counterparties see a BUST on the trade stream.
+func (server *Server) BustTrade(
+	ctx context.Context,
+	req *BustTradeRequest,
+) (*BustTradeResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+
+	var restored []match.BidAsk
+	job, err := server.settlements.Bust(req.FillId, func(job settlement.Job) error {
+		var err error
+		restored, err = server.unwindFill(job, req.RestoreOrders)
+		return err
+	})
+	if err != nil {
+		return nil, bustRejected(req.FillId, err)
+	}
+	server.feed.PublishBust(job.Fill)
+
+	resp := &BustTradeResponse{Fill: job.Fill}
+	for _, order := range restored {
+		switch ord := order.(type) {
+		case *pqueue.Bid:
+			resp.RestoredOrders = append(resp.RestoredOrders, RestoredOrder{match.SIDE_BID, ord.Id, ord.QuantityRemaining()})
+		case *pqueue.Ask:
+			resp.RestoredOrders = append(resp.RestoredOrders, RestoredOrder{match.SIDE_ASK, ord.Id, ord.QuantityRemaining()})
+		}
+	}
+
+	server.recordAudit(audit.Entry{
+		Action:    "BUST_TRADE",
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+		FillId:    req.FillId,
+		ArtworkId: job.Fill.ArtworkId,
+		Detail:    fmt.Sprintf("restored %d resting orders", len(resp.RestoredOrders)),
+	})
+	return resp, nil
+}
+
+// CorrectTrade busts a fill that has not settled and replaces it with one
+// between the same counterparties at the corrected price and quantity,
+// which is settled like any other trade. Both counterparties see the BUST
+// followed by a CORRECTION on the trade stream.
+func (server *Server) CorrectTrade(
+	ctx context.Context,
+	req *CorrectTradeRequest,
+) (*CorrectTradeResponse, error) {
+
+	if err := checkOperator(req.Operator, req.Reason); err != nil {
+		return nil, err
+	}
+	original, err := server.settlements.Get(req.FillId)
+	if err != nil {
+		return nil, bustRejected(req.FillId, err)
+	}
+	inst := server.match.Instrument(original.Job.Fill.ArtworkId)
+	if err := inst.CheckOrder(req.Quantity, req.Price); err != nil {
+		return nil, orderRejected("correction", err)
+	}
+
+	var corrected match.FillOrder
+	var correctErr error
+	job, err := server.settlements.Bust(req.FillId, func(job settlement.Job) error {
+		if _, err := server.unwindFill(job, false); err != nil {
+			return err
+		}
+		// the original is busted whether or not the correction can be booked
+		corrected, correctErr = server.match.CorrectFill(job.Fill, req.Price, req.Quantity)
+		return nil
+	})
+	if err != nil {
+		return nil, bustRejected(req.FillId, err)
+	}
+	server.feed.PublishBust(job.Fill)
+
+	entry := audit.Entry{
+		Action:    "CORRECT_TRADE",
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+		FillId:    req.FillId,
+		ArtworkId: job.Fill.ArtworkId,
+	}
+	if correctErr != nil {
+		entry.Detail = fmt.Sprintf("busted, correction to %d at %s failed: %v", req.Quantity, req.Price, correctErr)
+		server.recordAudit(entry)
+		return nil, status.Errorf(codes.FailedPrecondition, "fill %d was busted but its correction failed: %v", req.FillId, correctErr)
+	}
+
+	server.feed.PublishCorrection(corrected, req.FillId)
+	server.settleFill(corrected)
+
+	entry.Detail = fmt.Sprintf("replaced by fill %d: %d at %s", corrected.Id, corrected.QuantityFilled, corrected.Price)
+	server.recordAudit(entry)
+	return &CorrectTradeResponse{Busted: job.Fill, Corrected: corrected}, nil
+}
+
+// unwindFill reverses everything the fill changed outside settlement. The
+// ledger and royalty reversals can fail on their journals, so they go before
+// the books are unwound, and a bust retried after a failure skips whichever
+// of them is already done.
+func (server *Server) unwindFill(job settlement.Job, restore bool) ([]match.BidAsk, error) {
+	if _, err := server.ledger.Reverse(job.Fill.Id); err != nil && !errors.Is(err, ledger.ErrAlreadyReversed) {
+		return nil, err
+	}
+	if err := server.royaltyReport.Reverse(job.Royalties); err != nil && !errors.Is(err, royalty.ErrAlreadyReversed) {
+		return nil, err
+	}
+	return server.match.BustFill(job.Fill, restore)
+}
+
+func (server *Server) recordAudit(entry audit.Entry) {
+	if err := server.audit.Record(entry); err != nil {
+		// the action has already been taken, so it cannot be refused
+		log.Printf("failed to record %s in the audit log: %v", entry.Action, err)
+	}
+}
+
+func checkOperator(operator, reason string) error {
+	var violations []string
+	if operator == "" {
+		violations = append(violations, "operator")
+	}
+	if reason == "" {
+		violations = append(violations, "reason")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return invalidArgument(fieldViolation(violations[0], violations[0]+" is required for the audit log"))
+}
+
+func bustRejected(fillId uint64, err error) error {
+	switch {
+	case errors.Is(err, settlement.ErrUnknownFill):
+		return status.Errorf(codes.NotFound, "fill %d has not been submitted for settlement", fillId)
+	case errors.Is(err, settlement.ErrInFlight):
+		return status.Errorf(codes.Aborted, "fill %d is being settled, try again once it finishes", fillId)
+	case errors.Is(err, settlement.ErrSettled):
+		return preconditionFailure("SETTLED", "fill_id", fmt.Sprintf("fill %d has already settled on chain", fillId))
+	case errors.Is(err, holdings.ErrInsufficientHoldings):
+		return preconditionFailure("INSUFFICIENT_HOLDINGS", "fill_id", err.Error())
+	case errors.Is(err, account.ErrInsufficientFunds):
+		return preconditionFailure("INSUFFICIENT_FUNDS", "fill_id", err.Error())
+	default:
+		return status.Errorf(codes.FailedPrecondition, "cannot bust fill %d: %v", fillId, err)
+	}
+}
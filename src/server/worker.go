@@ -3,15 +3,104 @@
 
 package main
 
-import "fmt"
+import (
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/settlement"
+	"log"
+	"time"
+
+	"github.com/blidd/fractr-proto/storage"
+)
+
+func (server *Server) newSettlementJob(tx match.FillOrder) settlement.Job {
+	payouts, err := server.royalties.Split(tx)
+	if err != nil {
+		// cannot happen for fills the engine accepted, whose notional fits
+		log.Printf("failed to compute royalties of fill %d: %v", tx.Id, err)
+	}
+	if err := server.royaltyReport.Record(payouts); err != nil {
+		log.Printf("failed to record royalties of fill %d: %v", tx.Id, err)
+	}
+
+	return settlement.Job{Fill: tx, Royalties: payouts}
+}
+
+// settleFill pays the fill's royalties, posts it to the ledger and submits
+// it for settlement.
+func (server *Server) settleFill(tx match.FillOrder) {
+	job := server.newSettlementJob(tx)
+	for _, payout := range job.Royalties {
+		server.feed.PublishRoyalty(payout)
+	}
+	if _, err := server.ledger.PostFill(job.Fill, job.Royalties); err != nil {
+		log.Printf("failed to post fill %d to the ledger: %v", tx.Id, err)
+	}
+	if err := server.settlements.Submit(job); err != nil {
+		log.Printf("failed to submit fill %d for settlement: %v", tx.Id, err)
+	}
+}
+
+// how often resting orders are checked for expiry
+const expirySweepInterval = time.Second
+
+// ExpirySweeper removes expired orders from the books. It runs apart from
+// the worker, which must keep draining the engine's channels: a book stays
+// locked while its fills are sent, so a sweep waiting on that lock inside
+// the worker would never get it. Run it as a goroutine.
+func (server *Server) ExpirySweeper() {
+	expirySweep := time.NewTicker(expirySweepInterval)
+	defer expirySweep.Stop()
+
+	for now := range expirySweep.C {
+		expired, err := server.match.ExpireOrders(now)
+		if err != nil {
+			log.Printf("failed to release expired orders: %v", err)
+		}
+		for _, order := range expired {
+			log.Printf("order expired: %+v", order)
+		}
+	}
+}
 
 // run as async go routine
 func (server *Server) Worker() {
+	log.Printf("spinning up worker routine")
 
 	for {
 		select {
-		case order := <-server.match.Orders():
-			fmt.Printf("%+v\n", order)
+		case tx := <-server.match.Orders():
+			server.feed.PublishTrade(tx)
+			server.settleFill(tx)
+			server.stops.Print(tx)
+			server.baskets.Print(tx)
+
+		case order := <-server.match.Jobs():
+
+			switch ord := order.(type) {
+			case *pqueue.Bid:
+				server.ls.Put(
+					storage.Type_BID,
+					ord.Id,
+					[]uint64{},
+					false,
+					"",
+					"",
+					server.bidStatusToProto(ord),
+					nil,
+				)
+			case *pqueue.Ask:
+				server.ls.Put(
+					storage.Type_ASK,
+					ord.Id,
+					[]uint64{},
+					false,
+					"",
+					"",
+					nil,
+					server.askStatusToProto(ord),
+				)
+			}
 		}
 	}
 
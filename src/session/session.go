@@ -0,0 +1,262 @@
+// sessions tie a trading system's orders to its connection, so a system
+// that fails cannot leave stale orders on the books. A session opened with
+// cancel on disconnect cancels every order placed through it once it
+// closes, whether the client closes it, its stream ends or its heartbeats
+// lapse. Orders that have filled or been cancelled since are skipped.
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/match"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionClosed   = errors.New("session is closed")
+	ErrNotOwner        = errors.New("order is not the session user's")
+)
+
+// Order is an order placed through a session.
+type Order struct {
+	ArtworkId uint64
+	Side      uint32 // match.SIDE_BID or match.SIDE_ASK
+	OrderId   uint64
+}
+
+type Session struct {
+	Id                 uint64
+	UserId             uint64
+	CancelOnDisconnect bool
+	// the session closes if no heartbeat arrives for this long; 0 leaves it
+	// open until it is closed
+	Heartbeat time.Duration
+	OpenedAt  time.Time
+	LastSeen  time.Time
+	Closed    bool
+	Reason    string // why it closed
+	Orders    int    // orders placed through it
+
+	orders []Order
+	timer  *time.Timer
+}
+
+// closedRetention is how long a closed session is kept, so orders placed
+// through it as it closed are still cancelled and its client can still see
+// why it closed.
+const closedRetention = time.Minute
+
+// Manager keeps track of open sessions and those closed within the last
+// retention period. It is safe for concurrent use.
+type Manager struct {
+	engine    *match.OrderMatchingEngine
+	mu        sync.Mutex
+	sessions  map[uint64]*Session // key: session id
+	lastId    uint64
+	listener  func(Session, []match.BidAsk)
+	retention time.Duration
+}
+
+func New(engine *match.OrderMatchingEngine) *Manager {
+	return &Manager{
+		engine:    engine,
+		sessions:  make(map[uint64]*Session),
+		retention: closedRetention,
+	}
+}
+
+// SetCloseListener makes the manager call listener with every session that
+// closes and the orders it cancelled. It is called with the manager locked,
+// so it must not call back into the manager.
+func (manager *Manager) SetCloseListener(listener func(Session, []match.BidAsk)) {
+	manager.listener = listener
+}
+
+// Open starts a session for the user.
+func (manager *Manager) Open(userId uint64, cancelOnDisconnect bool, heartbeat time.Duration) Session {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.lastId++
+	now := time.Now()
+	s := &Session{
+		Id:                 manager.lastId,
+		UserId:             userId,
+		CancelOnDisconnect: cancelOnDisconnect,
+		Heartbeat:          heartbeat,
+		OpenedAt:           now,
+		LastSeen:           now,
+	}
+	manager.sessions[s.Id] = s
+	if heartbeat > 0 {
+		id := s.Id
+		s.timer = time.AfterFunc(heartbeat, func() { manager.lapse(id) })
+	}
+	return *s
+}
+
+// Get returns the session with the given id.
+func (manager *Manager) Get(sessionId uint64) (Session, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, ok := manager.sessions[sessionId]
+	if !ok {
+		return Session{}, fmt.Errorf("%w: %d", ErrSessionNotFound, sessionId)
+	}
+	return *s, nil
+}
+
+// Heartbeat keeps the session open for another heartbeat interval.
+func (manager *Manager) Heartbeat(sessionId uint64) (Session, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, err := manager.open(sessionId)
+	if err != nil {
+		return Session{}, err
+	}
+	s.LastSeen = time.Now()
+	if s.timer != nil {
+		s.timer.Reset(s.Heartbeat)
+	}
+	return *s, nil
+}
+
+// Check returns an error unless userId may place orders through the
+// session.
+func (manager *Manager) Check(sessionId, userId uint64) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, err := manager.open(sessionId)
+	if err != nil {
+		return err
+	}
+	if s.UserId != userId {
+		return fmt.Errorf("%w: session %d is user %d's, not %d", ErrNotOwner, sessionId, s.UserId, userId)
+	}
+	return nil
+}
+
+// Track records an order placed through the session, which Check has
+// allowed. If the session closed while the order was being placed, the
+// order is cancelled as the session's other orders were and Track returns
+// ErrSessionClosed.
+func (manager *Manager) Track(sessionId uint64, order Order) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, ok := manager.sessions[sessionId]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrSessionNotFound, sessionId)
+	}
+	if s.Closed {
+		if s.CancelOnDisconnect {
+			manager.cancel(s.UserId, order)
+		}
+		return fmt.Errorf("%w: session %d: %s", ErrSessionClosed, sessionId, s.Reason)
+	}
+	s.orders = append(s.orders, order)
+	s.Orders++
+	return nil
+}
+
+// Close ends the session, cancelling its orders if it was opened with
+// cancel on disconnect, and returns the orders cancelled.
+func (manager *Manager) Close(sessionId uint64, reason string) (Session, []match.BidAsk, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, err := manager.open(sessionId)
+	if err != nil {
+		return Session{}, nil, err
+	}
+	cancelled := manager.close(s, reason)
+	return *s, cancelled, nil
+}
+
+func (manager *Manager) lapse(sessionId uint64) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, ok := manager.sessions[sessionId]
+	// a heartbeat may have come in while the timer fired
+	if !ok || s.Closed || time.Since(s.LastSeen) < s.Heartbeat {
+		return
+	}
+	manager.close(s, fmt.Sprintf("no heartbeat for %s", s.Heartbeat))
+}
+
+func (manager *Manager) close(s *Session, reason string) []match.BidAsk {
+	s.Closed, s.Reason = true, reason
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	var cancelled []match.BidAsk
+	if s.CancelOnDisconnect {
+		for _, order := range s.orders {
+			if removed, ok := manager.cancel(s.UserId, order); ok {
+				cancelled = append(cancelled, removed)
+			}
+		}
+	}
+	s.orders = nil
+	id := s.Id
+	time.AfterFunc(manager.retention, func() { manager.forget(id) })
+
+	if manager.listener != nil {
+		manager.listener(*s, cancelled)
+	}
+	return cancelled
+}
+
+// forget drops a closed session once its retention period is over.
+func (manager *Manager) forget(sessionId uint64) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	delete(manager.sessions, sessionId)
+}
+
+// cancel takes the user's order off its book if it is still resting there.
+func (manager *Manager) cancel(userId uint64, order Order) (match.BidAsk, bool) {
+	var removed match.BidAsk
+	var err error
+	switch order.Side {
+	case match.SIDE_BID:
+		bid, cancelErr := manager.engine.CancelUserBid(order.ArtworkId, order.OrderId, userId)
+		if bid != nil {
+			removed = bid
+		}
+		err = cancelErr
+	case match.SIDE_ASK:
+		ask, cancelErr := manager.engine.CancelUserAsk(order.ArtworkId, order.OrderId, userId)
+		if ask != nil {
+			removed = ask
+		}
+		err = cancelErr
+	}
+	if err != nil && !errors.Is(err, match.ErrOrderNotFound) {
+		log.Printf("failed to cancel order %d on artwork %d: %v", order.OrderId, order.ArtworkId, err)
+	}
+	return removed, removed != nil
+}
+
+// open returns the session if orders can still be placed through it.
+func (manager *Manager) open(sessionId uint64) (*Session, error) {
+	s, ok := manager.sessions[sessionId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrSessionNotFound, sessionId)
+	}
+	if s.Closed {
+		return nil, fmt.Errorf("%w: session %d: %s", ErrSessionClosed, sessionId, s.Reason)
+	}
+	return s, nil
+}
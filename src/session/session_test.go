@@ -0,0 +1,178 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fractr-marketplace-secondary/account"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+const (
+	artworkId = 1
+	userId    = 10
+)
+
+// setupManager returns a manager on an engine listing one artwork, with the
+// user holding 100.00 USD.
+func setupManager() (*Manager, *match.OrderMatchingEngine, *account.Memory) {
+	engine := match.New()
+	engine.AddArtworkIfNotExists(artworkId)
+	accounts := account.NewMemory()
+	accounts.Deposit(userId, "USD", price.New(10000, 2))
+	engine.SetAccountService(accounts)
+
+	go func() {
+		for {
+			select {
+			case <-engine.Orders():
+			case <-engine.Jobs():
+			}
+		}
+	}()
+	return New(engine), engine, accounts
+}
+
+// placeBid rests a bid for the user through the session.
+func placeBid(t *testing.T, manager *Manager, engine *match.OrderMatchingEngine, sessionId, bidId uint64) {
+	if err := manager.Check(sessionId, userId); err != nil {
+		t.Fatalf("failed to check session: %v", err)
+	}
+	if _, err := engine.FillBidOrder(pqueue.NewBid(bidId, userId, artworkId, 10, price.New(100, 2))); err != nil {
+		t.Fatalf("failed to place bid: %v", err)
+	}
+	if err := manager.Track(sessionId, Order{ArtworkId: artworkId, Side: match.SIDE_BID, OrderId: bidId}); err != nil {
+		t.Fatalf("failed to track bid: %v", err)
+	}
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	manager, engine, accounts := setupManager()
+
+	var closed []Session
+	manager.SetCloseListener(func(s Session, _ []match.BidAsk) { closed = append(closed, s) })
+
+	kept := manager.Open(userId, false, 0)
+	pulled := manager.Open(userId, true, 0)
+	if err := manager.Check(pulled.Id, userId+1); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("Expected another user's session to be refused, got %v", err)
+	}
+	placeBid(t, manager, engine, kept.Id, 1)
+	placeBid(t, manager, engine, pulled.Id, 2)
+	placeBid(t, manager, engine, pulled.Id, 3)
+	if _, err := engine.CancelBid(artworkId, 3); err != nil {
+		t.Fatalf("failed to cancel bid: %v", err)
+	}
+
+	if _, cancelled, err := manager.Close(kept.Id, "done"); err != nil || len(cancelled) != 0 {
+		t.Fatalf("Expected a session without cancel on disconnect to leave its orders, got %v, %v", cancelled, err)
+	}
+	s, cancelled, err := manager.Close(pulled.Id, "done")
+	if err != nil || len(cancelled) != 1 || cancelled[0].(*pqueue.Bid).Id != 2 {
+		t.Fatalf("Expected only bid 2 to be cancelled, got %v, %v", cancelled, err)
+	}
+	if !s.Closed || s.Orders != 2 || len(closed) != 2 {
+		t.Fatalf("Expected both sessions to be closed, got %+v and %d closed", s, len(closed))
+	}
+	if balance := accounts.Balance(userId, "USD"); balance.Reserved.String() != "10.00" {
+		t.Errorf("Expected only bid 1 to stay reserved, got %+v", balance)
+	}
+
+	// an order placed while the session closed is cancelled too
+	if _, err := engine.FillBidOrder(pqueue.NewBid(4, userId, artworkId, 10, price.New(100, 2))); err != nil {
+		t.Fatalf("failed to place bid: %v", err)
+	}
+	err = manager.Track(pulled.Id, Order{ArtworkId: artworkId, Side: match.SIDE_BID, OrderId: 4})
+	if !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("Expected tracking on a closed session to fail, got %v", err)
+	}
+	if _, err := engine.CancelBid(artworkId, 4); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected the late bid to be cancelled, got %v", err)
+	}
+}
+
+func TestCancelOnDisconnectLeavesOtherUsersOrders(t *testing.T) {
+	manager, engine, accounts := setupManager()
+	accounts.Deposit(userId+1, "USD", price.New(10000, 2))
+
+	other := pqueue.NewBid(1, userId+1, artworkId, 10, price.New(200, 2))
+	if _, err := engine.FillBidOrder(other); err != nil {
+		t.Fatalf("failed to place the other user's bid: %v", err)
+	}
+	s := manager.Open(userId, true, 0)
+	placeBid(t, manager, engine, s.Id, 1)
+
+	if _, cancelled, err := manager.Close(s.Id, "done"); err != nil || len(cancelled) != 1 || cancelled[0] == other {
+		t.Fatalf("Expected only the session's bid to be cancelled, got %v, %v", cancelled, err)
+	}
+	if cancelled, err := engine.CancelUserBid(artworkId, 1, userId+1); err != nil || cancelled != other {
+		t.Errorf("Expected the other user's bid to keep resting, got %v, %v", cancelled, err)
+	}
+}
+
+func TestSessionClosesWhenHeartbeatsLapse(t *testing.T) {
+	manager, engine, _ := setupManager()
+
+	s := manager.Open(userId, true, 40*time.Millisecond)
+	placeBid(t, manager, engine, s.Id, 1)
+
+	// heartbeats keep it open past its interval
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := manager.Heartbeat(s.Id); err != nil {
+			t.Fatalf("failed to heartbeat: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s, err := manager.Get(s.Id)
+		if err != nil {
+			t.Fatalf("failed to get session: %v", err)
+		}
+		if s.Closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the session to close, got %+v", s)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := engine.CancelBid(artworkId, 1); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected the bid to be cancelled, got %v", err)
+	}
+	if _, err := manager.Heartbeat(s.Id); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Expected heartbeats on a closed session to fail, got %v", err)
+	}
+}
+
+func TestClosedSessionsAreForgotten(t *testing.T) {
+	manager, _, _ := setupManager()
+	manager.retention = 10 * time.Millisecond
+
+	s := manager.Open(userId, true, 0)
+	if _, _, err := manager.Close(s.Id, "done"); err != nil {
+		t.Fatalf("failed to close session: %v", err)
+	}
+	if s, err := manager.Get(s.Id); err != nil || !s.Closed {
+		t.Fatalf("Expected the closed session to be kept for a while, got %+v, %v", s, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := manager.Get(s.Id)
+		if errors.Is(err, ErrSessionNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the closed session to be forgotten, got %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// a heartbeat timer firing late finds nothing to close
+	manager.lapse(s.Id)
+}
@@ -0,0 +1,510 @@
+// settlement carries each fill through to the transfer of its fractions,
+// payment and royalties. A fill starts PENDING, is SUBMITTED while its
+// executor carries it out and ends COMPLETE, or REJECTED if the executor
+// refuses it or it keeps failing. Failed attempts go back to PENDING and
+// are retried with exponential backoff. Fills queued close together are
+// settled as one batch when the executor supports it; a rejected batch is
+// split in half until the fills at fault are found, so one bad fill does
+// not reject the rest. Every transition is journalled, so a restarted
+// server resumes the fills it had not finished settling.
+
+package settlement
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/libstore"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/royalty"
+)
+
+// ErrRejected is wrapped by executors refusing a settlement outright, which
+// is never retried.
+var ErrRejected = errors.New("settlement: rejected")
+
+var (
+	ErrUnknownFill = errors.New("settlement: unknown fill")
+	// ErrInFlight is returned when busting a fill whose settlement has
+	// been submitted and not yet finished.
+	ErrInFlight = errors.New("settlement: fill is being settled")
+	// ErrSettled is returned when busting a fill that has already settled.
+	ErrSettled = errors.New("settlement: fill already settled")
+)
+
+var (
+	errDone    = errors.New("settlement: already done")
+	errBusting = errors.New("settlement: being busted")
+)
+
+// a job is everything that must be transferred for one fill: the fractions
+// and payment between buyer and seller, and the royalties owed to the
+// artwork's artists out of the seller's proceeds
+type Job struct {
+	Fill      match.FillOrder  `json:"fill"`
+	Royalties []royalty.Payout `json:"royalties"`
+}
+
+// Executor carries out settlements, e.g. by calling the smart contract.
+type Executor interface {
+	// Execute settles the job, returning once it has completed. Errors
+	// wrapping ErrRejected are final; anything else is retried. A fill that
+	// was SUBMITTED when the server stopped is executed again on restart.
+	Execute(job Job) error
+}
+
+// BatchExecutor is implemented by executors that can settle several jobs
+// at once, all or none of them.
+type BatchExecutor interface {
+	Executor
+	// ExecuteBatch settles every job or none. Errors are treated as by
+	// Execute, for the whole batch.
+	ExecuteBatch(jobs []Job) error
+}
+
+// ExecutorFunc adapts a function to an Executor.
+type ExecutorFunc func(job Job) error
+
+func (fn ExecutorFunc) Execute(job Job) error {
+	return fn(job)
+}
+
+// Settlement is the latest state of one fill's settlement. Job.Fill.Status
+// holds its status.
+type Settlement struct {
+	Job       Job       `json:"job"`
+	BatchId   uint64    `json:"batch_id,omitempty"` // batch of the latest attempt
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s Settlement) Status() uint32 {
+	return s.Job.Fill.Status
+}
+
+func (s Settlement) done() bool {
+	switch s.Status() {
+	case match.ORDER_COMPLETE, match.ORDER_REJECTED, match.ORDER_BUSTED:
+		return true
+	}
+	return false
+}
+
+type Config struct {
+	MaxAttempts int           // attempts before a failing fill is rejected
+	RetryDelay  time.Duration // delay before the first retry, doubled after each
+	BatchSize   int           // most fills per batch; 0 or 1 settles fills one by one
+	BatchWindow time.Duration // how long a batch waits to fill up
+}
+
+var DefaultConfig = Config{
+	MaxAttempts: 5,
+	RetryDelay:  time.Second,
+	BatchSize:   32,
+	BatchWindow: 100 * time.Millisecond,
+}
+
+// Pipeline settles fills one batch at a time, oldest fill first among those
+// due. It is safe for concurrent use, and submitting never waits on the
+// executor, however far behind it is.
+type Pipeline struct {
+	executor    Executor
+	cfg         Config
+	settlements map[uint64]*Settlement // key: fillId
+	lastFillId  uint64
+	lastBatchId uint64
+	due         map[uint64]time.Time // PENDING fills and when they may be attempted
+	busting     map[uint64]bool      // fills being unwound by Bust
+	wake        chan struct{}        // signalled when a fill is queued
+	journal     *libstore.Journal    // nil keeps settlements in memory only
+	mu          sync.Mutex
+}
+
+func New(executor Executor, cfg Config) *Pipeline {
+	return &Pipeline{
+		executor:    executor,
+		cfg:         cfg,
+		settlements: make(map[uint64]*Settlement),
+		due:         make(map[uint64]time.Time),
+		busting:     make(map[uint64]bool),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Open returns a pipeline journalled at path, with every fill the journal
+// had not finished settling queued to be attempted again.
+func Open(path string, executor Executor, cfg Config) (*Pipeline, error) {
+	journal, err := libstore.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := New(executor, cfg)
+	err = journal.Replay(func(record json.RawMessage) error {
+		var settlement Settlement
+		if err := json.Unmarshal(record, &settlement); err != nil {
+			return err
+		}
+		p.settlements[settlement.Job.Fill.Id] = &settlement
+		if settlement.Job.Fill.Id > p.lastFillId {
+			p.lastFillId = settlement.Job.Fill.Id
+		}
+		if settlement.BatchId > p.lastBatchId {
+			p.lastBatchId = settlement.BatchId
+		}
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to replay settlements: %v", err)
+	}
+	p.journal = journal
+
+	now := time.Now()
+	for fillId, settlement := range p.settlements {
+		if !settlement.done() {
+			p.queue(fillId, now)
+		}
+	}
+	return p, nil
+}
+
+func (p *Pipeline) Close() error {
+	if p.journal == nil {
+		return nil
+	}
+	return p.journal.Close()
+}
+
+// LastFillId is the highest fill id the pipeline has seen, for the engine
+// to resume numbering fills after.
+func (p *Pipeline) LastFillId() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastFillId
+}
+
+// Submit records the fill as PENDING and queues it to be settled.
+func (p *Pipeline) Submit(job Job) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.settlements[job.Fill.Id]; ok {
+		return fmt.Errorf("settlement: fill %d already submitted", job.Fill.Id)
+	}
+	job.Fill.Status = match.ORDER_PENDING
+	settlement := &Settlement{Job: job}
+	p.settlements[job.Fill.Id] = settlement
+	if job.Fill.Id > p.lastFillId {
+		p.lastFillId = job.Fill.Id
+	}
+	if err := p.record(settlement); err != nil {
+		return err
+	}
+	p.queue(job.Fill.Id, time.Now())
+	return nil
+}
+
+// queue makes the fill due to be attempted at at. The caller holds p.mu.
+func (p *Pipeline) queue(fillId uint64, at time.Time) {
+	p.due[fillId] = at
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run settles queued fills until the process exits. Run it as a goroutine.
+func (p *Pipeline) Run() {
+	for {
+		p.attempt(p.collect())
+	}
+}
+
+// collect waits for fills to fall due and takes them, oldest first, up to
+// the batch size. A batch waits up to the batch window after its first
+// fill falls due for more to join it.
+func (p *Pipeline) collect() []uint64 {
+	size := p.cfg.BatchSize
+	if _, ok := p.executor.(BatchExecutor); !ok || size <= 1 {
+		size = 1
+	}
+
+	var window <-chan time.Time
+	windowClosed := size == 1
+	for {
+		p.mu.Lock()
+		due, next := p.dueFills(time.Now())
+		if len(due) >= size || (len(due) > 0 && windowClosed) {
+			due = earliest(due, size)
+			for _, fillId := range due {
+				delete(p.due, fillId)
+			}
+			p.mu.Unlock()
+			return due
+		}
+		p.mu.Unlock()
+
+		if len(due) > 0 && window == nil {
+			timer := time.NewTimer(p.cfg.BatchWindow)
+			defer timer.Stop()
+			window = timer.C
+		}
+		var retry <-chan time.Time
+		var retryTimer *time.Timer
+		if !next.IsZero() {
+			retryTimer = time.NewTimer(time.Until(next))
+			retry = retryTimer.C
+		}
+		select {
+		case <-p.wake:
+		case <-window:
+			window, windowClosed = nil, true
+		case <-retry:
+		}
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+	}
+}
+
+// dueFills returns the fills due at now, and when the next of the others
+// falls due, or zero if none is waiting. The caller holds p.mu.
+func (p *Pipeline) dueFills(now time.Time) ([]uint64, time.Time) {
+	var due []uint64
+	var next time.Time
+	for fillId, at := range p.due {
+		if !at.After(now) {
+			due = append(due, fillId)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return due, next
+}
+
+// earliest returns the size lowest fill ids, in order, so fills settle in
+// the order they were made.
+func earliest(fillIds []uint64, size int) []uint64 {
+	if size == 1 {
+		first := fillIds[0]
+		for _, fillId := range fillIds[1:] {
+			if fillId < first {
+				first = fillId
+			}
+		}
+		return []uint64{first}
+	}
+	sort.Slice(fillIds, func(i, j int) bool { return fillIds[i] < fillIds[j] })
+	if len(fillIds) > size {
+		fillIds = fillIds[:size]
+	}
+	return fillIds
+}
+
+// attempt submits the fills as one batch. A rejected batch of several
+// fills is split in half and each half attempted again.
+func (p *Pipeline) attempt(fillIds []uint64) {
+	p.mu.Lock()
+	p.lastBatchId++
+	batchId := p.lastBatchId
+	p.mu.Unlock()
+
+	var submitted []uint64
+	var jobs []Job
+	for _, fillId := range fillIds {
+		job, err := p.transition(fillId, match.ORDER_SUBMITTED, batchId, nil)
+		if errors.Is(err, errDone) || errors.Is(err, errBusting) {
+			// busted while it was queued; a failed bust queues it again
+			continue
+		} else if err != nil {
+			log.Printf("failed to submit settlement of fill %d: %v", fillId, err)
+			continue
+		}
+		submitted = append(submitted, fillId)
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return
+	}
+
+	var execErr error
+	if len(jobs) == 1 {
+		execErr = p.executor.Execute(jobs[0])
+	} else {
+		execErr = p.executor.(BatchExecutor).ExecuteBatch(jobs)
+	}
+
+	if errors.Is(execErr, ErrRejected) && len(submitted) > 1 {
+		half := len(submitted) / 2
+		p.attempt(submitted[:half])
+		p.attempt(submitted[half:])
+		return
+	}
+
+	for _, fillId := range submitted {
+		var err error
+		switch {
+		case execErr == nil:
+			_, err = p.transition(fillId, match.ORDER_COMPLETE, batchId, nil)
+		case errors.Is(execErr, ErrRejected):
+			_, err = p.transition(fillId, match.ORDER_REJECTED, batchId, execErr)
+		default:
+			err = p.retry(fillId, batchId, execErr)
+		}
+		if err != nil {
+			log.Printf("failed to record settlement of fill %d: %v", fillId, err)
+		}
+	}
+}
+
+// Bust marks a fill that is waiting to be settled, or was rejected, as
+// BUSTED so it is never settled. unwind is called first, without holding
+// the pipeline's lock so fills keep being submitted meanwhile, though none
+// can start settling this one; the fill is only marked if it succeeds.
+func (p *Pipeline) Bust(fillId uint64, unwind func(job Job) error) (Job, error) {
+	p.mu.Lock()
+	settlement, ok := p.settlements[fillId]
+	if !ok {
+		p.mu.Unlock()
+		return Job{}, ErrUnknownFill
+	}
+	var err error
+	switch {
+	case p.busting[fillId]:
+		err = fmt.Errorf("settlement: fill %d already being busted", fillId)
+	case settlement.Status() == match.ORDER_SUBMITTED:
+		err = ErrInFlight
+	case settlement.Status() == match.ORDER_COMPLETE:
+		err = ErrSettled
+	case settlement.Status() == match.ORDER_BUSTED:
+		err = fmt.Errorf("settlement: fill %d already busted", fillId)
+	}
+	if err != nil {
+		p.mu.Unlock()
+		return Job{}, err
+	}
+	p.busting[fillId] = true
+	delete(p.due, fillId)
+	job := settlement.Job
+	p.mu.Unlock()
+
+	unwindErr := unwind(job)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.busting, fillId)
+	if unwindErr != nil {
+		if settlement.Status() == match.ORDER_PENDING {
+			p.queue(fillId, time.Now())
+		}
+		return Job{}, unwindErr
+	}
+	settlement.Job.Fill.Status = match.ORDER_BUSTED
+	return settlement.Job, p.record(settlement)
+}
+
+// retry puts the fill back to PENDING and requeues it after its backoff,
+// or rejects it once it has used up its attempts.
+func (p *Pipeline) retry(fillId, batchId uint64, execErr error) error {
+	p.mu.Lock()
+	attempts := p.settlements[fillId].Attempts
+	p.mu.Unlock()
+
+	if attempts >= p.cfg.MaxAttempts {
+		_, err := p.transition(fillId, match.ORDER_REJECTED, batchId,
+			fmt.Errorf("giving up after %d attempts: %v", attempts, execErr))
+		return err
+	}
+	if _, err := p.transition(fillId, match.ORDER_PENDING, batchId, execErr); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue(fillId, time.Now().Add(p.cfg.RetryDelay<<(attempts-1)))
+	return nil
+}
+
+// transition moves the fill to status within the batch, counting an
+// attempt on submission, and journals the result.
+func (p *Pipeline) transition(fillId uint64, status uint32, batchId uint64, cause error) (Job, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	settlement, ok := p.settlements[fillId]
+	if !ok {
+		return Job{}, ErrUnknownFill
+	}
+	if settlement.done() {
+		return Job{}, fmt.Errorf("%w: fill %d is %s", errDone, fillId, match.StatusName(settlement.Status()))
+	}
+	if p.busting[fillId] {
+		return Job{}, fmt.Errorf("%w: fill %d", errBusting, fillId)
+	}
+
+	settlement.Job.Fill.Status = status
+	settlement.BatchId = batchId
+	if status == match.ORDER_SUBMITTED {
+		settlement.Attempts++
+	}
+	settlement.Error = ""
+	if cause != nil {
+		settlement.Error = cause.Error()
+	}
+	return settlement.Job, p.record(settlement)
+}
+
+func (p *Pipeline) record(settlement *Settlement) error {
+	settlement.UpdatedAt = time.Now()
+	if p.journal == nil {
+		return nil
+	}
+	return p.journal.Append(settlement)
+}
+
+// OrderFilled returns how much of the user's order on the artwork its
+// fills that were not busted add up to, and whether it has any fills at
+// all, busted or not.
+func (p *Pipeline) OrderFilled(userId, artworkId uint64, side uint32, orderId uint64) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var filled uint64
+	var found bool
+	for _, settlement := range p.settlements {
+		fill := settlement.Job.Fill
+		if fill.ArtworkId != artworkId {
+			continue
+		}
+		if side == match.SIDE_BID && (fill.BidId != orderId || fill.BuyerId != userId) ||
+			side == match.SIDE_ASK && (fill.AskId != orderId || fill.SellerId != userId) {
+			continue
+		}
+		found = true
+		if fill.Status != match.ORDER_BUSTED {
+			filled += fill.QuantityFilled
+		}
+	}
+	return filled, found
+}
+
+func (p *Pipeline) Get(fillId uint64) (Settlement, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	settlement, ok := p.settlements[fillId]
+	if !ok {
+		return Settlement{}, ErrUnknownFill
+	}
+	return *settlement, nil
+}
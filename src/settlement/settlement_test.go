@@ -0,0 +1,277 @@
+package settlement
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/price"
+)
+
+var testConfig = Config{MaxAttempts: 3, RetryDelay: time.Millisecond}
+
+func job(fillId uint64) Job {
+	return Job{Fill: match.FillOrder{Id: fillId, ArtworkId: 1, Price: price.New(100, 2), QuantityFilled: 1}}
+}
+
+// failing executes by failing each fill a number of times, or rejecting it.
+type failing struct {
+	failures map[uint64]int
+	rejected map[uint64]bool
+	executed []uint64
+	mu       sync.Mutex
+}
+
+func (f *failing) Execute(job Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.executed = append(f.executed, job.Fill.Id)
+	if f.rejected[job.Fill.Id] {
+		return ErrRejected
+	}
+	if f.failures[job.Fill.Id] > 0 {
+		f.failures[job.Fill.Id]--
+		return errors.New("contract unavailable")
+	}
+	return nil
+}
+
+// await polls until the fill's settlement is done.
+func await(t *testing.T, p *Pipeline, fillId uint64) Settlement {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if settlement, err := p.Get(fillId); err == nil && settlement.done() {
+			return settlement
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("settlement of fill %d did not finish", fillId)
+	return Settlement{}
+}
+
+func TestPipelineRetriesFailures(t *testing.T) {
+	executor := &failing{failures: map[uint64]int{2: 2, 3: 5}, rejected: map[uint64]bool{4: true}}
+	p := New(executor, testConfig)
+	go p.Run()
+
+	for fillId := uint64(1); fillId <= 4; fillId++ {
+		if err := p.Submit(job(fillId)); err != nil {
+			t.Fatalf("failed to submit fill %d: %v", fillId, err)
+		}
+	}
+
+	expected := []struct {
+		fillId   uint64
+		status   uint32
+		attempts int
+	}{
+		{1, match.ORDER_COMPLETE, 1},
+		{2, match.ORDER_COMPLETE, 3},
+		{3, match.ORDER_REJECTED, 3}, // still failing after MaxAttempts
+		{4, match.ORDER_REJECTED, 1}, // rejections are never retried
+	}
+	for _, e := range expected {
+		settlement := await(t, p, e.fillId)
+		if settlement.Status() != e.status || settlement.Attempts != e.attempts {
+			t.Errorf("fill %d: expected %s after %d attempts, got %s after %d (%s)",
+				e.fillId, match.StatusName(e.status), e.attempts,
+				match.StatusName(settlement.Status()), settlement.Attempts, settlement.Error)
+		}
+	}
+
+	if err := p.Submit(job(1)); err == nil {
+		t.Errorf("Expected resubmitting a fill to fail")
+	}
+}
+
+func TestOpenResumesUnfinishedSettlements(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settlements.jsonl")
+
+	// nothing runs the first pipeline, so its fills stay PENDING
+	p, err := Open(path, &failing{}, testConfig)
+	if err != nil {
+		t.Fatalf("failed to open pipeline: %v", err)
+	}
+	p.Submit(job(7))
+	p.Submit(job(8))
+	p.Close()
+
+	executor := &failing{}
+	p, err = Open(path, executor, testConfig)
+	if err != nil {
+		t.Fatalf("failed to reopen pipeline: %v", err)
+	}
+	defer p.Close()
+	go p.Run()
+
+	await(t, p, 7)
+	await(t, p, 8)
+	if p.LastFillId() != 8 {
+		t.Errorf("Expected last fill id 8, got %d", p.LastFillId())
+	}
+	if len(executor.executed) != 2 {
+		t.Errorf("Expected both fills to be settled once, got %v", executor.executed)
+	}
+}
+
+// batching records the batches it was given and rejects any containing a
+// poisoned fill.
+type batching struct {
+	failing
+	poisoned map[uint64]bool
+	batches  [][]uint64
+}
+
+func (b *batching) ExecuteBatch(jobs []Job) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fillIds []uint64
+	for _, job := range jobs {
+		fillIds = append(fillIds, job.Fill.Id)
+	}
+	b.batches = append(b.batches, fillIds)
+	for _, fillId := range fillIds {
+		if b.poisoned[fillId] {
+			return ErrRejected
+		}
+	}
+	return nil
+}
+
+func (b *batching) Execute(job Job) error {
+	return b.ExecuteBatch([]Job{job})
+}
+
+func TestPipelineBatchesFills(t *testing.T) {
+	executor := &batching{poisoned: map[uint64]bool{3: true}}
+	cfg := testConfig
+	cfg.BatchSize, cfg.BatchWindow = 4, time.Second
+	p := New(executor, cfg)
+
+	for fillId := uint64(1); fillId <= 4; fillId++ {
+		p.Submit(job(fillId))
+	}
+	go p.Run()
+
+	for fillId := uint64(1); fillId <= 4; fillId++ {
+		settlement := await(t, p, fillId)
+		expected := uint32(match.ORDER_COMPLETE)
+		if fillId == 3 {
+			expected = match.ORDER_REJECTED
+		}
+		if settlement.Status() != expected {
+			t.Errorf("fill %d: expected %s, got %s", fillId, match.StatusName(expected), match.StatusName(settlement.Status()))
+		}
+	}
+
+	// the rejected batch is halved until the poisoned fill is on its own
+	if len(executor.batches) != 5 || len(executor.batches[0]) != 4 {
+		t.Errorf("Expected [1 2 3 4] to be split down to [3], got %v", executor.batches)
+	}
+	first, _ := p.Get(1)
+	second, _ := p.Get(2)
+	if first.BatchId != second.BatchId {
+		t.Errorf("Expected fills 1 and 2 to settle in the same batch, got %d and %d", first.BatchId, second.BatchId)
+	}
+}
+
+func TestBustSkipsSettlement(t *testing.T) {
+	executor := &failing{}
+	p := New(executor, testConfig)
+	for fillId := uint64(1); fillId <= 2; fillId++ {
+		if err := p.Submit(job(fillId)); err != nil {
+			t.Fatalf("failed to submit fill %d: %v", fillId, err)
+		}
+	}
+
+	// a failed unwind leaves the fill to be settled
+	if _, err := p.Bust(1, func(Job) error { return errors.New("cannot unwind") }); err == nil {
+		t.Fatalf("Expected a failed unwind to fail the bust")
+	}
+	if settlement, _ := p.Get(1); settlement.Status() != match.ORDER_PENDING {
+		t.Fatalf("Expected fill 1 to stay PENDING, got %s", match.StatusName(settlement.Status()))
+	}
+
+	busted, err := p.Bust(1, func(Job) error { return nil })
+	if err != nil || busted.Fill.Status != match.ORDER_BUSTED {
+		t.Fatalf("Expected fill 1 to be BUSTED, got %+v, %v", busted.Fill, err)
+	}
+
+	go p.Run()
+	await(t, p, 2)
+	if settlement, _ := p.Get(1); settlement.Status() != match.ORDER_BUSTED || settlement.Attempts != 0 {
+		t.Errorf("Expected busted fill 1 never to be attempted, got %+v", settlement)
+	}
+
+	if _, err := p.Bust(2, func(Job) error { return nil }); !errors.Is(err, ErrSettled) {
+		t.Errorf("Expected ErrSettled, got %v", err)
+	}
+	if _, err := p.Bust(3, func(Job) error { return nil }); !errors.Is(err, ErrUnknownFill) {
+		t.Errorf("Expected ErrUnknownFill, got %v", err)
+	}
+}
+
+func TestSubmitNeverWaitsOnTheExecutor(t *testing.T) {
+	stalled := make(chan struct{})
+	p := New(ExecutorFunc(func(Job) error {
+		<-stalled
+		return nil
+	}), testConfig)
+	go p.Run()
+
+	// far more fills than were ever buffered pile up behind a stalled chain
+	submitted := make(chan error)
+	go func() {
+		for fillId := uint64(1); fillId <= 2000; fillId++ {
+			if err := p.Submit(job(fillId)); err != nil {
+				submitted <- err
+				return
+			}
+		}
+		submitted <- nil
+	}()
+	select {
+	case err := <-submitted:
+		if err != nil {
+			t.Fatalf("failed to submit: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Submit blocked behind the stalled executor")
+	}
+
+	close(stalled)
+	await(t, p, 1)
+	await(t, p, 2000)
+}
+
+func TestBustUnwindsWhileFillsAreSubmitted(t *testing.T) {
+	p := New(&failing{}, testConfig)
+	p.Submit(job(1))
+
+	busted, err := p.Bust(1, func(Job) error {
+		// restoring orders waits on a book whose matcher is handing the
+		// worker a new fill to submit
+		submitted := make(chan error, 1)
+		go func() { submitted <- p.Submit(job(2)) }()
+		select {
+		case err := <-submitted:
+			return err
+		case <-time.After(time.Second):
+			return errors.New("Submit blocked behind the bust")
+		}
+	})
+	if err != nil || busted.Fill.Status != match.ORDER_BUSTED {
+		t.Fatalf("Expected fill 1 to be BUSTED, got %+v, %v", busted.Fill, err)
+	}
+
+	go p.Run()
+	await(t, p, 2)
+	if settlement, _ := p.Get(1); settlement.Attempts != 0 {
+		t.Errorf("Expected busted fill 1 never to be attempted, got %+v", settlement)
+	}
+}
@@ -0,0 +1,456 @@
+// trailing stops protect a position without resting on the book. A stop
+// ask's trigger trails the highest trade price printed on its artwork since
+// it was placed, by a fixed amount or a percentage, so it ratchets up as
+// the price rises and never down; a stop bid's trails the lowest price the
+// same way. When a print reaches the trigger, the stop is converted to a
+// limit order at its limit price or, without one, to a market order that
+// takes the book up to one trail past the print and cancels whatever it
+// could not fill. Every change to a stop is journalled, so a restarted
+// server resumes its trails where they were.
+
+package stop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"fractr-marketplace-secondary/instrument"
+	"fractr-marketplace-secondary/libstore"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+// stop statuses
+const (
+	// the trigger trails the artwork's prints
+	STOP_ACTIVE = iota
+	// a print reached the trigger and the order is being placed
+	STOP_TRIGGERED
+	// the order was placed on the book
+	STOP_PLACED
+	STOP_CANCELLED
+	// the book refused the order
+	STOP_REJECTED
+)
+
+var statusNames = map[uint32]string{
+	STOP_ACTIVE:    "ACTIVE",
+	STOP_TRIGGERED: "TRIGGERED",
+	STOP_PLACED:    "PLACED",
+	STOP_CANCELLED: "CANCELLED",
+	STOP_REJECTED:  "REJECTED",
+}
+
+func StatusName(status uint32) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", status)
+}
+
+var (
+	ErrInvalidStop  = errors.New("invalid trailing stop")
+	ErrStopExists   = errors.New("trailing stop already exists")
+	ErrStopNotFound = errors.New("trailing stop not found")
+	ErrNotActive    = errors.New("trailing stop is no longer active")
+	ErrNotOwner     = errors.New("trailing stop is not the user's")
+	// ErrNoLastPrice is returned for a stop on an artwork that has not
+	// traded, which it would have no price to trail.
+	ErrNoLastPrice = errors.New("artwork has not traded")
+)
+
+// Stop is the latest state of a trailing stop.
+type Stop struct {
+	Id        uint64 `json:"id"` // also the id of the order it is converted to
+	UserId    uint64 `json:"user_id"`
+	ArtworkId uint64 `json:"artwork_id"`
+	Side      uint32 `json:"side"` // match.SIDE_BID or match.SIDE_ASK
+	Quantity  uint64 `json:"quantity"`
+	// exactly one of the trails is set
+	Trail    price.Price `json:"trail"`     // absolute distance from the extreme
+	TrailBps uint32      `json:"trail_bps"` // distance as a fraction of the extreme
+	// the converted order's price; zero converts the stop to a market order
+	Limit price.Price `json:"limit"`
+
+	Extreme price.Price `json:"extreme"` // highest print for asks, lowest for bids
+	Trigger price.Price `json:"trigger"`
+	Status  uint32      `json:"status"`
+	Reason  string      `json:"reason,omitempty"` // why the order was rejected
+
+	PlacedAt       time.Time `json:"placed_at"`
+	TriggeredAt    time.Time `json:"triggered_at,omitempty"`
+	QuantityFilled uint64    `json:"quantity_filled"`
+	// set, and journalled, just before a triggered stop's order is placed,
+	// so a restart can tell whether the order may have reached the book
+	OrderId uint64 `json:"order_id,omitempty"`
+}
+
+func (s *Stop) trail() (price.Price, error) {
+	if s.TrailBps == 0 {
+		return s.Trail, nil
+	}
+	return s.Extreme.MulDiv(uint64(s.TrailBps), 10000)
+}
+
+// follow moves the stop's trigger after a print, reporting whether the
+// print reached it.
+func (s *Stop) follow(print price.Price) (bool, error) {
+	if s.Side == match.SIDE_ASK && print.Cmp(s.Extreme) > 0 ||
+		s.Side == match.SIDE_BID && print.Cmp(s.Extreme) < 0 {
+		s.Extreme = print
+	}
+
+	trail, err := s.trail()
+	if err != nil {
+		return false, err
+	}
+	if s.Side == match.SIDE_ASK {
+		s.Trigger, err = s.Extreme.Sub(trail)
+		if errors.Is(err, price.ErrNegative) {
+			s.Trigger, err = price.Price{Scale: s.Extreme.Scale}, nil
+		}
+		return err == nil && print.Cmp(s.Trigger) <= 0, err
+	}
+	s.Trigger, err = s.Extreme.Add(trail)
+	return err == nil && print.Cmp(s.Trigger) >= 0, err
+}
+
+// orderPrice is the price of the order the stop converts to after print
+// reached its trigger.
+func (s *Stop) orderPrice(inst instrument.Instrument, print price.Price) (price.Price, error) {
+	if !s.Limit.IsZero() {
+		return s.Limit, nil
+	}
+
+	trail, err := s.trail()
+	if err != nil {
+		return price.Price{}, err
+	}
+	if s.Side == match.SIDE_BID {
+		limit, err := print.Add(trail)
+		if err != nil {
+			return price.Price{}, err
+		}
+		if limit, err = limit.Rescale(inst.PriceScale); err != nil {
+			return price.Price{}, err
+		}
+		return inst.Price(limit.Units - limit.Units%inst.TickSize), nil
+	}
+
+	limit, err := print.Sub(trail)
+	if errors.Is(err, price.ErrNegative) {
+		return inst.Price(inst.MinPrice), nil
+	}
+	if err != nil {
+		return price.Price{}, err
+	}
+	if limit, err = limit.Rescale(inst.PriceScale); err != nil {
+		return price.Price{}, err
+	}
+	units := limit.Units
+	if rem := units % inst.TickSize; rem != 0 {
+		units += inst.TickSize - rem
+	}
+	if units < inst.MinPrice {
+		units = inst.MinPrice
+	}
+	return inst.Price(units), nil
+}
+
+// OrderLookup returns how much of the user's order on the artwork filled,
+// and whether it filled at all, e.g. from the fills being settled.
+type OrderLookup func(userId, artworkId uint64, side uint32, orderId uint64) (uint64, bool)
+
+// Watcher keeps the trailing stops and follows the artworks' prints. It is
+// safe for concurrent use.
+type Watcher struct {
+	engine  *match.OrderMatchingEngine
+	mu      sync.Mutex
+	stops   map[uint64]*Stop  // key: stop id
+	journal *libstore.Journal // nil keeps stops in memory only
+}
+
+func New(engine *match.OrderMatchingEngine) *Watcher {
+	return &Watcher{
+		engine: engine,
+		stops:  make(map[uint64]*Stop),
+	}
+}
+
+// Open returns a watcher journalled at path. Stops that had triggered
+// without their order being placed are placed again, at their trigger,
+// unless the journal shows the order was on its way to the book and
+// orders finds fills of it; those stops were placed.
+func Open(path string, engine *match.OrderMatchingEngine, orders OrderLookup) (*Watcher, error) {
+	journal, err := libstore.OpenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := New(engine)
+	err = journal.Replay(func(record json.RawMessage) error {
+		var s Stop
+		if err := json.Unmarshal(record, &s); err != nil {
+			return err
+		}
+		watcher.stops[s.Id] = &s
+		return nil
+	})
+	if err != nil {
+		journal.Close()
+		return nil, fmt.Errorf("failed to replay trailing stops: %v", err)
+	}
+	watcher.journal = journal
+
+	for _, s := range watcher.stops {
+		if s.Status != STOP_TRIGGERED {
+			continue
+		}
+		if s.OrderId != 0 {
+			if filled, ok := orders(s.UserId, s.ArtworkId, s.Side, s.OrderId); ok {
+				placed := *s
+				placed.Status, placed.QuantityFilled = STOP_PLACED, filled
+				if err := watcher.save(&placed); err != nil {
+					journal.Close()
+					return nil, fmt.Errorf("failed to journal stop %d: %v", s.Id, err)
+				}
+				*s = placed
+				continue
+			}
+		}
+		go watcher.fire(*s, s.Trigger)
+	}
+	return watcher, nil
+}
+
+func (watcher *Watcher) Close() error {
+	if watcher.journal == nil {
+		return nil
+	}
+	return watcher.journal.Close()
+}
+
+// Place starts a trailing stop, trailing from the artwork's last trade
+// price.
+func (watcher *Watcher) Place(s Stop) (Stop, error) {
+	if err := watcher.check(s); err != nil {
+		return Stop{}, err
+	}
+	last, ok := watcher.engine.LastPrice(s.ArtworkId)
+	if !ok {
+		return Stop{}, fmt.Errorf("%w: %d", ErrNoLastPrice, s.ArtworkId)
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if _, ok := watcher.stops[s.Id]; ok {
+		return Stop{}, fmt.Errorf("%w: %d", ErrStopExists, s.Id)
+	}
+	s.Extreme, s.Status, s.PlacedAt = last, STOP_ACTIVE, time.Now()
+	s.TriggeredAt, s.Reason, s.QuantityFilled = time.Time{}, "", 0
+	if _, err := s.follow(last); err != nil {
+		return Stop{}, fmt.Errorf("%w: %v", ErrInvalidStop, err)
+	}
+	if err := watcher.save(&s); err != nil {
+		return Stop{}, err
+	}
+	watcher.stops[s.Id] = &s
+	return s, nil
+}
+
+// Get returns the stop with the given id.
+func (watcher *Watcher) Get(stopId uint64) (Stop, error) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	s, ok := watcher.stops[stopId]
+	if !ok {
+		return Stop{}, fmt.Errorf("%w: %d", ErrStopNotFound, stopId)
+	}
+	return *s, nil
+}
+
+// Cancel withdraws the user's stop before it triggers.
+func (watcher *Watcher) Cancel(stopId, userId uint64) (Stop, error) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	s, ok := watcher.stops[stopId]
+	if !ok {
+		return Stop{}, fmt.Errorf("%w: %d", ErrStopNotFound, stopId)
+	}
+	if s.UserId != userId {
+		return Stop{}, fmt.Errorf("%w: stop %d is user %d's, not %d", ErrNotOwner, stopId, s.UserId, userId)
+	}
+	if s.Status != STOP_ACTIVE {
+		return Stop{}, fmt.Errorf("%w: stop %d is %s", ErrNotActive, stopId, StatusName(s.Status))
+	}
+	cancelled := *s
+	cancelled.Status = STOP_CANCELLED
+	if err := watcher.save(&cancelled); err != nil {
+		return Stop{}, err
+	}
+	*s = cancelled
+	return *s, nil
+}
+
+// Print follows a fill on the artwork's book with the artwork's stops,
+// converting those it triggers to orders. The orders are placed apart from
+// the caller, which may be draining the engine's fills.
+func (watcher *Watcher) Print(fill match.FillOrder) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	for _, s := range watcher.stops {
+		if s.ArtworkId != fill.ArtworkId || s.Status != STOP_ACTIVE {
+			continue
+		}
+		followed := *s
+		hit, err := followed.follow(fill.Price)
+		if err != nil {
+			log.Printf("failed to trail stop %d: %v", s.Id, err)
+			continue
+		}
+		if followed.Extreme == s.Extreme && !hit {
+			continue
+		}
+		if hit {
+			followed.Status, followed.TriggeredAt = STOP_TRIGGERED, time.Now()
+		}
+		if err := watcher.save(&followed); err != nil {
+			log.Printf("failed to journal stop %d: %v", s.Id, err)
+			continue
+		}
+		*s = followed
+		if hit {
+			go watcher.fire(followed, fill.Price)
+		}
+	}
+}
+
+// fire places the order a triggered stop converts to.
+func (watcher *Watcher) fire(s Stop, print price.Price) {
+	var filled uint64
+	limit, err := s.orderPrice(watcher.engine.Instrument(s.ArtworkId), print)
+	if err == nil {
+		err = watcher.intend(s.Id)
+	}
+	if err == nil {
+		filled, err = watcher.placeOrder(s, limit)
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	fired := *watcher.stops[s.Id]
+	fired.Status, fired.QuantityFilled = STOP_PLACED, filled
+	if err != nil {
+		fired.Status, fired.Reason = STOP_REJECTED, err.Error()
+	}
+	if err := watcher.save(&fired); err != nil {
+		log.Printf("failed to journal stop %d: %v", s.Id, err)
+	}
+	*watcher.stops[s.Id] = fired
+}
+
+// intend journals that the stop's order is about to be placed.
+func (watcher *Watcher) intend(stopId uint64) error {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	placing := *watcher.stops[stopId]
+	placing.OrderId = stopId
+	if err := watcher.save(&placing); err != nil {
+		return fmt.Errorf("failed to journal the order about to be placed: %v", err)
+	}
+	*watcher.stops[stopId] = placing
+	return nil
+}
+
+// placeOrder places the stop's order at limit, returning how much of it
+// filled. What a market order could not fill is cancelled.
+func (watcher *Watcher) placeOrder(s Stop, limit price.Price) (uint64, error) {
+	market := s.Limit.IsZero()
+	if s.Side == match.SIDE_BID {
+		bid, err := watcher.engine.FillBidOrder(pqueue.NewBid(s.Id, s.UserId, s.ArtworkId, s.Quantity, limit))
+		if err != nil {
+			return 0, err
+		}
+		if market && bid.QuantityRemaining() > 0 {
+			if _, err := watcher.engine.CancelUserBid(s.ArtworkId, s.Id, s.UserId); err != nil && !errors.Is(err, match.ErrOrderNotFound) {
+				return bid.QuantityFilled(), err
+			}
+		}
+		return bid.QuantityFilled(), nil
+	}
+
+	ask, err := watcher.engine.FillAskOrder(pqueue.NewAsk(s.Id, s.UserId, s.ArtworkId, s.Quantity, limit))
+	if err != nil {
+		return 0, err
+	}
+	if market && ask.QuantityRemaining() > 0 {
+		if _, err := watcher.engine.CancelUserAsk(s.ArtworkId, s.Id, s.UserId); err != nil && !errors.Is(err, match.ErrOrderNotFound) {
+			return ask.QuantityFilled(), err
+		}
+	}
+	return ask.QuantityFilled(), nil
+}
+
+// check returns an error wrapping ErrInvalidStop, or a *RuleError from the
+// artwork's instrument, if the stop cannot be placed.
+func (watcher *Watcher) check(s Stop) error {
+	if !watcher.engine.HasArtwork(s.ArtworkId) {
+		return fmt.Errorf("%w: %d", match.ErrArtworkNotListed, s.ArtworkId)
+	}
+	if s.Side != match.SIDE_BID && s.Side != match.SIDE_ASK {
+		return fmt.Errorf("%w: side must be BID (0) or ASK (1)", ErrInvalidStop)
+	}
+	if s.Trail.IsZero() == (s.TrailBps == 0) {
+		return fmt.Errorf("%w: exactly one of trail and trail_bps must be set", ErrInvalidStop)
+	}
+	if s.TrailBps >= 10000 {
+		return fmt.Errorf("%w: trail_bps must be under 10000", ErrInvalidStop)
+	}
+	if s.Id > match.MaxOrderId {
+		return fmt.Errorf("%w: stop id %d exceeds maximum %d", ErrInvalidStop, s.Id, match.MaxOrderId)
+	}
+
+	// a market order's price is only known once it triggers
+	inst := watcher.engine.Instrument(s.ArtworkId)
+	limit := s.Limit
+	if limit.IsZero() {
+		limit = inst.Price(inst.MinPrice)
+	}
+	var ruleErr *instrument.RuleError
+	if err := inst.CheckOrder(s.Quantity, limit); errors.As(err, &ruleErr) {
+		for i, v := range ruleErr.Violations {
+			if v.Field == "price" {
+				ruleErr.Violations[i].Field = "limit"
+			}
+		}
+		return ruleErr
+	} else if err != nil {
+		return err
+	}
+	if trail, err := s.Trail.Rescale(inst.PriceScale); err != nil || trail.Units%inst.TickSize != 0 {
+		return &instrument.RuleError{ArtworkId: inst.ArtworkId, Violations: []instrument.Violation{{
+			Field:       "trail",
+			Description: fmt.Sprintf("trail %s is not a multiple of tick size %s", s.Trail, inst.Price(inst.TickSize)),
+		}}}
+	}
+	return nil
+}
+
+// save journals the stop's new state before it is applied.
+func (watcher *Watcher) save(s *Stop) error {
+	if watcher.journal == nil {
+		return nil
+	}
+	return watcher.journal.Append(s)
+}
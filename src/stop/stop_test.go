@@ -0,0 +1,192 @@
+package stop
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fractr-marketplace-secondary/libstore"
+	"fractr-marketplace-secondary/match"
+	"fractr-marketplace-secondary/pqueue"
+	"fractr-marketplace-secondary/price"
+)
+
+const artworkId = 1
+
+// setupWatcher returns a watcher on an engine listing one artwork, with
+// every fill printed to it as the server's worker does.
+func setupWatcher(t *testing.T, path string) (*Watcher, *match.OrderMatchingEngine) {
+	engine := match.New()
+	engine.AddArtworkIfNotExists(artworkId)
+
+	watcher := New(engine)
+	if path != "" {
+		var err error
+		if watcher, err = Open(path, engine, nothingFilled); err != nil {
+			t.Fatalf("failed to open watcher: %v", err)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case fill := <-engine.Orders():
+				watcher.Print(fill)
+			case <-engine.Jobs():
+			}
+		}
+	}()
+	return watcher, engine
+}
+
+// nothingFilled finds no fills of any order.
+func nothingFilled(userId, artworkId uint64, side uint32, orderId uint64) (uint64, bool) {
+	return 0, false
+}
+
+var lastTradeId uint64 = 1000
+
+// trade prints a trade of one fraction at p between two other users.
+func trade(t *testing.T, engine *match.OrderMatchingEngine, p price.Price) {
+	lastTradeId++
+	if _, err := engine.FillAskOrder(pqueue.NewAsk(lastTradeId, 21, artworkId, 1, p)); err != nil {
+		t.Fatalf("failed to place ask: %v", err)
+	}
+	if _, err := engine.FillBidOrder(pqueue.NewBid(lastTradeId, 20, artworkId, 1, p)); err != nil {
+		t.Fatalf("failed to place bid: %v", err)
+	}
+}
+
+// await waits for the stop to satisfy cond.
+func await(t *testing.T, watcher *Watcher, stopId uint64, cond func(Stop) bool) Stop {
+	deadline := time.Now().Add(time.Second)
+	for {
+		s, err := watcher.Get(stopId)
+		if err != nil {
+			t.Fatalf("failed to get stop: %v", err)
+		}
+		if cond(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stop %d did not reach the expected state, got %+v", stopId, s)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTrailingStopAskRatchetsAndFires(t *testing.T) {
+	watcher, engine := setupWatcher(t, "")
+
+	ask := Stop{Id: 100, UserId: 10, ArtworkId: artworkId, Side: match.SIDE_ASK, Quantity: 5, Trail: price.New(100, 2)}
+	if _, err := watcher.Place(ask); !errors.Is(err, ErrNoLastPrice) {
+		t.Fatalf("Expected a stop on an untraded artwork to be refused, got %v", err)
+	}
+
+	trade(t, engine, price.New(1000, 2))
+	s, err := watcher.Place(ask)
+	if err != nil || s.Trigger.String() != "9.00" {
+		t.Fatalf("Expected the stop to trigger at 9.00, got %+v (%v)", s, err)
+	}
+
+	// the trigger follows the price up but not back down
+	trade(t, engine, price.New(1200, 2))
+	await(t, watcher, ask.Id, func(s Stop) bool { return s.Trigger.String() == "11.00" })
+	trade(t, engine, price.New(1150, 2))
+	if s, _ := watcher.Get(ask.Id); s.Trigger.String() != "11.00" || s.Status != STOP_ACTIVE {
+		t.Fatalf("Expected the stop to stay at 11.00, got %+v", s)
+	}
+
+	// reaching the trigger sells into the bids down to 10.00 as a market
+	// order, cancelling the rest
+	if _, err := engine.FillBidOrder(pqueue.NewBid(200, 30, artworkId, 3, price.New(1050, 2))); err != nil {
+		t.Fatalf("failed to place bid: %v", err)
+	}
+	trade(t, engine, price.New(1100, 2))
+	s = await(t, watcher, ask.Id, func(s Stop) bool { return s.Status != STOP_ACTIVE && s.Status != STOP_TRIGGERED })
+	if s.Status != STOP_PLACED || s.QuantityFilled != 3 {
+		t.Fatalf("Expected the stop to sell 3, got %+v", s)
+	}
+	if _, err := engine.CancelAsk(artworkId, ask.Id); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected the market order's remainder to be cancelled, got %v", err)
+	}
+	if _, err := watcher.Cancel(ask.Id, 10); !errors.Is(err, ErrNotActive) {
+		t.Errorf("Expected a placed stop not to be cancellable, got %v", err)
+	}
+}
+
+func TestOpenResumesTrailingStops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stops.jsonl")
+	watcher, engine := setupWatcher(t, path)
+
+	trade(t, engine, price.New(1000, 2))
+	bid := Stop{Id: 100, UserId: 10, ArtworkId: artworkId, Side: match.SIDE_BID, Quantity: 5, TrailBps: 1000, Limit: price.New(2000, 2)}
+	if s, err := watcher.Place(bid); err != nil || s.Trigger.String() != "11.00" {
+		t.Fatalf("Expected the stop to trigger at 11.00, got %+v (%v)", s, err)
+	}
+	trade(t, engine, price.New(800, 2))
+	await(t, watcher, bid.Id, func(s Stop) bool { return s.Trigger.String() == "8.80" })
+	watcher.Close()
+
+	watcher, err := Open(path, engine, nothingFilled)
+	if err != nil {
+		t.Fatalf("failed to reopen watcher: %v", err)
+	}
+	defer watcher.Close()
+	s, err := watcher.Get(bid.Id)
+	if err != nil || s.Status != STOP_ACTIVE || s.Extreme.String() != "8.00" || s.Trigger.String() != "8.80" {
+		t.Fatalf("Expected the stop to resume trailing 8.00, got %+v (%v)", s, err)
+	}
+	if _, err := watcher.Cancel(bid.Id, 11); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Expected another user's cancel to be refused, got %v", err)
+	}
+	if s, err := watcher.Cancel(bid.Id, 10); err != nil || s.Status != STOP_CANCELLED {
+		t.Errorf("Expected the stop to be cancelled, got %+v (%v)", s, err)
+	}
+}
+
+func TestOpenDoesNotPlaceAnOrderTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stops.jsonl")
+	journal, err := libstore.OpenJournal(path)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	// both stops had triggered when the server stopped; only stop 101's
+	// order was on its way to the book, and it filled
+	for _, s := range []Stop{
+		{Id: 100, UserId: 10, ArtworkId: artworkId, Side: match.SIDE_BID, Quantity: 5, TrailBps: 1000, Limit: price.New(2000, 2), Trigger: price.New(1100, 2), Status: STOP_TRIGGERED},
+		{Id: 101, UserId: 10, ArtworkId: artworkId, Side: match.SIDE_BID, Quantity: 5, TrailBps: 1000, Limit: price.New(2000, 2), Trigger: price.New(1100, 2), Status: STOP_TRIGGERED, OrderId: 101},
+	} {
+		if err := journal.Append(s); err != nil {
+			t.Fatalf("failed to journal stop %d: %v", s.Id, err)
+		}
+	}
+	journal.Close()
+
+	engine := match.New()
+	engine.AddArtworkIfNotExists(artworkId)
+	go func() {
+		for range engine.Jobs() {
+		}
+	}()
+	filled := func(userId, artworkId uint64, side uint32, orderId uint64) (uint64, bool) {
+		return 5, orderId == 101
+	}
+	watcher, err := Open(path, engine, filled)
+	if err != nil {
+		t.Fatalf("failed to reopen watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	await(t, watcher, 100, func(s Stop) bool { return s.Status == STOP_PLACED })
+	if s, _ := watcher.Get(101); s.Status != STOP_PLACED || s.QuantityFilled != 5 {
+		t.Fatalf("Expected stop 101 to be found placed and filled, got %+v", s)
+	}
+	if _, err := engine.CancelBid(artworkId, 100); err != nil {
+		t.Errorf("Expected stop 100's order to be placed again, got %v", err)
+	}
+	if _, err := engine.CancelBid(artworkId, 101); !errors.Is(err, match.ErrOrderNotFound) {
+		t.Errorf("Expected stop 101's order not to be placed twice, got %v", err)
+	}
+}